@@ -16,6 +16,8 @@ import (
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/simonhorlick/gocryptfs/internal/configfile"
+	"github.com/simonhorlick/gocryptfs/internal/contentenc"
+	"github.com/simonhorlick/gocryptfs/internal/ctlsock"
 	"github.com/simonhorlick/gocryptfs/internal/exitcodes"
 	"github.com/simonhorlick/gocryptfs/internal/prefer_openssl"
 	"github.com/simonhorlick/gocryptfs/internal/readpassword"
@@ -29,16 +31,27 @@ type argContainer struct {
 	plaintextnames, quiet, nosyslog, wpanic,
 	longnames, allow_other, reverse, aessiv, nonempty, raw64,
 	noprealloc, speed, hkdf, serialize_reads, forcedecode, hh, info,
-	sharedstorage, devrandom, fsck, trezor bool
+	sharedstorage, devrandom, fsck, trezor, extract, cat, importDir,
+	rekey, rollback, listkeys, argon2id, xchacha, integrity, ivcache, stableids,
+	manifest, oneFileSystem, crossMounts, repair, dryRun, json, fsckIncremental, scrub, selftest bool
 	// Mount options with opposites
 	dev, nodev, suid, nosuid, exec, noexec, rw, ro bool
 	masterkey, mountpoint, cipherdir, cpuprofile, extpass,
-	memprofile, ko, passfile, ctlsock, fsname, force_owner, trace string
+	memprofile, ko, passfile, ctlsock, fsname, force_owner, trace, addkey, revokekey,
+	blocksize, fsckCheckpoint string
 	// For reverse mode, --exclude is available. It can be specified multiple times.
 	exclude multipleStrings
+	// Gitignore-style patterns, on the command line or in a file
+	excludeWildcard, excludeFrom multipleStrings
+	// -follow-symlinks
+	followSymlinks multipleStrings
 	// Configuration file name override
 	config             string
 	notifypid, scryptn int
+	// Argon2id parameters for -init
+	argon2_mem, argon2_time, argon2_threads int
+	// Number of -fsck workers
+	fsckJobs int
 	// Idle time before autounmount
 	idle time.Duration
 	// Helper variables that are NOT cli options all start with an underscore
@@ -46,8 +59,13 @@ type argContainer struct {
 	_configCustom bool
 	// _ctlsockFd stores the control socket file descriptor (ctlsock stores the path)
 	_ctlsockFd net.Listener
+	// _ctlsockInfo is prepared by initFuseFrontend and passed to ctlsock.Serve
+	// by doMount
+	_ctlsockInfo ctlsock.MountInfo
 	// _forceOwner is, if non-nil, a parsed, validated Owner (as opposed to the string above)
 	_forceOwner *fuse.Owner
+	// _blockSize is the parsed "-blocksize" value, or 0 if it was not passed
+	_blockSize uint64
 }
 
 type multipleStrings []string
@@ -148,10 +166,18 @@ func parseCliOpts() (args argContainer) {
 		"Only works if user_allow_other is set in /etc/fuse.conf.")
 	flagSet.BoolVar(&args.reverse, "reverse", false, "Reverse mode")
 	flagSet.BoolVar(&args.aessiv, "aessiv", false, "AES-SIV encryption")
+	flagSet.BoolVar(&args.xchacha, "xchacha", false, "XChaCha20-Poly1305 encryption")
+	flagSet.BoolVar(&args.integrity, "integrity", false, "Authenticate file lengths and bind file content to file names")
+	flagSet.BoolVar(&args.stableids, "stableids", false, "Keep the ciphertext of renamed files stable (reverse mode, with -init)")
+	flagSet.BoolVar(&args.ivcache, "ivcache", false, "Keep the ciphertext of hard-linked files stable across remounts (reverse mode)")
+	flagSet.BoolVar(&args.manifest, "manifest", false, "Provide gocryptfs.manifest and fail reads of changing files (reverse mode)")
+	flagSet.BoolVar(&args.oneFileSystem, "one-file-system", true, "Do not show the content of mount points (reverse mode)")
+	flagSet.BoolVar(&args.crossMounts, "cross-mounts", false, "Show the content of mount points, same as -one-file-system=false (reverse mode)")
 	flagSet.BoolVar(&args.nonempty, "nonempty", false, "Allow mounting over non-empty directories")
 	flagSet.BoolVar(&args.raw64, "raw64", true, "Use unpadded base64 for file names")
 	flagSet.BoolVar(&args.noprealloc, "noprealloc", false, "Disable preallocation before writing")
 	flagSet.BoolVar(&args.speed, "speed", false, "Run crypto speed test")
+	flagSet.BoolVar(&args.selftest, "selftest", false, "Run crypto known-answer tests")
 	flagSet.BoolVar(&args.hkdf, "hkdf", true, "Use HKDF as an additional key derivation step")
 	flagSet.BoolVar(&args.serialize_reads, "serialize_reads", false, "Try to serialize read operations")
 	flagSet.BoolVar(&args.forcedecode, "forcedecode", false, "Force decode of files even if integrity check fails."+
@@ -161,6 +187,18 @@ func parseCliOpts() (args argContainer) {
 	flagSet.BoolVar(&args.sharedstorage, "sharedstorage", false, "Make concurrent access to a shared CIPHERDIR safer")
 	flagSet.BoolVar(&args.devrandom, "devrandom", false, "Use /dev/random for generating master key")
 	flagSet.BoolVar(&args.fsck, "fsck", false, "Run a filesystem check on CIPHERDIR")
+	flagSet.BoolVar(&args.repair, "repair", false, "Fix the problems that -fsck finds")
+	flagSet.BoolVar(&args.dryRun, "dry-run", false, "Only print what -fsck -repair would do")
+	flagSet.BoolVar(&args.json, "json", false, "Print the -fsck or -scrub report as JSON")
+	flagSet.BoolVar(&args.scrub, "scrub", false, "Check the structure of the ciphertext in CIPHERDIR, without the password")
+	flagSet.StringVar(&args.fsckCheckpoint, "fsck-checkpoint", "", "Save the -fsck progress to FILE and resume from it")
+	flagSet.BoolVar(&args.fsckIncremental, "fsck-incremental", false, "Only check files changed since the last successful -fsck-checkpoint run")
+	flagSet.BoolVar(&args.extract, "extract", false, "Decrypt PLAINPATH from CIPHERDIR to DEST without mounting")
+	flagSet.BoolVar(&args.cat, "cat", false, "Decrypt the file PLAINPATH from CIPHERDIR to stdout without mounting")
+	flagSet.BoolVar(&args.importDir, "import", false, "Encrypt the plaintext directory SRCDIR into CIPHERDIR without mounting")
+	flagSet.BoolVar(&args.rekey, "rekey", false, "Re-encrypt CIPHERDIR with a new master key")
+	flagSet.BoolVar(&args.rollback, "rollback", false, "Roll back an interrupted -rekey run")
+	flagSet.BoolVar(&args.listkeys, "listkeys", false, "List the key slots of CIPHERDIR")
 	if readpassword.TrezorSupport {
 		flagSet.BoolVar(&args.trezor, "trezor", false, "Protect the masterkey using a SatoshiLabs Trezor instead of a password")
 	}
@@ -185,16 +223,30 @@ func parseCliOpts() (args argContainer) {
 	flagSet.StringVar(&args.ctlsock, "ctlsock", "", "Create control socket at specified path")
 	flagSet.StringVar(&args.fsname, "fsname", "", "Override the filesystem name")
 	flagSet.StringVar(&args.force_owner, "force_owner", "", "uid:gid pair to coerce ownership")
+	flagSet.StringVar(&args.blocksize, "blocksize", "", "Plaintext block size, like 64K or 1M. "+
+		"Possible values: powers of two from 4K to 1M")
 	flagSet.StringVar(&args.trace, "trace", "", "Write execution trace to file")
+	flagSet.StringVar(&args.addkey, "addkey", "", "Add a key slot with the specified label and its own password")
+	flagSet.StringVar(&args.revokekey, "revokekey", "", "Delete the key slot with the specified label")
 
 	// -e, --exclude
 	flagSet.Var(&args.exclude, "e", "Alias for -exclude")
 	flagSet.Var(&args.exclude, "exclude", "Exclude relative path from reverse view")
+	// -ew, --exclude-wildcard
+	flagSet.Var(&args.excludeWildcard, "ew", "Alias for -exclude-wildcard")
+	flagSet.Var(&args.excludeWildcard, "exclude-wildcard", "Exclude path from reverse view, supporting wildcards")
+	flagSet.Var(&args.excludeFrom, "exclude-from", "File from which to read exclusion patterns (with -exclude-wildcard syntax)")
+	flagSet.Var(&args.followSymlinks, "follow-symlinks", "Follow symlinks to directories inside DIR (reverse mode)")
 
 	flagSet.IntVar(&args.notifypid, "notifypid", 0, "Send USR1 to the specified process after "+
 		"successful mount - used internally for daemonization")
 	flagSet.IntVar(&args.scryptn, "scryptn", configfile.ScryptDefaultLogN, "scrypt cost parameter logN. Possible values: 10-28. "+
 		"A lower value speeds up mounting and reduces its memory needs, but makes the password susceptible to brute-force attacks")
+	flagSet.BoolVar(&args.argon2id, "argon2id", false, "Use Argon2id instead of scrypt to hash the password (only for -init)")
+	flagSet.IntVar(&args.argon2_mem, "argon2-mem", configfile.Argon2DefaultMemory, "Argon2id memory cost in KiB")
+	flagSet.IntVar(&args.argon2_time, "argon2-time", configfile.Argon2DefaultTime, "Argon2id number of passes")
+	flagSet.IntVar(&args.argon2_threads, "argon2-threads", configfile.Argon2DefaultThreads, "Argon2id degree of parallelism. Possible values: 1-255")
+	flagSet.IntVar(&args.fsckJobs, "fsck-jobs", 1, "Number of files -fsck checks in parallel")
 
 	flagSet.DurationVar(&args.idle, "i", 0, "Alias for -idle")
 	flagSet.DurationVar(&args.idle, "idle", 0, "Auto-unmount after specified idle duration (ignored in reverse mode). "+
@@ -232,6 +284,10 @@ func parseCliOpts() (args argContainer) {
 			tlog.Fatal.Printf("The -forcedecode and -aessiv flags are incompatible because they use different crypto libs (openssl vs native Go)")
 			os.Exit(exitcodes.Usage)
 		}
+		if args.xchacha == true {
+			tlog.Fatal.Printf("The -forcedecode and -xchacha flags are incompatible because they use different crypto libs (openssl vs native Go)")
+			os.Exit(exitcodes.Usage)
+		}
 		if args.reverse == true {
 			tlog.Fatal.Printf("The reverse mode and the -forcedecode option are not compatible")
 			os.Exit(exitcodes.Usage)
@@ -271,6 +327,26 @@ func parseCliOpts() (args argContainer) {
 	return args
 }
 
+// parseBlockSize parses a "-blocksize" value. It accepts a number of bytes
+// with an optional "K" or "M" suffix.
+func parseBlockSize(s string) (uint64, error) {
+	var mult uint64 = 1
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1024
+		s = s[:len(s)-1]
+	case "M":
+		mult = 1024 * 1024
+		s = s[:len(s)-1]
+	}
+	bs, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	bs *= mult
+	return bs, contentenc.CheckBS(bs)
+}
+
 // prettyArgs pretty-prints the command-line arguments.
 func prettyArgs() string {
 	pa := fmt.Sprintf("%v", os.Args)
@@ -294,5 +370,29 @@ func countOpFlags(args *argContainer) int {
 	if args.fsck {
 		count++
 	}
+	if args.scrub {
+		count++
+	}
+	if args.extract {
+		count++
+	}
+	if args.cat {
+		count++
+	}
+	if args.importDir {
+		count++
+	}
+	if args.rekey {
+		count++
+	}
+	if args.addkey != "" {
+		count++
+	}
+	if args.listkeys {
+		count++
+	}
+	if args.revokekey != "" {
+		count++
+	}
 	return count
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/simonhorlick/gocryptfs/internal/exitcodes"
+	"github.com/simonhorlick/gocryptfs/internal/fusefrontend"
+	"github.com/simonhorlick/gocryptfs/internal/tlog"
+)
+
+type extractObj struct {
+	fs *fusefrontend.FS
+	// Number of items that could not be extracted
+	errorCount int
+	// Destination paths of hard-linked files (Nlink > 1) that we have already
+	// extracted, indexed by inode number
+	seenInodes map[uint64]string
+}
+
+func (ex *extractObj) fail(format string, a ...interface{}) {
+	tlog.Warn.Printf("extract: "+format, a...)
+	ex.errorCount++
+}
+
+// copyFile decrypts the plaintext file at "path" and writes the content
+// to "w".
+func (ex *extractObj) copyFile(path string, w io.Writer) error {
+	f, status := ex.fs.Open(path, syscall.O_RDONLY, nil)
+	if !status.Ok() {
+		return fmt.Errorf("error opening %q: %v", path, status)
+	}
+	defer f.Release()
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	var off int64
+	for {
+		result, status := f.Read(buf, off)
+		if !status.Ok() {
+			return fmt.Errorf("error reading %q at offset %d: %v", path, off, status)
+		}
+		data, _ := result.Bytes(buf)
+		if len(data) == 0 {
+			return nil
+		}
+		_, err := w.Write(data)
+		if err != nil {
+			return err
+		}
+		off += int64(len(data))
+	}
+}
+
+// extractFile decrypts the regular file "path" to the new file "dest".
+func (ex *extractObj) extractFile(path string, dest string, attr *fuse.Attr) {
+	if attr.Nlink > 1 {
+		if first, ok := ex.seenInodes[attr.Ino]; ok {
+			err := os.Link(first, dest)
+			if err != nil {
+				ex.fail("%v", err)
+			}
+			return
+		}
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		ex.fail("%v", err)
+		return
+	}
+	err = ex.copyFile(path, out)
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		ex.fail("%v", err)
+		// Do not leave a partial copy behind
+		os.Remove(dest)
+		return
+	}
+	if attr.Nlink > 1 {
+		// Only a complete copy may become the target of the other links
+		ex.seenInodes[attr.Ino] = dest
+	}
+	ex.setAttr(dest, attr)
+}
+
+// setAttr applies the permissions and the timestamps stored in "attr" to
+// "dest".
+func (ex *extractObj) setAttr(dest string, attr *fuse.Attr) {
+	err := syscall.Chmod(dest, attr.Mode&07777)
+	if err != nil {
+		ex.fail("chmod %q: %v", dest, err)
+	}
+	atime := time.Unix(int64(attr.Atime), int64(attr.Atimensec))
+	mtime := time.Unix(int64(attr.Mtime), int64(attr.Mtimensec))
+	err = os.Chtimes(dest, atime, mtime)
+	if err != nil {
+		ex.fail("%v", err)
+	}
+}
+
+// extractPath recursively decrypts "path" to "dest".
+func (ex *extractObj) extractPath(path string, dest string) {
+	tlog.Debug.Printf("ex.extractPath %q -> %q", path, dest)
+	attr, status := ex.fs.GetAttr(path, nil)
+	if !status.Ok() {
+		ex.fail("error stating %q: %v", path, status)
+		return
+	}
+	switch attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		ex.extractFile(path, dest, attr)
+	case syscall.S_IFLNK:
+		target, status := ex.fs.Readlink(path, nil)
+		if !status.Ok() {
+			ex.fail("error reading symlink %q: %v", path, status)
+			return
+		}
+		err := os.Symlink(target, dest)
+		if err != nil {
+			ex.fail("%v", err)
+		}
+	case syscall.S_IFDIR:
+		// Make sure we can write into the directory. The real permissions are
+		// applied after the contents have been extracted.
+		err := os.Mkdir(dest, 0700)
+		if err != nil {
+			ex.fail("%v", err)
+			return
+		}
+		entries, status := ex.fs.OpenDir(path, nil)
+		if !status.Ok() {
+			ex.fail("error opening dir %q: %v", path, status)
+			return
+		}
+		for _, entry := range entries {
+			if entry.Name == "." || entry.Name == ".." {
+				continue
+			}
+			ex.extractPath(filepath.Join(path, entry.Name), filepath.Join(dest, entry.Name))
+		}
+		ex.setAttr(dest, attr)
+	default:
+		tlog.Info.Printf("extract: skipping special file %q (mode %#o)", path, attr.Mode)
+	}
+}
+
+// extract implements "-extract CIPHERDIR PLAINPATH DEST" and
+// "-cat CIPHERDIR PLAINPATH". It decrypts files from CIPHERDIR without
+// mounting it.
+func extract(args *argContainer) {
+	op, nArgs := "-extract", 3
+	if args.cat {
+		op, nArgs = "-cat", 2
+		// stdout belongs to the file content
+		tlog.Info.Logger.SetOutput(os.Stderr)
+		tlog.Debug.Logger.SetOutput(os.Stderr)
+	}
+	if flagSet.NArg() != nArgs {
+		tlog.Fatal.Printf("The option %s takes exactly %d arguments, %d given",
+			op, nArgs, flagSet.NArg())
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse {
+		tlog.Fatal.Printf("Running %s with -reverse is not supported", op)
+		os.Exit(exitcodes.Usage)
+	}
+	// PLAINPATH is relative to the root of the filesystem
+	plainPath := strings.TrimPrefix(filepath.Clean("/"+flagSet.Arg(1)), "/")
+	var dest string
+	if args.extract {
+		dest = flagSet.Arg(2)
+		if _, err := os.Lstat(dest); err == nil {
+			tlog.Fatal.Printf("Destination %q already exists", dest)
+			os.Exit(exitcodes.Extract)
+		}
+	}
+	pfs, wipeKeys := initFuseFrontend(args)
+	ex := extractObj{
+		fs:         pfs.(*fusefrontend.FS),
+		seenInodes: make(map[uint64]string),
+	}
+	if args.cat {
+		attr, status := ex.fs.GetAttr(plainPath, nil)
+		if status.Ok() && !attr.IsRegular() {
+			ex.fail("%q is not a regular file", plainPath)
+		} else if err := ex.copyFile(plainPath, os.Stdout); err != nil {
+			ex.fail("%v", err)
+		}
+	} else {
+		ex.extractPath(plainPath, dest)
+	}
+	wipeKeys()
+	if ex.errorCount > 0 {
+		tlog.Fatal.Printf("%s: %d errors", op, ex.errorCount)
+		os.Exit(exitcodes.Extract)
+	}
+}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
@@ -18,28 +24,191 @@ import (
 	"github.com/simonhorlick/gocryptfs/internal/tlog"
 )
 
+// Problem classes, see fsckProblem.Class
+const (
+	fsckBadName      = "bad_name"
+	fsckMissingDirIV = "missing_diriv"
+	fsckBadHeader    = "bad_header"
+	fsckAuthFailure  = "auth_failure"
+	fsckTornBlock    = "torn_block"
+	fsckIntegrity    = "integrity_violation"
+	fsckBadXattr     = "bad_xattr"
+	fsckBadSymlink   = "bad_symlink"
+	fsckIOError      = "io_error"
+)
+
+// fsckProblem is a single problem found by fsck. "-fsck -json" prints the
+// list of problems.
+type fsckProblem struct {
+	// Path is the plaintext path. It is not known for entries whose name
+	// cannot be decrypted.
+	Path string `json:",omitempty"`
+	// CipherPath is the ciphertext path, relative to CIPHERDIR
+	CipherPath string `json:",omitempty"`
+	// Inode is the inode number of the ciphertext file
+	Inode uint64 `json:",omitempty"`
+	Class string
+	// Block is only set for auth_failure and torn_block
+	Block *fsckBlock `json:",omitempty"`
+	// Text is the error message
+	Text string `json:",omitempty"`
+}
+
+// fsckBlock is the location of a file block that cannot be read
+type fsckBlock struct {
+	No           uint64
+	PlainOffset  uint64
+	CipherOffset uint64
+}
+
+// fsckReport is the output of "-fsck -json"
+type fsckReport struct {
+	Problems []fsckProblem
+	Skipped  []string
+	// Repairs lists the "-repair" actions, as they are printed without
+	// "-json"
+	Repairs []string `json:",omitempty"`
+	Summary fsckSummary
+}
+
+type fsckSummary struct {
+	// Number of directories and files that have been checked
+	Dirs, Files uint64
+	// Number of files that have not been checked again because of
+	// "-fsck-checkpoint" or "-fsck-incremental"
+	AlreadyChecked, Unchanged int
+	CorruptFiles              int
+	Skipped                   int
+	Problems                  int
+	Repairs                   int
+	// Number of problems per class
+	Classes map[string]int
+}
+
+// fsckProgressInterval is how often the progress line is updated, and
+// fsckCheckpointInterval how often the "-fsck-checkpoint" file is written
+const (
+	fsckProgressInterval   = time.Second
+	fsckCheckpointInterval = 30 * time.Second
+)
+
+// fsckJob is a file whose content a "-fsck-jobs" worker checks
+type fsckJob struct {
+	path string
+	ino  uint64
+	// cPath and ctime are only set with "-fsck-checkpoint"
+	cPath string
+	ctime int64
+}
+
 type fsckObj struct {
+	// fs is nil for a "-scrub" without the master key
 	fs *fusefrontend.FS
-	// List of corrupt files
-	corruptList []string
+	// wipeKeys purges the keys from memory after the check
+	wipeKeys func()
+	// Absolute path to CIPHERDIR
+	cipherdir string
+	// List of problems
+	problems []fsckProblem
+	// problemKeys maps fsckProblem.key to the index in "problems"
+	problemKeys map[string]int
 	// List of skipped files
 	skippedList []string
-	// Protects corruptList
+	// Protects problems, problemKeys, skippedList, corruptNames, repairs,
+	// repairCount and checkpoint
 	listLock sync.Mutex
 	// stop a running watchMitigatedCorruptions thread
 	watchDone chan struct{}
 	// Inode numbers of hard-linked files (Nlink > 1) that we have already checked
 	seenInodes map[uint64]struct{}
+	// "-repair", "-dry-run" and "-json"
+	repair, dryRun, json bool
+	// Corrupt entries reported by the last OpenDir(), only collected for
+	// "-repair"
+	corruptNames []string
+	// Repair actions and their outcome
+	repairs []string
+	// Number of successful repairs
+	repairCount int
+	// The directory walk runs in the main goroutine and hands the files to
+	// the "-fsck-jobs" workers through this channel. The workers do not
+	// cause mitigated corruption reports, so the watchers of the walk only
+	// see their own.
+	jobs chan fsckJob
+	// "-fsck-checkpoint" or nil
+	checkpoint *fsckCheckpoint
+	// "-fsck-incremental": files whose ciphertext ctime is before this time
+	// are not checked. Zero otherwise.
+	unchangedBefore time.Time
+	// Progress counters, accessed atomically
+	dirCount, fileCount, filesChecked, bytesRead uint64
+	// Files that have not been checked again, only accessed by the walk
+	alreadyChecked, unchanged int
 }
 
 func runsAsRoot() bool {
 	return syscall.Geteuid() == 0
 }
 
-func (ck *fsckObj) markCorrupt(path string) {
+// printf prints a human-readable message. Suppressed by "-json".
+func (ck *fsckObj) printf(format string, v ...interface{}) {
+	if ck.json {
+		return
+	}
+	fmt.Printf(format, v...)
+}
+
+// key identifies a problem by its location. A resumed run finds the problems
+// in directories again, the repair of a directory reads it more than once,
+// and "-scrub" reports some problems before "-fsck" finds them again with a
+// different text. So the key only contains the plaintext path if the
+// ciphertext path is unknown, and the text only for bad_xattr, where it names
+// the xattr.
+func (p *fsckProblem) key() string {
+	k := p.CipherPath
+	if k == "" {
+		k = "\x00" + p.Path
+	}
+	k += "\x00" + p.Class
+	if p.Class == fsckBadXattr {
+		k += "\x00" + p.Text
+	}
+	if p.Block != nil {
+		k += fmt.Sprintf("\x00%d", p.Block.No)
+	}
+	return k
+}
+
+// problem records "p". The ciphertext path and the inode number are filled
+// in if they are missing.
+func (ck *fsckObj) problem(p fsckProblem) {
+	if p.CipherPath == "" && p.Path != "" {
+		p.CipherPath, _ = ck.fs.CipherPath(p.Path)
+	}
+	if p.Inode == 0 && p.CipherPath != "" {
+		var st syscall.Stat_t
+		if syscall.Lstat(filepath.Join(ck.cipherdir, p.CipherPath), &st) == nil {
+			p.Inode = st.Ino
+		}
+	}
 	ck.listLock.Lock()
-	ck.corruptList = append(ck.corruptList, path)
-	ck.listLock.Unlock()
+	defer ck.listLock.Unlock()
+	if i, ok := ck.problemKeys[p.key()]; ok {
+		// Fill in what the first report did not know
+		q := &ck.problems[i]
+		if q.Path == "" {
+			q.Path = p.Path
+		}
+		if q.Inode == 0 {
+			q.Inode = p.Inode
+		}
+		if q.Text == "" {
+			q.Text = p.Text
+		}
+		return
+	}
+	ck.problemKeys[p.key()] = len(ck.problems)
+	ck.problems = append(ck.problems, p)
 }
 
 func (ck *fsckObj) markSkipped(path string) {
@@ -48,13 +217,23 @@ func (ck *fsckObj) markSkipped(path string) {
 	ck.listLock.Unlock()
 }
 
-// Watch for mitigated corruptions that occur during OpenDir()
-func (ck *fsckObj) watchMitigatedCorruptionsOpenDir(path string) {
+// Watch for mitigated corruptions that occur during OpenDir(). The problems
+// are only recorded if "record" is set, the entries are always collected for
+// "-repair".
+func (ck *fsckObj) watchMitigatedCorruptionsOpenDir(path string, record bool) {
 	for {
 		select {
 		case item := <-ck.fs.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt entry in dir %q: %q\n", path, item)
-			ck.markCorrupt(filepath.Join(path, item))
+			if record {
+				ck.printf("fsck: corrupt entry in dir %q: %q\n", path, item)
+				cDir, _ := ck.fs.CipherPath(path)
+				ck.problem(fsckProblem{CipherPath: filepath.Join(cDir, item), Class: fsckBadName})
+			}
+			if ck.repair {
+				ck.listLock.Lock()
+				ck.corruptNames = append(ck.corruptNames, item)
+				ck.listLock.Unlock()
+			}
 		case <-ck.watchDone:
 			return
 		}
@@ -64,19 +243,34 @@ func (ck *fsckObj) watchMitigatedCorruptionsOpenDir(path string) {
 // Recursively check dir for corruption
 func (ck *fsckObj) dir(path string) {
 	tlog.Debug.Printf("ck.dir %q\n", path)
+	atomic.AddUint64(&ck.dirCount, 1)
 	ck.xattrs(path)
 	// Run OpenDir and catch transparently mitigated corruptions
-	go ck.watchMitigatedCorruptionsOpenDir(path)
+	go ck.watchMitigatedCorruptionsOpenDir(path, true)
 	entries, status := ck.fs.OpenDir(path, nil)
 	ck.watchDone <- struct{}{}
 	// Also catch non-mitigated corruptions
 	if !status.Ok() {
-		fmt.Printf("fsck: error opening dir %q: %v\n", path, status)
+		ck.printf("fsck: error opening dir %q: %v\n", path, status)
 		if status == fuse.EACCES && !runsAsRoot() {
 			ck.markSkipped(path)
 		} else {
-			ck.markCorrupt(path)
+			class := fsckIOError
+			// A dry run tells us if gocryptfs.diriv is the problem
+			if action, _ := ck.fs.RepairDirIV(path, true); action != "" {
+				class = fsckMissingDirIV
+			}
+			ck.problem(fsckProblem{Path: path, Class: class, Text: status.String()})
 		}
+	}
+	// Look again if the repair has changed something. A new gocryptfs.diriv
+	// needs a second round for the entries.
+	for try := 0; ck.repair && try < 2 && ck.repairDir(path, status); try++ {
+		go ck.watchMitigatedCorruptionsOpenDir(path, false)
+		entries, status = ck.fs.OpenDir(path, nil)
+		ck.watchDone <- struct{}{}
+	}
+	if !status.Ok() {
 		return
 	}
 	// Sort alphabetically
@@ -98,39 +292,121 @@ func (ck *fsckObj) dir(path string) {
 		case syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFBLK, syscall.S_IFCHR:
 			// nothing to check
 		default:
-			fmt.Printf("fsck: unhandled file type %x\n", filetype)
+			ck.printf("fsck: unhandled file type %x\n", filetype)
 		}
 	}
 }
 
-func (ck *fsckObj) symlink(path string) {
-	_, status := ck.fs.Readlink(path, nil)
+// repairDir fixes the problems found by OpenDir(path). "status" is what
+// OpenDir returned. Returns true if anything has been changed.
+func (ck *fsckObj) repairDir(path string, status fuse.Status) bool {
+	ck.listLock.Lock()
+	names := ck.corruptNames
+	ck.corruptNames = nil
+	ck.listLock.Unlock()
+	changed := false
 	if !status.Ok() {
-		ck.markCorrupt(path)
-		fmt.Printf("fsck: error reading symlink %q: %v\n", path, status)
+		action, err := ck.fs.RepairDirIV(path, ck.dryRun)
+		changed = ck.repaired(action, err) || changed
+	}
+	for _, n := range names {
+		action, err := ck.fs.RepairName(path, n, ck.dryRun)
+		changed = ck.repaired(action, err) || changed
 	}
+	return changed
 }
 
-// Watch for mitigated corruptions that occur during Read()
-func (ck *fsckObj) watchMitigatedCorruptionsRead(path string) {
-	for {
-		select {
-		case item := <-ck.fs.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt file %q (inode %s)\n", path, item)
-			ck.markCorrupt(path)
-		case <-ck.watchDone:
+// repaired prints and records the outcome of a repair "action". Returns true
+// if the action has been carried out.
+func (ck *fsckObj) repaired(action string, err error) bool {
+	var msg string
+	done := false
+	if action == "" {
+		if err == nil {
+			return false
+		}
+		msg = fmt.Sprintf("repair failed: %v", err)
+	} else if ck.dryRun {
+		msg = "would " + action
+	} else if err != nil {
+		msg = fmt.Sprintf("failed to %s: %v", action, err)
+	} else {
+		msg = "repair: " + action
+		done = true
+	}
+	ck.printf("fsck: %s\n", msg)
+	ck.listLock.Lock()
+	ck.repairs = append(ck.repairs, msg)
+	if done {
+		ck.repairCount++
+	}
+	ck.listLock.Unlock()
+	return done
+}
+
+// repairFile fixes the blocks of "path" in the range that could not be read.
+func (ck *fsckObj) repairFile(f *fusefrontend.File, path string, off int64, length int) {
+	if !ck.dryRun {
+		// The file has been opened read-only for checking
+		f2, status := ck.fs.Open(path, syscall.O_RDWR, nil)
+		if !status.Ok() {
+			ck.repaired(fmt.Sprintf("open %q for writing", path), syscall.Errno(status))
 			return
 		}
+		defer f2.Release()
+		f = f2.(*nodefs.WithFlags).File.(*fusefrontend.File)
+	}
+	actions, err := f.RepairBlocks(off, length, ck.dryRun)
+	for i, a := range actions {
+		var aErr error
+		if i == len(actions)-1 {
+			// Only the last action can have failed
+			aErr = err
+		}
+		ck.repaired(fmt.Sprintf("%s of %q", a, path), aErr)
+	}
+	if len(actions) == 0 {
+		ck.repaired("", err)
+	}
+}
+
+// repairIntegrity fixes the end of the file "path" after an interrupted
+// append or truncate. Returns true if anything has been changed.
+func (ck *fsckObj) repairIntegrity(f *fusefrontend.File, path string) bool {
+	if !ck.dryRun {
+		// The file has been opened read-only for checking
+		f2, status := ck.fs.Open(path, syscall.O_RDWR, nil)
+		if !status.Ok() {
+			ck.repaired(fmt.Sprintf("open %q for writing", path), syscall.Errno(status))
+			return false
+		}
+		defer f2.Release()
+		f = f2.(*nodefs.WithFlags).File.(*fusefrontend.File)
+	}
+	action, err := f.RepairIntegrity(ck.dryRun)
+	if action != "" {
+		action = fmt.Sprintf("%s of %q", action, path)
 	}
+	return ck.repaired(action, err)
 }
 
-// Check file for corruption
+func (ck *fsckObj) symlink(path string) {
+	_, status := ck.fs.Readlink(path, nil)
+	if !status.Ok() {
+		ck.problem(fsckProblem{Path: path, Class: fsckBadSymlink, Text: status.String()})
+		ck.printf("fsck: error reading symlink %q: %v\n", path, status)
+	}
+}
+
+// Check file for corruption. The content is checked by a "-fsck-jobs"
+// worker, see fileContent.
 func (ck *fsckObj) file(path string) {
 	tlog.Debug.Printf("ck.file %q\n", path)
+	atomic.AddUint64(&ck.fileCount, 1)
 	attr, status := ck.fs.GetAttr(path, nil)
 	if !status.Ok() {
-		ck.markCorrupt(path)
-		fmt.Printf("fsck: error stating file %q: %v\n", path, status)
+		ck.problem(fsckProblem{Path: path, Class: fsckIOError, Text: status.String()})
+		ck.printf("fsck: error stating file %q: %v\n", path, status)
 		return
 	}
 	if attr.Nlink > 1 {
@@ -142,44 +418,89 @@ func (ck *fsckObj) file(path string) {
 		ck.seenInodes[attr.Ino] = struct{}{}
 	}
 	ck.xattrs(path)
+	job := fsckJob{
+		path:  path,
+		ino:   attr.Ino,
+		ctime: int64(attr.Ctime)*int64(time.Second) + int64(attr.Ctimensec),
+	}
+	if !ck.unchangedBefore.IsZero() && job.ctime < ck.unchangedBefore.UnixNano() {
+		tlog.Debug.Printf("ck.file: skipping %q (unchanged)\n", path)
+		ck.unchanged++
+		return
+	}
+	if ck.checkpoint != nil {
+		job.cPath, _ = ck.fs.CipherPath(path)
+		ck.listLock.Lock()
+		ctime, ok := ck.checkpoint.Done[job.cPath]
+		ck.listLock.Unlock()
+		if ok && ctime == job.ctime {
+			tlog.Debug.Printf("ck.file: skipping %q (already checked)\n", path)
+			ck.alreadyChecked++
+			return
+		}
+	}
+	ck.jobs <- job
+}
+
+// fileContent checks the content of the file in "job"
+func (ck *fsckObj) fileContent(job fsckJob) {
+	path := job.path
+	defer ck.fileDone(job)
 	f, status := ck.fs.Open(path, syscall.O_RDONLY, nil)
 	if !status.Ok() {
-		fmt.Printf("fsck: error opening file %q: %v\n", path, status)
+		ck.printf("fsck: error opening file %q: %v\n", path, status)
 		if status == fuse.EACCES && !runsAsRoot() {
 			ck.markSkipped(path)
 		} else {
-			ck.markCorrupt(path)
+			ck.problem(fsckProblem{Path: path, Inode: job.ino, Class: fsckIOError, Text: status.String()})
 		}
 		return
 	}
 	defer f.Release()
+	f2 := f.(*nodefs.WithFlags).File.(*fusefrontend.File)
+	// An incomplete header would be reported as a mitigated corruption by
+	// Read(), so we must catch it before
+	if err := f2.CheckHeader(); err != nil {
+		ck.problem(fsckProblem{Path: path, Inode: job.ino, Class: fsckBadHeader, Text: err.Error()})
+		ck.printf("fsck: invalid header in file %q (inum %d): %v\n", path, job.ino, err)
+		return
+	}
+	if err := f2.VerifyIntegrity(); err != nil {
+		ck.problem(fsckProblem{Path: path, Inode: job.ino, Class: fsckIntegrity, Text: err.Error()})
+		ck.printf("fsck: integrity violation in file %q (inum %d): %v\n", path, job.ino, err)
+		if !ck.repair || !ck.repairIntegrity(f2, path) || f2.VerifyIntegrity() != nil {
+			return
+		}
+	}
 	// 128 kiB of zeros
 	allZero := make([]byte, fuse.MAX_KERNEL_WRITE)
 	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
 	var off int64
-	// Read() through the whole file and catch transparently mitigated corruptions
-	go ck.watchMitigatedCorruptionsRead(path)
-	defer func() { ck.watchDone <- struct{}{} }()
 	for {
 		tlog.Debug.Printf("ck.file: read %d bytes from offset %d\n", len(buf), off)
 		result, status := f.Read(buf, off)
 		if !status.Ok() {
-			ck.markCorrupt(path)
-			fmt.Printf("fsck: error reading file %q (inum %d): %v\n", path, inum(f), status)
-			return
+			ck.printf("fsck: error reading file %q (inum %d): %v\n", path, job.ino, status)
+			ck.badBlocks(f2, path, job.ino, off, len(buf))
+			if ck.repair {
+				ck.repairFile(f2, path, off, len(buf))
+			}
+			// Look for more bad blocks in the rest of the file
+			off += int64(len(buf))
+			continue
 		}
 		n := result.Size()
 		// EOF
 		if n == 0 {
 			return
 		}
+		atomic.AddUint64(&ck.bytesRead, uint64(n))
 		off += int64(n)
 		// If we seem to be in the middle of a file hole, try to skip to the next
 		// data section.
 		data := buf[:n]
 		if bytes.Equal(data, allZero) {
 			tlog.Debug.Printf("ck.file: trying to skip file hole\n")
-			f2 := f.(*fusefrontend.File)
 			nextOff, err := f2.SeekData(off)
 			if err == nil {
 				off = nextOff
@@ -188,13 +509,52 @@ func (ck *fsckObj) file(path string) {
 	}
 }
 
+// fileDone marks the file in "job" as checked
+func (ck *fsckObj) fileDone(job fsckJob) {
+	atomic.AddUint64(&ck.filesChecked, 1)
+	if ck.checkpoint == nil {
+		return
+	}
+	ck.listLock.Lock()
+	ck.checkpoint.Done[job.cPath] = job.ctime
+	ck.listLock.Unlock()
+}
+
+// badBlocks records the blocks of "path" in the range that could not be read
+func (ck *fsckObj) badBlocks(f *fusefrontend.File, path string, ino uint64, off int64, length int) {
+	bad, err := f.BadBlocks(off, length)
+	if err != nil || len(bad) == 0 {
+		// The range could not be read, but each block on its own can
+		text := fmt.Sprintf("read error at offset %d", off)
+		if err != nil {
+			text = err.Error()
+		}
+		ck.problem(fsckProblem{Path: path, Inode: ino, Class: fsckIOError, Text: text})
+		return
+	}
+	for _, b := range bad {
+		class := fsckAuthFailure
+		if b.Torn {
+			class = fsckTornBlock
+		}
+		ck.printf("fsck: %s in file %q: block #%d, offset %d, ciphertext offset %d\n",
+			class, path, b.BlockNo, b.PlainOff, b.CipherOff)
+		ck.problem(fsckProblem{
+			Path:  path,
+			Inode: ino,
+			Class: class,
+			Block: &fsckBlock{No: b.BlockNo, PlainOffset: b.PlainOff, CipherOffset: b.CipherOff},
+		})
+	}
+}
+
 // Watch for mitigated corruptions that occur during ListXAttr()
 func (ck *fsckObj) watchMitigatedCorruptionsListXAttr(path string) {
 	for {
 		select {
 		case item := <-ck.fs.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt xattr name on file %q: %q\n", path, item)
-			ck.markCorrupt(path + " xattr:" + item)
+			ck.printf("fsck: corrupt xattr name on file %q: %q\n", path, item)
+			ck.problem(fsckProblem{Path: path, Class: fsckBadXattr, Text: fmt.Sprintf("corrupt name %q", item)})
 		case <-ck.watchDone:
 			return
 		}
@@ -209,26 +569,183 @@ func (ck *fsckObj) xattrs(path string) {
 	ck.watchDone <- struct{}{}
 	// Also catch non-mitigated corruptions
 	if !status.Ok() {
-		fmt.Printf("fsck: error listing xattrs on %q: %v\n", path, status)
-		ck.markCorrupt(path)
+		ck.printf("fsck: error listing xattrs on %q: %v\n", path, status)
+		ck.problem(fsckProblem{Path: path, Class: fsckBadXattr, Text: status.String()})
 		return
 	}
 	for _, a := range attrs {
 		_, status := ck.fs.GetXAttr(path, a, nil)
 		if !status.Ok() {
-			fmt.Printf("fsck: error reading xattr %q from %q: %v\n", a, path, status)
+			ck.printf("fsck: error reading xattr %q from %q: %v\n", a, path, status)
 			if status == fuse.EACCES && !runsAsRoot() {
 				ck.markSkipped(path)
 			} else {
-				ck.markCorrupt(path)
+				ck.problem(fsckProblem{Path: path, Class: fsckBadXattr, Text: fmt.Sprintf("%q: %v", a, status)})
+			}
+		}
+	}
+}
+
+// corruptFiles returns the number of distinct paths that have a problem
+func (ck *fsckObj) corruptFiles() int {
+	paths := make(map[string]struct{})
+	for _, p := range ck.problems {
+		if p.Path != "" {
+			paths[p.Path] = struct{}{}
+		} else {
+			paths["cipher:"+p.CipherPath] = struct{}{}
+		}
+	}
+	return len(paths)
+}
+
+// printJSON prints the "-json" report
+func (ck *fsckObj) printJSON() {
+	r := fsckReport{
+		Problems: ck.problems,
+		Skipped:  ck.skippedList,
+		Repairs:  ck.repairs,
+		Summary: fsckSummary{
+			Dirs:           ck.dirCount,
+			Files:          ck.fileCount,
+			AlreadyChecked: ck.alreadyChecked,
+			Unchanged:      ck.unchanged,
+			CorruptFiles:   ck.corruptFiles(),
+			Skipped:        len(ck.skippedList),
+			Problems:       len(ck.problems),
+			Repairs:        ck.repairCount,
+			Classes:        make(map[string]int),
+		},
+	}
+	// Empty lists instead of null
+	if r.Problems == nil {
+		r.Problems = []fsckProblem{}
+	}
+	if r.Skipped == nil {
+		r.Skipped = []string{}
+	}
+	// The "-fsck-jobs" workers find problems in random order. Sort them so
+	// that reports can be compared.
+	sort.Sort(sortableProblems(r.Problems))
+	sort.Strings(r.Skipped)
+	for _, p := range ck.problems {
+		r.Summary.Classes[p.Class]++
+	}
+	out, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		tlog.Fatal.Printf("fsck: json: %v", err)
+		os.Exit(exitcodes.FsckErrors)
+	}
+	fmt.Println(string(out))
+}
+
+// showProgress updates the progress line on stderr, if it is a terminal,
+// and saves the "-fsck-checkpoint" file regularly. It returns when "done"
+// is closed.
+func (ck *fsckObj) showProgress(done chan struct{}) {
+	tty := terminal.IsTerminal(int(os.Stderr.Fd()))
+	ticker := time.NewTicker(fsckProgressInterval)
+	defer ticker.Stop()
+	lastSave := time.Now()
+	for {
+		select {
+		case <-done:
+			if tty {
+				fmt.Fprintf(os.Stderr, "\n")
 			}
+			return
+		case <-ticker.C:
+		}
+		if tty {
+			fmt.Fprintf(os.Stderr, "\rfsck: %d dirs, %d of %d files checked, %d MiB read ",
+				atomic.LoadUint64(&ck.dirCount), atomic.LoadUint64(&ck.filesChecked),
+				atomic.LoadUint64(&ck.fileCount), atomic.LoadUint64(&ck.bytesRead)>>20)
 		}
+		if ck.checkpoint != nil && time.Since(lastSave) >= fsckCheckpointInterval {
+			ck.saveCheckpoint()
+			lastSave = time.Now()
+		}
+	}
+}
+
+// saveCheckpoint writes the progress of the current run to the
+// "-fsck-checkpoint" file
+func (ck *fsckObj) saveCheckpoint() {
+	ck.listLock.Lock()
+	defer ck.listLock.Unlock()
+	ck.checkpoint.Problems = ck.problems
+	ck.checkpoint.Skipped = ck.skippedList
+	err := ck.checkpoint.save()
+	if err != nil {
+		tlog.Warn.Printf("fsck: could not save checkpoint: %v", err)
 	}
 }
 
+// finishCheckpoint records the end of the run in the "-fsck-checkpoint" file
+func (ck *fsckObj) finishCheckpoint() {
+	cp := ck.checkpoint
+	ck.listLock.Lock()
+	if len(ck.problems) == 0 && len(ck.skippedList) == 0 {
+		cp.LastSuccess = cp.RunStart
+	}
+	cp.RunStart = time.Time{}
+	cp.Done = nil
+	ck.problems, ck.skippedList = nil, nil
+	ck.listLock.Unlock()
+	ck.saveCheckpoint()
+}
+
+// initCheckpoint loads the "-fsck-checkpoint" file and restores the state of
+// an interrupted run
+func (ck *fsckObj) initCheckpoint(args *argContainer) {
+	cp, err := loadFsckCheckpoint(args.fsckCheckpoint, args.cipherdir)
+	if err != nil {
+		tlog.Fatal.Printf("fsck: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	if cp.resuming() {
+		tlog.Info.Printf("fsck: resuming the run started at %v, %d files already checked",
+			cp.RunStart.Format(time.RFC3339), len(cp.Done))
+		for i := range cp.Problems {
+			ck.problemKeys[cp.Problems[i].key()] = i
+		}
+		ck.problems = cp.Problems
+		ck.skippedList = cp.Skipped
+	} else {
+		cp.RunStart = time.Now()
+		cp.Done = make(map[string]int64)
+	}
+	if args.fsckIncremental {
+		if cp.LastSuccess.IsZero() {
+			tlog.Info.Printf("fsck: no successful run recorded, checking all files")
+		} else {
+			tlog.Info.Printf("fsck: only checking files changed since %v", cp.LastSuccess.Format(time.RFC3339))
+			ck.unchangedBefore = cp.LastSuccess
+		}
+	}
+	ck.checkpoint = cp
+	ck.saveCheckpoint()
+	// Save the progress when we are interrupted
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ch
+		ck.saveCheckpoint()
+		tlog.Info.Printf("\nfsck: interrupted, run again with the same -fsck-checkpoint to resume")
+		os.Exit(exitcodes.SigInt)
+	}()
+}
+
 func fsck(args *argContainer) {
+	ck := newFsck(args)
+	ck.run(args.fsckJobs)
+	ck.finish("fsck")
+}
+
+// newFsck unlocks the filesystem for checking
+func newFsck(args *argContainer) *fsckObj {
 	if args.reverse {
-		tlog.Fatal.Printf("Running -fsck with -reverse is not supported")
+		tlog.Fatal.Printf("Running -fsck or -scrub with -reverse is not supported")
 		os.Exit(exitcodes.Usage)
 	}
 	args.allow_other = false
@@ -236,23 +753,96 @@ func fsck(args *argContainer) {
 	fs := pfs.(*fusefrontend.FS)
 	fs.MitigatedCorruptions = make(chan string)
 	ck := fsckObj{
-		fs:         fs,
-		watchDone:  make(chan struct{}),
-		seenInodes: make(map[uint64]struct{}),
+		fs:          fs,
+		wipeKeys:    wipeKeys,
+		cipherdir:   args.cipherdir,
+		problemKeys: make(map[string]int),
+		watchDone:   make(chan struct{}),
+		seenInodes:  make(map[uint64]struct{}),
+		repair:      args.repair,
+		dryRun:      args.dryRun,
+		json:        args.json,
+		jobs:        make(chan fsckJob, args.fsckJobs),
+	}
+	if args.fsckCheckpoint != "" {
+		ck.initCheckpoint(args)
+	}
+	return &ck
+}
+
+// run checks the whole filesystem using "jobs" workers and wipes the keys
+func (ck *fsckObj) run(jobs int) {
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range ck.jobs {
+				ck.fileContent(job)
+			}
+		}()
 	}
+	progressDone := make(chan struct{})
+	go ck.showProgress(progressDone)
 	ck.dir("")
-	wipeKeys()
-	if len(ck.corruptList) == 0 && len(ck.skippedList) == 0 {
-		tlog.Info.Printf("fsck summary: no problems found\n")
+	close(ck.jobs)
+	wg.Wait()
+	close(progressDone)
+	ck.wipeKeys()
+}
+
+// finish prints the report and exits with exitcodes.FsckErrors if there are
+// problems. "name" is the operation ("fsck" or "scrub") for the messages.
+func (ck *fsckObj) finish(name string) {
+	if ck.json {
+		ck.printJSON()
+	}
+	corrupt, skipped := ck.corruptFiles(), len(ck.skippedList)
+	if ck.checkpoint != nil {
+		ck.finishCheckpoint()
+	}
+	if corrupt == 0 && skipped == 0 {
+		tlog.Info.Printf("%s summary: no problems found\n", name)
 		return
 	}
-	if len(ck.skippedList) > 0 {
-		tlog.Warn.Printf("fsck: re-run this program as root to check all files!\n")
+	if skipped > 0 {
+		tlog.Warn.Printf("%s: re-run this program as root to check all files!\n", name)
+	}
+	ck.printf("%s summary: %d corrupt files, %d files skipped\n", name, corrupt, skipped)
+	if ck.repairCount > 0 {
+		ck.printf("%s summary: %d repairs done, run -fsck again to check the result\n", name, ck.repairCount)
 	}
-	fmt.Printf("fsck summary: %d corrupt files, %d files skipped\n", len(ck.corruptList), len(ck.skippedList))
 	os.Exit(exitcodes.FsckErrors)
 }
 
+// sortableProblems sorts by path, class and block number
+type sortableProblems []fsckProblem
+
+func (s sortableProblems) Len() int {
+	return len(s)
+}
+
+func (s sortableProblems) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortableProblems) Less(i, j int) bool {
+	a, b := s[i], s[j]
+	if a.Path != b.Path {
+		return a.Path < b.Path
+	}
+	if a.CipherPath != b.CipherPath {
+		return a.CipherPath < b.CipherPath
+	}
+	if a.Class != b.Class {
+		return a.Class < b.Class
+	}
+	if a.Block != nil && b.Block != nil {
+		return a.Block.No < b.Block.No
+	}
+	return a.Text < b.Text
+}
+
 type sortableDirEntries []fuse.DirEntry
 
 func (s sortableDirEntries) Len() int {
@@ -266,9 +856,3 @@ func (s sortableDirEntries) Swap(i, j int) {
 func (s sortableDirEntries) Less(i, j int) bool {
 	return strings.Compare(s[i].Name, s[j].Name) < 0
 }
-
-func inum(f nodefs.File) uint64 {
-	var a fuse.Attr
-	f.GetAttr(&a)
-	return a.Ino
-}
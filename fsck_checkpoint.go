@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// fsckCheckpointVersion is the format version of the "-fsck-checkpoint" file
+const fsckCheckpointVersion = 1
+
+// fsckCheckpoint is stored in JSON format in the "-fsck-checkpoint" file. It
+// allows an interrupted run to be resumed, and "-fsck-incremental" to skip
+// the files that have not changed since the last successful run.
+//
+// Checked files are identified by their ciphertext path, so no plaintext
+// names are written to disk except for those in Problems and Skipped.
+type fsckCheckpoint struct {
+	Version int
+	// Cipherdir is the absolute path of the CIPHERDIR that has been checked
+	Cipherdir string
+	// RunStart is the start time of the unfinished run. Zero if the last run
+	// has finished.
+	RunStart time.Time
+	// Done maps the ciphertext path of every file the unfinished run has
+	// checked to its ctime, in nanoseconds, at that point
+	Done map[string]int64
+	// Problems and Skipped are what the unfinished run has found so far
+	Problems []fsckProblem
+	Skipped  []string
+	// LastSuccess is the start time of the last run that has found no
+	// problems
+	LastSuccess time.Time
+	// filename is not exported to JSON
+	filename string
+}
+
+// loadFsckCheckpoint reads "filename". A missing file gives an empty
+// checkpoint. A file that belongs to another CIPHERDIR is an error.
+func loadFsckCheckpoint(filename string, cipherdir string) (*fsckCheckpoint, error) {
+	cp := fsckCheckpoint{
+		Version:   fsckCheckpointVersion,
+		Cipherdir: cipherdir,
+		filename:  filename,
+	}
+	js, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &cp, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var onDisk fsckCheckpoint
+	err = json.Unmarshal(js, &onDisk)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %q: %v", filename, err)
+	}
+	if onDisk.Version != fsckCheckpointVersion {
+		return nil, fmt.Errorf("%q has version %d, want %d", filename, onDisk.Version, fsckCheckpointVersion)
+	}
+	if onDisk.Cipherdir != cipherdir {
+		return nil, fmt.Errorf("%q belongs to %q", filename, onDisk.Cipherdir)
+	}
+	onDisk.filename = filename
+	return &onDisk, nil
+}
+
+// resuming returns true if the checkpoint contains an unfinished run
+func (cp *fsckCheckpoint) resuming() bool {
+	return !cp.RunStart.IsZero()
+}
+
+func (cp *fsckCheckpoint) save() error {
+	js, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(cp.filename, append(js, '\n'), 0600)
+}
@@ -16,9 +16,7 @@ import (
 )
 
 const (
-	ivLen      = contentenc.DefaultIVBits / 8
 	authTagLen = cryptocore.AuthTagLen
-	blockSize  = contentenc.DefaultBS + ivLen + cryptocore.AuthTagLen
 	myName     = "gocryptfs-xray"
 )
 
@@ -27,11 +25,13 @@ func errExit(err error) {
 	os.Exit(1)
 }
 
-func prettyPrintHeader(h *contentenc.FileHeader, aessiv bool) {
+func prettyPrintHeader(h *contentenc.FileHeader, aessiv bool, xchacha bool) {
 	id := hex.EncodeToString(h.ID)
 	msg := "Header: Version: %d, Id: %s"
 	if aessiv {
 		msg += ", assuming AES-SIV mode"
+	} else if xchacha {
+		msg += ", assuming XChaCha20-Poly1305 mode"
 	} else {
 		msg += ", assuming AES-GCM mode"
 	}
@@ -41,6 +41,9 @@ func prettyPrintHeader(h *contentenc.FileHeader, aessiv bool) {
 func main() {
 	dumpmasterkey := flag.Bool("dumpmasterkey", false, "Decrypt and dump the master key")
 	aessiv := flag.Bool("aessiv", false, "Assume AES-SIV mode instead of AES-GCM")
+	xchacha := flag.Bool("xchacha", false, "Assume XChaCha20-Poly1305 mode instead of AES-GCM")
+	plainBS := flag.Int("blocksize", contentenc.DefaultBS, "Plaintext block size of the filesystem in bytes "+
+		"(see \"BlockSize\" in gocryptfs.conf)")
 	flag.Parse()
 	if flag.NArg() != 1 {
 		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] FILE\n"+
@@ -53,6 +56,10 @@ func main() {
 			"  gocryptfs-xray -dumpmasterkey myfs/gocryptfs.conf\n")
 		os.Exit(1)
 	}
+	if *aessiv && *xchacha {
+		fmt.Fprintf(os.Stderr, "-aessiv and -xchacha are mutually exclusive\n")
+		os.Exit(1)
+	}
 	fn := flag.Arg(0)
 	fd, err := os.Open(fn)
 	if err != nil {
@@ -62,7 +69,10 @@ func main() {
 	if *dumpmasterkey {
 		dumpMasterKey(fn)
 	} else {
-		inspectCiphertext(fd, *aessiv)
+		if err := contentenc.CheckBS(uint64(*plainBS)); err != nil {
+			errExit(err)
+		}
+		inspectCiphertext(fd, *aessiv, *xchacha, int64(*plainBS))
 	}
 }
 
@@ -80,7 +90,12 @@ func dumpMasterKey(fn string) {
 	}
 }
 
-func inspectCiphertext(fd *os.File, aessiv bool) {
+func inspectCiphertext(fd *os.File, aessiv bool, xchacha bool, plainBS int64) {
+	ivLen := contentenc.DefaultIVBits / 8
+	if xchacha {
+		ivLen = contentenc.XChaCha20Poly1305IVBits / 8
+	}
+	blockSize := plainBS + int64(ivLen) + authTagLen
 	headerBytes := make([]byte, contentenc.HeaderLen)
 	n, err := fd.ReadAt(headerBytes, 0)
 	if err == io.EOF && n == 0 {
@@ -96,7 +111,7 @@ func inspectCiphertext(fd *os.File, aessiv bool) {
 	if err != nil {
 		errExit(err)
 	}
-	prettyPrintHeader(header, aessiv)
+	prettyPrintHeader(header, aessiv, xchacha)
 	var i int64
 	buf := make([]byte, blockSize)
 	for i = 0; ; i++ {
@@ -42,6 +42,23 @@ func TestAessivXray(t *testing.T) {
 	}
 }
 
+func TestXchachaXray(t *testing.T) {
+	expected, err := ioutil.ReadFile("xchacha_fs.xray.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("../gocryptfs-xray", "-xchacha", "xchacha_fs/b-PlODEeemBLQitGFRYUbQ")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(out, expected) != 0 {
+		t.Errorf("Unexpected output")
+		fmt.Printf("expected:\n%s", string(expected))
+		fmt.Printf("have:\n%s", string(out))
+	}
+}
+
 func TestDumpmasterkey(t *testing.T) {
 	expected := "b4d8b25c324dd6eaa328c9906e8a2a3c6038552a042ced4326cfff210c62957a\n"
 	cmd := exec.Command("../gocryptfs-xray", "-dumpmasterkey", "aesgcm_fs/gocryptfs.conf")
@@ -8,7 +8,12 @@ import (
 
 const tUsage = "" +
 	"Usage: " + tlog.ProgramName + " -init|-passwd|-info [OPTIONS] CIPHERDIR\n" +
-	"  or   " + tlog.ProgramName + " [OPTIONS] CIPHERDIR MOUNTPOINT\n"
+	"  or   " + tlog.ProgramName + " [OPTIONS] CIPHERDIR MOUNTPOINT\n" +
+	"  or   " + tlog.ProgramName + " -extract [OPTIONS] CIPHERDIR PLAINPATH DEST\n" +
+	"  or   " + tlog.ProgramName + " -cat [OPTIONS] CIPHERDIR PLAINPATH\n" +
+	"  or   " + tlog.ProgramName + " -import [OPTIONS] CIPHERDIR SRCDIR\n" +
+	"  or   " + tlog.ProgramName + " -rekey [-rollback] [OPTIONS] CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -addkey LABEL|-listkeys|-revokekey LABEL [OPTIONS] CIPHERDIR\n"
 
 // helpShort is what gets displayed when passed "-h" or on syntax error.
 func helpShort() {
@@ -17,17 +22,23 @@ func helpShort() {
 	fmt.Printf(tUsage)
 	fmt.Printf(`
 Common Options (use -hh to show all):
+  -addkey            Add a key slot with its own password
   -aessiv            Use AES-SIV encryption (with -init)
   -allow_other       Allow other users to access the mount
+  -argon2id          Hash the password using Argon2id instead of scrypt (with -init)
   -i, -idle          Unmount automatically after specified idle duration
   -config            Custom path to config file
   -ctlsock           Create control socket at location
+  -cat               Decrypt a file to stdout without mounting
   -extpass           Call external program to prompt for the password
+  -extract           Decrypt a file or directory without mounting
   -fg                Stay in the foreground
   -fusedebug         Debug FUSE calls
   -h, -help          This short help text
   -hh                Long help text with all options
+  -import            Encrypt a directory into CIPHERDIR without mounting
   -init              Initialize encrypted directory
+  -integrity         Detect truncated and swapped files (with -init)
   -info              Display information about encrypted directory
   -masterkey         Mount with explicit master key instead of password
   -nonempty          Allow mounting over non-empty directory
@@ -36,10 +47,12 @@ Common Options (use -hh to show all):
   -passwd            Change password
   -plaintextnames    Do not encrypt file names (with -init)
   -q, -quiet         Silence informational messages
+  -rekey             Re-encrypt everything with a new master key
   -reverse           Enable reverse mode
   -ro                Mount read-only
   -speed             Run crypto speed test
   -version           Print version information
+  -xchacha           Use XChaCha20-Poly1305 encryption (with -init)
   --                 Stop option parsing
 `)
 }
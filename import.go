@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/simonhorlick/gocryptfs/internal/exitcodes"
+	"github.com/simonhorlick/gocryptfs/internal/fusefrontend"
+	"github.com/simonhorlick/gocryptfs/internal/openfiletable"
+	"github.com/simonhorlick/gocryptfs/internal/syscallcompat"
+	"github.com/simonhorlick/gocryptfs/internal/tlog"
+)
+
+type importObj struct {
+	fs *fusefrontend.FS
+	// Number of items that could not be imported
+	errorCount int
+	// Number of files that were skipped because they have been imported by
+	// an earlier, interrupted run
+	skipCount int
+	// Plaintext paths of hard-linked source files (Nlink > 1) that we have
+	// already imported, indexed by source device and inode number. The
+	// source tree may span several filesystems.
+	seenInodes map[openfiletable.QIno]string
+}
+
+func (im *importObj) fail(format string, a ...interface{}) {
+	tlog.Warn.Printf("import: "+format, a...)
+	im.errorCount++
+}
+
+// alreadyImported checks if the plaintext file at "path" has the same size
+// and modification time as the source file. The mtime is the last thing we
+// set when importing a file, so a match means that the file has been
+// completely imported before.
+func (im *importObj) alreadyImported(path string, srcAttr *fuse.Attr) bool {
+	attr, status := im.fs.GetAttr(path, nil)
+	if !status.Ok() || !attr.IsRegular() {
+		return false
+	}
+	return attr.Size == srcAttr.Size &&
+		attr.Mtime == srcAttr.Mtime && attr.Mtimensec == srcAttr.Mtimensec
+}
+
+// copyFile encrypts the content of the source file "src" into the new
+// plaintext file "path". All-zero chunks are skipped to preserve sparse files.
+func (im *importObj) copyFile(src string, path string, size uint64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	f, status := im.fs.Create(path, syscall.O_WRONLY, 0600, nil)
+	if !status.Ok() {
+		return fmt.Errorf("error creating %q: %v", path, status)
+	}
+	defer f.Release()
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	allZero := make([]byte, fuse.MAX_KERNEL_WRITE)
+	var off uint64
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 && !bytes.Equal(buf[:n], allZero[:n]) {
+			_, status = f.Write(buf[:n], int64(off))
+			if !status.Ok() {
+				return fmt.Errorf("error writing %q at offset %d: %v", path, off, status)
+			}
+		}
+		off += uint64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if off != size {
+		return fmt.Errorf("%q changed size during import", src)
+	}
+	// Trailing zeros were skipped
+	status = f.Truncate(size)
+	if !status.Ok() {
+		return fmt.Errorf("error truncating %q: %v", path, status)
+	}
+	status = f.Fsync(0)
+	if !status.Ok() {
+		return fmt.Errorf("error syncing %q: %v", path, status)
+	}
+	return nil
+}
+
+// copyXattrs copies the "user." extended attributes of "src" to "path".
+// The values and names get encrypted by fusefrontend.
+func (im *importObj) copyXattrs(src string, path string) {
+	attrs, err := syscallcompat.Llistxattr(src)
+	if err != nil {
+		if err != syscall.ENOTSUP {
+			im.fail("listing xattrs on %q: %v", src, err)
+		}
+		return
+	}
+	for _, a := range attrs {
+		data, err := syscallcompat.Lgetxattr(src, a)
+		if err != nil {
+			im.fail("reading xattr %q from %q: %v", a, src, err)
+			continue
+		}
+		status := im.fs.SetXAttr(path, a, data, 0, nil)
+		if status == fuse.Status(syscall.EOPNOTSUPP) {
+			tlog.Info.Printf("import: skipping unsupported xattr %q on %q", a, src)
+		} else if !status.Ok() {
+			im.fail("setting xattr %q on %q: %v", a, path, status)
+		}
+	}
+}
+
+// setAttr applies owner (only when running as root), permissions and
+// timestamps from "a" to the plaintext path "path" in "fs". The timestamps
+// come last, -import uses them to mark a file as completely imported.
+// Errors are passed to "fail". Used by -import and -rekey.
+func setAttr(fs *fusefrontend.FS, path string, a *fuse.Attr, fail func(format string, a ...interface{})) {
+	if runsAsRoot() {
+		status := fs.Chown(path, a.Uid, a.Gid, nil)
+		if !status.Ok() {
+			fail("chown %q: %v", path, status)
+		}
+	}
+	if !a.IsSymlink() {
+		status := fs.Chmod(path, a.Mode&07777, nil)
+		if !status.Ok() {
+			fail("chmod %q: %v", path, status)
+		}
+	}
+	atime := time.Unix(int64(a.Atime), int64(a.Atimensec))
+	mtime := time.Unix(int64(a.Mtime), int64(a.Mtimensec))
+	status := fs.Utimens(path, &atime, &mtime, nil)
+	if !status.Ok() {
+		fail("utimens %q: %v", path, status)
+	}
+}
+
+// rememberLink records "path" as the imported copy of a hard-linked source
+// file, so that its other names become hard links to it. Only the first
+// complete copy is recorded.
+func (im *importObj) rememberLink(qIno openfiletable.QIno, a *fuse.Attr, path string) {
+	if a.Nlink <= 1 {
+		return
+	}
+	if _, ok := im.seenInodes[qIno]; !ok {
+		im.seenInodes[qIno] = path
+	}
+}
+
+// importPath recursively encrypts the source file or directory "src" to the
+// plaintext path "path".
+func (im *importObj) importPath(src string, path string) {
+	tlog.Debug.Printf("im.importPath %q -> %q", src, path)
+	var st syscall.Stat_t
+	err := syscall.Lstat(src, &st)
+	if err != nil {
+		im.fail("%v", err)
+		return
+	}
+	a := &fuse.Attr{}
+	a.FromStat(&st)
+	switch a.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		qIno := openfiletable.QInoFromStat(&st)
+		if a.Nlink > 1 {
+			first, ok := im.seenInodes[qIno]
+			if ok && !im.alreadyImported(path, a) {
+				im.fs.Unlink(path, nil)
+				status := im.fs.Link(first, path, nil)
+				// Filesystems in the integrity format do not support hard
+				// links. Import a copy instead.
+				if status != fuse.EPERM {
+					if !status.Ok() {
+						im.fail("error linking %q to %q: %v", path, first, status)
+					}
+					return
+				}
+			}
+		}
+		if im.alreadyImported(path, a) {
+			im.skipCount++
+			im.rememberLink(qIno, a, path)
+			return
+		}
+		// Left over from an interrupted run, or the source has changed
+		im.fs.Unlink(path, nil)
+		err = im.copyFile(src, path, a.Size)
+		if err != nil {
+			im.fail("%v", err)
+			// Don't leave a partial file behind
+			im.fs.Unlink(path, nil)
+			return
+		}
+		im.copyXattrs(src, path)
+		setAttr(im.fs, path, a, im.fail)
+		im.rememberLink(qIno, a, path)
+	case syscall.S_IFLNK:
+		target, err := os.Readlink(src)
+		if err != nil {
+			im.fail("%v", err)
+			return
+		}
+		if oldTarget, status := im.fs.Readlink(path, nil); status.Ok() && oldTarget == target {
+			im.skipCount++
+			return
+		}
+		im.fs.Unlink(path, nil)
+		status := im.fs.Symlink(target, path, nil)
+		if !status.Ok() {
+			im.fail("error creating symlink %q: %v", path, status)
+			return
+		}
+		setAttr(im.fs, path, a, im.fail)
+	case syscall.S_IFDIR:
+		if path != "" {
+			// The directory may already exist from an interrupted run. Make sure
+			// we can write into it, the real permissions are applied at the end.
+			status := im.fs.Mkdir(path, 0700, nil)
+			if status == fuse.Status(syscall.EEXIST) {
+				status = im.fs.Chmod(path, 0700, nil)
+			}
+			if !status.Ok() {
+				im.fail("error creating directory %q: %v", path, status)
+				return
+			}
+		}
+		names, err := readDirNames(src)
+		if err != nil {
+			im.fail("%v", err)
+			return
+		}
+		for _, name := range names {
+			im.importPath(filepath.Join(src, name), filepath.Join(path, name))
+		}
+		if path != "" {
+			im.copyXattrs(src, path)
+			setAttr(im.fs, path, a, im.fail)
+		}
+	case syscall.S_IFIFO, syscall.S_IFCHR, syscall.S_IFBLK:
+		if _, status := im.fs.GetAttr(path, nil); status.Ok() {
+			im.skipCount++
+			return
+		}
+		status := im.fs.Mknod(path, a.Mode, a.Rdev, nil)
+		if !status.Ok() {
+			im.fail("error creating special file %q: %v", path, status)
+			return
+		}
+		setAttr(im.fs, path, a, im.fail)
+	default:
+		tlog.Info.Printf("import: skipping unsupported file %q (mode %#o)", src, a.Mode)
+	}
+}
+
+// readDirNames returns the sorted names of the entries in directory "dir".
+func readDirNames(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	return names, nil
+}
+
+// importTree implements "-import CIPHERDIR SRCDIR". It encrypts the contents
+// of the plaintext directory SRCDIR into the root of CIPHERDIR without
+// mounting. When interrupted, running the same command again continues where
+// the last run stopped.
+func importTree(args *argContainer) {
+	if flagSet.NArg() != 2 {
+		tlog.Fatal.Printf("The option -import takes exactly 2 arguments, %d given", flagSet.NArg())
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse {
+		tlog.Fatal.Printf("Running -import with -reverse is not supported")
+		os.Exit(exitcodes.Usage)
+	}
+	src, _ := filepath.Abs(flagSet.Arg(1))
+	err := isDir(src)
+	if err != nil {
+		tlog.Fatal.Printf("Invalid source directory: %v", err)
+		os.Exit(exitcodes.Import)
+	}
+	// Compare the resolved paths, so that a symlink cannot hide the overlap
+	realSrc, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		tlog.Fatal.Printf("Invalid source directory: %v", err)
+		os.Exit(exitcodes.Import)
+	}
+	realCipherdir, err := filepath.EvalSymlinks(args.cipherdir)
+	if err != nil {
+		tlog.Fatal.Printf("Invalid cipherdir: %v", err)
+		os.Exit(exitcodes.Import)
+	}
+	if realSrc == realCipherdir || strings.HasPrefix(realSrc, realCipherdir+"/") {
+		tlog.Fatal.Printf("Source directory %q is inside cipherdir %q, this is not supported", src, args.cipherdir)
+		os.Exit(exitcodes.Import)
+	}
+	// We would import the ciphertext we are writing
+	if strings.HasPrefix(realCipherdir, realSrc+"/") {
+		tlog.Fatal.Printf("Cipherdir %q is inside source directory %q, this is not supported", args.cipherdir, src)
+		os.Exit(exitcodes.Import)
+	}
+	pfs, wipeKeys := initFuseFrontend(args)
+	im := importObj{
+		fs:         pfs.(*fusefrontend.FS),
+		seenInodes: make(map[openfiletable.QIno]string),
+	}
+	im.importPath(src, "")
+	wipeKeys()
+	if im.skipCount > 0 {
+		tlog.Info.Printf("import: %d items were already imported and have been skipped", im.skipCount)
+	}
+	if im.errorCount > 0 {
+		tlog.Fatal.Printf("import: %d errors", im.errorCount)
+		os.Exit(exitcodes.Import)
+	}
+}
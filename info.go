@@ -38,7 +38,19 @@ func info(filename string) {
 	fmt.Printf("Creator:      %s\n", cf.Creator)
 	fmt.Printf("FeatureFlags: %s\n", strings.Join(cf.FeatureFlags, " "))
 	fmt.Printf("EncryptedKey: %dB\n", len(cf.EncryptedKey))
-	s := cf.ScryptObject
-	fmt.Printf("ScryptObject: Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
-		len(s.Salt), s.N, s.R, s.P, s.KeyLen)
+	if a := cf.Argon2Object; a != nil {
+		fmt.Printf("Argon2Object: Salt=%dB Memory=%d Time=%d Threads=%d KeyLen=%d\n",
+			len(a.Salt), a.Memory, a.Time, a.Threads, a.KeyLen)
+	} else {
+		s := cf.ScryptObject
+		fmt.Printf("ScryptObject: Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
+			len(s.Salt), s.N, s.R, s.P, s.KeyLen)
+	}
+	if cf.BlockSize != 0 {
+		fmt.Printf("BlockSize:    %d\n", cf.BlockSize)
+	}
+	for _, k := range cf.KeySlots {
+		fmt.Printf("KeySlot:      Label=%q EncryptedKey=%dB %s\n",
+			k.Label, len(k.EncryptedKey), kdfSummary(&k.ScryptObject, k.Argon2Object))
+	}
 }
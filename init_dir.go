@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
@@ -46,6 +47,26 @@ func isDir(dir string) error {
 	return nil
 }
 
+// argon2FromArgs checks the "-argon2-*" options and returns the Argon2id
+// parameters for a new config file. The minimum bounds are enforced by
+// configfile when the password is hashed. Does not return on error.
+func argon2FromArgs(args *argContainer) *configfile.Argon2KDF {
+	if args.argon2_mem < 1 || args.argon2_mem > math.MaxUint32 {
+		tlog.Fatal.Printf("Invalid -argon2-mem value %d", args.argon2_mem)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.argon2_time < 1 || args.argon2_time > math.MaxUint32 {
+		tlog.Fatal.Printf("Invalid -argon2-time value %d", args.argon2_time)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.argon2_threads < 1 || args.argon2_threads > math.MaxUint8 {
+		tlog.Fatal.Printf("Invalid -argon2-threads value %d, possible values: 1-255", args.argon2_threads)
+		os.Exit(exitcodes.Usage)
+	}
+	a := configfile.NewArgon2KDF(uint32(args.argon2_mem), uint32(args.argon2_time), uint8(args.argon2_threads))
+	return &a
+}
+
 // initDir handles "gocryptfs -init". It prepares a directory for use as a
 // gocryptfs storage directory.
 // In forward mode, this means creating the gocryptfs.conf and gocryptfs.diriv
@@ -67,6 +88,10 @@ func initDir(args *argContainer) {
 			os.Exit(exitcodes.Init)
 		}
 	}
+	var argon2Params *configfile.Argon2KDF
+	if args.argon2id {
+		argon2Params = argon2FromArgs(args)
+	}
 	// Choose password for config file
 	if args.extpass == "" {
 		tlog.Info.Printf("Choose a password for protecting your files.")
@@ -84,8 +109,21 @@ func initDir(args *argContainer) {
 			readpassword.CheckTrailingGarbage()
 		}
 		creator := tlog.ProgramName + " " + GitVersion
-		err = configfile.Create(args.config, password, args.plaintextnames,
-			args.scryptn, creator, args.aessiv, args.devrandom, trezorPayload)
+		err = configfile.Create(&configfile.CreateArgs{
+			Filename:          args.config,
+			Password:          password,
+			PlaintextNames:    args.plaintextnames,
+			LogN:              args.scryptn,
+			Creator:           creator,
+			AESSIV:            args.aessiv,
+			XChaCha20Poly1305: args.xchacha,
+			DevRandom:         args.devrandom,
+			TrezorPayload:     trezorPayload,
+			Argon2:            argon2Params,
+			BlockSize:         int(args._blockSize),
+			Integrity:         args.integrity,
+			StableIDs:         args.stableids,
+		})
 		if err != nil {
 			tlog.Fatal.Println(err)
 			os.Exit(exitcodes.WriteConf)
@@ -0,0 +1,98 @@
+package configfile
+
+import (
+	"os"
+
+	"golang.org/x/crypto/argon2"
+
+	"github.com/simonhorlick/gocryptfs/internal/cryptocore"
+	"github.com/simonhorlick/gocryptfs/internal/exitcodes"
+	"github.com/simonhorlick/gocryptfs/internal/tlog"
+)
+
+const (
+	// Argon2DefaultMemory is the default Argon2id memory cost in KiB.
+	// Together with Argon2DefaultTime and Argon2DefaultThreads, this is the
+	// second recommended option from RFC 9106, section 4.
+	Argon2DefaultMemory = 64 * 1024
+	// Argon2DefaultTime is the default number of Argon2id passes.
+	Argon2DefaultTime = 3
+	// Argon2DefaultThreads is the default Argon2id parallelism.
+	Argon2DefaultThreads = 4
+	// Like scryptMinLogN, this should be fast enough for all purposes. We
+	// reject lower values that we might get through modified config files.
+	argon2MinMemory  = 8 * 1024
+	argon2MinTime    = 1
+	argon2MinThreads = 1
+	// We always generate 32-byte salts. Anything smaller than that is rejected.
+	argon2MinSaltLen = 32
+)
+
+// Argon2KDF is an instance of the Argon2id key derivation function.
+type Argon2KDF struct {
+	// Salt is the random salt that is passed to Argon2id
+	Salt []byte
+	// Memory is the memory cost in KiB
+	Memory uint32
+	// Time is the number of passes over the memory
+	Time uint32
+	// Threads is the degree of parallelism
+	Threads uint8
+	// KeyLen is the output data length
+	KeyLen int
+}
+
+// NewArgon2KDF returns a new instance of Argon2KDF with a random salt.
+// Parameters that are zero are set to their defaults.
+func NewArgon2KDF(memory uint32, time uint32, threads uint8) Argon2KDF {
+	var a Argon2KDF
+	a.Salt = cryptocore.RandBytes(cryptocore.KeyLen)
+	a.Memory = memory
+	if a.Memory == 0 {
+		a.Memory = Argon2DefaultMemory
+	}
+	a.Time = time
+	if a.Time == 0 {
+		a.Time = Argon2DefaultTime
+	}
+	a.Threads = threads
+	if a.Threads == 0 {
+		a.Threads = Argon2DefaultThreads
+	}
+	a.KeyLen = cryptocore.KeyLen
+	return a
+}
+
+// DeriveKey returns a new key from a supplied password.
+func (a *Argon2KDF) DeriveKey(pw []byte) []byte {
+	a.validateParams()
+
+	return argon2.IDKey(pw, a.Salt, a.Time, a.Memory, a.Threads, uint32(a.KeyLen))
+}
+
+// validateParams checks that all parameters are at or above hardcoded limits.
+// If not, it exits with an error message.
+// This makes sure we do not get weak parameters passed through a
+// rogue gocryptfs.conf.
+func (a *Argon2KDF) validateParams() {
+	if a.Memory < argon2MinMemory {
+		tlog.Fatal.Printf("Fatal: argon2 parameter Memory below minimum: value=%d, min=%d", a.Memory, argon2MinMemory)
+		os.Exit(exitcodes.Argon2Params)
+	}
+	if a.Time < argon2MinTime {
+		tlog.Fatal.Printf("Fatal: argon2 parameter Time below minimum: value=%d, min=%d", a.Time, argon2MinTime)
+		os.Exit(exitcodes.Argon2Params)
+	}
+	if a.Threads < argon2MinThreads {
+		tlog.Fatal.Printf("Fatal: argon2 parameter Threads below minimum: value=%d, min=%d", a.Threads, argon2MinThreads)
+		os.Exit(exitcodes.Argon2Params)
+	}
+	if len(a.Salt) < argon2MinSaltLen {
+		tlog.Fatal.Printf("Fatal: argon2 salt length below minimum: value=%d, min=%d", len(a.Salt), argon2MinSaltLen)
+		os.Exit(exitcodes.Argon2Params)
+	}
+	if a.KeyLen < cryptocore.KeyLen {
+		tlog.Fatal.Printf("Fatal: argon2 parameter KeyLen below minimum: value=%d, min=%d", a.KeyLen, cryptocore.KeyLen)
+		os.Exit(exitcodes.Argon2Params)
+	}
+}
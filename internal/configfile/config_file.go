@@ -25,6 +25,9 @@ const (
 	// the config file gets stored next to the plain-text files. Make it hidden
 	// (start with dot) to not annoy the user.
 	ConfReverseName = ".gocryptfs.reverse.conf"
+	// RekeyDirName is the staging directory that "gocryptfs -rekey" creates
+	// in the root of CIPHERDIR while it re-encrypts the filesystem.
+	RekeyDirName = "gocryptfs.rekey"
 )
 
 // ConfFile is the content of a config file.
@@ -38,6 +41,9 @@ type ConfFile struct {
 	EncryptedKey []byte
 	// ScryptObject stores parameters for scrypt hashing (key derivation)
 	ScryptObject ScryptKDF
+	// Argon2Object stores parameters for Argon2id hashing. If FlagArgon2id
+	// is set, it is used instead of ScryptObject.
+	Argon2Object *Argon2KDF `json:",omitempty"`
 	// Version is the On-Disk-Format version this filesystem uses
 	Version uint16
 	// FeatureFlags is a list of feature flags this filesystem has enabled.
@@ -49,8 +55,17 @@ type ConfFile struct {
 	// a Trezor security module. The randomness makes sure that a unique unlock
 	// value is used for each gocryptfs filesystem.
 	TrezorPayload []byte `json:",omitempty"`
+	// KeySlots stores additional copies of the master key, each encrypted
+	// with a different password. Only used when FlagKeySlots is set.
+	KeySlots []KeySlot `json:",omitempty"`
+	// BlockSize is the plaintext block size in bytes. Only used when
+	// FlagBlockSize is set, otherwise contentenc.DefaultBS applies.
+	BlockSize int `json:",omitempty"`
 	// Filename is the name of the config file. Not exported to JSON.
 	filename string
+	// unlockedSlot is the label of the key slot that DecryptMasterKey has
+	// unlocked, or empty for the primary EncryptedKey. Not exported to JSON.
+	unlockedSlot string
 }
 
 // randBytesDevRandom gets "n" random bytes from /dev/random or panics
@@ -68,20 +83,42 @@ func randBytesDevRandom(n int) []byte {
 	return b
 }
 
+// CreateArgs exists because the argument list to Create became too long.
+type CreateArgs struct {
+	Filename          string
+	Password          []byte
+	PlaintextNames    bool
+	LogN              int
+	Creator           string
+	AESSIV            bool
+	XChaCha20Poly1305 bool
+	DevRandom         bool
+	TrezorPayload     []byte
+	// Argon2 selects Argon2id with these parameters instead of scrypt
+	// (the salt is generated).
+	Argon2 *Argon2KDF
+	// BlockSize is the plaintext block size. Zero means
+	// contentenc.DefaultBS.
+	BlockSize int
+	// Integrity enables the integrity format (FlagIntegrity)
+	Integrity bool
+	// StableIDs enables FlagStableIDs (reverse mode only)
+	StableIDs bool
+}
+
 // Create - create a new config with a random key encrypted with
-// "password" and write it to "filename".
-// Uses scrypt with cost parameter logN.
-func Create(filename string, password []byte, plaintextNames bool,
-	logN int, creator string, aessiv bool, devrandom bool, trezorPayload []byte) error {
+// "Password" and write it to "Filename".
+// Uses scrypt with cost parameter "LogN", or Argon2id if "Argon2" is set.
+func Create(args *CreateArgs) error {
 	var cf ConfFile
-	cf.filename = filename
-	cf.Creator = creator
+	cf.filename = args.Filename
+	cf.Creator = args.Creator
 	cf.Version = contentenc.CurrentVersion
 
 	// Set feature flags
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagGCMIV128])
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagHKDF])
-	if plaintextNames {
+	if args.PlaintextNames {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagPlaintextNames])
 	} else {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDirIV])
@@ -89,17 +126,43 @@ func Create(filename string, password []byte, plaintextNames bool,
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagLongNames])
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagRaw64])
 	}
-	if aessiv {
+	if args.AESSIV {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagAESSIV])
 	}
-	if len(trezorPayload) > 0 {
+	if args.XChaCha20Poly1305 {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagXChaCha20Poly1305])
+	}
+	if args.Integrity {
+		if args.PlaintextNames {
+			return fmt.Errorf("the integrity format cannot be used with plaintext names")
+		}
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagIntegrity])
+	}
+	if args.StableIDs {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagStableIDs])
+	}
+	if len(args.TrezorPayload) > 0 {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagTrezor])
-		cf.TrezorPayload = trezorPayload
+		cf.TrezorPayload = args.TrezorPayload
+	}
+	if args.Argon2 != nil {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagArgon2id])
+		cf.Argon2Object = args.Argon2
+	}
+	// The default block size is not stored so that older gocryptfs versions
+	// can still mount the filesystem.
+	if args.BlockSize != 0 && args.BlockSize != contentenc.DefaultBS {
+		err := contentenc.CheckBS(uint64(args.BlockSize))
+		if err != nil {
+			return err
+		}
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagBlockSize])
+		cf.BlockSize = args.BlockSize
 	}
 	{
 		// Generate new random master key
 		var key []byte
-		if devrandom {
+		if args.DevRandom {
 			key = randBytesDevRandom(cryptocore.KeyLen)
 		} else {
 			key = cryptocore.RandBytes(cryptocore.KeyLen)
@@ -108,7 +171,7 @@ func Create(filename string, password []byte, plaintextNames bool,
 		// Encrypt it using the password
 		// This sets ScryptObject and EncryptedKey
 		// Note: this looks at the FeatureFlags, so call it AFTER setting them.
-		cf.EncryptKey(key, password, logN)
+		cf.EncryptKey(key, args.Password, args.LogN)
 		for i := range key {
 			key[i] = 0
 		}
@@ -118,6 +181,14 @@ func Create(filename string, password []byte, plaintextNames bool,
 	return cf.WriteFile()
 }
 
+// PlainBS returns the plaintext block size of the filesystem.
+func (cf *ConfFile) PlainBS() uint64 {
+	if cf.BlockSize == 0 {
+		return contentenc.DefaultBS
+	}
+	return uint64(cf.BlockSize)
+}
+
 // LoadAndDecrypt - read config file from disk and decrypt the
 // contained key using "password".
 // Returns the decrypted key and the ConfFile object
@@ -178,6 +249,43 @@ func Load(filename string) (*ConfFile, error) {
 		}
 	}
 
+	if cf.IsFeatureFlagSet(FlagXChaCha20Poly1305) {
+		if cf.IsFeatureFlagSet(FlagAESSIV) {
+			return nil, fmt.Errorf("feature flags %q and %q cannot be used together",
+				knownFlags[FlagAESSIV], knownFlags[FlagXChaCha20Poly1305])
+		}
+		if !cf.IsFeatureFlagSet(FlagHKDF) {
+			return nil, fmt.Errorf("feature flag %q requires %q",
+				knownFlags[FlagXChaCha20Poly1305], knownFlags[FlagHKDF])
+		}
+	}
+
+	if cf.IsFeatureFlagSet(FlagIntegrity) && cf.IsFeatureFlagSet(FlagPlaintextNames) {
+		return nil, fmt.Errorf("feature flags %q and %q cannot be used together",
+			knownFlags[FlagPlaintextNames], knownFlags[FlagIntegrity])
+	}
+
+	if cf.IsFeatureFlagSet(FlagBlockSize) != (cf.BlockSize != 0) {
+		return nil, fmt.Errorf("BlockSize does not match the %q feature flag", knownFlags[FlagBlockSize])
+	}
+	if cf.BlockSize != 0 {
+		if err = contentenc.CheckBS(uint64(cf.BlockSize)); err != nil {
+			return nil, err
+		}
+	}
+
+	// The KDF objects must match FlagArgon2id. Otherwise, someone could
+	// downgrade the password hashing by editing the config file.
+	if cf.IsFeatureFlagSet(FlagArgon2id) != (cf.Argon2Object != nil) {
+		return nil, fmt.Errorf("Argon2Object does not match the %q feature flag", knownFlags[FlagArgon2id])
+	}
+	for _, s := range cf.KeySlots {
+		if cf.IsFeatureFlagSet(FlagArgon2id) != (s.Argon2Object != nil) {
+			return nil, fmt.Errorf("Argon2Object of key slot %q does not match the %q feature flag",
+				s.Label, knownFlags[FlagArgon2id])
+		}
+	}
+
 	// Check that all required feature flags are set
 	var requiredFlags []flagIota
 	if cf.IsFeatureFlagSet(FlagPlaintextNames) {
@@ -212,17 +320,40 @@ func Load(filename string) (*ConfFile, error) {
 }
 
 // DecryptMasterKey decrypts the masterkey stored in cf.EncryptedKey using
-// password.
+// password. If that fails and FlagKeySlots is set, all key slots are tried
+// in turn.
 func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err error) {
+	masterkey, err = cf.unwrapKey(passwordKDF(&cf.ScryptObject, cf.Argon2Object), cf.EncryptedKey, password)
+	if err == nil {
+		cf.unlockedSlot = ""
+		return masterkey, nil
+	}
+	if cf.IsFeatureFlagSet(FlagKeySlots) {
+		for _, s := range cf.KeySlots {
+			masterkey, err = cf.unwrapKey(passwordKDF(&s.ScryptObject, s.Argon2Object), s.EncryptedKey, password)
+			if err == nil {
+				tlog.Debug.Printf("DecryptMasterKey: unlocked key slot %q", s.Label)
+				cf.unlockedSlot = s.Label
+				return masterkey, nil
+			}
+		}
+	}
+	tlog.Warn.Printf("failed to unlock master key: %s", err.Error())
+	return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
+}
+
+// unwrapKey decrypts "encryptedKey" using a key derived from "password" by
+// "kdf".
+func (cf *ConfFile) unwrapKey(kdf passwordHasher, encryptedKey []byte, password []byte) ([]byte, error) {
 	// Generate derived key from password
-	scryptHash := cf.ScryptObject.DeriveKey(password)
+	scryptHash := kdf.DeriveKey(password)
 
 	// Unlock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
 	ce := getKeyEncrypter(scryptHash, useHKDF)
 
 	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages on incorrect password
-	masterkey, err = ce.DecryptBlock(cf.EncryptedKey, 0, nil)
+	key, err := ce.DecryptBlock(encryptedKey, 0, nil)
 	tlog.Warn.Enabled = true
 
 	// Purge scrypt-derived key
@@ -233,26 +364,52 @@ func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err err
 	ce.Wipe()
 	ce = nil
 
-	if err != nil {
-		tlog.Warn.Printf("failed to unlock master key: %s", err.Error())
-		return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
-	}
-	return masterkey, nil
+	return key, err
 }
 
 // EncryptKey - encrypt "key" using an scrypt hash generated from "password"
 // and store it in cf.EncryptedKey.
 // Uses scrypt with cost parameter logN and stores the scrypt parameters in
-// cf.ScryptObject.
+// cf.ScryptObject. If FlagArgon2id is set, Argon2id with the parameters
+// from cf.Argon2Object is used instead, and logN is ignored.
 func (cf *ConfFile) EncryptKey(key []byte, password []byte, logN int) {
+	cf.EncryptedKey, cf.ScryptObject, cf.Argon2Object = cf.wrapKeyNewSalt(key, password, logN)
+}
+
+// passwordHasher is implemented by ScryptKDF and Argon2KDF.
+type passwordHasher interface {
+	DeriveKey(pw []byte) []byte
+}
+
+// passwordKDF returns "a" if it is set, and "s" otherwise.
+func passwordKDF(s *ScryptKDF, a *Argon2KDF) passwordHasher {
+	if a != nil {
+		return a
+	}
+	return s
+}
+
+// wrapKeyNewSalt encrypts "key" using a freshly salted password hash. The
+// hash function is chosen like EncryptKey does. Returns the encrypted key
+// and the KDF object that has been used, the other one is empty.
+func (cf *ConfFile) wrapKeyNewSalt(key []byte, password []byte, logN int) ([]byte, ScryptKDF, *Argon2KDF) {
+	if cf.IsFeatureFlagSet(FlagArgon2id) {
+		a := NewArgon2KDF(cf.Argon2Object.Memory, cf.Argon2Object.Time, cf.Argon2Object.Threads)
+		return cf.wrapKey(&a, key, password), ScryptKDF{}, &a
+	}
+	s := NewScryptKDF(logN)
+	return cf.wrapKey(&s, key, password), s, nil
+}
+
+// wrapKey encrypts "key" using a key derived from "password" by "kdf".
+func (cf *ConfFile) wrapKey(kdf passwordHasher, key []byte, password []byte) []byte {
 	// Generate scrypt-derived key from password
-	cf.ScryptObject = NewScryptKDF(logN)
-	scryptHash := cf.ScryptObject.DeriveKey(password)
+	scryptHash := kdf.DeriveKey(password)
 
 	// Lock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
 	ce := getKeyEncrypter(scryptHash, useHKDF)
-	cf.EncryptedKey = ce.EncryptBlock(key, 0, nil)
+	encryptedKey := ce.EncryptBlock(key, 0, nil)
 
 	// Purge scrypt-derived key
 	for i := range scryptHash {
@@ -261,6 +418,8 @@ func (cf *ConfFile) EncryptKey(key []byte, password []byte, logN int) {
 	scryptHash = nil
 	ce.Wipe()
 	ce = nil
+
+	return encryptedKey
 }
 
 // WriteFile - write out config in JSON format to file "filename.tmp"
@@ -1,6 +1,7 @@
 package configfile
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 	"time"
@@ -62,7 +63,7 @@ func TestLoadV2StrangeFeature(t *testing.T) {
 }
 
 func TestCreateConfDefault(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, false, 10, "test", false, false, nil)
+	err := Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -83,14 +84,14 @@ func TestCreateConfDefault(t *testing.T) {
 }
 
 func TestCreateConfDevRandom(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, false, 10, "test", false, true, nil)
+	err := Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", DevRandom: true})
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestCreateConfPlaintextnames(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, true, 10, "test", false, false, nil)
+	err := Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, PlaintextNames: true, LogN: 10, Creator: "test"})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -111,7 +112,7 @@ func TestCreateConfPlaintextnames(t *testing.T) {
 
 // Reverse mode uses AESSIV
 func TestCreateConfFileAESSIV(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, false, 10, "test", true, false, nil)
+	err := Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", AESSIV: true})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -145,3 +146,135 @@ func TestIsFeatureFlagKnown(t *testing.T) {
 		t.Errorf("flag %q should be NOT known", f)
 	}
 }
+
+func TestKeySlots(t *testing.T) {
+	err := Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.AddKeySlot("alice", key, []byte("alicepw"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.AddKeySlot("alice", key, []byte("other"), 10); err == nil {
+		t.Error("duplicate label should be rejected")
+	}
+	if err = c.AddKeySlot(PrimaryKeySlotLabel, key, []byte("other"), 10); err == nil {
+		t.Error("primary label should be rejected")
+	}
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	key2, c, err := LoadAndDecrypt("config_test/tmp.conf", []byte("alicepw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, key2) {
+		t.Error("key slot returned a different master key")
+	}
+	if c.UnlockedKeySlot() != "alice" || !c.IsFeatureFlagSet(FlagKeySlots) {
+		t.Errorf("UnlockedKeySlot=%q flags=%v", c.UnlockedKeySlot(), c.FeatureFlags)
+	}
+	if err = c.RevokeKeySlot(PrimaryKeySlotLabel); err == nil {
+		t.Error("revoking the primary key should fail")
+	}
+	if err = c.RevokeKeySlot("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if c.IsFeatureFlagSet(FlagKeySlots) || len(c.KeySlots) != 0 {
+		t.Errorf("revoking the last slot should clear the flag: flags=%v", c.FeatureFlags)
+	}
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	tlog.Warn.Enabled = false
+	_, _, err = LoadAndDecrypt("config_test/tmp.conf", []byte("alicepw"))
+	tlog.Warn.Enabled = true
+	if err == nil {
+		t.Error("revoked password still works")
+	}
+}
+
+func TestArgon2id(t *testing.T) {
+	a := NewArgon2KDF(argon2MinMemory, argon2MinTime, argon2MinThreads)
+	err := Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test", Argon2: &a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagArgon2id) || c.Argon2Object == nil {
+		t.Fatalf("Argon2id not enabled: flags=%v", c.FeatureFlags)
+	}
+	if c.Argon2Object.Memory != argon2MinMemory {
+		t.Errorf("wrong Memory parameter %d", c.Argon2Object.Memory)
+	}
+	tlog.Warn.Enabled = false
+	_, _, err = LoadAndDecrypt("config_test/tmp.conf", []byte("wrong"))
+	tlog.Warn.Enabled = true
+	if err == nil {
+		t.Error("wrong password was accepted")
+	}
+	// Key slots inherit the parameters
+	err = c.AddKeySlot("alice", key, []byte("alicepw"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.KeySlots[0].Argon2Object == nil {
+		t.Error("key slot does not use Argon2id")
+	}
+	// Dropping the feature flag must not downgrade to scrypt
+	var flags []string
+	for _, f := range c.FeatureFlags {
+		if f != knownFlags[FlagArgon2id] {
+			flags = append(flags, f)
+		}
+	}
+	c.FeatureFlags = flags
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err == nil {
+		t.Error("Argon2Object without feature flag should be rejected")
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	err := Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test",
+		BlockSize: 3000})
+	if err == nil {
+		t.Error("block size that is not a power of two should be rejected")
+	}
+	err = Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test",
+		BlockSize: 65536})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagBlockSize) || c.PlainBS() != 65536 {
+		t.Errorf("flags=%v PlainBS=%d", c.FeatureFlags, c.PlainBS())
+	}
+	// The default block size is not stored
+	err = Create(&CreateArgs{Filename: "config_test/tmp.conf", Password: testPw, LogN: 10, Creator: "test",
+		BlockSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.IsFeatureFlagSet(FlagBlockSize) || c.PlainBS() != 4096 {
+		t.Errorf("flags=%v PlainBS=%d", c.FeatureFlags, c.PlainBS())
+	}
+}
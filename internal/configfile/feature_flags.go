@@ -22,25 +22,50 @@ const (
 	// FlagHKDF enables HKDF-derived keys for use with GCM, EME and SIV
 	// instead of directly using the master key (GCM and EME) or the SHA-512
 	// hashed master key (SIV).
-	// Note that this flag does not change the password hashing algorithm
-	// which always is scrypt.
+	// Note that this flag does not change the password hashing algorithm,
+	// see FlagArgon2id for that.
 	FlagHKDF
 	// FlagTrezor means that "-trezor" was used when creating the filesystem.
 	// The masterkey is protected using a Trezor device instead of a password.
 	FlagTrezor
+	// FlagKeySlots means that the master key is additionally stored in
+	// the KeySlots list, each copy protected by its own password.
+	FlagKeySlots
+	// FlagArgon2id means that the master key is protected using an Argon2id
+	// password hash (Argon2Object) instead of scrypt (ScryptObject).
+	FlagArgon2id
+	// FlagXChaCha20Poly1305 selects the XChaCha20-Poly1305 crypto backend
+	// with 192-bit IVs for file content. Requires FlagHKDF.
+	FlagXChaCha20Poly1305
+	// FlagBlockSize means that the plaintext block size is not the default
+	// 4096 bytes but stored in the BlockSize field.
+	FlagBlockSize
+	// FlagIntegrity authenticates the file length and binds the content of
+	// each file to its encrypted name. Requires encrypted file names.
+	FlagIntegrity
+	// FlagStableIDs makes reverse mode derive the file ID and block IVs of a
+	// file from its inode number and generation instead of its path, so that
+	// the ciphertext survives a rename.
+	FlagStableIDs
 )
 
 // knownFlags stores the known feature flags and their string representation
 var knownFlags = map[flagIota]string{
-	FlagPlaintextNames: "PlaintextNames",
-	FlagDirIV:          "DirIV",
-	FlagEMENames:       "EMENames",
-	FlagGCMIV128:       "GCMIV128",
-	FlagLongNames:      "LongNames",
-	FlagAESSIV:         "AESSIV",
-	FlagRaw64:          "Raw64",
-	FlagHKDF:           "HKDF",
-	FlagTrezor:         "Trezor",
+	FlagPlaintextNames:    "PlaintextNames",
+	FlagDirIV:             "DirIV",
+	FlagEMENames:          "EMENames",
+	FlagGCMIV128:          "GCMIV128",
+	FlagLongNames:         "LongNames",
+	FlagAESSIV:            "AESSIV",
+	FlagRaw64:             "Raw64",
+	FlagHKDF:              "HKDF",
+	FlagTrezor:            "Trezor",
+	FlagKeySlots:          "KeySlots",
+	FlagArgon2id:          "Argon2id",
+	FlagXChaCha20Poly1305: "XChaCha20Poly1305",
+	FlagBlockSize:         "BlockSize",
+	FlagIntegrity:         "Integrity",
+	FlagStableIDs:         "StableIDs",
 }
 
 // Filesystems that do not have these feature flags set are deprecated.
@@ -0,0 +1,108 @@
+package configfile
+
+import (
+	"fmt"
+)
+
+// PrimaryKeySlotLabel is how the primary key, stored in
+// ConfFile.EncryptedKey, is shown next to the labels of the additional key
+// slots.
+const PrimaryKeySlotLabel = "primary"
+
+// KeySlot is an additional copy of the master key, protected by its own
+// password. This allows several people to share a filesystem without
+// sharing a password.
+type KeySlot struct {
+	// Label identifies the slot for "-listkeys" and "-revokekey"
+	Label string
+	// EncryptedKey holds the master key, unlocked using a password hashed
+	// with scrypt
+	EncryptedKey []byte
+	// ScryptObject stores parameters for scrypt hashing (key derivation)
+	ScryptObject ScryptKDF
+	// Argon2Object replaces ScryptObject if FlagArgon2id is set
+	Argon2Object *Argon2KDF `json:",omitempty"`
+}
+
+// UnlockedKeySlot returns the label of the key slot that the last
+// successful DecryptMasterKey call has unlocked. Returns an empty string for
+// the primary key.
+func (cf *ConfFile) UnlockedKeySlot() string {
+	return cf.unlockedSlot
+}
+
+// findKeySlot returns the index of the slot labeled "label" in cf.KeySlots,
+// or -1.
+func (cf *ConfFile) findKeySlot(label string) int {
+	for i := range cf.KeySlots {
+		if cf.KeySlots[i].Label == label {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddKeySlot stores a new copy of "key" in cf.KeySlots, encrypted with
+// "password". Uses scrypt with cost parameter logN, or Argon2id with the
+// parameters of the primary key if FlagArgon2id is set. The FlagKeySlots feature
+// flag is set, which makes gocryptfs versions that do not know about key
+// slots refuse the config file.
+func (cf *ConfFile) AddKeySlot(label string, key []byte, password []byte, logN int) error {
+	if label == "" || label == PrimaryKeySlotLabel {
+		return fmt.Errorf("invalid key slot label %q", label)
+	}
+	if cf.findKeySlot(label) >= 0 {
+		return fmt.Errorf("key slot %q already exists", label)
+	}
+	s := KeySlot{Label: label}
+	s.EncryptedKey, s.ScryptObject, s.Argon2Object = cf.wrapKeyNewSalt(key, password, logN)
+	cf.KeySlots = append(cf.KeySlots, s)
+	if !cf.IsFeatureFlagSet(FlagKeySlots) {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagKeySlots])
+	}
+	return nil
+}
+
+// EncryptKeySlot replaces the password of the existing key slot "label".
+// An empty label selects the primary key, like EncryptKey does.
+func (cf *ConfFile) EncryptKeySlot(label string, key []byte, password []byte, logN int) error {
+	if label == "" {
+		cf.EncryptKey(key, password, logN)
+		return nil
+	}
+	i := cf.findKeySlot(label)
+	if i < 0 {
+		return fmt.Errorf("key slot %q does not exist", label)
+	}
+	s := &cf.KeySlots[i]
+	s.EncryptedKey, s.ScryptObject, s.Argon2Object = cf.wrapKeyNewSalt(key, password, logN)
+	return nil
+}
+
+// RevokeKeySlot deletes the key slot "label". The primary key cannot be
+// revoked. When the last slot is gone, the FlagKeySlots feature flag is
+// cleared again.
+func (cf *ConfFile) RevokeKeySlot(label string) error {
+	if label == PrimaryKeySlotLabel {
+		return fmt.Errorf("the primary key cannot be revoked, change its password using -passwd instead")
+	}
+	i := cf.findKeySlot(label)
+	if i < 0 {
+		return fmt.Errorf("key slot %q does not exist", label)
+	}
+	// Build new slices instead of modifying the shared backing arrays
+	var slots []KeySlot
+	slots = append(slots, cf.KeySlots[:i]...)
+	cf.KeySlots = append(slots, cf.KeySlots[i+1:]...)
+	if len(cf.KeySlots) == 0 {
+		cf.KeySlots = nil
+		var flags []string
+		for _, f := range cf.FeatureFlags {
+			if f != knownFlags[FlagKeySlots] {
+				flags = append(flags, f)
+			}
+		}
+		cf.FeatureFlags = flags
+	}
+	return nil
+}
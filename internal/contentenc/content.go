@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
 	"runtime"
 	"sync"
@@ -23,11 +24,20 @@ type NonceMode int
 const (
 	// DefaultBS is the default plaintext block size
 	DefaultBS = 4096
+	// MinBS is the smallest plaintext block size that can be selected using
+	// "-blocksize"
+	MinBS = DefaultBS
+	// MaxBS is the largest plaintext block size that can be selected using
+	// "-blocksize"
+	MaxBS = 1024 * 1024
 	// DefaultIVBits is the default length of IV, in bits.
 	// We always use 128-bit IVs for file content, but the
 	// master key in the config file is encrypted with a 96-bit IV for
 	// gocryptfs v1.2 and earlier. v1.3 switched to 128 bit.
 	DefaultIVBits = 128
+	// XChaCha20Poly1305IVBits is the length of the IV that the
+	// XChaCha20-Poly1305 backend uses for file content, in bits.
+	XChaCha20Poly1305IVBits = 192
 
 	_ = iota // skip zero
 	// RandomNonce chooses a random nonce.
@@ -60,28 +70,46 @@ type ContentEnc struct {
 	// Plaintext block pool. Always returns plainBS-sized byte slices
 	// (usually 4096 bytes).
 	pBlockPool bPool
-	// Ciphertext request data pool. Always returns byte slices of size
-	// fuse.MAX_KERNEL_WRITE + encryption overhead.
+	// Ciphertext request data pool. Always returns byte slices large enough
+	// to hold all ciphertext blocks touched by a fuse.MAX_KERNEL_WRITE sized
+	// request.
 	// Used by Read() to temporarily store the ciphertext as it is read from
 	// disk.
 	CReqPool bPool
-	// Plaintext request data pool. Slice have size fuse.MAX_KERNEL_WRITE.
+	// Plaintext request data pool. Like CReqPool, but for the plaintext
+	// blocks.
 	PReqPool bPool
 }
 
+// CheckBS returns an error if "plainBS" cannot be used as the plaintext block
+// size. Valid block sizes are powers of two between MinBS and MaxBS.
+func CheckBS(plainBS uint64) error {
+	if plainBS < MinBS || plainBS > MaxBS || plainBS&(plainBS-1) != 0 {
+		return fmt.Errorf("invalid block size %d, must be a power of two between %d and %d",
+			plainBS, MinBS, MaxBS)
+	}
+	return nil
+}
+
 // New returns an initialized ContentEnc instance.
 func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool) *ContentEnc {
-	if fuse.MAX_KERNEL_WRITE%plainBS != 0 {
-		log.Panicf("unaligned MAX_KERNEL_WRITE=%d", fuse.MAX_KERNEL_WRITE)
+	if err := CheckBS(plainBS); err != nil {
+		log.Panic(err)
 	}
 	cipherBS := plainBS + uint64(cc.IVLen) + cryptocore.AuthTagLen
-	// Take IV and GHASH overhead into account.
-	cReqSize := int(fuse.MAX_KERNEL_WRITE / plainBS * cipherBS)
+	// A request of up to fuse.MAX_KERNEL_WRITE bytes covers this many blocks
+	// (at least one, even if the block is larger than the request).
+	reqBlocks := (fuse.MAX_KERNEL_WRITE + plainBS - 1) / plainBS
 	// Unaligned reads (happens during fsck, could also happen with O_DIRECT?)
 	// touch one additional ciphertext and plaintext block. Reserve space for the
 	// extra block.
-	cReqSize += int(cipherBS)
-	pReqSize := fuse.MAX_KERNEL_WRITE + int(plainBS)
+	reqBlocks++
+	// In the integrity format, an appending write also re-encrypts the old
+	// last block of the file.
+	reqBlocks++
+	// Take IV and GHASH overhead into account.
+	cReqSize := int(reqBlocks * cipherBS)
+	pReqSize := int(reqBlocks * plainBS)
 	c := &ContentEnc{
 		cryptoCore:   cc,
 		plainBS:      plainBS,
@@ -107,8 +135,28 @@ func (be *ContentEnc) CipherBS() uint64 {
 	return be.cipherBS
 }
 
-// DecryptBlocks decrypts a number of blocks
-func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, fileID []byte) ([]byte, error) {
+// AEADBackend returns the content encryption backend in use
+func (be *ContentEnc) AEADBackend() cryptocore.AEADTypeEnum {
+	return be.cryptoCore.AEADBackend
+}
+
+// FileIntegrity is the additional associated data that filesystems created
+// with "-integrity" authenticate together with the file content blocks.
+// Pass nil to use the classic format.
+type FileIntegrity struct {
+	// Binding identifies the encrypted name of the file. It is
+	// authenticated together with block 0, which binds the content to the
+	// name and, through the directory IV, to the directory.
+	Binding []byte
+	// LastBlockNo is the number of the last block of the file. Every
+	// block carries a flag that says if it is the last one, which
+	// authenticates the file length.
+	LastBlockNo uint64
+}
+
+// DecryptBlocks decrypts a number of blocks. "integrity" is nil unless the
+// filesystem uses the integrity format.
+func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, fileID []byte, integrity *FileIntegrity) ([]byte, error) {
 	cBuf := bytes.NewBuffer(ciphertext)
 	var err error
 	pBuf := bytes.NewBuffer(be.PReqPool.Get()[:0])
@@ -116,7 +164,7 @@ func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, file
 	for cBuf.Len() > 0 {
 		cBlock := cBuf.Next(int(be.cipherBS))
 		var pBlock []byte
-		pBlock, err = be.DecryptBlock(cBlock, blockNo, fileID)
+		pBlock, err = be.decryptBlock(cBlock, blockNo, fileID, integrity)
 		if err != nil {
 			if be.forceDecode && err == stupidgcm.ErrAuth {
 				tlog.Warn.Printf("DecryptBlocks: authentication failure in block #%d, overridden by forcedecode", firstBlockNo)
@@ -134,7 +182,10 @@ func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, file
 // concatAD concatenates the block number and the file ID to a byte blob
 // that can be passed to AES-GCM as associated data (AD).
 // Result is: aData = [blockNo.bigEndian fileID].
-func concatAD(blockNo uint64, fileID []byte) (aData []byte) {
+// In the integrity format, a byte that is 1 for the last block of the file
+// (0 otherwise) follows, and block 0 is additionally bound to the file name:
+// aData = [blockNo.bigEndian fileID lastBlockFlag binding].
+func concatAD(blockNo uint64, fileID []byte, integrity *FileIntegrity) (aData []byte) {
 	if fileID != nil && len(fileID) != headerIDLen {
 		// fileID is nil when decrypting the master key from the config file,
 		// and for symlinks and xattrs.
@@ -145,6 +196,20 @@ func concatAD(blockNo uint64, fileID []byte) (aData []byte) {
 	aData = make([]byte, lenUint64, lenUint64+headerIDLen)
 	binary.BigEndian.PutUint64(aData, blockNo)
 	aData = append(aData, fileID...)
+	if integrity == nil {
+		return aData
+	}
+	if fileID == nil {
+		log.Panic("the integrity format needs a fileID")
+	}
+	var lastBlockFlag byte
+	if blockNo == integrity.LastBlockNo {
+		lastBlockFlag = 1
+	}
+	aData = append(aData, lastBlockFlag)
+	if blockNo == 0 {
+		aData = append(aData, integrity.Binding...)
+	}
 	return aData
 }
 
@@ -153,6 +218,13 @@ func concatAD(blockNo uint64, fileID []byte) (aData []byte) {
 // Corner case: A full-sized block of all-zero ciphertext bytes is translated
 // to an all-zero plaintext block, i.e. file hole passthrough.
 func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []byte) ([]byte, error) {
+	return be.decryptBlock(ciphertext, blockNo, fileID, nil)
+}
+
+// decryptBlock is the backend for DecryptBlock and DecryptBlocks.
+// The integrity format does not have file holes, so all-zero blocks are not
+// passed through when "integrity" is set.
+func (be *ContentEnc) decryptBlock(ciphertext []byte, blockNo uint64, fileID []byte, integrity *FileIntegrity) ([]byte, error) {
 
 	// Empty block?
 	if len(ciphertext) == 0 {
@@ -160,7 +232,7 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 	}
 
 	// All-zero block?
-	if bytes.Equal(ciphertext, be.allZeroBlock) {
+	if integrity == nil && bytes.Equal(ciphertext, be.allZeroBlock) {
 		tlog.Debug.Printf("DecryptBlock: file hole encountered")
 		return make([]byte, be.plainBS), nil
 	}
@@ -184,7 +256,7 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 	// Decrypt
 	plaintext := be.pBlockPool.Get()
 	plaintext = plaintext[:0]
-	aData := concatAD(blockNo, fileID)
+	aData := concatAD(blockNo, fileID, integrity)
 	plaintext, err := be.cryptoCore.AEADCipher.Open(plaintext, nonce, ciphertext, aData)
 
 	if err != nil {
@@ -205,9 +277,10 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 const encryptMaxSplit = 2
 
 // EncryptBlocks is like EncryptBlock but takes multiple plaintext blocks.
+// "integrity" is nil unless the filesystem uses the integrity format.
 // Returns a byte slice from CReqPool - so don't forget to return it
 // to the pool.
-func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte) []byte {
+func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte, integrity *FileIntegrity) []byte {
 	ciphertextBlocks := make([][]byte, len(plaintextBlocks))
 	// For large writes, we parallelize encryption.
 	if len(plaintextBlocks) >= 32 {
@@ -226,13 +299,13 @@ func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint6
 					// Last group, pick up any left-over blocks
 					high = len(plaintextBlocks)
 				}
-				be.doEncryptBlocks(plaintextBlocks[low:high], ciphertextBlocks[low:high], firstBlockNo+uint64(low), fileID)
+				be.doEncryptBlocks(plaintextBlocks[low:high], ciphertextBlocks[low:high], firstBlockNo+uint64(low), fileID, integrity)
 				wg.Done()
 			}(i)
 		}
 		wg.Wait()
 	} else {
-		be.doEncryptBlocks(plaintextBlocks, ciphertextBlocks, firstBlockNo, fileID)
+		be.doEncryptBlocks(plaintextBlocks, ciphertextBlocks, firstBlockNo, fileID, integrity)
 	}
 	// Concatenate ciphertext into a single byte array.
 	tmp := be.CReqPool.Get()
@@ -246,9 +319,10 @@ func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint6
 }
 
 // doEncryptBlocks is called by EncryptBlocks to do the actual encryption work
-func (be *ContentEnc) doEncryptBlocks(in [][]byte, out [][]byte, firstBlockNo uint64, fileID []byte) {
+func (be *ContentEnc) doEncryptBlocks(in [][]byte, out [][]byte, firstBlockNo uint64, fileID []byte, integrity *FileIntegrity) {
 	for i, v := range in {
-		out[i] = be.EncryptBlock(v, firstBlockNo+uint64(i), fileID)
+		nonce := be.cryptoCore.IVGenerator.Get()
+		out[i] = be.doEncryptBlock(v, firstBlockNo+uint64(i), fileID, integrity, nonce)
 	}
 }
 
@@ -258,7 +332,7 @@ func (be *ContentEnc) doEncryptBlocks(in [][]byte, out [][]byte, firstBlockNo ui
 func (be *ContentEnc) EncryptBlock(plaintext []byte, blockNo uint64, fileID []byte) []byte {
 	// Get a fresh random nonce
 	nonce := be.cryptoCore.IVGenerator.Get()
-	return be.doEncryptBlock(plaintext, blockNo, fileID, nonce)
+	return be.doEncryptBlock(plaintext, blockNo, fileID, nil, nonce)
 }
 
 // EncryptBlockNonce - Encrypt plaintext using a nonce chosen by the caller.
@@ -269,13 +343,14 @@ func (be *ContentEnc) EncryptBlockNonce(plaintext []byte, blockNo uint64, fileID
 	if be.cryptoCore.AEADBackend != cryptocore.BackendAESSIV {
 		log.Panic("deterministic nonces are only secure in SIV mode")
 	}
-	return be.doEncryptBlock(plaintext, blockNo, fileID, nonce)
+	return be.doEncryptBlock(plaintext, blockNo, fileID, nil, nonce)
 }
 
-// doEncryptBlock is the backend for EncryptBlock and EncryptBlockNonce.
-// blockNo and fileID are used as associated data.
+// doEncryptBlock is the backend for EncryptBlock, EncryptBlockNonce and
+// EncryptBlocks.
+// blockNo, fileID and integrity are used as associated data.
 // The output is nonce + ciphertext + tag.
-func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []byte, nonce []byte) []byte {
+func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []byte, integrity *FileIntegrity, nonce []byte) []byte {
 	// Empty block?
 	if len(plaintext) == 0 {
 		return plaintext
@@ -284,7 +359,7 @@ func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []
 		log.Panic("wrong nonce length")
 	}
 	// Block is authenticated with block number and file ID
-	aData := concatAD(blockNo, fileID)
+	aData := concatAD(blockNo, fileID, integrity)
 	// Get a cipherBS-sized block of memory, copy the nonce into it and truncate to
 	// nonce length
 	cBlock := be.cBlockPool.Get()
@@ -325,6 +400,17 @@ func (be *ContentEnc) MergeBlocks(oldData []byte, newData []byte, offset int) []
 	return out[0:outLen]
 }
 
+// SetCryptoCore replaces the crypto backend. This is used to put the keys
+// back after a ctlsock "Lock" request has wiped them. The caller must make
+// sure that no encryption or decryption is running concurrently, and "cc"
+// must use the same backend and IV length as the old one.
+func (be *ContentEnc) SetCryptoCore(cc *cryptocore.CryptoCore) {
+	if cc.AEADBackend != be.cryptoCore.AEADBackend || cc.IVLen != be.cryptoCore.IVLen {
+		log.Panicf("SetCryptoCore: incompatible backend %v", cc.AEADBackend)
+	}
+	be.cryptoCore = cc
+}
+
 // Wipe tries to wipe secret keys from memory by overwriting them with zeros
 // and/or setting references to nil.
 func (be *ContentEnc) Wipe() {
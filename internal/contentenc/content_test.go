@@ -94,3 +94,76 @@ func TestBlockNo(t *testing.T) {
 		t.Errorf("actual: %d", b)
 	}
 }
+
+// XChaCha20-Poly1305 has 8 bytes more per-block overhead than GCM because of
+// the longer IV.
+func TestXChaCha20Poly1305Sizes(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendXChaCha20Poly1305, XChaCha20Poly1305IVBits, true, false)
+	f := New(cc, DefaultBS, false)
+
+	if f.BlockOverhead() != 40 {
+		t.Errorf("wrong overhead %d", f.BlockOverhead())
+	}
+	for _, plainSize := range []uint64{1, 4095, 4096, 4097, 70000} {
+		cipherSize := f.PlainSizeToCipherSize(plainSize)
+		blocks := (plainSize + DefaultBS - 1) / DefaultBS
+		if cipherSize != HeaderLen+plainSize+blocks*40 {
+			t.Errorf("plainSize=%d: wrong cipherSize %d", plainSize, cipherSize)
+		}
+		if f.CipherSizeToPlainSize(cipherSize) != plainSize {
+			t.Errorf("plainSize=%d: round trip gave %d", plainSize, f.CipherSizeToPlainSize(cipherSize))
+		}
+	}
+	fileID := make([]byte, headerIDLen)
+	plaintext := []byte("hello world")
+	ciphertext := f.EncryptBlock(plaintext, 5, fileID)
+	if uint64(len(ciphertext)) != uint64(len(plaintext))+f.BlockOverhead() {
+		t.Errorf("wrong ciphertext length %d", len(ciphertext))
+	}
+	out, err := f.DecryptBlock(ciphertext, 5, fileID)
+	if err != nil || string(out) != string(plaintext) {
+		t.Errorf("round trip failed: %v", err)
+	}
+	if _, err = f.DecryptBlock(ciphertext, 6, fileID); err == nil {
+		t.Error("decrypting with the wrong block number should fail")
+	}
+}
+
+// In the integrity format, the last block and block 0 are authenticated with
+// the additional data from FileIntegrity, and there is no hole passthrough.
+func TestFileIntegrity(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false)
+	fileID := make([]byte, headerIDLen)
+	blocks := [][]byte{make([]byte, DefaultBS), make([]byte, DefaultBS), []byte("last")}
+	good := &FileIntegrity{Binding: []byte("name"), LastBlockNo: 2}
+	ciphertext := f.EncryptBlocks(blocks, 0, fileID, good)
+	ciphertext = append([]byte{}, ciphertext...)
+	if _, err := f.DecryptBlocks(ciphertext, 0, fileID, good); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.DecryptBlocks(ciphertext, 0, fileID, nil); err == nil {
+		t.Error("decrypting without FileIntegrity should fail")
+	}
+	// Swapped file
+	other := &FileIntegrity{Binding: []byte("other"), LastBlockNo: 2}
+	if _, err := f.DecryptBlocks(ciphertext, 0, fileID, other); err == nil {
+		t.Error("decrypting with a different binding should fail")
+	}
+	// Only block 0 is bound to the name
+	cipherBS := int(f.CipherBS())
+	if _, err := f.DecryptBlocks(ciphertext[cipherBS:], 1, fileID, other); err != nil {
+		t.Error(err)
+	}
+	// Truncated at a block boundary
+	if _, err := f.DecryptBlocks(ciphertext[:2*cipherBS], 0, fileID, &FileIntegrity{Binding: good.Binding, LastBlockNo: 1}); err == nil {
+		t.Error("decrypting a truncated file should fail")
+	}
+	// All-zero blocks are not file holes
+	zeros := make([]byte, cipherBS)
+	if _, err := f.DecryptBlocks(zeros, 1, fileID, good); err == nil {
+		t.Error("decrypting an all-zero block should fail")
+	}
+}
@@ -126,7 +126,9 @@ func (be *ContentEnc) ExplodeCipherRange(offset uint64, length uint64) []IntraBl
 	return blocks
 }
 
-// BlockOverhead returns the per-block overhead.
+// BlockOverhead returns the per-block overhead, the IV plus the auth tag.
+// This is 32 bytes for AES-GCM and AES-SIV, and 40 bytes for
+// XChaCha20-Poly1305 which uses 192-bit IVs.
 func (be *ContentEnc) BlockOverhead() uint64 {
 	return be.cipherBS - be.plainBS
 }
@@ -12,6 +12,8 @@ import (
 
 	"github.com/rfjakob/eme"
 
+	"golang.org/x/crypto/chacha20poly1305"
+
 	"github.com/simonhorlick/gocryptfs/internal/siv_aead"
 	"github.com/simonhorlick/gocryptfs/internal/stupidgcm"
 	"github.com/simonhorlick/gocryptfs/internal/tlog"
@@ -20,7 +22,8 @@ import (
 const (
 	// KeyLen is the cipher key length in bytes.  32 for AES-256.
 	KeyLen = 32
-	// AuthTagLen is the length of a GCM auth tag in bytes.
+	// AuthTagLen is the length of a GCM auth tag in bytes. Poly1305 tags have
+	// the same length.
 	AuthTagLen = 16
 )
 
@@ -34,13 +37,31 @@ const (
 	BackendGoGCM AEADTypeEnum = 4
 	// BackendAESSIV specifies an AESSIV backend.
 	BackendAESSIV AEADTypeEnum = 5
+	// BackendXChaCha20Poly1305 specifies the XChaCha20-Poly1305 backend.
+	// It is fast on CPUs without AES instructions.
+	BackendXChaCha20Poly1305 AEADTypeEnum = 6
 )
 
+// String returns the backend name as used by "gocryptfs -speed".
+func (a AEADTypeEnum) String() string {
+	switch a {
+	case BackendOpenSSL:
+		return "AES-GCM-256-OpenSSL"
+	case BackendGoGCM:
+		return "AES-GCM-256-Go"
+	case BackendAESSIV:
+		return "AES-SIV-512-Go"
+	case BackendXChaCha20Poly1305:
+		return "XChaCha20-Poly1305-Go"
+	}
+	return fmt.Sprintf("AEADTypeEnum(%d)", int(a))
+}
+
 // CryptoCore is the low level crypto implementation.
 type CryptoCore struct {
 	// EME is used for filename encryption.
 	EMECipher *eme.EMECipher
-	// GCM or AES-SIV. This is used for content encryption.
+	// GCM, AES-SIV or XChaCha20-Poly1305. This is used for content encryption.
 	AEADCipher cipher.AEAD
 	// Which backend is behind AEADCipher?
 	AEADBackend AEADTypeEnum
@@ -49,7 +70,8 @@ type CryptoCore struct {
 	IVLen       int
 }
 
-// New returns a new CryptoCore object or panics.
+// New returns a new CryptoCore object or panics. It does not check the
+// backend, call SelfTest before.
 //
 // Even though the "GCMIV128" feature flag is now mandatory, we must still
 // support 96-bit IVs here because they were used for encrypting the master
@@ -132,6 +154,22 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 		for i := range key64 {
 			key64[i] = 0
 		}
+	} else if aeadType == BackendXChaCha20Poly1305 {
+		if IVLen != chacha20poly1305.NonceSizeX {
+			log.Panicf("XChaCha20-Poly1305 must use %d-byte nonces", chacha20poly1305.NonceSizeX)
+		}
+		// Filesystems without HKDF predate this backend, so we always use it.
+		if !useHKDF {
+			log.Panic("XChaCha20-Poly1305 requires HKDF")
+		}
+		chachaKey := hkdfDerive(key, hkdfInfoXChaChaContent, chacha20poly1305.KeySize)
+		aeadCipher, err = chacha20poly1305.NewX(chachaKey)
+		if err != nil {
+			log.Panic(err)
+		}
+		for i := range chachaKey {
+			chachaKey[i] = 0
+		}
 	} else {
 		log.Panic("unknown backend cipher")
 	}
@@ -154,7 +192,11 @@ type wiper interface {
 //
 // This is not bulletproof due to possible GC copies, but
 // still raises to bar for extracting the key.
+// Calling Wipe more than once is allowed.
 func (c *CryptoCore) Wipe() {
+	if c.AEADCipher == nil {
+		return
+	}
 	be := c.AEADBackend
 	if be == BackendOpenSSL || be == BackendAESSIV {
 		tlog.Debug.Printf("CryptoCore.Wipe: Wiping AEADBackend %d key", be)
@@ -0,0 +1,190 @@
+package cryptocore
+
+// Known-answer tests for the crypto backends. A backend that is built
+// against the wrong OpenSSL version can produce wrong ciphertext without
+// reporting an error, and we would write it to disk.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/rfjakob/eme"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/simonhorlick/gocryptfs/internal/siv_aead"
+	"github.com/simonhorlick/gocryptfs/internal/stupidgcm"
+)
+
+// aeadVector is a known-answer test for an AEAD. All fields are hex-encoded.
+// "ciphertext" includes the authentication tag.
+type aeadVector struct {
+	key, nonce, ad, plaintext, ciphertext string
+}
+
+var (
+	// "gocryptfs known-answer test", checked against OpenSSL
+	gcmVector = aeadVector{
+		key:        "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		nonce:      "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf",
+		ad:         "c0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3d4d5d6d7",
+		plaintext:  "676f63727970746673206b6e6f776e2d616e737765722074657374",
+		ciphertext: "4dcc40ce61bdb910b0be74df8263e3bde32b300e1b4671d898611e135b43c8ab4eb59b3c605b05a3cdf639",
+	}
+	// Same plaintext, 64-byte key for AES-SIV-512
+	sivVector = aeadVector{
+		key: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+			"202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f",
+		nonce:      "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf",
+		ad:         "c0c1c2c3c4c5c6c7c8c9cacbcccdcecfd0d1d2d3d4d5d6d7",
+		plaintext:  "676f63727970746673206b6e6f776e2d616e737765722074657374",
+		ciphertext: "f08dc872bab16316522912618fbb3be7fe9ac6041968f119ff84258769f0cd0484db3e934e9d7f60977f94",
+	}
+	// https://tools.ietf.org/html/draft-irtf-cfrg-xchacha-01#appendix-A.3.1
+	xchachaVector = aeadVector{
+		key:   "808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f",
+		nonce: "404142434445464748494a4b4c4d4e4f5051525354555657",
+		ad:    "50515253c0c1c2c3c4c5c6c7",
+		plaintext: "4c616469657320616e642047656e746c656d656e206f662074686520636c6173" +
+			"73206f66202739393a204966204920636f756c64206f6666657220796f75206f" +
+			"6e6c79206f6e652074697020666f7220746865206675747572652c2073756e73" +
+			"637265656e20776f756c642062652069742e",
+		ciphertext: "bd6d179d3e83d43b9576579493c0e939572a1700252bfaccbed2902c21396cbb" +
+			"731c7f1b0b4aa6440bf3a82f4eda7e39ae64c6708c54c216cb96b72e1213b452" +
+			"2f8c9ba40db5d945b11b69b982c1bb9e3f3fac2bc369488f76b2383565d3fff9" +
+			"21f9664c97637da9768812f615c68b13b52ec0875924c1c7987947deafd8780a" +
+			"cf49",
+	}
+)
+
+// unhex decodes a hex string from the vectors above or panics
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// checkAEAD runs vector "v" against the AEAD that "newAEAD" creates from the
+// key. It also checks that a modified ciphertext is rejected.
+func checkAEAD(v aeadVector, newAEAD func(key []byte) (cipher.AEAD, error)) error {
+	a, err := newAEAD(unhex(v.key))
+	if err != nil {
+		return err
+	}
+	nonce, ad := unhex(v.nonce), unhex(v.ad)
+	plaintext, ciphertext := unhex(v.plaintext), unhex(v.ciphertext)
+	if out := a.Seal(nil, nonce, plaintext, ad); !bytes.Equal(out, ciphertext) {
+		return fmt.Errorf("wrong ciphertext %x", out)
+	}
+	out, err := a.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return fmt.Errorf("decryption failed: %v", err)
+	}
+	if !bytes.Equal(out, plaintext) {
+		return fmt.Errorf("wrong plaintext %x", out)
+	}
+	ciphertext[0] ^= 1
+	if _, err = a.Open(nil, nonce, ciphertext, ad); err == nil {
+		return fmt.Errorf("modified ciphertext has been accepted")
+	}
+	return nil
+}
+
+// selfTestEME checks the EME filename encryption against the vector from
+// github.com/rfjakob/eme: all-zero key, tweak and input
+func selfTestEME() error {
+	bc, err := aes.NewCipher(make([]byte, KeyLen))
+	if err != nil {
+		return err
+	}
+	e := eme.New(bc)
+	want := unhex("f1b9ce8ca15a4ba9fb476905434b9fd3")
+	out := e.Encrypt(make([]byte, 16), make([]byte, 16))
+	if !bytes.Equal(out, want) {
+		return fmt.Errorf("EME: wrong ciphertext %x", out)
+	}
+	if out = e.Decrypt(make([]byte, 16), want); !bytes.Equal(out, make([]byte, 16)) {
+		return fmt.Errorf("EME: wrong plaintext %x", out)
+	}
+	return nil
+}
+
+// selfTestHKDF checks hkdfDerive against RFC 5869 test case 3, which uses no
+// salt and no info like we do.
+func selfTestHKDF() error {
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	want := unhex("8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8")
+	if out := hkdfDerive(ikm, "", len(want)); !bytes.Equal(out, want) {
+		return fmt.Errorf("HKDF: wrong output %x", out)
+	}
+	return nil
+}
+
+// selfTest runs the known-answer tests for the content encryption backend
+// "aeadType", and for EME and HKDF, which every filesystem uses.
+func selfTest(aeadType AEADTypeEnum) error {
+	if err := selfTestEME(); err != nil {
+		return err
+	}
+	if err := selfTestHKDF(); err != nil {
+		return err
+	}
+	var err error
+	switch aeadType {
+	case BackendOpenSSL:
+		err = checkAEAD(gcmVector, func(key []byte) (cipher.AEAD, error) {
+			return stupidgcm.New(key, false), nil
+		})
+	case BackendGoGCM:
+		err = checkAEAD(gcmVector, func(key []byte) (cipher.AEAD, error) {
+			bc, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			// 128-bit IVs, like we use for file content
+			return cipher.NewGCMWithNonceSize(bc, 16)
+		})
+	case BackendAESSIV:
+		err = checkAEAD(sivVector, func(key []byte) (cipher.AEAD, error) {
+			return siv_aead.New(key), nil
+		})
+	case BackendXChaCha20Poly1305:
+		err = checkAEAD(xchachaVector, chacha20poly1305.NewX)
+	default:
+		return fmt.Errorf("unknown backend %v", aeadType)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %v", aeadType, err)
+	}
+	return nil
+}
+
+// selfTestResults caches the result of selfTest per backend
+var selfTestResults struct {
+	sync.Mutex
+	m map[AEADTypeEnum]error
+}
+
+// SelfTest runs the known-answer tests for the content encryption backend
+// "aeadType", and for EME and HKDF, which every filesystem uses. The tests
+// only run once per backend, later calls return the cached result.
+// Callers must not encrypt anything with "aeadType" if this returns an error.
+func SelfTest(aeadType AEADTypeEnum) error {
+	selfTestResults.Lock()
+	defer selfTestResults.Unlock()
+	if err, ok := selfTestResults.m[aeadType]; ok {
+		return err
+	}
+	err := selfTest(aeadType)
+	if selfTestResults.m == nil {
+		selfTestResults.m = make(map[AEADTypeEnum]error)
+	}
+	selfTestResults.m[aeadType] = err
+	return err
+}
@@ -0,0 +1,71 @@
+package cryptocore
+
+import (
+	"crypto/cipher"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/simonhorlick/gocryptfs/internal/stupidgcm"
+)
+
+// All backends should pass their known-answer tests
+func TestSelfTest(t *testing.T) {
+	for _, b := range []AEADTypeEnum{BackendOpenSSL, BackendGoGCM, BackendAESSIV, BackendXChaCha20Poly1305} {
+		if b == BackendOpenSSL && stupidgcm.BuiltWithoutOpenssl {
+			continue
+		}
+		if err := SelfTest(b); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// SelfTest returns a cached failure instead of running the tests again
+func TestSelfTestCached(t *testing.T) {
+	SelfTest(BackendAESSIV)
+	selfTestResults.Lock()
+	want := errors.New("cached failure")
+	selfTestResults.m[BackendAESSIV] = want
+	selfTestResults.Unlock()
+	defer func() {
+		selfTestResults.Lock()
+		delete(selfTestResults.m, BackendAESSIV)
+		selfTestResults.Unlock()
+	}()
+	if err := SelfTest(BackendAESSIV); err != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+}
+
+// checkAEAD should notice a wrong ciphertext
+func TestCheckAEADWrong(t *testing.T) {
+	v := xchachaVector
+	v.ciphertext = "00" + v.ciphertext[2:]
+	if err := checkAEAD(v, chacha20poly1305.NewX); err == nil {
+		t.Error("wrong ciphertext has not been detected")
+	}
+	// An AEAD that accepts anything
+	v = xchachaVector
+	err := checkAEAD(v, func(key []byte) (cipher.AEAD, error) {
+		a, err := chacha20poly1305.NewX(key)
+		return noAuth{a}, err
+	})
+	if err == nil {
+		t.Error("missing authentication has not been detected")
+	}
+}
+
+// noAuth returns the plaintext even if authentication fails
+type noAuth struct {
+	cipher.AEAD
+}
+
+func (n noAuth) Open(dst, nonce, ciphertext, ad []byte) ([]byte, error) {
+	out, err := n.AEAD.Open(dst, nonce, ciphertext, ad)
+	if err != nil {
+		return dst, nil
+	}
+	return out, nil
+}
@@ -9,7 +9,9 @@ import (
 	"io"
 	"net"
 	"os"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/simonhorlick/gocryptfs/internal/tlog"
 )
@@ -18,16 +20,122 @@ import (
 type Interface interface {
 	EncryptPath(string) (string, error)
 	DecryptPath(string) (string, error)
+	// Status fills in the fields of StatusStruct that the filesystem knows
+	// about. The rest is filled in from MountInfo.
+	Status() StatusStruct
+	// ListDir lists the ciphertext directory "cipherPath", and all
+	// directories below it if "recursive" is set.
+	ListDir(cipherPath string, recursive bool) ([]DirEntry, error)
+	// UpdateManifest regenerates the manifest file of a reverse mount
+	// ("-manifest")
+	UpdateManifest() error
 }
 
 // RequestStruct is sent by a client
 type RequestStruct struct {
+	// ID is copied into the response, which allows a client to match
+	// responses to requests. Requests with an ID may be answered out of order.
+	// Any JSON value can be used.
+	ID          json.RawMessage `json:",omitempty"`
 	EncryptPath string
 	DecryptPath string
+	// EncryptPaths and DecryptPaths encrypt or decrypt many paths at once.
+	// The results are returned in ResponseStruct.Results, in the same order.
+	EncryptPaths []string `json:",omitempty"`
+	DecryptPaths []string `json:",omitempty"`
+	// Status requests a StatusStruct in ResponseStruct.Status
+	Status bool
+	// Lock wipes the keys from memory. Until the filesystem is unlocked
+	// again, all operations fail with EACCES.
+	Lock bool
+	// Unlock unlocks the filesystem using Password or Masterkey
+	Unlock bool
+	// Password is the password for Unlock
+	Password string
+	// Masterkey is the hex-encoded master key for Unlock, as
+	// accepted by "-masterkey"
+	Masterkey string
+	// Unmount unmounts the filesystem. It is refused with EBUSY while files
+	// are open, unless Force is set.
+	Unmount bool
+	// Lazy makes Unmount detach the filesystem even if it is busy, like
+	// "fusermount -u -z"
+	Lazy bool
+	// Force makes Unmount ignore open files
+	Force bool
+	// Idle queries the idle timeout ("-idle")
+	Idle bool
+	// SetIdle changes the idle timeout. The syntax is the same as for
+	// "-idle", and "0" disables the timeout.
+	SetIdle string
+	// ListDir lists the entries of a directory with their plaintext and
+	// ciphertext names. The path is a plaintext path unless Cipher is set.
+	// An empty path, or ".", is the root directory.
+	ListDir *string `json:",omitempty"`
+	// Cipher indicates that ListDir is a ciphertext path
+	Cipher bool
+	// Recursive makes ListDir descend into subdirectories
+	Recursive bool
+	// Manifest regenerates gocryptfs.manifest in reverse mode with
+	// "-manifest". The response is sent when the new manifest is in place.
+	Manifest bool
+}
+
+// StatusStruct describes the state of a running mount. It is sent in
+// response to a Status request.
+type StatusStruct struct {
+	// Mountpoint is the absolute path of the mountpoint
+	Mountpoint string
+	// Cipherdir is the absolute path of the backing directory
+	Cipherdir string
+	// Reverse is true for "-reverse" mounts
+	Reverse bool
+	// FeatureFlags are the feature flags from the config file. Empty when
+	// mounted using "-masterkey" or "-zerokey".
+	FeatureFlags []string
+	// CryptoBackend is the content encryption backend, named like in
+	// "gocryptfs -speed"
+	CryptoBackend string
+	// OpenFiles is the number of files that are currently open
+	OpenFiles int
+	// WriteOps is the number of write operations since mount
+	WriteOps uint64
+	// DirCacheHits and DirCacheMisses are the directory cache statistics
+	// since mount
+	DirCacheHits   uint64
+	DirCacheMisses uint64
+	// MitigatedCorruptions is the number of corrupt items (file names,
+	// xattrs, ...) that have been skipped since mount
+	MitigatedCorruptions uint64
+	// Uptime is the time since mount in seconds
+	Uptime int64
+	// Locked is true while the keys are wiped
+	Locked bool
+}
+
+// MountInfo is passed to Serve and contains the information about the mount
+// that the filesystem does not have.
+type MountInfo struct {
+	Mountpoint   string
+	FeatureFlags []string
+	// Started is when the filesystem was mounted
+	Started time.Time
+	// Lock and Unlock implement the Lock and Unlock requests. Nil if not
+	// supported.
+	Lock   func() error
+	Unlock func(password []byte, masterkey string) error
+	// Unmount implements the Unmount request. Nil if not supported.
+	Unmount func(lazy bool, force bool) error
+	// IdleTimeout and SetIdleTimeout implement the Idle and SetIdle
+	// requests. Nil if not supported.
+	IdleTimeout    func() time.Duration
+	SetIdleTimeout func(time.Duration) error
 }
 
 // ResponseStruct is sent by us as response to a request
 type ResponseStruct struct {
+	// ID is the ID of the request
+	ID json.RawMessage `json:",omitempty"`
 	// Result is the resulting decrypted or encrypted path. Empty on error.
 	Result string
 	// ErrNo is the error number as defined in errno.h.
@@ -39,21 +147,78 @@ type ResponseStruct struct {
 	// WarnText contains warnings that may have been encountered while
 	// processing the message.
 	WarnText string
+	// Status is the response to a Status request
+	Status *StatusStruct `json:",omitempty"`
+	// IdleTimeout is the idle timeout after an Idle or SetIdle request,
+	// "0s" when disabled
+	IdleTimeout string `json:",omitempty"`
+	// Results contains the results of an EncryptPaths or DecryptPaths
+	// request
+	Results []PathResult `json:",omitempty"`
+	// Entries is the response to a ListDir request. It is omitted if the
+	// directory is empty.
+	Entries []DirEntry `json:",omitempty"`
+}
+
+// DirEntry is one entry in the response to a ListDir request. The paths are
+// relative to the root of the filesystem.
+type DirEntry struct {
+	PlainPath  string
+	CipherPath string
+	// Type is "file", "dir", "symlink" or "other"
+	Type string
+	// LongName is true if the full ciphertext name is stored in a
+	// "gocryptfs.longname.*.name" file
+	LongName bool `json:",omitempty"`
+	// ErrText is set if the name could not be decrypted. PlainPath is empty
+	// in this case.
+	ErrText string `json:",omitempty"`
+}
+
+// DirEntryType returns the DirEntry.Type for the file type bits in "mode"
+func DirEntryType(mode uint32) string {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		return "file"
+	case syscall.S_IFDIR:
+		return "dir"
+	case syscall.S_IFLNK:
+		return "symlink"
+	}
+	return "other"
+}
+
+// PathResult is the result for one path of an EncryptPaths or DecryptPaths
+// request. The fields have the same meaning as in ResponseStruct.
+type PathResult struct {
+	Result   string
+	ErrNo    int32  `json:",omitempty"`
+	ErrText  string `json:",omitempty"`
+	WarnText string `json:",omitempty"`
 }
 
 type ctlSockHandler struct {
 	fs     Interface
+	info   MountInfo
 	socket *net.UnixListener
+	// requestLock is held for reading while a request is handled
+	requestLock sync.RWMutex
 }
 
 // Serve serves incoming connections on "sock". This call blocks so you
 // probably want to run it in a new goroutine.
-func Serve(sock net.Listener, fs Interface) {
+// Serve returns when "sock" is closed and the requests in flight have been
+// answered. This makes sure that the reply to an Unmount request is sent
+// before the program exits.
+func Serve(sock net.Listener, fs Interface, info MountInfo) {
 	handler := ctlSockHandler{
 		fs:     fs,
+		info:   info,
 		socket: sock.(*net.UnixListener),
 	}
 	handler.acceptLoop()
+	handler.requestLock.Lock()
+	handler.requestLock.Unlock()
 }
 
 func (ch *ctlSockHandler) acceptLoop() {
@@ -70,115 +235,305 @@ func (ch *ctlSockHandler) acceptLoop() {
 	}
 }
 
-// ReadBufSize is the size of the request read buffer.
-// The longest possible path is 4096 bytes on Linux and 1024 on Mac OS X so
-// 5000 bytes should be enough to hold the whole JSON request. This
-// assumes that the path does not contain too many characters that had to be
-// be escaped in JSON (for example, a null byte blows up to "\u0000").
-// We abort the connection if the request is bigger than this.
+// ReadBufSize was the request size limit of the original protocol, where
+// every request had to arrive in a single read(). The response to a
+// request for a single path still fits into a buffer of this size.
 const ReadBufSize = 5000
 
-// handleConnection reads and parses JSON requests from "conn"
-func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
-	buf := make([]byte, ReadBufSize)
+// MaxRequestSize is the size limit for a single request. Larger batches
+// have to be split. We abort the connection if a request is bigger.
+const MaxRequestSize = 16 * 1024 * 1024
+
+// maxInflight is the number of requests with an ID that are handled
+// concurrently on one connection.
+const maxInflight = 16
+
+var errRequestTooBig = fmt.Errorf("request too big (max = %d bytes)", MaxRequestSize)
+
+// limitReader fails with errRequestTooBig when more than MaxRequestSize bytes
+// have been read since "n" was last reset. json.Decoder reads ahead, so
+// a few bytes of the next request may count towards the current one.
+type limitReader struct {
+	r io.Reader
+	n int
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n > MaxRequestSize {
+		return 0, errRequestTooBig
+	}
+	n, err := l.r.Read(p)
+	l.n += n
+	return n, err
+}
+
+// ctlConn serializes the responses written to a connection
+type ctlConn struct {
+	*net.UnixConn
+	writeLock sync.Mutex
+}
+
+// handleConnection reads and parses JSON requests from "conn". Requests may
+// be concatenated or separated by newlines, and a request may arrive in
+// several reads. Requests without an ID are handled one after the other.
+// Requests with an ID are handled concurrently, so their responses may
+// arrive out of order.
+func (ch *ctlSockHandler) handleConnection(uconn *net.UnixConn) {
+	conn := &ctlConn{UnixConn: uconn}
+	defer conn.Close()
+	// Wait for concurrent requests before closing the connection
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	inflight := make(chan struct{}, maxInflight)
+	lr := &limitReader{r: conn}
+	dec := json.NewDecoder(lr)
 	for {
-		n, err := conn.Read(buf)
+		lr.n = 0
+		var in RequestStruct
+		err := dec.Decode(&in)
 		if err == io.EOF {
-			conn.Close()
-			return
-		} else if err != nil {
-			tlog.Warn.Printf("ctlsock: Read error: %#v", err)
-			conn.Close()
 			return
 		}
-		if n == ReadBufSize {
-			tlog.Warn.Printf("ctlsock: request too big (max = %d bytes)", ReadBufSize-1)
-			conn.Close()
+		if _, ok := err.(*json.UnmarshalTypeError); ok {
+			// The request was well-formed JSON, so we can go on with the
+			// next one
+			tlog.Warn.Printf("ctlsock: JSON Unmarshal error: %v", err)
+			conn.send(&ResponseStruct{ID: in.ID}, errors.New("JSON Unmarshal error: "+err.Error()))
+			continue
+		}
+		if _, ok := err.(*json.SyntaxError); ok {
+			// We cannot find the start of the next request
+			tlog.Warn.Printf("ctlsock: JSON Unmarshal error: %v", err)
+			conn.send(&ResponseStruct{}, errors.New("JSON Unmarshal error: "+err.Error()))
 			return
 		}
-		buf = buf[:n]
-		var in RequestStruct
-		err = json.Unmarshal(buf, &in)
 		if err != nil {
-			tlog.Warn.Printf("ctlsock: JSON Unmarshal error: %#v", err)
-			err = errors.New("JSON Unmarshal error: " + err.Error())
-			sendResponse(conn, err, "", "")
+			tlog.Warn.Printf("ctlsock: Read error: %v", err)
+			return
+		}
+		ch.requestLock.RLock()
+		if in.ID == nil {
+			conn.send(ch.handleRequest(&in))
+			ch.requestLock.RUnlock()
 			continue
 		}
-		ch.handleRequest(&in, conn)
-		// Restore original size.
-		buf = buf[:cap(buf)]
+		inflight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			conn.send(ch.handleRequest(&in))
+			ch.requestLock.RUnlock()
+			<-inflight
+			wg.Done()
+		}()
 	}
 }
 
-// handleRequest handles an already-unmarshaled JSON request
-func (ch *ctlSockHandler) handleRequest(in *RequestStruct, conn *net.UnixConn) {
-	var err error
-	var inPath, outPath, clean, warnText string
-	// You cannot perform both decryption and encryption in one request
-	if in.DecryptPath != "" && in.EncryptPath != "" {
-		err = errors.New("Ambiguous")
-		sendResponse(conn, err, "", "")
-		return
+// handleRequest handles an already-unmarshaled JSON request and returns the
+// response and the error to report in it
+func (ch *ctlSockHandler) handleRequest(in *RequestStruct) (*ResponseStruct, error) {
+	resp := &ResponseStruct{ID: in.ID}
+	// You cannot perform more than one operation in one request
+	n := 0
+	for _, set := range []bool{in.DecryptPath != "", in.EncryptPath != "",
+		len(in.DecryptPaths) > 0, len(in.EncryptPaths) > 0, in.Status,
+		in.Lock, in.Unlock, in.Unmount, in.Idle, in.SetIdle != "",
+		in.ListDir != nil, in.Manifest} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return resp, errors.New("Ambiguous")
+	}
+	if in.Status {
+		st := ch.status()
+		resp.Status = &st
+		return resp, nil
+	}
+	if in.Lock || in.Unlock {
+		return resp, ch.lockUnlock(in)
+	}
+	if in.Unmount {
+		if ch.info.Unmount == nil {
+			return resp, errors.New("Unmount is not supported")
+		}
+		return resp, ch.info.Unmount(in.Lazy, in.Force)
+	}
+	if in.Idle || in.SetIdle != "" {
+		return resp, ch.idle(in, resp)
+	}
+	if len(in.EncryptPaths) > 0 || len(in.DecryptPaths) > 0 {
+		ch.batch(in, resp)
+		return resp, nil
+	}
+	if in.ListDir != nil {
+		return resp, ch.listDir(in, resp)
+	}
+	if in.Manifest {
+		return resp, ch.fs.UpdateManifest()
 	}
 	// Neither encryption nor encryption has been requested, makes no sense
 	if in.DecryptPath == "" && in.EncryptPath == "" {
-		err = errors.New("Empty input")
-		sendResponse(conn, err, "", "")
-		return
+		return resp, errors.New("Empty input")
 	}
-	// Canonicalize input path
+	var err error
 	if in.EncryptPath != "" {
-		inPath = in.EncryptPath
+		resp.Result, resp.WarnText, err = ch.translatePath(in.EncryptPath, true)
 	} else {
-		inPath = in.DecryptPath
+		resp.Result, resp.WarnText, err = ch.translatePath(in.DecryptPath, false)
 	}
-	clean = SanitizePath(inPath)
+	return resp, err
+}
+
+// translatePath canonicalizes "inPath" and encrypts or decrypts it
+func (ch *ctlSockHandler) translatePath(inPath string, encrypt bool) (outPath string, warnText string, err error) {
+	clean := SanitizePath(inPath)
 	// Warn if a non-canonical path was passed
 	if inPath != clean {
 		warnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", inPath, clean)
 	}
 	// Error out if the canonical path is now empty
 	if clean == "" {
-		err = errors.New("Empty input after canonicalization")
-		sendResponse(conn, err, "", warnText)
-		return
+		return "", warnText, errors.New("Empty input after canonicalization")
 	}
 	// Actual encrypt or decrypt operation
-	if in.EncryptPath != "" {
+	if encrypt {
 		outPath, err = ch.fs.EncryptPath(clean)
 	} else {
 		outPath, err = ch.fs.DecryptPath(clean)
 	}
-	sendResponse(conn, err, outPath, warnText)
+	return outPath, warnText, err
+}
+
+// batch handles the EncryptPaths and DecryptPaths requests
+func (ch *ctlSockHandler) batch(in *RequestStruct, resp *ResponseStruct) {
+	encrypt := len(in.EncryptPaths) > 0
+	paths := in.DecryptPaths
+	if encrypt {
+		paths = in.EncryptPaths
+	}
+	resp.Results = make([]PathResult, len(paths))
+	for i, p := range paths {
+		r := &resp.Results[i]
+		var err error
+		r.Result, r.WarnText, err = ch.translatePath(p, encrypt)
+		if err != nil {
+			r.ErrNo = errNo(err)
+			r.ErrText = err.Error()
+		}
+	}
 }
 
-// sendResponse sends a JSON response message
-func sendResponse(conn *net.UnixConn, err error, result string, warnText string) {
-	msg := ResponseStruct{
-		Result:   result,
-		WarnText: warnText,
+// listDir handles the ListDir request
+func (ch *ctlSockHandler) listDir(in *RequestStruct, resp *ResponseStruct) error {
+	inPath := *in.ListDir
+	clean := SanitizePath(inPath)
+	if clean == "" && inPath != "" && inPath != "." && inPath != "/" {
+		// Unlike for EncryptPath, an empty path is valid here, so we have
+		// to catch paths that point above the root dir
+		return fmt.Errorf("Invalid path '%s'", inPath)
+	}
+	if inPath != clean && clean != "" {
+		resp.WarnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", inPath, clean)
+	}
+	cipherPath := clean
+	var err error
+	if !in.Cipher {
+		cipherPath, err = ch.fs.EncryptPath(clean)
+		if err != nil {
+			return err
+		}
+	}
+	resp.Entries, err = ch.fs.ListDir(cipherPath, in.Recursive)
+	return err
+}
+
+// lockUnlock handles the Lock and Unlock requests
+func (ch *ctlSockHandler) lockUnlock(in *RequestStruct) error {
+	if ch.info.Lock == nil || ch.info.Unlock == nil {
+		return errors.New("Lock and Unlock are not supported")
+	}
+	if in.Lock {
+		tlog.Info.Printf("ctlsock: locking filesystem")
+		return ch.info.Lock()
+	}
+	if in.Password == "" && in.Masterkey == "" {
+		return errors.New("Unlock needs Password or Masterkey")
 	}
+	err := ch.info.Unlock([]byte(in.Password), in.Masterkey)
 	if err != nil {
-		msg.ErrText = err.Error()
-		msg.ErrNo = -1
-		// Try to extract the actual error number
-		if pe, ok := err.(*os.PathError); ok {
-			if se, ok := pe.Err.(syscall.Errno); ok {
-				msg.ErrNo = int32(se)
-			}
-		} else if err == syscall.ENOENT {
-			msg.ErrNo = int32(syscall.ENOENT)
+		tlog.Warn.Printf("ctlsock: unlock failed: %v", err)
+		return err
+	}
+	tlog.Info.Printf("ctlsock: filesystem unlocked")
+	return nil
+}
+
+// idle handles the Idle and SetIdle requests
+func (ch *ctlSockHandler) idle(in *RequestStruct, resp *ResponseStruct) error {
+	if ch.info.IdleTimeout == nil || ch.info.SetIdleTimeout == nil {
+		return errors.New("Idle timeout is not supported")
+	}
+	if in.SetIdle != "" {
+		d, err := time.ParseDuration(in.SetIdle)
+		if err == nil && d < 0 {
+			err = errors.New("Idle timeout cannot be less than 0")
+		}
+		if err == nil {
+			err = ch.info.SetIdleTimeout(d)
+		}
+		if err != nil {
+			return err
+		}
+		tlog.Info.Printf("ctlsock: idle timeout set to %v", d)
+	}
+	resp.IdleTimeout = ch.info.IdleTimeout().String()
+	return nil
+}
+
+// status merges the filesystem status with what we know about the mount
+func (ch *ctlSockHandler) status() StatusStruct {
+	st := ch.fs.Status()
+	st.Mountpoint = ch.info.Mountpoint
+	st.FeatureFlags = ch.info.FeatureFlags
+	if !ch.info.Started.IsZero() {
+		st.Uptime = int64(time.Since(ch.info.Started) / time.Second)
+	}
+	return st
+}
+
+// errNo tries to extract the error number from "err". Returns -1 if the
+// error number is not known.
+func errNo(err error) int32 {
+	if pe, ok := err.(*os.PathError); ok {
+		if se, ok := pe.Err.(syscall.Errno); ok {
+			return int32(se)
 		}
+	} else if se, ok := err.(syscall.Errno); ok {
+		return int32(se)
+	}
+	return -1
+}
+
+// send fills the error fields of "msg" from "err" and sends it to the client
+// as JSON
+func (conn *ctlConn) send(msg *ResponseStruct, err error) {
+	if err != nil {
+		msg.Result = ""
+		msg.ErrText = err.Error()
+		msg.ErrNo = errNo(err)
 	}
 	jsonMsg, err := json.Marshal(msg)
 	if err != nil {
 		tlog.Warn.Printf("ctlsock: Marshal failed: %v", err)
 		return
 	}
-	// For convenience for the user, add a newline at the end.
+	// For convenience for the user, add a newline at the end. This also
+	// delimits the responses.
 	jsonMsg = append(jsonMsg, '\n')
+	conn.writeLock.Lock()
 	_, err = conn.Write(jsonMsg)
+	conn.writeLock.Unlock()
 	if err != nil {
 		tlog.Warn.Printf("ctlsock: Write failed: %v", err)
 	}
@@ -0,0 +1,370 @@
+package ctlsock
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type fakeFS struct {
+	manifestUpdates int
+}
+
+func (fs *fakeFS) EncryptPath(p string) (string, error) {
+	return "enc-" + p, nil
+}
+
+func (fs *fakeFS) DecryptPath(p string) (string, error) {
+	return "dec-" + p, nil
+}
+
+func (fs *fakeFS) Status() StatusStruct {
+	return StatusStruct{Cipherdir: "/cipher", OpenFiles: 2}
+}
+
+func (fs *fakeFS) ListDir(cipherPath string, recursive bool) ([]DirEntry, error) {
+	if cipherPath == "missing" {
+		return nil, syscall.ENOENT
+	}
+	entries := []DirEntry{{PlainPath: "dec-" + cipherPath, CipherPath: cipherPath, Type: "dir"}}
+	if recursive {
+		entries = append(entries, DirEntry{PlainPath: "dec-sub", CipherPath: "sub", Type: "file", LongName: true})
+	}
+	return entries, nil
+}
+
+func (fs *fakeFS) UpdateManifest() error {
+	fs.manifestUpdates++
+	return nil
+}
+
+// query sends "req" to the socket at "path" and returns the response.
+func query(t *testing.T, path string, req RequestStruct) (resp ResponseStruct) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	msg, _ := json.Marshal(req)
+	_, err = conn.Write(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, ReadBufSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(buf[:n], &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sock")
+	sock, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	info := MountInfo{
+		Mountpoint:   "/mnt",
+		FeatureFlags: []string{"HKDF"},
+		Started:      time.Now().Add(-time.Minute),
+	}
+	go Serve(sock, &fakeFS{}, info)
+
+	resp := query(t, path, RequestStruct{Status: true})
+	st := resp.Status
+	if resp.ErrNo != 0 || st == nil {
+		t.Fatalf("got an error reply: %+v", resp)
+	}
+	if st.Mountpoint != "/mnt" || st.Cipherdir != "/cipher" || st.OpenFiles != 2 {
+		t.Errorf("wrong status: %+v", st)
+	}
+	if len(st.FeatureFlags) != 1 || st.Uptime < 60 {
+		t.Errorf("wrong status: %+v", st)
+	}
+	// Path requests do not carry a status
+	resp = query(t, path, RequestStruct{EncryptPath: "foo"})
+	if resp.Result != "enc-foo" || resp.Status != nil {
+		t.Errorf("wrong reply: %+v", resp)
+	}
+	resp = query(t, path, RequestStruct{Status: true, DecryptPath: "foo"})
+	if resp.ErrText != "Ambiguous" {
+		t.Errorf("wrong reply: %+v", resp)
+	}
+}
+
+func TestLockUnlockRequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sock")
+	sock, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	locked := false
+	info := MountInfo{
+		Lock: func() error {
+			locked = true
+			return nil
+		},
+		Unlock: func(password []byte, masterkey string) error {
+			if string(password) != "test" {
+				return syscall.EACCES
+			}
+			locked = false
+			return nil
+		},
+	}
+	go Serve(sock, &fakeFS{}, info)
+
+	resp := query(t, path, RequestStruct{Lock: true})
+	if resp.ErrNo != 0 || !locked {
+		t.Fatalf("Lock failed: %+v", resp)
+	}
+	resp = query(t, path, RequestStruct{Unlock: true})
+	if resp.ErrNo == 0 {
+		t.Errorf("Unlock without a password succeeded")
+	}
+	resp = query(t, path, RequestStruct{Unlock: true, Password: "wrong"})
+	if resp.ErrNo != int32(syscall.EACCES) || !locked {
+		t.Errorf("Unlock with a wrong password: %+v", resp)
+	}
+	resp = query(t, path, RequestStruct{Unlock: true, Password: "test"})
+	if resp.ErrNo != 0 || locked {
+		t.Errorf("Unlock failed: %+v", resp)
+	}
+	resp = query(t, path, RequestStruct{Lock: true, Unlock: true})
+	if resp.ErrText != "Ambiguous" {
+		t.Errorf("wrong reply: %+v", resp)
+	}
+}
+
+func TestUnmountIdleRequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sock")
+	sock, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle := time.Duration(0)
+	var unmounted string
+	info := MountInfo{
+		Unmount: func(lazy bool, force bool) error {
+			if !force {
+				return syscall.EBUSY
+			}
+			unmounted = fmt.Sprintf("lazy=%v", lazy)
+			return nil
+		},
+		IdleTimeout: func() time.Duration {
+			return idle
+		},
+		SetIdleTimeout: func(d time.Duration) error {
+			idle = d
+			return nil
+		},
+	}
+	done := make(chan struct{})
+	go func() {
+		Serve(sock, &fakeFS{}, info)
+		close(done)
+	}()
+
+	resp := query(t, path, RequestStruct{Idle: true})
+	if resp.ErrNo != 0 || resp.IdleTimeout != "0s" {
+		t.Errorf("wrong reply: %+v", resp)
+	}
+	resp = query(t, path, RequestStruct{SetIdle: "90s"})
+	if resp.ErrNo != 0 || resp.IdleTimeout != "1m30s" || idle != 90*time.Second {
+		t.Errorf("wrong reply: %+v", resp)
+	}
+	for _, bad := range []string{"xyz", "-1s"} {
+		resp = query(t, path, RequestStruct{SetIdle: bad})
+		if resp.ErrNo == 0 {
+			t.Errorf("SetIdle %q was accepted", bad)
+		}
+	}
+	resp = query(t, path, RequestStruct{Unmount: true})
+	if resp.ErrNo != int32(syscall.EBUSY) {
+		t.Errorf("wrong reply: %+v", resp)
+	}
+	resp = query(t, path, RequestStruct{Unmount: true, Lazy: true, Force: true})
+	if resp.ErrNo != 0 || unmounted != "lazy=true" {
+		t.Errorf("wrong reply: %+v", resp)
+	}
+	// Serve returns after the socket is closed
+	sock.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Serve did not return")
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sock")
+	sock, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	go Serve(sock, &fakeFS{}, MountInfo{})
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	// Newline-delimited, concatenated, and split across two writes
+	_, err = conn.Write([]byte(`{"ID":1,"EncryptPath":"a"}` + "\n" +
+		`{"ID":"two","DecryptPaths":["b","/c/",""]}{"EncryptPath":`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	_, err = conn.Write([]byte(`"d"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(conn)
+	resps := make(map[string]ResponseStruct)
+	for i := 0; i < 3; i++ {
+		var resp ResponseStruct
+		err = dec.Decode(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resps[string(resp.ID)] = resp
+	}
+	if r := resps["1"]; r.Result != "enc-a" || r.ErrNo != 0 {
+		t.Errorf("wrong reply: %+v", r)
+	}
+	if r := resps[""]; r.Result != "enc-d" || r.ErrNo != 0 {
+		t.Errorf("wrong reply: %+v", r)
+	}
+	r := resps[`"two"`]
+	if len(r.Results) != 3 {
+		t.Fatalf("wrong reply: %+v", r)
+	}
+	if r.Results[0].Result != "dec-b" || r.Results[0].ErrNo != 0 {
+		t.Errorf("wrong result: %+v", r.Results[0])
+	}
+	if r.Results[1].Result != "dec-c" || r.Results[1].WarnText == "" {
+		t.Errorf("wrong result: %+v", r.Results[1])
+	}
+	if r.Results[2].ErrNo == 0 {
+		t.Errorf("empty path was accepted: %+v", r.Results[2])
+	}
+	// A syntax error closes the connection after the error response
+	_, err = conn.Write([]byte("{xyz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp ResponseStruct
+	err = dec.Decode(&resp)
+	if err != nil || resp.ErrNo == 0 {
+		t.Errorf("wrong reply: %+v, %v", resp, err)
+	}
+	if err = dec.Decode(&resp); err == nil {
+		t.Error("connection should have been closed")
+	}
+}
+
+func TestListDirRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sock")
+	sock, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	go Serve(sock, &fakeFS{}, MountInfo{})
+
+	str := func(s string) *string { return &s }
+	// A plaintext path is encrypted first
+	resp := query(t, path, RequestStruct{ListDir: str("/foo/")})
+	if len(resp.Entries) != 1 || resp.Entries[0].CipherPath != "enc-foo" || resp.WarnText == "" {
+		t.Errorf("wrong reply: %+v", resp)
+	}
+	resp = query(t, path, RequestStruct{ListDir: str("foo"), Cipher: true, Recursive: true})
+	if len(resp.Entries) != 2 || resp.Entries[0].CipherPath != "foo" || !resp.Entries[1].LongName {
+		t.Errorf("wrong reply: %+v", resp)
+	}
+	// The root directory
+	resp = query(t, path, RequestStruct{ListDir: str(""), Cipher: true})
+	if len(resp.Entries) != 1 || resp.ErrNo != 0 || resp.WarnText != "" {
+		t.Errorf("wrong reply: %+v", resp)
+	}
+	resp = query(t, path, RequestStruct{ListDir: str("missing"), Cipher: true})
+	if resp.ErrNo != int32(syscall.ENOENT) || resp.Entries != nil {
+		t.Errorf("wrong reply: %+v", resp)
+	}
+	resp = query(t, path, RequestStruct{ListDir: str("../foo"), Cipher: true})
+	if resp.ErrNo == 0 {
+		t.Errorf("path above the root dir was accepted: %+v", resp)
+	}
+	resp = query(t, path, RequestStruct{ListDir: str("foo"), Status: true})
+	if resp.ErrNo == 0 {
+		t.Errorf("ambiguous request was accepted: %+v", resp)
+	}
+}
+
+func TestManifestRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctlsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sock")
+	sock, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	fs := &fakeFS{}
+	go Serve(sock, fs, MountInfo{})
+
+	resp := query(t, path, RequestStruct{Manifest: true})
+	if resp.ErrNo != 0 || fs.manifestUpdates != 1 {
+		t.Errorf("wrong reply: %+v, updates=%d", resp, fs.manifestUpdates)
+	}
+	resp = query(t, path, RequestStruct{Manifest: true, Status: true})
+	if resp.ErrNo == 0 {
+		t.Errorf("ambiguous request was accepted: %+v", resp)
+	}
+}
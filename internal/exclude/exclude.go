@@ -0,0 +1,186 @@
+// Package exclude implements the gitignore-style patterns used by
+// "-exclude-wildcard" and "-exclude-from".
+package exclude
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// pattern is one parsed pattern line
+type pattern struct {
+	// negate is set for patterns starting with "!". They re-include paths
+	// that an earlier pattern has excluded.
+	negate bool
+	// dirOnly is set for patterns ending in "/"
+	dirOnly bool
+	// anchored patterns contain a "/" and are matched against the whole path.
+	// The others are matched against the last path component only.
+	anchored bool
+	// parts is the pattern split at "/". Each element is a path.Match pattern
+	// or "**".
+	parts []string
+}
+
+// Matcher decides if a path is excluded
+type Matcher struct {
+	patterns []pattern
+}
+
+// New parses the patterns in "lines", which have the syntax of a .gitignore
+// file:
+//
+//	*.tmp          matches in every directory
+//	/build         a leading or inner slash anchors the pattern at the root
+//	cache/         a trailing slash only matches directories
+//	**/logs, a/**  "**" matches any number of directories
+//	!keep.tmp      a leading "!" re-includes a path excluded before
+//
+// Empty lines and lines starting with "#" are ignored. The last matching
+// pattern wins, and, like in git, a path cannot be re-included if one of its
+// parent directories is excluded.
+func New(lines []string) (*Matcher, error) {
+	m := &Matcher{}
+	for _, line := range lines {
+		p, ok, err := parse(line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			m.patterns = append(m.patterns, p)
+		}
+	}
+	return m, nil
+}
+
+// ReadFile reads the patterns in file "name", one per line.
+func ReadFile(name string) ([]string, error) {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(content), "\n"), nil
+}
+
+// parse parses one line. ok is false if the line does not contain a pattern.
+func parse(line string) (p pattern, ok bool, err error) {
+	line = strings.TrimSuffix(line, "\r")
+	// Trailing spaces are ignored unless they are escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || line[0] == '#' {
+		return p, false, nil
+	}
+	orig := line
+	if line[0] == '!' {
+		p.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return p, false, fmt.Errorf("invalid pattern %q", orig)
+	}
+	p.parts = strings.Split(line, "/")
+	for _, part := range p.parts {
+		// path.Match only reports syntax errors when it gets to the bad part
+		// of the pattern, which "" never does. Match against the pattern
+		// itself instead.
+		if _, err := path.Match(part, part); err != nil || part == "" {
+			return p, false, fmt.Errorf("invalid pattern %q", orig)
+		}
+	}
+	return p, true, nil
+}
+
+// Excluded returns true if the relative plaintext path "relPath" is excluded,
+// either itself or because one of its parent directories is. "isDir" tells
+// if "relPath" is a directory. It is only called if a pattern ending in "/"
+// matches the name.
+// The root directory "" is never excluded.
+func (m *Matcher) Excluded(relPath string, isDir func() bool) bool {
+	if relPath == "" || len(m.patterns) == 0 {
+		return false
+	}
+	parts := strings.Split(relPath, "/")
+	isParent := func() bool { return true }
+	for i := 1; i < len(parts); i++ {
+		if m.match(parts[:i], isParent) {
+			return true
+		}
+	}
+	return m.match(parts, isDir)
+}
+
+// match checks the path given by "parts" against all patterns
+func (m *Matcher) match(parts []string, isDir func() bool) bool {
+	excluded := false
+	dirKnown, dir := false, false
+	for _, p := range m.patterns {
+		// Only patterns that would change the result are interesting
+		if p.negate != excluded {
+			continue
+		}
+		if !p.matches(parts) {
+			continue
+		}
+		if p.dirOnly {
+			if !dirKnown {
+				dir = isDir()
+				dirKnown = true
+			}
+			if !dir {
+				continue
+			}
+		}
+		excluded = !p.negate
+	}
+	return excluded
+}
+
+func (p *pattern) matches(parts []string) bool {
+	if !p.anchored {
+		ok, _ := path.Match(p.parts[0], parts[len(parts)-1])
+		return ok
+	}
+	return matchParts(p.parts, parts)
+}
+
+// matchParts matches the path components "name" against the pattern
+// components "pat".
+func matchParts(pat []string, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			if len(pat) == 1 {
+				// A trailing "**" matches everything inside, but not the
+				// directory itself
+				return len(name) > 0
+			}
+			// Otherwise "**" matches zero or more directories
+			for i := 0; i <= len(name); i++ {
+				if matchParts(pat[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat = pat[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,76 @@
+package exclude
+
+import (
+	"testing"
+)
+
+func TestExcluded(t *testing.T) {
+	m, err := New([]string{
+		"# comment",
+		"",
+		"*.tmp",
+		"!keep.tmp",
+		"/build",
+		"cache/",
+		"**/node_modules",
+		"docs/**",
+		"a/**/z",
+		"\\!bang  ",
+		"\\#hash",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{"", true, false},
+		{"x.tmp", false, true},
+		{"dir/sub/x.tmp", false, true},
+		{"keep.tmp", false, false},
+		{"dir/keep.tmp", false, false},
+		{"build", true, true},
+		{"build/out", false, true},
+		{"dir/build", true, false},
+		{"cache", true, true},
+		{"cache", false, false},
+		{"dir/cache/x", false, true},
+		{"node_modules", true, true},
+		{"x/y/node_modules/z", false, true},
+		{"docs", true, false},
+		{"docs/x", false, true},
+		{"a/z", false, true},
+		{"a/b/c/z", false, true},
+		{"b/z", false, false},
+		{"!bang", false, true},
+		{"#hash", false, true},
+		{"keep", false, false},
+	}
+	for _, tc := range testCases {
+		isDir := tc.isDir
+		if m.Excluded(tc.path, func() bool { return isDir }) != tc.excluded {
+			t.Errorf("%q (dir=%v): want excluded=%v", tc.path, tc.isDir, tc.excluded)
+		}
+	}
+}
+
+// A file cannot be re-included if its parent directory is excluded
+func TestExcludedParent(t *testing.T) {
+	m, err := New([]string{"dir", "!dir/file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Excluded("dir/file", func() bool { return false }) {
+		t.Error("dir/file should be excluded")
+	}
+}
+
+func TestInvalidPattern(t *testing.T) {
+	for _, p := range []string{"[", "a/[b", "/", "!"} {
+		if _, err := New([]string{p}); err == nil {
+			t.Errorf("%q should be rejected", p)
+		}
+	}
+}
@@ -61,7 +61,7 @@ const (
 	// Profiler - error occurred when trying to write cpu or memory profile or
 	// execution trace
 	Profiler = 25
-	// FsckErrors - the filesystem check found errors
+	// FsckErrors - the filesystem check ("-fsck" or "-scrub") found errors
 	FsckErrors = 26
 	// DeprecatedFS - this filesystem is deprecated
 	DeprecatedFS = 27
@@ -72,6 +72,19 @@ const (
 	ExcludeError = 29
 	// DevNull means that /dev/null could not be opened
 	DevNull = 30
+	// Extract - "-extract" or "-cat" could not decrypt all requested files
+	Extract = 31
+	// Import - "-import" could not encrypt all files
+	Import = 32
+	// Rekey - "-rekey" did not complete, or the filesystem cannot be used
+	// because a "-rekey" run was interrupted
+	Rekey = 33
+	// Argon2Params means that the config file contains weak Argon2id
+	// parameters
+	Argon2Params = 34
+	// SelfTest means that a crypto backend has failed its known-answer test
+	// ("-selftest" or the automatic test in cryptocore.New)
+	SelfTest = 35
 )
 
 // Err wraps an error with an associated numeric exit code
@@ -32,4 +32,28 @@ type Args struct {
 	ForceDecode bool
 	// Exclude is a list of paths to make inaccessible
 	Exclude []string
+	// ExcludeWildcard is a list of gitignore-style patterns, see package
+	// exclude
+	ExcludeWildcard []string
+	// ExcludeFrom is a list of files containing more patterns
+	ExcludeFrom []string
+	// IVCache is the file that stores the IVs of hard-linked files in
+	// reverse mode ("-ivcache"). Empty if disabled.
+	IVCache string
+	// StableIDs derives the file IVs in reverse mode from the inode number
+	// and generation instead of the path (configfile.FlagStableIDs)
+	StableIDs bool
+	// OneFileSystem hides the content of file systems that are mounted
+	// below the backing directory in reverse mode ("-one-file-system")
+	OneFileSystem bool
+	// FollowSymlinks is a list of absolute directories without symlinks.
+	// Symlinks that point to a directory inside one of them are followed in
+	// reverse mode ("-follow-symlinks").
+	FollowSymlinks []string
+	// Manifest enables the virtual gocryptfs.manifest file in reverse mode
+	// and makes reads fail when a file changes while it is being read
+	Manifest bool
+	// Integrity selects the integrity format (configfile.FlagIntegrity) that
+	// authenticates the file length and binds the content to the file name.
+	Integrity bool
 }
@@ -5,10 +5,13 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"syscall"
 
+	"github.com/simonhorlick/gocryptfs/internal/configfile"
 	"github.com/simonhorlick/gocryptfs/internal/ctlsock"
 	"github.com/simonhorlick/gocryptfs/internal/nametransform"
+	"github.com/simonhorlick/gocryptfs/internal/openfiletable"
 	"github.com/simonhorlick/gocryptfs/internal/syscallcompat"
 	"github.com/simonhorlick/gocryptfs/internal/tlog"
 )
@@ -103,3 +106,119 @@ func (fs *FS) decryptPathAt(dirfd int, cipherPath string) (plainPath string, err
 
 	return plainPath, nil
 }
+
+// Status implements ctlsock.Interface
+func (fs *FS) Status() ctlsock.StatusStruct {
+	hits, misses := fs.dirCache.Stats()
+	return ctlsock.StatusStruct{
+		Cipherdir:            fs.args.Cipherdir,
+		CryptoBackend:        fs.contentEnc.AEADBackend().String(),
+		OpenFiles:            openfiletable.CountOpenFiles(),
+		WriteOps:             openfiletable.WriteOpCount(),
+		DirCacheHits:         hits,
+		DirCacheMisses:       misses,
+		MitigatedCorruptions: atomic.LoadUint64(&fs.mitigatedCorruptionCount),
+	}
+}
+
+// UpdateManifest implements ctlsock.Interface. Only reverse mode has a
+// manifest.
+func (fs *FS) UpdateManifest() error {
+	return syscall.ENOTSUP
+}
+
+// ListDir implements ctlsock.Interface
+//
+// Symlink-safe through OpenDirNofollow() and decryptPathAt().
+func (fs *FS) ListDir(cipherPath string, recursive bool) ([]ctlsock.DirEntry, error) {
+	dirfd, _, err := fs.openBackingDir("")
+	if err != nil {
+		return nil, err
+	}
+	plainPath, err := fs.decryptPathAt(dirfd, cipherPath)
+	syscall.Close(dirfd)
+	if err != nil {
+		return nil, err
+	}
+	var out []ctlsock.DirEntry
+	err = fs.listDir(cipherPath, plainPath, recursive, &out)
+	return out, err
+}
+
+// listDir appends the entries of the ciphertext directory "cDir", whose
+// plaintext path is "pDir", to "out". Like OpenDir, it skips our own
+// metadata files, and entries it cannot decrypt are reported with ErrText set.
+func (fs *FS) listDir(cDir string, pDir string, recursive bool, out *[]ctlsock.DirEntry) error {
+	dirfd, err := syscallcompat.OpenDirNofollow(fs.args.Cipherdir, filepath.Dir(cDir))
+	if err != nil {
+		return err
+	}
+	fd, err := syscallcompat.Openat(dirfd, filepath.Base(cDir), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	syscall.Close(dirfd)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	cipherEntries, err := syscallcompat.Getdents(fd)
+	if err != nil {
+		return err
+	}
+	var dirIV []byte
+	if !fs.args.PlaintextNames {
+		dirIV, err = nametransform.ReadDirIVAt(fd)
+		if err != nil {
+			return err
+		}
+	}
+	var subdirs []ctlsock.DirEntry
+	for _, e := range cipherEntries {
+		cName := e.Name
+		if cDir == "" && (cName == configfile.ConfDefaultName || cName == configfile.RekeyDirName) {
+			continue
+		}
+		entry := ctlsock.DirEntry{
+			CipherPath: path.Join(cDir, cName),
+			Type:       ctlsock.DirEntryType(e.Mode),
+		}
+		if fs.args.PlaintextNames {
+			entry.PlainPath = path.Join(pDir, cName)
+		} else {
+			if cName == nametransform.DirIVFilename {
+				continue
+			}
+			isLong := nametransform.LongNameNone
+			if fs.args.LongNames {
+				isLong = nametransform.NameType(cName)
+			}
+			if isLong == nametransform.LongNameFilename {
+				continue
+			}
+			if isLong == nametransform.LongNameContent {
+				entry.LongName = true
+				cName, err = nametransform.ReadLongNameAt(fd, cName)
+			}
+			var name string
+			if err == nil {
+				name, err = fs.nameTransform.DecryptName(cName, dirIV)
+			}
+			if err != nil {
+				fs.reportMitigatedCorruption(e.Name)
+				entry.ErrText = err.Error()
+				err = nil
+			} else {
+				entry.PlainPath = path.Join(pDir, name)
+			}
+		}
+		*out = append(*out, entry)
+		if recursive && entry.Type == "dir" && entry.ErrText == "" {
+			subdirs = append(subdirs, entry)
+		}
+	}
+	for _, d := range subdirs {
+		err = fs.listDir(d.CipherPath, d.PlainPath, recursive, out)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -60,6 +60,10 @@ type dirCacheStruct struct {
 	// Hit rate stats. Evaluated and reset by the expire thread.
 	lookups uint64
 	hits    uint64
+	// Hit rate stats since mount, reported through the control socket.
+	// Never reset.
+	totalLookups uint64
+	totalHits    uint64
 }
 
 // Clear clears the cache contents.
@@ -108,6 +112,7 @@ func (d *dirCacheStruct) Store(dirRelPath string, fd int, iv []byte) {
 func (d *dirCacheStruct) Lookup(dirRelPath string) (fd int, iv []byte) {
 	d.Lock()
 	defer d.Unlock()
+	d.totalLookups++
 	if enableStats {
 		d.lookups++
 	}
@@ -134,6 +139,7 @@ func (d *dirCacheStruct) Lookup(dirRelPath string) (fd int, iv []byte) {
 		d.dbg("Lookup %q: miss\n", dirRelPath)
 		return -1, nil
 	}
+	d.totalHits++
 	if enableStats {
 		d.hits++
 	}
@@ -144,6 +150,13 @@ func (d *dirCacheStruct) Lookup(dirRelPath string) (fd int, iv []byte) {
 	return fd, iv
 }
 
+// Stats returns the number of cache hits and misses since mount.
+func (d *dirCacheStruct) Stats() (hits uint64, misses uint64) {
+	d.Lock()
+	defer d.Unlock()
+	return d.totalHits, d.totalLookups - d.totalHits
+}
+
 // expireThread is started on the first Lookup()
 func (d *dirCacheStruct) expireThread() {
 	for {
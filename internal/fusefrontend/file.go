@@ -61,6 +61,22 @@ type File struct {
 
 // NewFile returns a new go-fuse File instance.
 func NewFile(fd *os.File, fs *FS) (nodefs.File, fuse.Status) {
+	f, status := newFile(fd, fs)
+	if !status.Ok() {
+		return nil, status
+	}
+	return &nodefs.WithFlags{
+		// Disable kernel page cache. This option prevents the kernel from
+		// requesting reads non-sequentially.
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+		File:      f,
+	}, fuse.OK
+}
+
+// newFile registers "fd" in the open file table and returns the File.
+// In the integrity format, the name of "fd" must be the encrypted name of
+// the file, as it determines the binding.
+func newFile(fd *os.File, fs *FS) (*File, fuse.Status) {
 	var st syscall.Stat_t
 	err := syscall.Fstat(int(fd.Fd()), &st)
 	if err != nil {
@@ -69,20 +85,22 @@ func NewFile(fd *os.File, fs *FS) (nodefs.File, fuse.Status) {
 	}
 	qi := openfiletable.QInoFromStat(&st)
 	e := openfiletable.Register(qi)
+	if fs.args.Integrity {
+		e.IDLock.Lock()
+		if e.Binding == nil {
+			e.Binding = fileBinding(fd.Name())
+		}
+		e.IDLock.Unlock()
+	}
 
-	return &nodefs.WithFlags{
-		// Disable kernel page cache. This option prevents the kernel from
-		// requesting reads non-sequentially.
-		FuseFlags: fuse.FOPEN_DIRECT_IO,
-		File: &File{
-			fd:             fd,
-			contentEnc:     fs.contentEnc,
-			qIno:           qi,
-			fileTableEntry: e,
-			loopbackFile:   nodefs.NewLoopbackFile(fd),
-			fs:             fs,
-			File:           nodefs.NewDefaultFile(),
-		},
+	return &File{
+		fd:             fd,
+		contentEnc:     fs.contentEnc,
+		qIno:           qi,
+		fileTableEntry: e,
+		loopbackFile:   nodefs.NewLoopbackFile(fd),
+		fs:             fs,
+		File:           nodefs.NewDefaultFile(),
 	}, fuse.OK
 }
 
@@ -177,6 +195,14 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 	if fileID == nil {
 		log.Panicf("fileID=%v", fileID)
 	}
+	var integrity *contentenc.FileIntegrity
+	if f.fs.args.Integrity {
+		var status fuse.Status
+		integrity, status = f.readIntegrity(fileID)
+		if !status.Ok() {
+			return nil, status
+		}
+	}
 	// Read the backing ciphertext in one go
 	blocks := f.contentEnc.ExplodePlainRange(off, length)
 	alignedOffset, alignedLength := blocks[0].JointCiphertextRange(blocks)
@@ -203,7 +229,7 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 	tlog.Debug.Printf("ReadAt offset=%d bytes (%d blocks), want=%d, got=%d", alignedOffset, firstBlockNo, alignedLength, n)
 
 	// Decrypt it
-	plaintext, err := f.contentEnc.DecryptBlocks(ciphertext, firstBlockNo, fileID)
+	plaintext, err := f.contentEnc.DecryptBlocks(ciphertext, firstBlockNo, fileID, integrity)
 	f.fs.contentEnc.CReqPool.Put(ciphertext)
 	if err != nil {
 		if f.fs.args.ForceDecode && err == stupidgcm.ErrAuth {
@@ -317,12 +343,21 @@ func (f *File) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 		// Write into the to-encrypt list
 		toEncrypt[i] = blockData
 	}
+	firstBlockNo := blocks[0].BlockNo
+	var integrity *contentenc.FileIntegrity
+	if f.fs.args.Integrity {
+		var status fuse.Status
+		toEncrypt, firstBlockNo, integrity, status = f.writeIntegrity(toEncrypt, firstBlockNo)
+		if !status.Ok() {
+			return 0, status
+		}
+	}
 	// Encrypt all blocks
-	ciphertext := f.contentEnc.EncryptBlocks(toEncrypt, blocks[0].BlockNo, f.fileTableEntry.ID)
+	ciphertext := f.contentEnc.EncryptBlocks(toEncrypt, firstBlockNo, f.fileTableEntry.ID, integrity)
 	// Preallocate so we cannot run out of space in the middle of the write.
 	// This prevents partially written (=corrupt) blocks.
 	var err error
-	cOff := int64(blocks[0].BlockCipherOff())
+	cOff := int64(f.contentEnc.BlockNoToCipherOff(firstBlockNo))
 	if !f.fs.args.NoPrealloc {
 		err = syscallcompat.EnospcPrealloc(int(f.fd.Fd()), cOff, int64(len(ciphertext)))
 		if err != nil {
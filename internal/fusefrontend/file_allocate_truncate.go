@@ -135,6 +135,9 @@ func (f *File) Truncate(newSize uint64) fuse.Status {
 	}
 
 	// File shrinks
+	if f.fs.args.Integrity {
+		return f.truncateShrinkIntegrity(newSize)
+	}
 	blockNo := f.contentEnc.PlainOffToBlockNo(newSize)
 	cipherOff := f.contentEnc.BlockNoToCipherOff(blockNo)
 	plainOff := f.contentEnc.BlockNoToPlainOff(blockNo)
@@ -176,11 +179,15 @@ func (f *File) statPlainSize() (uint64, error) {
 
 // truncateGrowFile extends a file using seeking or ftruncate performing RMW on
 // the first and last block as necessary. New blocks in the middle become
-// file holes unless they have been fallocate()'d beforehand.
+// file holes unless they have been fallocate()'d beforehand. The integrity
+// format writes zeros instead.
 func (f *File) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) fuse.Status {
 	if newPlainSz <= oldPlainSz {
 		log.Panicf("BUG: newSize=%d <= oldSize=%d", newPlainSz, oldPlainSz)
 	}
+	if f.fs.args.Integrity {
+		return f.fillZeros(oldPlainSz, newPlainSz)
+	}
 	newEOFOffset := newPlainSz - 1
 	if oldPlainSz > 0 {
 		n1 := f.contentEnc.PlainOffToBlockNo(oldPlainSz - 1)
@@ -0,0 +1,80 @@
+package fusefrontend
+
+// Consistency checks used by "gocryptfs -fsck"
+
+import (
+	"fmt"
+	"io"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/simonhorlick/gocryptfs/internal/contentenc"
+)
+
+// BadBlock is a file block that cannot be read
+type BadBlock struct {
+	// BlockNo is the number of the block, starting at zero
+	BlockNo uint64
+	// PlainOff and CipherOff are the offsets of the block in the plaintext
+	// and in the ciphertext file
+	PlainOff  uint64
+	CipherOff uint64
+	// Torn is set if the block is the last block of the file. This is
+	// usually caused by an interrupted write.
+	Torn bool
+}
+
+// CheckHeader returns an error if the file header is invalid or incomplete.
+// Empty files are fine. Unlike readFileID, it does not report an incomplete
+// header as a mitigated corruption, so it is safe to call from concurrent
+// fsck workers.
+func (f *File) CheckHeader() error {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	f.fileTableEntry.ContentLock.RLock()
+	defer f.fileTableEntry.ContentLock.RUnlock()
+	// Like readFileID, read one byte more than the header
+	buf := make([]byte, contentenc.HeaderLen+1)
+	n, err := f.fd.ReadAt(buf, 0)
+	if err == io.EOF {
+		if n == 0 {
+			return nil
+		}
+		return fmt.Errorf("incomplete file, got %d instead of %d bytes", n, len(buf))
+	} else if err != nil {
+		return err
+	}
+	_, err = contentenc.ParseHeader(buf[:contentenc.HeaderLen])
+	return err
+}
+
+// BadBlocks reads the plaintext range of "length" bytes at "off" block by
+// block and returns the blocks that cannot be read.
+func (f *File) BadBlocks(off int64, length int) ([]BadBlock, error) {
+	var a fuse.Attr
+	status := f.GetAttr(&a)
+	if !status.Ok() {
+		return nil, syscall.Errno(status)
+	}
+	ce := f.contentEnc
+	end := uint64(off) + uint64(length)
+	if end > a.Size {
+		end = a.Size
+	}
+	buf := make([]byte, ce.PlainBS())
+	var bad []BadBlock
+	for blockNo := ce.PlainOffToBlockNo(uint64(off)); ce.BlockNoToPlainOff(blockNo) < end; blockNo++ {
+		plainOff := ce.BlockNoToPlainOff(blockNo)
+		if _, status := f.Read(buf, int64(plainOff)); status.Ok() {
+			continue
+		}
+		bad = append(bad, BadBlock{
+			BlockNo:   blockNo,
+			PlainOff:  plainOff,
+			CipherOff: ce.BlockNoToCipherOff(blockNo),
+			Torn:      plainOff+ce.PlainBS() >= a.Size,
+		})
+	}
+	return bad, nil
+}
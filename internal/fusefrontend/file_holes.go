@@ -31,6 +31,10 @@ func (f *File) writePadHole(targetOff int64) fuse.Status {
 	if targetBlock <= nextBlock {
 		return fuse.OK
 	}
+	// The integrity format cannot have holes, fill the gap with zeros.
+	if f.fs.args.Integrity {
+		return f.fillZeros(plainSize, uint64(targetOff))
+	}
 	// The write goes past the next block. nextBlock has
 	// to be zero-padded to the block boundary and (at least) nextBlock+1
 	// will contain a file hole in the ciphertext.
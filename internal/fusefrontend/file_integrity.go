@@ -0,0 +1,327 @@
+package fusefrontend
+
+// Helper functions for the integrity format (configfile.FlagIntegrity)
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/simonhorlick/gocryptfs/internal/contentenc"
+	"github.com/simonhorlick/gocryptfs/internal/syscallcompat"
+	"github.com/simonhorlick/gocryptfs/internal/tlog"
+)
+
+// fileBinding returns the value that block 0 of a file is authenticated with
+// in the integrity format. The encrypted name "cName" depends on the
+// directory IV, so this binds the content to both the name and the directory.
+func fileBinding(cName string) []byte {
+	h := sha256.Sum256([]byte(cName))
+	return h[:]
+}
+
+// integrity returns the associated data for a file whose last block is
+// "lastBlockNo".
+func (f *File) integrity(lastBlockNo uint64) *contentenc.FileIntegrity {
+	f.fileTableEntry.IDLock.Lock()
+	binding := f.fileTableEntry.Binding
+	f.fileTableEntry.IDLock.Unlock()
+	return &contentenc.FileIntegrity{
+		Binding:     binding,
+		LastBlockNo: lastBlockNo,
+	}
+}
+
+// statBlockCount stats the file and returns the number of ciphertext blocks.
+// Unlike statPlainSize, a truncated last block still counts.
+func (f *File) statBlockCount() (uint64, error) {
+	fi, err := f.fd.Stat()
+	if err != nil {
+		tlog.Warn.Printf("ino%d fh%d: statBlockCount: %v", f.qIno.Ino, f.intFd(), err)
+		return 0, err
+	}
+	cipherSz := uint64(fi.Size())
+	if cipherSz <= contentenc.HeaderLen {
+		return 0, nil
+	}
+	return f.contentEnc.CipherOffToBlockNo(cipherSz-1) + 1, nil
+}
+
+// readBlock reads block "blockNo" from disk and decrypts it with
+// "integrity". The caller must return the plaintext to PReqPool.
+func (f *File) readBlock(blockNo uint64, fileID []byte, integrity *contentenc.FileIntegrity) ([]byte, error) {
+	ciphertext := make([]byte, f.contentEnc.CipherBS())
+	n, err := f.fd.ReadAt(ciphertext, int64(f.contentEnc.BlockNoToCipherOff(blockNo)))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, io.EOF
+	}
+	plaintext, err := f.contentEnc.DecryptBlocks(ciphertext[:n], blockNo, fileID, integrity)
+	if err != nil {
+		f.contentEnc.PReqPool.Put(plaintext)
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// blockOK reads block "blockNo" from disk and returns true if it
+// authenticates with "integrity".
+func (f *File) blockOK(blockNo uint64, fileID []byte, integrity *contentenc.FileIntegrity) bool {
+	plaintext, err := f.readBlock(blockNo, fileID, integrity)
+	if err != nil {
+		return false
+	}
+	f.contentEnc.PReqPool.Put(plaintext)
+	return true
+}
+
+// readIntegrity is called by doRead. It returns the associated data for
+// decrypting the file and makes sure that block 0 belongs to this file name,
+// which is checked once for each open file table entry.
+func (f *File) readIntegrity(fileID []byte) (*contentenc.FileIntegrity, fuse.Status) {
+	blockCount, err := f.statBlockCount()
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	var lastBlockNo uint64
+	if blockCount > 0 {
+		lastBlockNo = blockCount - 1
+	}
+	integrity := f.integrity(lastBlockNo)
+	f.fileTableEntry.IDLock.Lock()
+	bound := f.fileTableEntry.Bound
+	f.fileTableEntry.IDLock.Unlock()
+	if bound || blockCount == 0 {
+		return integrity, fuse.OK
+	}
+	if !f.blockOK(0, fileID, integrity) {
+		tlog.Warn.Printf("ino%d: integrity violation: block #0 does not authenticate under this file name",
+			f.qIno.Ino)
+		return nil, fuse.EIO
+	}
+	f.fileTableEntry.IDLock.Lock()
+	f.fileTableEntry.Bound = true
+	f.fileTableEntry.IDLock.Unlock()
+	return integrity, fuse.OK
+}
+
+// writeIntegrity is called by doWrite before it encrypts the blocks
+// "toEncrypt", starting at block "firstBlockNo". If the write appends to the
+// file, the old last block loses its last-block flag and is prepended to the
+// blocks to encrypt. A torn append is fixed by RepairIntegrity.
+// The caller must hold ContentLock exclusively.
+func (f *File) writeIntegrity(toEncrypt [][]byte, firstBlockNo uint64) ([][]byte, uint64, *contentenc.FileIntegrity, fuse.Status) {
+	blockCount, err := f.statBlockCount()
+	if err != nil {
+		return nil, 0, nil, fuse.ToStatus(err)
+	}
+	lastBlockNo := firstBlockNo + uint64(len(toEncrypt)) - 1
+	if blockCount > 0 {
+		oldLastBlockNo := blockCount - 1
+		if oldLastBlockNo > lastBlockNo {
+			lastBlockNo = oldLastBlockNo
+		} else if oldLastBlockNo < firstBlockNo {
+			// Holes are filled by writePadHole and truncateGrowFile
+			if oldLastBlockNo+1 != firstBlockNo {
+				tlog.Warn.Printf("ino%d: writeIntegrity: write to block #%d would leave a hole after block #%d",
+					f.qIno.Ino, firstBlockNo, oldLastBlockNo)
+				return nil, 0, nil, fuse.EIO
+			}
+			oldData, status := f.doRead(nil, f.contentEnc.BlockNoToPlainOff(oldLastBlockNo), f.contentEnc.PlainBS())
+			if !status.Ok() {
+				tlog.Warn.Printf("ino%d fh%d: writeIntegrity: reading the old last block failed: %s",
+					f.qIno.Ino, f.intFd(), status.String())
+				return nil, 0, nil, status
+			}
+			toEncrypt = append([][]byte{oldData}, toEncrypt...)
+			firstBlockNo = oldLastBlockNo
+		}
+	}
+	return toEncrypt, firstBlockNo, f.integrity(lastBlockNo), fuse.OK
+}
+
+// writeBlock encrypts "plaintext" as block "blockNo" of a file whose last
+// block is "lastBlockNo", and writes it to disk.
+// The caller must hold ContentLock exclusively and the file ID must be cached.
+func (f *File) writeBlock(blockNo uint64, plaintext []byte, lastBlockNo uint64) fuse.Status {
+	ciphertext := f.contentEnc.EncryptBlocks([][]byte{plaintext}, blockNo, f.fileTableEntry.ID,
+		f.integrity(lastBlockNo))
+	cOff := int64(f.contentEnc.BlockNoToCipherOff(blockNo))
+	_, err := f.fd.WriteAt(ciphertext, cOff)
+	f.contentEnc.CReqPool.Put(ciphertext)
+	if err != nil {
+		tlog.Warn.Printf("ino%d fh%d: writeBlock: WriteAt off=%d failed: %v", f.qIno.Ino, f.intFd(), cOff, err)
+	}
+	return fuse.ToStatus(err)
+}
+
+// truncateShrinkIntegrity shrinks the file to "newSize" (which must be
+// greater than zero) and marks the new last block as such. We cannot use
+// doWrite for that as it would want to re-encrypt the preceding block.
+func (f *File) truncateShrinkIntegrity(newSize uint64) fuse.Status {
+	blockNo := f.contentEnc.PlainOffToBlockNo(newSize - 1)
+	plainOff := f.contentEnc.BlockNoToPlainOff(blockNo)
+	data, status := f.doRead(nil, plainOff, newSize-plainOff)
+	if status != fuse.OK {
+		tlog.Warn.Printf("Truncate: shrink doRead returned error: %v", status)
+		return status
+	}
+	// Not atomic: if we crash before writeBlock, the file ends with a block
+	// that is not marked as the last one. RepairIntegrity fixes that.
+	err := syscall.Ftruncate(f.intFd(), int64(f.contentEnc.BlockNoToCipherOff(blockNo)))
+	if err != nil {
+		tlog.Warn.Printf("Truncate: shrink Ftruncate returned error: %v", err)
+		return fuse.ToStatus(err)
+	}
+	return f.writeBlock(blockNo, data, blockNo)
+}
+
+// fillZeros grows the file from "oldPlainSz" to "newPlainSz" by writing
+// encrypted zeros. The integrity format has no file holes, as all-zero
+// ciphertext blocks fail authentication.
+func (f *File) fillZeros(oldPlainSz uint64, newPlainSz uint64) fuse.Status {
+	chunk := newPlainSz - oldPlainSz
+	if chunk > fuse.MAX_KERNEL_WRITE {
+		chunk = fuse.MAX_KERNEL_WRITE
+	}
+	zeros := make([]byte, chunk)
+	for off := oldPlainSz; off < newPlainSz; {
+		n := newPlainSz - off
+		if n > chunk {
+			n = chunk
+		}
+		_, status := f.doWrite(zeros[:n], int64(off))
+		if !status.Ok() {
+			return status
+		}
+		off += n
+	}
+	return fuse.OK
+}
+
+// rebind re-encrypts block 0 so that the file content is bound to the new
+// binding "binding".
+func (f *File) rebind(binding []byte) fuse.Status {
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	f.fileTableEntry.ContentLock.Lock()
+	defer f.fileTableEntry.ContentLock.Unlock()
+
+	blockCount, err := f.statBlockCount()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	oldBinding := f.fileTableEntry.Binding
+	if blockCount > 0 {
+		// Verifies the old binding
+		data, status := f.doRead(nil, 0, f.contentEnc.PlainBS())
+		if !status.Ok() {
+			return status
+		}
+		f.fileTableEntry.Binding = binding
+		status = f.writeBlock(0, data, blockCount-1)
+		if !status.Ok() {
+			f.fileTableEntry.Binding = oldBinding
+			return status
+		}
+		return fuse.OK
+	}
+	f.fileTableEntry.Binding = binding
+	return fuse.OK
+}
+
+// rebind binds the content of the file "cName" in "dirfd" to the new
+// encrypted name "newCName". Called by Rename in the integrity format.
+// Directories, symlinks and device nodes are left alone as their content is
+// not bound to a name.
+func (fs *FS) rebind(dirfd int, cName string, newCName string) fuse.Status {
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return fuse.OK
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDWR|syscall.O_NOFOLLOW, 0)
+	if err == syscall.EACCES {
+		// Renaming a read-only file is allowed. Like openWriteOnlyFile, relax
+		// the permissions while blocking concurrent Open()s.
+		perms := uint32(st.Mode) & 07777
+		fs.openWriteOnlyLock.Lock()
+		err = syscallcompat.FchmodatNofollow(dirfd, cName, perms|0600)
+		if err == nil {
+			fd, err = syscallcompat.Openat(dirfd, cName, syscall.O_RDWR|syscall.O_NOFOLLOW, 0)
+			err2 := syscallcompat.FchmodatNofollow(dirfd, cName, perms)
+			if err2 != nil {
+				tlog.Warn.Printf("rebind: reverting permissions failed: %v", err2)
+			}
+		}
+		fs.openWriteOnlyLock.Unlock()
+	}
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	f, status := newFile(os.NewFile(uintptr(fd), cName), fs)
+	if !status.Ok() {
+		syscall.Close(fd)
+		return status
+	}
+	status = f.rebind(fileBinding(newCName))
+	f.Release()
+	return status
+}
+
+// VerifyIntegrity checks that block 0 authenticates under the name of the
+// file and that the last block is marked as the last one. "gocryptfs -fsck"
+// calls it to report a moved, swapped or truncated file before it reads the
+// remaining blocks through Read().
+// Always returns nil unless the filesystem uses the integrity format.
+func (f *File) VerifyIntegrity() error {
+	if !f.fs.args.Integrity {
+		return nil
+	}
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	f.fileTableEntry.ContentLock.RLock()
+	defer f.fileTableEntry.ContentLock.RUnlock()
+
+	fileID, err := f.readFileID()
+	if err == io.EOF {
+		// Empty file
+		return nil
+	} else if err != nil {
+		return err
+	}
+	blockCount, err := f.statBlockCount()
+	if err != nil {
+		return err
+	}
+	lastBlockNo := blockCount - 1
+	// A block that only authenticates when we pretend that there is another
+	// block after it has been the last block before the file was truncated.
+	truncated := func(blockNo uint64) bool {
+		return blockNo == lastBlockNo && f.blockOK(blockNo, fileID, f.integrity(lastBlockNo+1))
+	}
+	if !f.blockOK(0, fileID, f.integrity(lastBlockNo)) {
+		if truncated(0) {
+			return fmt.Errorf("file has been truncated after block #0")
+		}
+		return fmt.Errorf("block #0 does not authenticate under this file name (moved, swapped or corrupt file)")
+	}
+	if lastBlockNo > 0 && !f.blockOK(lastBlockNo, fileID, f.integrity(lastBlockNo)) {
+		if truncated(lastBlockNo) {
+			return fmt.Errorf("file has been truncated after block #%d", lastBlockNo)
+		}
+		return fmt.Errorf("last block #%d is corrupt", lastBlockNo)
+	}
+	return nil
+}
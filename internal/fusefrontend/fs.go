@@ -6,6 +6,7 @@ package fusefrontend
 import (
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -25,6 +26,10 @@ import (
 
 // FS implements the go-fuse virtual filesystem interface.
 type FS struct {
+	// mitigatedCorruptionCount counts reportMitigatedCorruption() calls.
+	// Accessed atomically, so it must stay the first field to be 64-bit
+	// aligned on 32-bit platforms.
+	mitigatedCorruptionCount uint64
 	// Embed pathfs.defaultFileSystem to avoid compile failure when the
 	// pathfs.FileSystem interface gets new functions. defaultFileSystem
 	// provides a no-op implementation for all functions.
@@ -541,6 +546,19 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 	if fs.args.PlaintextNames {
 		return fuse.ToStatus(syscallcompat.Renameat(oldDirfd, oldCName, newDirfd, newCName))
 	}
+	// In the integrity format, file content is bound to the encrypted name
+	if fs.args.Integrity && oldCName != newCName {
+		status := fs.rebind(oldDirfd, oldCName, newCName)
+		if !status.Ok() {
+			return status
+		}
+		defer func() {
+			if !code.Ok() {
+				// Roll back
+				fs.rebind(oldDirfd, oldCName, oldCName)
+			}
+		}()
+	}
 	// Long destination file name: create .name file
 	nameFileAlreadyThere := false
 	if nametransform.IsLongContent(newCName) {
@@ -582,13 +600,17 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 }
 
 // Link - FUSE call. Creates a hard link at "newPath" pointing to file
-// "oldPath".
+// "oldPath". Not supported in the integrity format.
 //
 // Symlink-safe through use of Linkat().
 func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code fuse.Status) {
 	if fs.isFiltered(newPath) {
 		return fuse.EPERM
 	}
+	// In the integrity format, file content is bound to a single name
+	if fs.args.Integrity {
+		return fuse.EPERM
+	}
 	oldDirFd, cOldName, err := fs.openBackingDir(oldPath)
 	if err != nil {
 		return fuse.ToStatus(err)
@@ -639,6 +661,7 @@ func (fs *FS) Access(relPath string, mode uint32, context *fuse.Context) (code f
 // item (filename for OpenDir(), xattr name for ListXAttr() etc).
 // See the MitigatedCorruptions channel for more info.
 func (fs *FS) reportMitigatedCorruption(item string) {
+	atomic.AddUint64(&fs.mitigatedCorruptionCount, 1)
 	if fs.MitigatedCorruptions == nil {
 		return
 	}
@@ -664,6 +687,12 @@ func (fs *FS) isFiltered(path string) bool {
 			configfile.ConfDefaultName)
 		return true
 	}
+	// ... and so is the staging directory of "-rekey"
+	if path == configfile.RekeyDirName {
+		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
+			configfile.RekeyDirName)
+		return true
+	}
 	// Note: gocryptfs.diriv is NOT forbidden because diriv and plaintextnames
 	// are exclusive
 	return false
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"runtime"
+	"strings"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -292,14 +293,18 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 			return nil, fuse.EIO
 		}
 	}
+	if fs.args.LongNames {
+		fs.reportOrphanedLongNames(cDirName, cipherEntries)
+	}
 	// Decrypted directory entries
 	var plain []fuse.DirEntry
 	var errorCount int
 	// Filter and decrypt filenames
 	for i := range cipherEntries {
 		cName := cipherEntries[i].Name
-		if dirName == "" && cName == configfile.ConfDefaultName {
-			// silently ignore "gocryptfs.conf" in the top level dir
+		if dirName == "" && (cName == configfile.ConfDefaultName || cName == configfile.RekeyDirName) {
+			// silently ignore "gocryptfs.conf" and the "-rekey" staging dir in
+			// the top level dir
 			continue
 		}
 		if fs.args.PlaintextNames {
@@ -333,7 +338,8 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 		if err != nil {
 			tlog.Warn.Printf("OpenDir %q: invalid entry %q: %v",
 				cDirName, cName, err)
-			fs.reportMitigatedCorruption(cName)
+			// Report the name of the file on disk, not the long name
+			fs.reportMitigatedCorruption(cipherEntries[i].Name)
 			if runtime.GOOS == "darwin" && cName == dsStoreName {
 				// MacOS creates lots of these files. Log the warning but don't
 				// increment errorCount - does not warrant returning EIO.
@@ -358,3 +364,27 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 
 	return plain, status
 }
+
+// reportOrphanedLongNames reports "gocryptfs.longname.*.name" files in
+// "entries" whose content file does not exist.
+func (fs *FS) reportOrphanedLongNames(cDirName string, entries []fuse.DirEntry) {
+	var nameFiles []string
+	for _, e := range entries {
+		if nametransform.NameType(e.Name) == nametransform.LongNameFilename {
+			nameFiles = append(nameFiles, e.Name)
+		}
+	}
+	if len(nameFiles) == 0 {
+		return
+	}
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name] = true
+	}
+	for _, n := range nameFiles {
+		if !names[strings.TrimSuffix(n, nametransform.LongNameSuffix)] {
+			tlog.Warn.Printf("OpenDir %q: orphaned %q", cDirName, n)
+			fs.reportMitigatedCorruption(n)
+		}
+	}
+}
@@ -74,3 +74,22 @@ func (fs *FS) openBackingDir(relPath string) (dirfd int, cName string, err error
 	}
 	return dirfd, cName, nil
 }
+
+// CipherPath returns the ciphertext path, relative to the cipherdir, that
+// belongs to the plaintext path "relPath". Used by "gocryptfs -fsck" to
+// report problems.
+func (fs *FS) CipherPath(relPath string) (string, error) {
+	if relPath == "" {
+		return "", nil
+	}
+	dirfd, cName, err := fs.openBackingDir(relPath)
+	if err != nil {
+		return "", err
+	}
+	syscall.Close(dirfd)
+	parent, err := fs.CipherPath(nametransform.Dir(relPath))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, cName), nil
+}
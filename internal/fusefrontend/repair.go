@@ -0,0 +1,280 @@
+package fusefrontend
+
+// Repair functions used by "gocryptfs -fsck -repair"
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/simonhorlick/gocryptfs/internal/nametransform"
+	"github.com/simonhorlick/gocryptfs/internal/syscallcompat"
+	"github.com/simonhorlick/gocryptfs/internal/tlog"
+)
+
+// LostFound is the plaintext name of the directory, in the root directory,
+// where RepairName moves entries whose names cannot be decrypted.
+const LostFound = "lost+found"
+
+// All Repair* functions return a description of the action they take, or ""
+// if there is nothing to do. With "dryRun", they only return the description.
+
+// openCipherDir returns an O_PATH fd for the ciphertext directory that belongs
+// to the plaintext directory "plainDir".
+func (fs *FS) openCipherDir(plainDir string) (int, error) {
+	parentfd, cName, err := fs.openBackingDir(plainDir)
+	if err != nil {
+		return -1, err
+	}
+	defer syscall.Close(parentfd)
+	return syscallcompat.Openat(parentfd, cName, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+}
+
+// RepairDirIV creates a new gocryptfs.diriv file in "plainDir" if it is
+// missing, or replaces it if it has the wrong length or is all-zero. Any
+// other error reading it is returned and nothing is changed. The names of
+// the existing entries cannot be decrypted with the new IV, so a second pass
+// with RepairName is needed.
+func (fs *FS) RepairDirIV(plainDir string, dryRun bool) (action string, err error) {
+	if fs.args.PlaintextNames {
+		return "", nil
+	}
+	dirfd, err := fs.openCipherDir(plainDir)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(dirfd)
+	_, err = nametransform.ReadDirIVAt(dirfd)
+	if err == nil {
+		return "", nil
+	}
+	_, invalid := err.(*nametransform.InvalidDirIVError)
+	if invalid {
+		action = fmt.Sprintf("replace invalid gocryptfs.diriv in %q", plainDir)
+	} else if err == syscall.ENOENT {
+		action = fmt.Sprintf("create missing gocryptfs.diriv in %q", plainDir)
+	} else {
+		return "", err
+	}
+	if dryRun {
+		return action, nil
+	}
+	defer fs.dirCache.Clear()
+	if invalid {
+		err = syscallcompat.Unlinkat(dirfd, nametransform.DirIVFilename, 0)
+		if err != nil {
+			return action, err
+		}
+	}
+	return action, nametransform.WriteDirIVAt(dirfd)
+}
+
+// RepairName fixes the directory entry "item" in "plainDir" that OpenDir
+// reported as corrupt. An orphaned gocryptfs.longname.*.name file is deleted.
+// Everything else is moved into LostFound under its ciphertext name: entries
+// whose name cannot be decrypted, and long name files that have lost their
+// .name file. We do not delete the latter, as the content may still be
+// intact.
+func (fs *FS) RepairName(plainDir string, item string, dryRun bool) (action string, err error) {
+	if fs.args.PlaintextNames {
+		return "", nil
+	}
+	dirfd, err := fs.openCipherDir(plainDir)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(dirfd)
+	if nametransform.NameType(item) == nametransform.LongNameFilename {
+		action = fmt.Sprintf("delete orphaned %q in %q", item, plainDir)
+		if dryRun {
+			return action, nil
+		}
+		return action, syscallcompat.Unlinkat(dirfd, item, 0)
+	}
+	onDisk := item
+	if plainDir == LostFound {
+		tlog.Warn.Printf("RepairName: not moving %q, it is already in %q", onDisk, LostFound)
+		return "", nil
+	}
+	newPath, err := fs.lostFoundPath(onDisk)
+	if err != nil {
+		return "", err
+	}
+	action = fmt.Sprintf("move %q in %q to %q", onDisk, plainDir, newPath)
+	if dryRun {
+		return action, nil
+	}
+	defer fs.dirCache.Clear()
+	status := fs.Mkdir(LostFound, 0700, nil)
+	if !status.Ok() && status != fuse.Status(syscall.EEXIST) {
+		return action, syscall.Errno(status)
+	}
+	newDirfd, newCName, err := fs.openBackingDir(newPath)
+	if err != nil {
+		return action, err
+	}
+	defer syscall.Close(newDirfd)
+	// In the integrity format, file content is bound to the encrypted name,
+	// like in Rename
+	rebound := false
+	if fs.args.Integrity {
+		status = fs.rebind(dirfd, onDisk, newCName)
+		if status == fuse.EIO {
+			// Block 0 does not authenticate under the current name either, so
+			// there is nothing to preserve
+			tlog.Warn.Printf("RepairName: %q is not bound to its name, moving it unchanged", onDisk)
+		} else if !status.Ok() {
+			return action, syscall.Errno(status)
+		} else {
+			rebound = true
+		}
+	}
+	if nametransform.IsLongContent(newCName) {
+		err = fs.nameTransform.WriteLongNameAt(newDirfd, newCName, newPath)
+	}
+	if err == nil {
+		err = syscallcompat.Renameat(dirfd, onDisk, newDirfd, newCName)
+		if err != nil && nametransform.IsLongContent(newCName) {
+			nametransform.DeleteLongNameAt(newDirfd, newCName)
+		}
+	}
+	if err != nil {
+		if rebound {
+			// Roll back
+			fs.rebind(dirfd, onDisk, onDisk)
+		}
+		return action, err
+	}
+	if nametransform.IsLongContent(onDisk) {
+		// Delete the undecryptable .name file, if there is one
+		nametransform.DeleteLongNameAt(dirfd, onDisk)
+	}
+	return action, nil
+}
+
+// lostFoundPath returns a path in LostFound, based on "name", that does not
+// exist yet.
+func (fs *FS) lostFoundPath(name string) (string, error) {
+	newPath := filepath.Join(LostFound, name)
+	for i := 1; ; i++ {
+		_, status := fs.GetAttr(newPath, nil)
+		if status == fuse.ENOENT {
+			return newPath, nil
+		} else if !status.Ok() {
+			return "", syscall.Errno(status)
+		}
+		newPath = filepath.Join(LostFound, fmt.Sprintf("%s.%d", name, i))
+	}
+}
+
+// RepairBlocks fixes the blocks that BadBlocks finds in the plaintext range
+// of "length" bytes at "off". A torn last block is cut off, other blocks are
+// overwritten with zeros. Unlike the other Repair functions, this returns one
+// action per block. The file must have been opened for writing unless
+// "dryRun" is set.
+func (f *File) RepairBlocks(off int64, length int, dryRun bool) (actions []string, err error) {
+	bad, err := f.BadBlocks(off, length)
+	if err != nil {
+		return nil, err
+	}
+	zeros := make([]byte, f.contentEnc.PlainBS())
+	for _, b := range bad {
+		status := fuse.OK
+		if b.Torn {
+			actions = append(actions, fmt.Sprintf("truncate torn last block #%d, new size %d", b.BlockNo, b.PlainOff))
+			if !dryRun {
+				status = f.Truncate(b.PlainOff)
+			}
+		} else {
+			actions = append(actions, fmt.Sprintf("zero-fill corrupt block #%d", b.BlockNo))
+			if !dryRun {
+				_, status = f.Write(zeros, int64(b.PlainOff))
+			}
+		}
+		if !status.Ok() {
+			return actions, syscall.Errno(status)
+		}
+	}
+	return actions, nil
+}
+
+// RepairIntegrity fixes the end of a file in the integrity format whose last
+// block is not marked as such, which is what an interrupted append or
+// truncate leaves behind. The highest block that authenticates decides: if
+// it is marked as the last block, everything after it is cut off. If it is
+// not, it is re-encrypted as the last block first, and then the rest is cut
+// off. An interrupted repair can simply be run again. The file must have
+// been opened for writing unless "dryRun" is set.
+func (f *File) RepairIntegrity(dryRun bool) (action string, err error) {
+	if !f.fs.args.Integrity {
+		return "", nil
+	}
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	f.fileTableEntry.ContentLock.Lock()
+	defer f.fileTableEntry.ContentLock.Unlock()
+
+	fileID, err := f.readFileID()
+	if err == io.EOF {
+		// Empty file
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	blockCount, err := f.statBlockCount()
+	if err != nil {
+		return "", err
+	}
+	lastBlockNo := blockCount - 1
+	if f.blockOK(lastBlockNo, fileID, f.integrity(lastBlockNo)) {
+		return "", nil
+	}
+	// Find the highest block that authenticates
+	blockNo := lastBlockNo
+	markLast := false
+	var plaintext []byte
+	for {
+		markLast = false
+		plaintext, err = f.readBlock(blockNo, fileID, f.integrity(blockNo))
+		if err != nil {
+			plaintext, err = f.readBlock(blockNo, fileID, f.integrity(blockNo+1))
+			markLast = err == nil
+		}
+		if err == nil {
+			break
+		}
+		if blockNo == 0 {
+			return "", fmt.Errorf("no block authenticates as the end of the file")
+		}
+		blockNo--
+	}
+	defer f.contentEnc.PReqPool.Put(plaintext)
+	newSize := f.contentEnc.BlockNoToPlainOff(blockNo) + uint64(len(plaintext))
+	if markLast {
+		action = fmt.Sprintf("mark block #%d as the last block", blockNo)
+	}
+	if blockNo < lastBlockNo {
+		if action != "" {
+			action += " and "
+		}
+		action += fmt.Sprintf("cut off the blocks after block #%d, new size %d", blockNo, newSize)
+	}
+	if dryRun {
+		return action, nil
+	}
+	if markLast {
+		if f.fileTableEntry.ID == nil {
+			f.fileTableEntry.ID = fileID
+		}
+		if status := f.writeBlock(blockNo, plaintext, blockNo); !status.Ok() {
+			return action, syscall.Errno(status)
+		}
+	}
+	if blockNo < lastBlockNo {
+		err = syscall.Ftruncate(f.intFd(), int64(f.contentEnc.PlainSizeToCipherSize(newSize)))
+	}
+	return action, err
+}
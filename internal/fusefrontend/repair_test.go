@@ -0,0 +1,275 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/simonhorlick/gocryptfs/internal/nametransform"
+	"github.com/simonhorlick/gocryptfs/tests/test_helpers"
+)
+
+// cipherPath returns the absolute ciphertext path of "relPath"
+func cipherPath(t *testing.T, fs *FS, relPath string) string {
+	cPath, err := fs.CipherPath(relPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs.args.Cipherdir + "/" + cPath
+}
+
+func TestRepairName(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, LongNames: true})
+	garbage := "xxxxxxxxxxxxxxxxxxxxxx"
+	orphan := "gocryptfs.longname.xxx.name"
+	for _, n := range []string{garbage, orphan} {
+		if err := ioutil.WriteFile(cipherdir+"/"+n, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Dry run: nothing changes
+	action, err := fs.RepairName("", garbage, true)
+	if action == "" || err != nil {
+		t.Fatalf("action=%q err=%v", action, err)
+	}
+	if _, err = os.Stat(cipherdir + "/" + garbage); err != nil {
+		t.Fatal(err)
+	}
+	// Undecryptable name: moved to lost+found
+	if _, err = fs.RepairName("", garbage, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(cipherdir + "/" + garbage); !os.IsNotExist(err) {
+		t.Errorf("%q is still there: %v", garbage, err)
+	}
+	if _, status := fs.GetAttr(LostFound+"/"+garbage, nil); !status.Ok() {
+		t.Errorf("not in lost+found: %v", status)
+	}
+	// Orphaned .name file: deleted
+	if _, err = fs.RepairName("", orphan, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(cipherdir + "/" + orphan); !os.IsNotExist(err) {
+		t.Errorf("%q is still there: %v", orphan, err)
+	}
+}
+
+// In the integrity format, a file moved into lost+found must stay readable
+func TestRepairNameIntegrity(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t, "-integrity")
+	fs := newTestFS(Args{Cipherdir: cipherdir, Integrity: true})
+	content := bytes.Repeat([]byte("x"), 5000)
+	f, status := fs.Create("file", syscall.O_RDWR, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if _, status = f.Write(content, 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	// An undecryptable name that the content is bound to
+	cName, err := fs.CipherPath("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage := "xxxxxxxxxxxxxxxxxxxxxx"
+	dirfd, err := syscall.Open(cipherdir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	if status = fs.rebind(dirfd, cName, garbage); !status.Ok() {
+		t.Fatal(status)
+	}
+	if err = syscall.Renameat(dirfd, cName, dirfd, garbage); err != nil {
+		t.Fatal(err)
+	}
+	fs.dirCache.Clear()
+	if _, err = fs.RepairName("", garbage, false); err != nil {
+		t.Fatal(err)
+	}
+	f, status = fs.Open(LostFound+"/"+garbage, syscall.O_RDONLY, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	buf := make([]byte, len(content)+1)
+	result, status := f.Read(buf, 0)
+	if !status.Ok() {
+		t.Fatalf("moved file is not readable: %v", status)
+	}
+	if data, _ := result.Bytes(buf); !bytes.Equal(data, content) {
+		t.Error("moved file has the wrong content")
+	}
+}
+
+func TestRepairDirIV(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	if status := fs.Mkdir("dir", 0700, nil); !status.Ok() {
+		t.Fatal(status)
+	}
+	if action, _ := fs.RepairDirIV("dir", false); action != "" {
+		t.Errorf("valid diriv: got action %q", action)
+	}
+	if err := os.Remove(cipherPath(t, fs, "dir") + "/" + nametransform.DirIVFilename); err != nil {
+		t.Fatal(err)
+	}
+	fs.dirCache.Clear()
+	if _, status := fs.OpenDir("dir", nil); status.Ok() {
+		t.Fatal("OpenDir should fail without diriv")
+	}
+	if action, err := fs.RepairDirIV("dir", false); action == "" || err != nil {
+		t.Fatalf("action=%q err=%v", action, err)
+	}
+	if _, status := fs.OpenDir("dir", nil); !status.Ok() {
+		t.Error(status)
+	}
+	// An all-zero diriv is replaced
+	dirIV := cipherPath(t, fs, "dir") + "/" + nametransform.DirIVFilename
+	if err := os.Remove(dirIV); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dirIV, make([]byte, nametransform.DirIVLen), 0400); err != nil {
+		t.Fatal(err)
+	}
+	fs.dirCache.Clear()
+	if action, err := fs.RepairDirIV("dir", false); action == "" || err != nil {
+		t.Fatalf("action=%q err=%v", action, err)
+	}
+	if _, status := fs.OpenDir("dir", nil); !status.Ok() {
+		t.Error(status)
+	}
+	// A diriv that cannot be read is left alone
+	if err := os.Remove(dirIV); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dirIV, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fs.dirCache.Clear()
+	if action, err := fs.RepairDirIV("dir", false); action != "" || err == nil {
+		t.Errorf("unreadable diriv: action=%q err=%v", action, err)
+	}
+	if fi, err := os.Lstat(dirIV); err != nil || !fi.IsDir() {
+		t.Errorf("unreadable diriv has been touched: %v", err)
+	}
+}
+
+func TestRepairBlocks(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	bs := int(fs.contentEnc.PlainBS())
+	f, status := fs.Create("file", syscall.O_RDWR, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	if _, status = f.Write(bytes.Repeat([]byte("x"), 3*bs), 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	// Corrupt block #1 and tear block #2
+	cFile, err := os.OpenFile(cipherPath(t, fs, "file"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cBS := int64(fs.contentEnc.CipherBS())
+	if _, err = cFile.WriteAt([]byte("garbage"), 18+cBS+20); err != nil {
+		t.Fatal(err)
+	}
+	if err = cFile.Truncate(18 + 2*cBS + 100); err != nil {
+		t.Fatal(err)
+	}
+	cFile.Close()
+
+	f2 := f.(*nodefs.WithFlags).File.(*File)
+	actions, err := f2.RepairBlocks(0, 3*bs, false)
+	if len(actions) != 2 || err != nil {
+		t.Fatalf("actions=%q err=%v", actions, err)
+	}
+	buf := make([]byte, 3*bs)
+	res, status := f.Read(buf, 0)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	data, _ := res.Bytes(buf)
+	if len(data) != 2*bs {
+		t.Fatalf("wrong size %d", len(data))
+	}
+	if !bytes.Equal(data[bs:], make([]byte, bs)) {
+		t.Error("block #1 has not been zeroed")
+	}
+}
+
+// An interrupted truncate or append leaves a last block that is not marked as
+// such. RepairIntegrity must make the file readable again.
+func TestRepairIntegrity(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t, "-integrity")
+	fs := newTestFS(Args{Cipherdir: cipherdir, Integrity: true})
+	bs := int(fs.contentEnc.PlainBS())
+	cbs := int64(fs.contentEnc.CipherBS())
+	content := bytes.Repeat([]byte("x"), 3*bs)
+	f, status := fs.Create("file", syscall.O_RDWR, 0600, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	f2 := f.(*nodefs.WithFlags).File.(*File)
+	cFile := cipherPath(t, fs, "file")
+	readable := func(size int) {
+		if err := f2.VerifyIntegrity(); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(content))
+		result, status := f.Read(buf, 0)
+		if !status.Ok() {
+			t.Fatal(status)
+		}
+		if data, _ := result.Bytes(buf); !bytes.Equal(data, content[:size]) {
+			t.Fatalf("wrong content, len=%d", len(data))
+		}
+	}
+	if _, status = f.Write(content, 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	if action, err := f2.RepairIntegrity(false); action != "" || err != nil {
+		t.Fatalf("healthy file: action=%q err=%v", action, err)
+	}
+	// Interrupted truncate: the ciphertext has been cut after block #1
+	if err := os.Truncate(cFile, 18+2*cbs); err != nil {
+		t.Fatal(err)
+	}
+	if f2.VerifyIntegrity() == nil {
+		t.Fatal("truncation not detected")
+	}
+	if action, _ := f2.RepairIntegrity(true); action == "" {
+		t.Fatal("dry run: no action")
+	}
+	if f2.VerifyIntegrity() == nil {
+		t.Fatal("dry run has changed the file")
+	}
+	if action, err := f2.RepairIntegrity(false); action == "" || err != nil {
+		t.Fatalf("action=%q err=%v", action, err)
+	}
+	readable(2 * bs)
+	// Torn append: block #1 has lost its last-block flag, but the new blocks
+	// never made it to disk
+	if _, status = f.Write(content[2*bs:], int64(2*bs)); !status.Ok() {
+		t.Fatal(status)
+	}
+	cf, err := os.OpenFile(cFile, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.WriteAt(make([]byte, cbs), 18+2*cbs)
+	cf.Close()
+	if action, err := f2.RepairIntegrity(false); action == "" || err != nil {
+		t.Fatalf("action=%q err=%v", action, err)
+	}
+	readable(2 * bs)
+}
@@ -3,10 +3,13 @@ package fusefrontend_reverse
 import (
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 
+	"github.com/simonhorlick/gocryptfs/internal/configfile"
 	"github.com/simonhorlick/gocryptfs/internal/ctlsock"
+	"github.com/simonhorlick/gocryptfs/internal/nametransform"
 	"github.com/simonhorlick/gocryptfs/internal/pathiv"
 )
 
@@ -36,3 +39,81 @@ func (rfs *ReverseFS) DecryptPath(cipherPath string) (string, error) {
 	p, err := rfs.decryptPath(cipherPath)
 	return p, err
 }
+
+// Status implements ctlsock.Interface. Reverse mode is read-only and has
+// no directory cache, so only the static fields are set.
+func (rfs *ReverseFS) Status() ctlsock.StatusStruct {
+	return ctlsock.StatusStruct{
+		Cipherdir:     rfs.args.Cipherdir,
+		Reverse:       true,
+		CryptoBackend: rfs.contentEnc.AEADBackend().String(),
+	}
+}
+
+// ListDir implements ctlsock.Interface. Like OpenDir, it skips excluded
+// entries. The virtual gocryptfs.diriv and gocryptfs.longname.*.name files
+// are not listed.
+func (rfs *ReverseFS) ListDir(cipherPath string, recursive bool) ([]ctlsock.DirEntry, error) {
+	if rfs.isExcluded(cipherPath) {
+		return nil, syscall.ENOENT
+	}
+	plainPath, err := rfs.decryptPath(cipherPath)
+	if err != nil {
+		return nil, err
+	}
+	var out []ctlsock.DirEntry
+	err = rfs.listDir(cipherPath, plainPath, recursive, &out)
+	return out, err
+}
+
+// listDir appends the entries of the ciphertext directory "cDir", whose
+// plaintext path is "pDir", to "out".
+func (rfs *ReverseFS) listDir(cDir string, pDir string, recursive bool, out *[]ctlsock.DirEntry) error {
+	entries, err := rfs.readDir(pDir)
+	if err != nil {
+		return err
+	}
+	plainNames := make([]string, len(entries))
+	for i := range entries {
+		plainNames[i] = entries[i].Name
+	}
+	// Encrypt names the same way OpenDir does
+	if rfs.args.PlaintextNames {
+		entries, _ = rfs.openDirPlaintextnames(cDir, entries)
+	} else {
+		dirIV := pathiv.Derive(cDir, pathiv.PurposeDirIV)
+		for i := range entries {
+			if cDir == "" && entries[i].Name == configfile.ConfReverseName {
+				entries[i].Name = configfile.ConfDefaultName
+				continue
+			}
+			entries[i].Name = rfs.nameTransform.EncryptName(entries[i].Name, dirIV)
+			if len(entries[i].Name) > unix.NAME_MAX {
+				entries[i].Name = rfs.nameTransform.HashLongName(entries[i].Name)
+			}
+		}
+	}
+	var subdirs []ctlsock.DirEntry
+	for i, e := range entries {
+		entry := ctlsock.DirEntry{
+			PlainPath:  filepath.Join(pDir, plainNames[i]),
+			CipherPath: filepath.Join(cDir, e.Name),
+			Type:       ctlsock.DirEntryType(e.Mode),
+			LongName:   !rfs.args.PlaintextNames && nametransform.IsLongContent(e.Name),
+		}
+		if rfs.isExcluded(entry.CipherPath) {
+			continue
+		}
+		*out = append(*out, entry)
+		if recursive && entry.Type == "dir" {
+			subdirs = append(subdirs, entry)
+		}
+	}
+	for _, d := range subdirs {
+		err = rfs.listDir(d.CipherPath, d.PlainPath, recursive, out)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
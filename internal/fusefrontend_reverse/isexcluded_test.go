@@ -1,7 +1,11 @@
 package fusefrontend_reverse
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
+
+	"github.com/simonhorlick/gocryptfs/internal/exclude"
 )
 
 func verifyExcluded(t *testing.T, rfs *ReverseFS, paths []string) {
@@ -11,7 +15,7 @@ func verifyExcluded(t *testing.T, rfs *ReverseFS, paths []string) {
 		}
 	}
 	if t.Failed() {
-		t.Logf("cExclude = %#v", rfs.cExclude)
+		t.Logf("cExclude = %#v, excluder = %#v", rfs.cExclude, rfs.excluder)
 	}
 }
 
@@ -24,3 +28,34 @@ func TestIsExcluded(t *testing.T) {
 	rfs.cExclude = []string{""}
 	verifyExcluded(t, &rfs, []string{"", "foo", "foo/bar"})
 }
+
+// With -plaintextnames, ciphertext and plaintext paths are identical, so we
+// can test the pattern matching without setting up encryption.
+func TestIsExcludedWildcard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestIsExcludedWildcard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.MkdirAll(dir+"/a/cache", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(dir+"/a/b.tmp", nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rfs ReverseFS
+	rfs.args.Cipherdir = dir
+	rfs.args.PlaintextNames = true
+	rfs.excluder, err = exclude.New([]string{"*.tmp", "cache/", "!keep.tmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyExcluded(t, &rfs, []string{"a/b.tmp", "x/y.tmp", "a/cache", "a/cache/z"})
+	for _, p := range []string{"", "a", "keep.tmp", "a/keep.tmp", "gocryptfs.conf"} {
+		if rfs.isExcluded(p) {
+			t.Errorf("Path %q should not be excluded", p)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package fusefrontend_reverse
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/simonhorlick/gocryptfs/internal/nametransform"
+	"github.com/simonhorlick/gocryptfs/internal/pathiv"
+	"github.com/simonhorlick/gocryptfs/internal/syscallcompat"
+	"github.com/simonhorlick/gocryptfs/internal/tlog"
+)
+
+// ivCacheSaveInterval is how often a changed IV cache is written to disk.
+// It is also written on unmount.
+const ivCacheSaveInterval = 10 * time.Second
+
+// ivCacheVersion is the version of the cache file format. Files with another
+// version are ignored.
+const ivCacheVersion = 2
+
+// ivCacheEntry is the on-disk record for one hard-linked inode
+type ivCacheEntry struct {
+	Dev uint64
+	Ino uint64
+	// Path is the relative plaintext path the IVs were derived from. It is
+	// used to detect stale entries.
+	Path     string
+	ID       []byte
+	Block0IV []byte
+}
+
+// ivCacheFile is the JSON format of the cache file
+type ivCacheFile struct {
+	Version int
+	Entries []ivCacheEntry
+}
+
+// ivCache persists the hard link entries of inodeTable ("-ivcache"). Without
+// it, the first path that is accessed after mount determines the IVs of a
+// hard-linked file, so its ciphertext can change across remounts.
+type ivCache struct {
+	filename string
+	lock     sync.Mutex
+	inodes   map[devIno]ivCacheEntry
+	// dirty is set when "inodes" differs from the file
+	dirty bool
+}
+
+// loadIVCache loads the IV cache from "filename" into inodeTable, dropping
+// stale entries, and starts saving changes in the background. A missing or
+// unreadable file results in an empty cache.
+func (rfs *ReverseFS) loadIVCache(filename string) *ivCache {
+	c := &ivCache{
+		filename: filename,
+		inodes:   make(map[devIno]ivCacheEntry),
+	}
+	var cf ivCacheFile
+	js, err := ioutil.ReadFile(filename)
+	if err == nil {
+		err = json.Unmarshal(js, &cf)
+	}
+	if err == nil && cf.Version != ivCacheVersion {
+		err = fmt.Errorf("unsupported version %d", cf.Version)
+		cf.Entries = nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		tlog.Warn.Printf("ivcache: ignoring %q: %v", filename, err)
+		c.dirty = true
+	}
+	for _, e := range cf.Entries {
+		if !rfs.ivCacheEntryValid(e) {
+			tlog.Debug.Printf("ivcache: dropping stale entry dev%d ino%d %q", e.Dev, e.Ino, e.Path)
+			c.dirty = true
+			continue
+		}
+		key := devIno{e.Dev, e.Ino}
+		c.inodes[key] = e
+		inodeTable.Store(key, pathiv.FileIVs{ID: e.ID, Block0IV: e.Block0IV})
+	}
+	tlog.Debug.Printf("ivcache: loaded %d of %d entries from %q", len(c.inodes), len(cf.Entries), filename)
+	go c.saveLoop()
+	return c
+}
+
+// ivCacheEntryValid checks that the path in "e" still is a hard link to
+// the inode in "e". Otherwise the inode number may have been reused for an
+// unrelated file.
+func (rfs *ReverseFS) ivCacheEntryValid(e ivCacheEntry) bool {
+	if len(e.ID) != nametransform.DirIVLen || len(e.Block0IV) != nametransform.DirIVLen {
+		return false
+	}
+	dirfd, err := rfs.openDir(filepath.Dir(e.Path))
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	err = syscallcompat.Fstatat(dirfd, filepath.Base(e.Path), &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return false
+	}
+	return st.Mode&syscall.S_IFMT == syscall.S_IFREG && uint64(st.Dev) == e.Dev &&
+		uint64(st.Ino) == e.Ino && st.Nlink > 1
+}
+
+// add records the IVs that have been derived for inode "key" from the
+// plaintext path "pRelPath".
+func (c *ivCache) add(key devIno, pRelPath string, ivs pathiv.FileIVs) {
+	c.lock.Lock()
+	c.inodes[key] = ivCacheEntry{Dev: key.Dev, Ino: key.Ino, Path: pRelPath, ID: ivs.ID, Block0IV: ivs.Block0IV}
+	c.dirty = true
+	c.lock.Unlock()
+}
+
+// save writes the cache to "filename.tmp" and renames it over "filename" if
+// there are changes.
+func (c *ivCache) save() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	cf := ivCacheFile{Version: ivCacheVersion}
+	for _, e := range c.inodes {
+		cf.Entries = append(cf.Entries, e)
+	}
+	js, err := json.Marshal(cf)
+	if err != nil {
+		return err
+	}
+	tmp := c.filename + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(js)
+	if err == nil {
+		err = fd.Sync()
+	}
+	fd.Close()
+	if err == nil {
+		err = os.Rename(tmp, c.filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+func (c *ivCache) saveLoop() {
+	for {
+		time.Sleep(ivCacheSaveInterval)
+		err := c.save()
+		if err != nil {
+			tlog.Warn.Printf("ivcache: save failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/simonhorlick/gocryptfs/internal/pathiv"
+)
+
+func TestIVCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestIVCache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(dir+"/a", nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Link(dir+"/a", dir+"/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	err = syscall.Stat(dir+"/a", &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rfs ReverseFS
+	rfs.args.Cipherdir = dir
+	cacheFile := dir + "/ivcache"
+
+	c := rfs.loadIVCache(cacheFile)
+	ivs := pathiv.DeriveFile("b")
+	key := devIno{uint64(st.Dev), uint64(st.Ino)}
+	c.add(key, "b", ivs)
+	err = c.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a remount
+	inodeTable.Delete(key)
+	rfs.loadIVCache(cacheFile)
+	v, found := inodeTable.Load(key)
+	if !found || !bytes.Equal(v.(pathiv.FileIVs).ID, ivs.ID) {
+		t.Fatalf("entry was not loaded: %v", v)
+	}
+	// Once the file is no longer hard-linked, the entry is stale
+	inodeTable.Delete(key)
+	err = os.Remove(dir + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = rfs.loadIVCache(cacheFile)
+	if _, found = inodeTable.Load(key); found || len(c.inodes) != 0 {
+		t.Error("stale entry was loaded")
+	}
+}
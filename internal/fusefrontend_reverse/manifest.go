@@ -0,0 +1,168 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/simonhorlick/gocryptfs/internal/ctlsock"
+	"github.com/simonhorlick/gocryptfs/internal/tlog"
+)
+
+// manifestName is the name of the virtual manifest file in the root directory
+// ("-manifest")
+const manifestName = "gocryptfs.manifest"
+
+// manifestReadSize is the chunk size used to hash files. It matches the
+// largest read request the kernel sends.
+const manifestReadSize = 128 * 1024
+
+// manifestEntry is one line of the manifest. Each line is a JSON object.
+type manifestEntry struct {
+	// Path is the relative ciphertext path
+	Path string
+	// Type is "file", "dir", "symlink" or "other", see ctlsock.DirEntryType
+	Type string `json:",omitempty"`
+	// Size is the ciphertext size
+	Size  uint64
+	Mtime time.Time
+	// SHA256 is the hex-encoded hash of the ciphertext. Only set for files.
+	SHA256 string `json:",omitempty"`
+	// ErrText is set if the entry could not be read. The other fields may be
+	// missing then.
+	ErrText string `json:",omitempty"`
+}
+
+type byName []fuse.DirEntry
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// isManifest returns true if "relPath" is the virtual manifest file
+func (rfs *ReverseFS) isManifest(relPath string) bool {
+	return rfs.args.Manifest && relPath == manifestName
+}
+
+// newManifestFile returns the last generated manifest as a virtual file.
+// The timestamps are those of the root directory.
+func (rfs *ReverseFS) newManifestFile() (nodefs.File, fuse.Status) {
+	content, _ := rfs.manifest.Load().([]byte)
+	return rfs.newVirtualFile(content, "", inoBaseManifest)
+}
+
+// addManifestEntry adds the manifest file to the root directory listing
+// "entries". With -plaintextnames, a real file of the same name is hidden.
+func (rfs *ReverseFS) addManifestEntry(entries []fuse.DirEntry) []fuse.DirEntry {
+	for i := range entries {
+		if entries[i].Name == manifestName {
+			tlog.Warn.Printf("The virtual file %q shadows a file of the same name in %q",
+				manifestName, rfs.args.Cipherdir)
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	return append(entries, fuse.DirEntry{Mode: virtualFileMode, Name: manifestName})
+}
+
+// UpdateManifest implements ctlsock.Interface. It walks the encrypted view
+// and replaces the content of the manifest file with the result. Files that
+// are opened while the walk runs still get the old content.
+func (rfs *ReverseFS) UpdateManifest() error {
+	if !rfs.args.Manifest {
+		return syscall.ENOTSUP
+	}
+	rfs.manifestUpdate.Lock()
+	defer rfs.manifestUpdate.Unlock()
+	start := time.Now()
+	var buf bytes.Buffer
+	n, errors := rfs.manifestDir("", json.NewEncoder(&buf))
+	rfs.manifest.Store(buf.Bytes())
+	tlog.Info.Printf("manifest: %d entries (%d errors) in %v", n, errors, time.Since(start))
+	return nil
+}
+
+// manifestDir appends the entries of directory "cDir", recursively, to "enc".
+// It returns the number of entries and how many of them have an error.
+func (rfs *ReverseFS) manifestDir(cDir string, enc *json.Encoder) (n int, errors int) {
+	entries, status := rfs.OpenDir(cDir, nil)
+	if !status.Ok() {
+		enc.Encode(manifestEntry{Path: cDir, ErrText: status.String()})
+		return 1, 1
+	}
+	// Sorted, so that unchanged trees produce identical manifests
+	sort.Sort(byName(entries))
+	for _, e := range entries {
+		cPath := filepath.Join(cDir, e.Name)
+		if rfs.isManifest(cPath) {
+			continue
+		}
+		me := rfs.manifestFile(cPath)
+		enc.Encode(me)
+		n++
+		if me.ErrText != "" {
+			errors++
+		} else if me.Type == "dir" {
+			n2, errors2 := rfs.manifestDir(cPath, enc)
+			n += n2
+			errors += errors2
+		}
+	}
+	return n, errors
+}
+
+// manifestFile returns the manifest entry for ciphertext path "cPath". The
+// ciphertext of regular files is read in full to compute the hash.
+func (rfs *ReverseFS) manifestFile(cPath string) manifestEntry {
+	me := manifestEntry{Path: cPath}
+	a, status := rfs.GetAttr(cPath, nil)
+	if !status.Ok() {
+		me.ErrText = status.String()
+		return me
+	}
+	me.Type = ctlsock.DirEntryType(a.Mode)
+	me.Size = a.Size
+	me.Mtime = time.Unix(int64(a.Mtime), int64(a.Mtimensec)).UTC()
+	if !a.IsRegular() {
+		return me
+	}
+	f, status := rfs.Open(cPath, syscall.O_RDONLY, nil)
+	if !status.Ok() {
+		me.ErrText = status.String()
+		return me
+	}
+	defer f.Release()
+	h := sha256.New()
+	buf := make([]byte, manifestReadSize)
+	for off := int64(0); ; {
+		res, status := f.Read(buf, off)
+		if !status.Ok() {
+			me.ErrText = status.String()
+			return me
+		}
+		if res == nil {
+			break
+		}
+		data, status := res.Bytes(buf)
+		res.Done()
+		if !status.Ok() {
+			me.ErrText = status.String()
+			return me
+		}
+		if len(data) == 0 {
+			break
+		}
+		h.Write(data)
+		off += int64(len(data))
+	}
+	me.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return me
+}
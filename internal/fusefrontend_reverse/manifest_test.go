@@ -0,0 +1,147 @@
+package fusefrontend_reverse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/simonhorlick/gocryptfs/internal/contentenc"
+	"github.com/simonhorlick/gocryptfs/internal/cryptocore"
+	"github.com/simonhorlick/gocryptfs/internal/nametransform"
+)
+
+// newManifestFS returns a ReverseFS with -manifest and -plaintextnames, so
+// that we do not have to encrypt the paths
+func newManifestFS(dir string) *ReverseFS {
+	key := make([]byte, cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendAESSIV, contentenc.DefaultIVBits, true, false)
+	rfs := &ReverseFS{}
+	rfs.args.Cipherdir = dir
+	rfs.args.PlaintextNames = true
+	rfs.args.Manifest = true
+	rfs.nameTransform = nametransform.New(cCore.EMECipher, true, true)
+	rfs.contentEnc = contentenc.New(cCore, contentenc.DefaultBS, false)
+	return rfs
+}
+
+// readAll reads "relPath" through rfs.Open
+func readAll(t *testing.T, rfs *ReverseFS, relPath string) []byte {
+	f, status := rfs.Open(relPath, 0, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	buf := make([]byte, 100000)
+	res, status := f.Read(buf, 0)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if res == nil {
+		return nil
+	}
+	data, _ := res.Bytes(buf)
+	return data
+}
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.Mkdir(dir+"/sub", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"/a", "/sub/b"} {
+		err = ioutil.WriteFile(dir+f, []byte("hello"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rfs := newManifestFS(dir)
+
+	err = rfs.UpdateManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, status := rfs.OpenDir("", nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	found := false
+	for _, e := range entries {
+		found = found || e.Name == manifestName
+	}
+	if !found {
+		t.Errorf("%s is not listed: %v", manifestName, entries)
+	}
+	a, status := rfs.GetAttr(manifestName, nil)
+	if !status.Ok() || !a.IsRegular() {
+		t.Fatalf("GetAttr: %v %v", a, status)
+	}
+
+	var got []manifestEntry
+	scanner := bufio.NewScanner(bytes.NewReader(readAll(t, rfs, manifestName)))
+	for scanner.Scan() {
+		var me manifestEntry
+		err = json.Unmarshal(scanner.Bytes(), &me)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, me)
+	}
+	if len(got) != 3 || got[0].Path != "a" || got[1].Path != "sub" || got[2].Path != "sub/b" {
+		t.Fatalf("wrong manifest: %+v", got)
+	}
+	cipher := readAll(t, rfs, "a")
+	hash := sha256.Sum256(cipher)
+	if got[0].Type != "file" || got[0].Size != uint64(len(cipher)) || got[0].SHA256 != hex.EncodeToString(hash[:]) {
+		t.Errorf("wrong entry: %+v", got[0])
+	}
+	if got[1].Type != "dir" || got[1].SHA256 != "" {
+		t.Errorf("wrong entry: %+v", got[1])
+	}
+	// Same plaintext, but the file IVs differ
+	if got[0].SHA256 == got[2].SHA256 {
+		t.Error("different files should not have the same hash")
+	}
+}
+
+// A file that changes while it is open fails with EIO
+func TestManifestChangedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestManifestChangedFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(dir+"/a", []byte("hello"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rfs := newManifestFS(dir)
+
+	f, status := rfs.Open("a", 0, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	buf := make([]byte, 100)
+	if _, status = f.Read(buf, 0); !status.Ok() {
+		t.Fatal(status)
+	}
+	err = ioutil.WriteFile(dir+"/a", []byte("hello world"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, status = f.Read(buf, 0); status != fuse.EIO {
+		t.Errorf("want EIO, got %v", status)
+	}
+}
@@ -0,0 +1,243 @@
+package fusefrontend_reverse
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/simonhorlick/gocryptfs/internal/syscallcompat"
+	"github.com/simonhorlick/gocryptfs/internal/tlog"
+)
+
+// maxFollow is the number of symlinks that may be followed in a single path.
+// It stops symlink loops that the ancestor check in followTarget cannot see.
+const maxFollow = 8
+
+// devIno identifies a backing file across filesystems. Inode numbers are only
+// unique per device.
+type devIno struct {
+	Dev uint64
+	Ino uint64
+}
+
+// initMounts sets up -one-file-system and -follow-symlinks. Both work
+// relative to the devices of the backing directory and of the
+// -follow-symlinks directories.
+func (rfs *ReverseFS) initMounts() error {
+	var err error
+	rfs.realCipherdir, err = filepath.EvalSymlinks(rfs.args.Cipherdir)
+	if err != nil {
+		return err
+	}
+	var st syscall.Stat_t
+	err = syscall.Stat(rfs.realCipherdir, &st)
+	if err != nil {
+		return err
+	}
+	rfs.rootDev = uint64(st.Dev)
+	rfs.devs = map[uint64]bool{rfs.rootDev: true}
+	for _, d := range rfs.args.FollowSymlinks {
+		err = syscall.Stat(d, &st)
+		if err != nil {
+			return err
+		}
+		rfs.devs[uint64(st.Dev)] = true
+	}
+	return nil
+}
+
+// checkParentDev implements -one-file-system: everything below a mount point
+// is hidden. The mount point itself stays visible as an empty directory, see
+// readDir. "dirfd" is the directory that contains the object.
+func (rfs *ReverseFS) checkParentDev(dirfd int) error {
+	if !rfs.args.OneFileSystem {
+		return nil
+	}
+	var st syscall.Stat_t
+	err := syscall.Fstat(dirfd, &st)
+	if err != nil {
+		return err
+	}
+	if !rfs.devs[uint64(st.Dev)] {
+		return syscall.ENOENT
+	}
+	return nil
+}
+
+// mapIno returns the inode number we report for backing inode "ino" on
+// device "dev". Inode numbers on the device of the backing directory are
+// passed through. Those on other devices, which may collide with them, are
+// mapped into the range starting at inoBaseForeign.
+func (rfs *ReverseFS) mapIno(dev uint64, ino uint64) (uint64, error) {
+	if dev == rfs.rootDev {
+		// Instead of risking an inode number collision, we return an error.
+		if ino > inoBaseMin {
+			return 0, syscall.EOVERFLOW
+		}
+		return ino, nil
+	}
+	rfs.foreignInosLock.Lock()
+	defer rfs.foreignInosLock.Unlock()
+	if rfs.foreignInos == nil {
+		rfs.foreignInos = make(map[devIno]uint64)
+	}
+	key := devIno{dev, ino}
+	mapped, found := rfs.foreignInos[key]
+	if !found {
+		mapped = inoBaseForeign + uint64(len(rfs.foreignInos)) + 1
+		rfs.foreignInos[key] = mapped
+	}
+	return mapped, nil
+}
+
+// openDir opens the plaintext directory "pRelPath" and returns an O_PATH fd,
+// like syscallcompat.OpenDirNofollow. Symlinks to directories inside one of
+// the -follow-symlinks directories are followed.
+func (rfs *ReverseFS) openDir(pRelPath string) (int, error) {
+	fd, _, err := rfs.openDirReal(pRelPath)
+	return fd, err
+}
+
+// openDirReal is openDir, and also returns the real absolute path of the
+// directory, which is needed to resolve relative symlinks inside it.
+func (rfs *ReverseFS) openDirReal(pRelPath string) (dirfd int, realDir string, err error) {
+	if len(rfs.args.FollowSymlinks) == 0 {
+		dirfd, err = syscallcompat.OpenDirNofollow(rfs.args.Cipherdir, pRelPath)
+		return dirfd, "", err
+	}
+	dirfd, err = syscallcompat.OpenDirNofollow(rfs.args.Cipherdir, "")
+	if err != nil {
+		return -1, "", err
+	}
+	realDir = rfs.realCipherdir
+	if pRelPath == "" {
+		return dirfd, realDir, nil
+	}
+	followed := 0
+	for _, name := range strings.Split(pRelPath, "/") {
+		fd, err := syscallcompat.Openat(dirfd, name, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+		if err == nil {
+			realDir = filepath.Join(realDir, name)
+		} else {
+			base, rel, ok := rfs.followTarget(dirfd, realDir, name)
+			if !ok {
+				syscall.Close(dirfd)
+				return -1, "", err
+			}
+			followed++
+			if followed > maxFollow {
+				syscall.Close(dirfd)
+				return -1, "", syscall.ELOOP
+			}
+			// Walk down from the -follow-symlinks directory, so that we
+			// cannot be redirected by a concurrent symlink change
+			fd, err = syscallcompat.OpenDirNofollow(base, rel)
+			if err != nil {
+				syscall.Close(dirfd)
+				return -1, "", err
+			}
+			realDir = filepath.Join(base, rel)
+		}
+		syscall.Close(dirfd)
+		dirfd = fd
+	}
+	return dirfd, realDir, nil
+}
+
+// followTarget checks if the symlink "name" in the directory "dirfd", whose
+// real path is "realDir", may be followed. This is the case if it resolves
+// to a directory inside one of the -follow-symlinks directories that is not
+// an ancestor of "realDir". The target is returned as the -follow-symlinks
+// directory "base" and the relative path "rel" below it.
+func (rfs *ReverseFS) followTarget(dirfd int, realDir string, name string) (base string, rel string, ok bool) {
+	target, err := syscallcompat.Readlinkat(dirfd, name)
+	if err != nil {
+		// Not a symlink
+		return "", "", false
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(realDir, target)
+	}
+	resolved, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return "", "", false
+	}
+	if fi, err := os.Stat(resolved); err != nil || !fi.IsDir() {
+		return "", "", false
+	}
+	if resolved == realDir || strings.HasPrefix(realDir, resolved+"/") {
+		tlog.Debug.Printf("followTarget: not following %q, %q is an ancestor", name, resolved)
+		return "", "", false
+	}
+	for _, d := range rfs.args.FollowSymlinks {
+		if resolved == d {
+			return d, "", true
+		}
+		if strings.HasPrefix(resolved, d+"/") {
+			return d, resolved[len(d)+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// followStat replaces "st", the Lstat result of the symlink "pRelPath", with
+// the attributes of the directory it points to if -follow-symlinks allows
+// following it.
+func (rfs *ReverseFS) followStat(pRelPath string, st *unix.Stat_t) {
+	fd, err := rfs.openDir(pRelPath)
+	if err != nil {
+		return
+	}
+	defer syscall.Close(fd)
+	var st2 unix.Stat_t
+	if err = unix.Fstat(fd, &st2); err == nil {
+		*st = st2
+	}
+}
+
+// readDir returns the entries of the plaintext directory "pRelPath". With
+// -one-file-system, a directory on another filesystem is empty. Symlinks that
+// -follow-symlinks allows are listed as directories.
+func (rfs *ReverseFS) readDir(pRelPath string) ([]fuse.DirEntry, error) {
+	dirfd, realDir, err := rfs.openDirReal(pRelPath)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dirfd)
+	fd, err := syscallcompat.Openat(dirfd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	if rfs.args.OneFileSystem {
+		var st syscall.Stat_t
+		err = syscall.Fstat(fd, &st)
+		if err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+		if !rfs.devs[uint64(st.Dev)] {
+			tlog.Debug.Printf("readDir %q: mount point, not crossing into dev %d", pRelPath, st.Dev)
+			syscall.Close(fd)
+			return nil, nil
+		}
+	}
+	entries, err := syscallcompat.Getdents(fd)
+	syscall.Close(fd)
+	if err != nil || len(rfs.args.FollowSymlinks) == 0 {
+		return entries, err
+	}
+	for i := range entries {
+		if entries[i].Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			continue
+		}
+		if _, _, ok := rfs.followTarget(dirfd, realDir, entries[i].Name); ok {
+			entries[i].Mode = syscall.S_IFDIR
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,84 @@
+package fusefrontend_reverse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestMapIno(t *testing.T) {
+	rfs := &ReverseFS{rootDev: 1}
+	if ino, err := rfs.mapIno(1, 5); ino != 5 || err != nil {
+		t.Errorf("root device: got %d, %v", ino, err)
+	}
+	if _, err := rfs.mapIno(1, inoBaseMin+1); err != syscall.EOVERFLOW {
+		t.Errorf("want EOVERFLOW, got %v", err)
+	}
+	a, _ := rfs.mapIno(2, 5)
+	b, _ := rfs.mapIno(3, 5)
+	a2, _ := rfs.mapIno(2, 5)
+	if a == b || a != a2 || a <= inoBaseForeign {
+		t.Errorf("foreign devices: got %d %d %d", a, b, a2)
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestFollowSymlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// dir/plain is the backing directory, dir/data/sub is outside of it
+	for _, d := range []string{"/plain", "/data/sub", "/other"} {
+		if err = os.MkdirAll(dir+d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ioutil.WriteFile(dir+"/data/sub/file", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"/plain/data":      "../data",
+		"/plain/other":     dir + "/other",
+		"/data/sub/parent": "..",
+	} {
+		if err = os.Symlink(target, dir+link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rfs := &ReverseFS{}
+	rfs.args.Cipherdir = dir + "/plain"
+	rfs.args.FollowSymlinks = []string{dir + "/data"}
+	if err = rfs.initMounts(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := rfs.readDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		isDir := e.Mode&syscall.S_IFMT == syscall.S_IFDIR
+		if isDir != (e.Name == "data") {
+			t.Errorf("%q: wrong mode %o", e.Name, e.Mode)
+		}
+	}
+	entries, err = rfs.readDir("data/sub")
+	if err != nil || len(entries) != 2 {
+		t.Errorf("readDir through symlink: %v %v", entries, err)
+	}
+	// Only symlinks into dir/data are followed
+	if _, err = rfs.readDir("other"); err == nil {
+		t.Error("symlink outside of -follow-symlinks was followed")
+	}
+	// A symlink to an ancestor would create a loop
+	if _, err = rfs.readDir("data/sub/parent"); err == nil {
+		t.Error("symlink to ancestor was followed")
+	}
+}
@@ -14,7 +14,6 @@ import (
 
 	"github.com/simonhorlick/gocryptfs/internal/nametransform"
 	"github.com/simonhorlick/gocryptfs/internal/pathiv"
-	"github.com/simonhorlick/gocryptfs/internal/syscallcompat"
 	"github.com/simonhorlick/gocryptfs/internal/tlog"
 )
 
@@ -63,21 +62,9 @@ func (rfs *ReverseFS) findLongnameParent(dir string, dirIV []byte, longname stri
 	if hit != "" {
 		return hit, nil
 	}
-	dirfd, err := syscallcompat.OpenDirNofollow(rfs.args.Cipherdir, filepath.Dir(dir))
+	dirEntries, err := rfs.readDir(dir)
 	if err != nil {
-		tlog.Warn.Printf("findLongnameParent: OpenDirNofollow failed: %v\n", err)
-		return "", err
-	}
-	fd, err := syscallcompat.Openat(dirfd, filepath.Base(dir), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
-	syscall.Close(dirfd)
-	if err != nil {
-		tlog.Warn.Printf("findLongnameParent: Openat failed: %v\n", err)
-		return "", err
-	}
-	dirEntries, err := syscallcompat.Getdents(fd)
-	syscall.Close(fd)
-	if err != nil {
-		tlog.Warn.Printf("findLongnameParent: Getdents failed: %v\n", err)
+		tlog.Warn.Printf("findLongnameParent: readDir failed: %v\n", err)
 		return "", err
 	}
 	longnameCacheLock.Lock()
@@ -122,5 +109,5 @@ func (rfs *ReverseFS) newNameFile(relPath string) (nodefs.File, fuse.Status) {
 	}
 	content := []byte(rfs.nameTransform.EncryptName(pName, dirIV))
 	parentFile := filepath.Join(pDir, pName)
-	return rfs.newVirtualFile(content, rfs.args.Cipherdir, parentFile, inoBaseNameFile)
+	return rfs.newVirtualFile(content, parentFile, inoBaseNameFile)
 }
@@ -2,9 +2,11 @@ package fusefrontend_reverse
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 
 	// In newer Go versions, this has moved to just "sync/syncmap".
@@ -30,10 +32,33 @@ type reverseFile struct {
 	block0IV []byte
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// Attributes of the backing file at open time. Size and mtime are used
+	// to detect changes while the file is being read.
+	openAttr fuse.Attr
+	// strict makes reads fail with EIO once the backing file has changed
+	// ("-manifest"). Otherwise we only warn.
+	strict     bool
+	changeWarn sync.Once
 }
 
+// inodeTable maps the devIno of hard-linked files to their FileIVs
 var inodeTable syncmap.Map
 
+// stableIDPath returns the string that the file IVs are derived from with
+// -stableids, in place of the ciphertext path. The inode number and
+// generation are encrypted like a file name, so that the file ID in the
+// header does not reveal them.
+// Files on other devices than the backing directory (-cross-mounts,
+// -follow-symlinks) also include the device number, which is less stable.
+func (rfs *ReverseFS) stableIDPath(dev uint64, ino uint64, generation uint32) string {
+	iv := pathiv.Derive("", pathiv.PurposeStableID)
+	id := fmt.Sprintf("%d.%d", ino, generation)
+	if dev != rfs.rootDev {
+		id = fmt.Sprintf("%d.%s", dev, id)
+	}
+	return rfs.nameTransform.EncryptName(id, iv)
+}
+
 // newFile decrypts and opens the path "relPath" and returns a reverseFile
 // object. The backing file descriptor is always read-only.
 func (rfs *ReverseFS) newFile(relPath string) (*reverseFile, fuse.Status) {
@@ -48,8 +73,13 @@ func (rfs *ReverseFS) newFile(relPath string) (*reverseFile, fuse.Status) {
 		return nil, fuse.ToStatus(err)
 	}
 	dir := filepath.Dir(pRelPath)
-	dirfd, err := syscallcompat.OpenDirNofollow(rfs.args.Cipherdir, dir)
+	dirfd, err := rfs.openDir(dir)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	err = rfs.checkParentDev(dirfd)
 	if err != nil {
+		syscall.Close(dirfd)
 		return nil, fuse.ToStatus(err)
 	}
 	fd, err := syscallcompat.Openat(dirfd, filepath.Base(pRelPath), syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
@@ -72,11 +102,14 @@ func (rfs *ReverseFS) newFile(relPath string) (*reverseFile, fuse.Status) {
 		syscall.Close(fd)
 		return nil, fuse.ToStatus(syscall.EACCES)
 	}
-	// See if we have that inode number already in the table
-	// (even if Nlink has dropped to 1)
 	var derivedIVs pathiv.FileIVs
-	v, found := inodeTable.Load(st.Ino)
-	if found {
+	key := devIno{uint64(st.Dev), uint64(st.Ino)}
+	if rfs.args.StableIDs {
+		// All hard links share the inode, so no need for the inode table
+		derivedIVs = pathiv.DeriveFile(rfs.stableIDPath(key.Dev, key.Ino, syscallcompat.GetGeneration(fd)))
+	} else if v, found := inodeTable.Load(key); found {
+		// We have that inode number already in the table
+		// (even if Nlink has dropped to 1)
 		tlog.Debug.Printf("ino%d: newFile: found in the inode table", st.Ino)
 		derivedIVs = v.(pathiv.FileIVs)
 	} else {
@@ -86,12 +119,15 @@ func (rfs *ReverseFS) newFile(relPath string) (*reverseFile, fuse.Status) {
 		// regardless of the path that is used to access the file.
 		// This means that the first path wins.
 		if st.Nlink > 1 {
-			v, found = inodeTable.LoadOrStore(st.Ino, derivedIVs)
+			v, found := inodeTable.LoadOrStore(key, derivedIVs)
 			if found {
 				// Another thread has stored a different value before we could.
 				derivedIVs = v.(pathiv.FileIVs)
 			} else {
 				tlog.Debug.Printf("ino%d: newFile: Nlink=%d, stored in the inode table", st.Ino, st.Nlink)
+				if rfs.ivCache != nil {
+					rfs.ivCache.add(key, pRelPath, derivedIVs)
+				}
 			}
 		}
 	}
@@ -105,6 +141,8 @@ func (rfs *ReverseFS) newFile(relPath string) (*reverseFile, fuse.Status) {
 		header:     header,
 		block0IV:   derivedIVs.Block0IV,
 		contentEnc: rfs.contentEnc,
+		openAttr:   a,
+		strict:     rfs.args.Manifest,
 	}, fuse.OK
 }
 
@@ -202,10 +240,37 @@ func (rf *reverseFile) Read(buf []byte, ioff int64) (resultData fuse.ReadResult,
 		}
 		out.Write(fileData)
 	}
+	// Check after reading so that we also catch changes that raced with
+	// the read itself
+	if rf.changed() && rf.strict {
+		return nil, fuse.EIO
+	}
 
 	return fuse.ReadResultData(out.Bytes()), fuse.OK
 }
 
+// changed returns true if the size or the mtime of the backing file differ
+// from when it was opened. The ciphertext that has been read so far may then
+// not belong to a single version of the file. A warning is logged once.
+func (rf *reverseFile) changed() bool {
+	var st syscall.Stat_t
+	err := syscall.Fstat(int(rf.fd.Fd()), &st)
+	if err != nil {
+		tlog.Warn.Printf("reverseFile.changed: Fstat: %v", err)
+		return false
+	}
+	var a fuse.Attr
+	a.FromStat(&st)
+	if a.Size == rf.openAttr.Size && a.Mtime == rf.openAttr.Mtime && a.Mtimensec == rf.openAttr.Mtimensec {
+		return false
+	}
+	rf.changeWarn.Do(func() {
+		tlog.Warn.Printf("ino%d: file has changed while being read: size %d -> %d",
+			a.Ino, rf.openAttr.Size, a.Size)
+	})
+	return true
+}
+
 // Release - FUSE call, close file
 func (rf *reverseFile) Release() {
 	rf.fd.Close()
@@ -0,0 +1,60 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/simonhorlick/gocryptfs/internal/contentenc"
+	"github.com/simonhorlick/gocryptfs/internal/cryptocore"
+	"github.com/simonhorlick/gocryptfs/internal/nametransform"
+)
+
+// fileID opens "relPath" through newFile and returns the file ID
+func fileID(t *testing.T, rfs *ReverseFS, relPath string) []byte {
+	f, status := rfs.newFile(relPath)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	f.Release()
+	return f.header.ID
+}
+
+func TestStableIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestStableIDs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(dir+"/a", []byte("hello"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := make([]byte, cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendAESSIV, contentenc.DefaultIVBits, true, false)
+	var rfs ReverseFS
+	// With plaintext names, we do not have to encrypt the paths
+	rfs.args.Cipherdir = dir
+	rfs.args.PlaintextNames = true
+	rfs.nameTransform = nametransform.New(cCore.EMECipher, true, true)
+	rfs.contentEnc = contentenc.New(cCore, contentenc.DefaultBS, false)
+
+	id1 := fileID(t, &rfs, "a")
+	rfs.args.StableIDs = true
+	id2 := fileID(t, &rfs, "a")
+	if bytes.Equal(id1, id2) {
+		t.Error("StableIDs should change the file ID")
+	}
+	err = os.Rename(dir+"/a", dir+"/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id3 := fileID(t, &rfs, "b"); !bytes.Equal(id2, id3) {
+		t.Error("file ID changed on rename")
+	}
+	rfs.args.StableIDs = false
+	if id4 := fileID(t, &rfs, "b"); bytes.Equal(id1, id4) {
+		t.Error("without StableIDs, the file ID should change on rename")
+	}
+}
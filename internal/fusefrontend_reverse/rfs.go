@@ -5,6 +5,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -17,6 +19,7 @@ import (
 	"github.com/simonhorlick/gocryptfs/internal/contentenc"
 	"github.com/simonhorlick/gocryptfs/internal/cryptocore"
 	"github.com/simonhorlick/gocryptfs/internal/ctlsock"
+	"github.com/simonhorlick/gocryptfs/internal/exclude"
 	"github.com/simonhorlick/gocryptfs/internal/exitcodes"
 	"github.com/simonhorlick/gocryptfs/internal/fusefrontend"
 	"github.com/simonhorlick/gocryptfs/internal/nametransform"
@@ -41,6 +44,27 @@ type ReverseFS struct {
 	// Relative ciphertext paths to exclude (hide) from the user. Used by -exclude.
 	// With -plaintextnames, these are relative *plaintext* paths.
 	cExclude []string
+	// Gitignore-style patterns that are matched against the plaintext path.
+	// Used by -exclude-wildcard and -exclude-from. Nil if there are none.
+	excluder *exclude.Matcher
+	// ivCache persists the IVs of hard-linked files ("-ivcache"). Nil if
+	// disabled.
+	ivCache *ivCache
+	// manifest is the content of the virtual manifest file ("-manifest"),
+	// a []byte. manifestUpdate serializes UpdateManifest.
+	manifest       atomic.Value
+	manifestUpdate sync.Mutex
+	// realCipherdir is Cipherdir with all symlinks resolved
+	realCipherdir string
+	// rootDev is the device of the backing directory. devs contains it and
+	// the devices of the -follow-symlinks directories, which are the
+	// devices -one-file-system stays on.
+	rootDev uint64
+	devs    map[uint64]bool
+	// foreignInos maps the inode numbers on devices other than rootDev,
+	// see mapIno
+	foreignInos     map[devIno]uint64
+	foreignInosLock sync.Mutex
 }
 
 var _ pathfs.FileSystem = &ReverseFS{}
@@ -58,8 +82,18 @@ func NewFS(args fusefrontend.Args, c *contentenc.ContentEnc, n *nametransform.Na
 		nameTransform: n,
 		contentEnc:    c,
 	}
-	if len(args.Exclude) > 0 {
-		for _, dirty := range args.Exclude {
+	if err := fs.initMounts(); err != nil {
+		tlog.Fatal.Printf("Cannot access backing directory: %v", err)
+		os.Exit(exitcodes.CipherDir)
+	}
+	excludes := args.Exclude
+	if args.IVCache != "" && filepath.Dir(args.IVCache) == filepath.Clean(args.Cipherdir) {
+		// Hide the cache file like the config file
+		name := filepath.Base(args.IVCache)
+		excludes = append(excludes[:len(excludes):len(excludes)], name, name+".tmp")
+	}
+	if len(excludes) > 0 {
+		for _, dirty := range excludes {
 			clean := ctlsock.SanitizePath(dirty)
 			if clean != dirty {
 				tlog.Warn.Printf("-exclude: non-canonical path %q has been interpreted as %q", dirty, clean)
@@ -86,9 +120,50 @@ func NewFS(args fusefrontend.Args, c *contentenc.ContentEnc, n *nametransform.Na
 		}
 		tlog.Debug.Printf("-exclude: %v -> %v", fs.args.Exclude, fs.cExclude)
 	}
+	if len(args.ExcludeWildcard) > 0 || len(args.ExcludeFrom) > 0 {
+		// Patterns from files come first so the command line can override
+		// them
+		var patterns []string
+		for _, f := range args.ExcludeFrom {
+			lines, err := exclude.ReadFile(f)
+			if err != nil {
+				tlog.Fatal.Printf("-exclude-from: %v", err)
+				os.Exit(exitcodes.ExcludeError)
+			}
+			patterns = append(patterns, lines...)
+		}
+		patterns = append(patterns, args.ExcludeWildcard...)
+		m, err := exclude.New(patterns)
+		if err != nil {
+			tlog.Fatal.Printf("-exclude-wildcard: %v", err)
+			os.Exit(exitcodes.ExcludeError)
+		}
+		fs.excluder = m
+	}
+	if args.IVCache != "" {
+		if args.StableIDs {
+			tlog.Info.Printf("-ivcache: not needed, hard links always get the same IVs with StableIDs")
+		} else {
+			fs.ivCache = fs.loadIVCache(args.IVCache)
+		}
+	}
+	if args.Manifest {
+		fs.UpdateManifest()
+	}
 	return fs
 }
 
+// OnUnmount - FUSE call. Saves the IV cache.
+func (rfs *ReverseFS) OnUnmount() {
+	if rfs.ivCache == nil {
+		return
+	}
+	err := rfs.ivCache.save()
+	if err != nil {
+		tlog.Warn.Printf("ivcache: save failed: %v", err)
+	}
+}
+
 // relDir is identical to filepath.Dir excepts that it returns "" when
 // filepath.Dir would return ".".
 // In the FUSE API, the root directory is called "", and we actually want that.
@@ -101,8 +176,15 @@ func relDir(path string) string {
 }
 
 // isExcluded finds out if relative ciphertext path "relPath" is excluded
-// (used when -exclude is passed by the user)
+// (used when -exclude, -exclude-wildcard or -exclude-from is passed by the
+// user)
 func (rfs *ReverseFS) isExcluded(relPath string) bool {
+	return rfs.isExcludedCipher(relPath) || rfs.isExcludedPlain(relPath)
+}
+
+// isExcludedCipher matches "relPath" against the "-exclude" paths, which
+// have been encrypted in NewFS.
+func (rfs *ReverseFS) isExcludedCipher(relPath string) bool {
 	for _, e := range rfs.cExclude {
 		// If the root dir is excluded, everything is excluded.
 		if e == "" {
@@ -120,6 +202,35 @@ func (rfs *ReverseFS) isExcluded(relPath string) bool {
 	return false
 }
 
+// isExcludedPlain decrypts "relPath" and matches it against the
+// gitignore-style patterns. Virtual files share the fate of the file or
+// directory they belong to.
+func (rfs *ReverseFS) isExcludedPlain(relPath string) bool {
+	if rfs.excluder == nil || rfs.isTranslatedConfig(relPath) || rfs.isManifest(relPath) {
+		return false
+	}
+	if rfs.isDirIV(relPath) {
+		relPath = relDir(relPath)
+	} else if rfs.isNameFile(relPath) {
+		relPath = strings.TrimSuffix(relPath, nametransform.LongNameSuffix)
+	}
+	pPath, err := rfs.decryptPath(relPath)
+	if err != nil {
+		// The operation itself will fail
+		return false
+	}
+	return rfs.excluder.Excluded(pPath, func() bool {
+		dirfd, err := rfs.openDir(filepath.Dir(pPath))
+		if err != nil {
+			return false
+		}
+		defer syscall.Close(dirfd)
+		var st unix.Stat_t
+		err = syscallcompat.Fstatat(dirfd, filepath.Base(pPath), &st, unix.AT_SYMLINK_NOFOLLOW)
+		return err == nil && st.Mode&syscall.S_IFMT == syscall.S_IFDIR
+	})
+}
+
 // isDirIV determines if the path points to a gocryptfs.diriv file
 func (rfs *ReverseFS) isDirIV(relPath string) bool {
 	if rfs.args.PlaintextNames {
@@ -173,10 +284,14 @@ func (rfs *ReverseFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr
 		}
 		return &a, fuse.OK
 	}
-	// Handle virtual files (gocryptfs.diriv, *.name)
+	// Handle virtual files (gocryptfs.diriv, *.name, gocryptfs.manifest)
 	var f nodefs.File
 	var status fuse.Status
 	virtual := false
+	if rfs.isManifest(relPath) {
+		virtual = true
+		f, status = rfs.newManifestFile()
+	}
 	if rfs.isDirIV(relPath) {
 		virtual = true
 		f, status = rfs.newDirIVFile(relPath)
@@ -208,15 +323,21 @@ func (rfs *ReverseFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	// Instead of risking an inode number collision, we return an error.
-	if st.Ino > inoBaseMin {
+	if st.Mode&syscall.S_IFMT == syscall.S_IFLNK && len(rfs.args.FollowSymlinks) > 0 {
+		if pRelPath, err := rfs.decryptPath(relPath); err == nil {
+			rfs.followStat(pRelPath, &st)
+		}
+	}
+	ino, err := rfs.mapIno(uint64(st.Dev), uint64(st.Ino))
+	if err != nil {
 		tlog.Warn.Printf("GetAttr %q: backing file inode number %d crosses reserved space, max=%d. Returning EOVERFLOW.",
 			relPath, st.Ino, inoBaseMin)
-		return nil, fuse.ToStatus(syscall.EOVERFLOW)
+		return nil, fuse.ToStatus(err)
 	}
 	var a fuse.Attr
 	st2 := syscallcompat.Unix2syscall(st)
 	a.FromStat(&st2)
+	a.Ino = ino
 	// Calculate encrypted file size
 	if a.IsRegular() {
 		a.Size = rfs.contentEnc.PlainSizeToCipherSize(a.Size)
@@ -242,7 +363,7 @@ func (rfs *ReverseFS) Access(relPath string, mode uint32, context *fuse.Context)
 	if rfs.isExcluded(relPath) {
 		return fuse.ENOENT
 	}
-	if rfs.isTranslatedConfig(relPath) || rfs.isDirIV(relPath) || rfs.isNameFile(relPath) {
+	if rfs.isTranslatedConfig(relPath) || rfs.isDirIV(relPath) || rfs.isNameFile(relPath) || rfs.isManifest(relPath) {
 		// access(2) R_OK flag for checking if the file is readable, always 4 as defined in POSIX.
 		ROK := uint32(0x4)
 		// Virtual files can always be read and never written
@@ -268,6 +389,9 @@ func (rfs *ReverseFS) Open(relPath string, flags uint32, context *fuse.Context)
 	if rfs.isTranslatedConfig(relPath) {
 		return rfs.loopbackfs.Open(configfile.ConfReverseName, flags, context)
 	}
+	if rfs.isManifest(relPath) {
+		return rfs.newManifestFile()
+	}
 	if rfs.isDirIV(relPath) {
 		return rfs.newDirIVFile(relPath)
 	}
@@ -312,17 +436,7 @@ func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.
 		return nil, fuse.ToStatus(err)
 	}
 	// Read plaintext dir
-	dirfd, err := syscallcompat.OpenDirNofollow(rfs.args.Cipherdir, filepath.Dir(relPath))
-	if err != nil {
-		return nil, fuse.ToStatus(err)
-	}
-	fd, err := syscallcompat.Openat(dirfd, filepath.Base(relPath), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
-	syscall.Close(dirfd)
-	if err != nil {
-		return nil, fuse.ToStatus(err)
-	}
-	entries, err := syscallcompat.Getdents(fd)
-	syscall.Close(fd)
+	entries, err := rfs.readDir(relPath)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
@@ -333,6 +447,9 @@ func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.
 			return nil, status
 		}
 		entries = rfs.excludeDirEntries(cipherPath, entries)
+		if cipherPath == "" && rfs.args.Manifest {
+			entries = rfs.addManifestEntry(entries)
+		}
 		return entries, fuse.OK
 	}
 	// Allocate maximum possible number of virtual files.
@@ -372,6 +489,9 @@ func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.
 	entries = append(entries, virtualFiles[:nVirtual]...)
 	// Filter out excluded entries
 	entries = rfs.excludeDirEntries(cipherPath, entries)
+	if cipherPath == "" && rfs.args.Manifest {
+		entries = rfs.addManifestEntry(entries)
+	}
 	return entries, fuse.OK
 }
 
@@ -379,7 +499,7 @@ func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.
 // cDir is the relative ciphertext path to the directory these entries are
 // from.
 func (rfs *ReverseFS) excludeDirEntries(cDir string, entries []fuse.DirEntry) (filtered []fuse.DirEntry) {
-	if rfs.cExclude == nil {
+	if rfs.cExclude == nil && rfs.excluder == nil {
 		return entries
 	}
 	filtered = make([]fuse.DirEntry, 0, len(entries))
@@ -8,7 +8,6 @@ import (
 
 	"github.com/simonhorlick/gocryptfs/internal/nametransform"
 	"github.com/simonhorlick/gocryptfs/internal/pathiv"
-	"github.com/simonhorlick/gocryptfs/internal/syscallcompat"
 	"github.com/simonhorlick/gocryptfs/internal/tlog"
 )
 
@@ -100,6 +99,7 @@ func (rfs *ReverseFS) decryptPath(relPath string) (string, error) {
 // the directory that contains the target file/dir and returns the fd to
 // the directory and the decrypted name of the target file.
 // The fd/name pair is intended for use with fchownat and friends.
+// With -one-file-system, paths below a mount point fail with ENOENT.
 func (rfs *ReverseFS) openBackingDir(cRelPath string) (dirfd int, pName string, err error) {
 	// Decrypt relative path
 	pRelPath, err := rfs.decryptPath(cRelPath)
@@ -108,10 +108,15 @@ func (rfs *ReverseFS) openBackingDir(cRelPath string) (dirfd int, pName string,
 	}
 	// Open directory, safe against symlink races
 	pDir := filepath.Dir(pRelPath)
-	dirfd, err = syscallcompat.OpenDirNofollow(rfs.args.Cipherdir, pDir)
+	dirfd, err = rfs.openDir(pDir)
 	if err != nil {
 		return -1, "", err
 	}
+	err = rfs.checkParentDev(dirfd)
+	if err != nil {
+		syscall.Close(dirfd)
+		return -1, "", err
+	}
 	pName = filepath.Base(pRelPath)
 	return dirfd, pName, nil
 }
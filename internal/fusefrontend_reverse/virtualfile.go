@@ -17,18 +17,23 @@ import (
 )
 
 const (
-	// virtualFileMode is the mode to use for virtual files (gocryptfs.diriv and
-	// *.name). They are always readable, as stated in func Access
+	// virtualFileMode is the mode to use for virtual files (gocryptfs.diriv,
+	// *.name and gocryptfs.manifest). They are always readable, as stated in func Access
 	virtualFileMode = syscall.S_IFREG | 0444
 	// inoBaseDirIV is the start of the inode number range that is used
 	// for virtual gocryptfs.diriv files. inoBaseNameFile is the thing for
-	// *.name files.
+	// *.name files, and inoBaseManifest for gocryptfs.manifest.
+	// Inode numbers of files on other devices than the backing directory are
+	// mapped to inoBaseForeign and up (see mapIno). Their virtual files get
+	// the mapped number plus one of the values above.
 	// The value 10^19 is just below 2^60. A power of 10 has been chosen so the
 	// "ls -li" output (which is base-10) is easy to read.
 	// 10^19 is the largest power of 10 that is smaller than
 	// INT64_MAX (=UINT64_MAX/2). This avoids signedness issues.
 	inoBaseDirIV    = uint64(1000000000000000000)
 	inoBaseNameFile = uint64(2000000000000000000)
+	inoBaseManifest = uint64(3000000000000000000)
+	inoBaseForeign  = uint64(4000000000000000000)
 	// inoBaseMin marks the start of the inode number space that is
 	// reserved for virtual files. It is the lowest of the inoBaseXXX values
 	// above.
@@ -42,7 +47,7 @@ func (rfs *ReverseFS) newDirIVFile(cRelPath string) (nodefs.File, fuse.Status) {
 		return nil, fuse.ToStatus(err)
 	}
 	iv := pathiv.Derive(cDir, pathiv.PurposeDirIV)
-	return rfs.newVirtualFile(iv, rfs.args.Cipherdir, dir, inoBaseDirIV)
+	return rfs.newVirtualFile(iv, dir, inoBaseDirIV)
 }
 
 type virtualFile struct {
@@ -50,9 +55,9 @@ type virtualFile struct {
 	nodefs.File
 	// file content
 	content []byte
-	// backing directory
-	cipherdir string
-	// path to a parent file (relative to cipherdir)
+	// the filesystem the file belongs to
+	rfs *ReverseFS
+	// path to a parent file (relative to the backing directory)
 	parentFile string
 	// inode number of a virtual file is inode of parent file plus inoBase
 	inoBase uint64
@@ -60,17 +65,17 @@ type virtualFile struct {
 
 // newVirtualFile creates a new in-memory file that does not have a representation
 // on disk. "content" is the file content. Timestamps and file owner are copied
-// from "parentFile" (plaintext path relative to "cipherdir").
+// from "parentFile" (plaintext path relative to the backing directory).
 // For a "gocryptfs.diriv" file, you would use the parent directory as
 // "parentFile".
-func (rfs *ReverseFS) newVirtualFile(content []byte, cipherdir string, parentFile string, inoBase uint64) (nodefs.File, fuse.Status) {
+func (rfs *ReverseFS) newVirtualFile(content []byte, parentFile string, inoBase uint64) (nodefs.File, fuse.Status) {
 	if inoBase < inoBaseMin {
 		log.Panicf("BUG: virtual inode number base %d is below reserved space", inoBase)
 	}
 	return &virtualFile{
 		File:       nodefs.NewDefaultFile(),
 		content:    content,
-		cipherdir:  cipherdir,
+		rfs:        rfs,
 		parentFile: parentFile,
 		inoBase:    inoBase,
 	}, fuse.OK
@@ -91,7 +96,7 @@ func (f *virtualFile) Read(buf []byte, off int64) (resultData fuse.ReadResult, s
 // GetAttr - FUSE call
 func (f *virtualFile) GetAttr(a *fuse.Attr) fuse.Status {
 	dir := filepath.Dir(f.parentFile)
-	dirfd, err := syscallcompat.OpenDirNofollow(f.cipherdir, dir)
+	dirfd, err := f.rfs.openDir(dir)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
@@ -103,12 +108,16 @@ func (f *virtualFile) GetAttr(a *fuse.Attr) fuse.Status {
 		tlog.Debug.Printf("GetAttr: Fstatat %q: %v\n", f.parentFile, err)
 		return fuse.ToStatus(err)
 	}
-	if st.Ino > inoBaseMin {
+	if st.Mode&syscall.S_IFMT == syscall.S_IFLNK && len(f.rfs.args.FollowSymlinks) > 0 {
+		f.rfs.followStat(f.parentFile, &st)
+	}
+	ino, err := f.rfs.mapIno(uint64(st.Dev), uint64(st.Ino))
+	if err != nil {
 		tlog.Warn.Printf("virtualFile.GetAttr: parent file inode number %d crosses reserved space, max=%d. Returning EOVERFLOW.",
 			st.Ino, inoBaseMin)
-		return fuse.ToStatus(syscall.EOVERFLOW)
+		return fuse.ToStatus(err)
 	}
-	st.Ino = st.Ino + f.inoBase
+	st.Ino = ino + f.inoBase
 	st.Size = int64(len(f.content))
 	st.Mode = virtualFileMode
 	st.Nlink = 1
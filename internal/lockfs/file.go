@@ -0,0 +1,152 @@
+package lockfs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// file wraps an open file of the wrapped filesystem. Open files survive a
+// Lock/Unlock cycle: while locked, their operations fail with EACCES, except
+// for Flush and Release, which do not need the keys and must not fail so
+// that the kernel can close the file.
+type file struct {
+	nodefs.File
+	fs *FS
+}
+
+var _ nodefs.File = &file{} // Verify that interface is implemented.
+
+// InnerFile implements nodefs.File
+func (f *file) InnerFile() nodefs.File {
+	return f.File
+}
+
+// String implements nodefs.File
+func (f *file) String() string {
+	return fmt.Sprintf("lockfs.file(%s)", f.File.String())
+}
+
+// Read implements nodefs.File
+func (f *file) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	if !f.fs.enter() {
+		return nil, fuse.EACCES
+	}
+	defer f.fs.lock.RUnlock()
+	return f.File.Read(buf, off)
+}
+
+// Write implements nodefs.File
+func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
+	if !f.fs.enter() {
+		return 0, fuse.EACCES
+	}
+	defer f.fs.lock.RUnlock()
+	return f.File.Write(data, off)
+}
+
+// GetLk implements nodefs.File
+func (f *file) GetLk(owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) fuse.Status {
+	if !f.fs.enter() {
+		return fuse.EACCES
+	}
+	defer f.fs.lock.RUnlock()
+	return f.File.GetLk(owner, lk, flags, out)
+}
+
+// SetLk implements nodefs.File
+func (f *file) SetLk(owner uint64, lk *fuse.FileLock, flags uint32) fuse.Status {
+	if !f.fs.enter() {
+		return fuse.EACCES
+	}
+	defer f.fs.lock.RUnlock()
+	return f.File.SetLk(owner, lk, flags)
+}
+
+// SetLkw implements nodefs.File
+func (f *file) SetLkw(owner uint64, lk *fuse.FileLock, flags uint32) fuse.Status {
+	if !f.fs.enter() {
+		return fuse.EACCES
+	}
+	defer f.fs.lock.RUnlock()
+	return f.File.SetLkw(owner, lk, flags)
+}
+
+// Flush implements nodefs.File
+func (f *file) Flush() fuse.Status {
+	f.fs.lock.RLock()
+	defer f.fs.lock.RUnlock()
+	return f.File.Flush()
+}
+
+// Release implements nodefs.File
+func (f *file) Release() {
+	f.fs.lock.RLock()
+	defer f.fs.lock.RUnlock()
+	f.File.Release()
+}
+
+// Fsync implements nodefs.File
+func (f *file) Fsync(flags int) fuse.Status {
+	if !f.fs.enter() {
+		return fuse.EACCES
+	}
+	defer f.fs.lock.RUnlock()
+	return f.File.Fsync(flags)
+}
+
+// Truncate implements nodefs.File
+func (f *file) Truncate(size uint64) fuse.Status {
+	if !f.fs.enter() {
+		return fuse.EACCES
+	}
+	defer f.fs.lock.RUnlock()
+	return f.File.Truncate(size)
+}
+
+// GetAttr implements nodefs.File
+func (f *file) GetAttr(a *fuse.Attr) fuse.Status {
+	if !f.fs.enter() {
+		return fuse.EACCES
+	}
+	defer f.fs.lock.RUnlock()
+	return f.File.GetAttr(a)
+}
+
+// Chown implements nodefs.File
+func (f *file) Chown(uid uint32, gid uint32) fuse.Status {
+	if !f.fs.enter() {
+		return fuse.EACCES
+	}
+	defer f.fs.lock.RUnlock()
+	return f.File.Chown(uid, gid)
+}
+
+// Chmod implements nodefs.File
+func (f *file) Chmod(perms uint32) fuse.Status {
+	if !f.fs.enter() {
+		return fuse.EACCES
+	}
+	defer f.fs.lock.RUnlock()
+	return f.File.Chmod(perms)
+}
+
+// Utimens implements nodefs.File
+func (f *file) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	if !f.fs.enter() {
+		return fuse.EACCES
+	}
+	defer f.fs.lock.RUnlock()
+	return f.File.Utimens(atime, mtime)
+}
+
+// Allocate implements nodefs.File
+func (f *file) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	if !f.fs.enter() {
+		return fuse.EACCES
+	}
+	defer f.fs.lock.RUnlock()
+	return f.File.Allocate(off, size, mode)
+}
@@ -0,0 +1,361 @@
+// Package lockfs wraps a filesystem so that it can be locked through the
+// control socket. While the filesystem is locked, the keys are wiped from
+// memory and every operation fails with EACCES, but the mount stays alive.
+package lockfs
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/simonhorlick/gocryptfs/internal/ctlsock"
+)
+
+// Backend is implemented by fusefrontend[_reverse]
+type Backend interface {
+	pathfs.FileSystem
+	ctlsock.Interface
+}
+
+// FS is the lockable wrapper around a Backend
+type FS struct {
+	// FS is the wrapped filesystem
+	FS Backend
+	// lock is held for reading during every operation, and for writing
+	// while the keys are wiped or replaced.
+	lock   sync.RWMutex
+	locked bool
+}
+
+var _ Backend = &FS{} // Verify that interface is implemented.
+
+// New returns a new, unlocked FS that wraps "fs".
+func New(fs Backend) *FS {
+	return &FS{FS: fs}
+}
+
+// Lock waits for running operations to finish, then calls "wipe" to wipe the
+// keys. Until Unlock is called, all operations fail with EACCES.
+func (l *FS) Lock(wipe func()) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.locked {
+		return errors.New("already locked")
+	}
+	wipe()
+	l.locked = true
+	return nil
+}
+
+// Unlock calls "rekey" to put the keys back and resumes service if it
+// succeeds.
+func (l *FS) Unlock(rekey func() error) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.locked {
+		return errors.New("not locked")
+	}
+	err := rekey()
+	if err != nil {
+		return err
+	}
+	l.locked = false
+	return nil
+}
+
+// enter must be called at the start of every operation that may need the
+// keys. If it returns true, the caller must call l.lock.RUnlock() when done.
+func (l *FS) enter() bool {
+	l.lock.RLock()
+	if l.locked {
+		l.lock.RUnlock()
+		return false
+	}
+	return true
+}
+
+// wrapFile wraps a File returned by Open or Create. nodefs only looks at the
+// outermost nodefs.WithFlags, so that one has to stay on top.
+func (l *FS) wrapFile(f nodefs.File) nodefs.File {
+	if f == nil {
+		return nil
+	}
+	if wf, ok := f.(*nodefs.WithFlags); ok {
+		return &nodefs.WithFlags{
+			File:        &file{File: wf.File, fs: l},
+			FuseFlags:   wf.FuseFlags,
+			OpenFlags:   wf.OpenFlags,
+			Description: wf.Description,
+		}
+	}
+	return &file{File: f, fs: l}
+}
+
+// EncryptPath implements ctlsock.Interface
+func (l *FS) EncryptPath(plainPath string) (string, error) {
+	if !l.enter() {
+		return "", syscall.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.EncryptPath(plainPath)
+}
+
+// DecryptPath implements ctlsock.Interface
+func (l *FS) DecryptPath(cipherPath string) (string, error) {
+	if !l.enter() {
+		return "", syscall.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.DecryptPath(cipherPath)
+}
+
+// ListDir implements ctlsock.Interface
+func (l *FS) ListDir(cipherPath string, recursive bool) ([]ctlsock.DirEntry, error) {
+	if !l.enter() {
+		return nil, syscall.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.ListDir(cipherPath, recursive)
+}
+
+// UpdateManifest implements ctlsock.Interface
+func (l *FS) UpdateManifest() error {
+	if !l.enter() {
+		return syscall.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.UpdateManifest()
+}
+
+// Status implements ctlsock.Interface. It works also while locked.
+func (l *FS) Status() ctlsock.StatusStruct {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	st := l.FS.Status()
+	st.Locked = l.locked
+	return st
+}
+
+// String implements pathfs.FileSystem
+func (l *FS) String() string {
+	return l.FS.String()
+}
+
+// SetDebug implements pathfs.FileSystem
+func (l *FS) SetDebug(debug bool) {
+	l.FS.SetDebug(debug)
+}
+
+// OnMount implements pathfs.FileSystem
+func (l *FS) OnMount(nodeFs *pathfs.PathNodeFs) {
+	l.FS.OnMount(nodeFs)
+}
+
+// OnUnmount implements pathfs.FileSystem
+func (l *FS) OnUnmount() {
+	l.FS.OnUnmount()
+}
+
+// StatFs implements pathfs.FileSystem. It does not need the keys and cannot
+// return EACCES, so it works also while locked.
+func (l *FS) StatFs(name string) *fuse.StatfsOut {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.FS.StatFs(name)
+}
+
+// GetAttr implements pathfs.FileSystem
+func (l *FS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if !l.enter() {
+		return nil, fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.GetAttr(name, context)
+}
+
+// Chmod implements pathfs.FileSystem
+func (l *FS) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if !l.enter() {
+		return fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.Chmod(name, mode, context)
+}
+
+// Chown implements pathfs.FileSystem
+func (l *FS) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	if !l.enter() {
+		return fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.Chown(name, uid, gid, context)
+}
+
+// Utimens implements pathfs.FileSystem
+func (l *FS) Utimens(name string, Atime *time.Time, Mtime *time.Time, context *fuse.Context) fuse.Status {
+	if !l.enter() {
+		return fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.Utimens(name, Atime, Mtime, context)
+}
+
+// Truncate implements pathfs.FileSystem
+func (l *FS) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	if !l.enter() {
+		return fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.Truncate(name, size, context)
+}
+
+// Access implements pathfs.FileSystem
+func (l *FS) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if !l.enter() {
+		return fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.Access(name, mode, context)
+}
+
+// Link implements pathfs.FileSystem
+func (l *FS) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if !l.enter() {
+		return fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.Link(oldName, newName, context)
+}
+
+// Mkdir implements pathfs.FileSystem
+func (l *FS) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if !l.enter() {
+		return fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.Mkdir(name, mode, context)
+}
+
+// Mknod implements pathfs.FileSystem
+func (l *FS) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	if !l.enter() {
+		return fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.Mknod(name, mode, dev, context)
+}
+
+// Rename implements pathfs.FileSystem
+func (l *FS) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	if !l.enter() {
+		return fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.Rename(oldName, newName, context)
+}
+
+// Rmdir implements pathfs.FileSystem
+func (l *FS) Rmdir(name string, context *fuse.Context) fuse.Status {
+	if !l.enter() {
+		return fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.Rmdir(name, context)
+}
+
+// Unlink implements pathfs.FileSystem
+func (l *FS) Unlink(name string, context *fuse.Context) fuse.Status {
+	if !l.enter() {
+		return fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.Unlink(name, context)
+}
+
+// GetXAttr implements pathfs.FileSystem
+func (l *FS) GetXAttr(name string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	if !l.enter() {
+		return nil, fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.GetXAttr(name, attribute, context)
+}
+
+// ListXAttr implements pathfs.FileSystem
+func (l *FS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	if !l.enter() {
+		return nil, fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.ListXAttr(name, context)
+}
+
+// RemoveXAttr implements pathfs.FileSystem
+func (l *FS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	if !l.enter() {
+		return fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.RemoveXAttr(name, attr, context)
+}
+
+// SetXAttr implements pathfs.FileSystem
+func (l *FS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	if !l.enter() {
+		return fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.SetXAttr(name, attr, data, flags, context)
+}
+
+// Open implements pathfs.FileSystem
+func (l *FS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if !l.enter() {
+		return nil, fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	f, status := l.FS.Open(name, flags, context)
+	return l.wrapFile(f), status
+}
+
+// Create implements pathfs.FileSystem
+func (l *FS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if !l.enter() {
+		return nil, fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	f, status := l.FS.Create(name, flags, mode, context)
+	return l.wrapFile(f), status
+}
+
+// OpenDir implements pathfs.FileSystem
+func (l *FS) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if !l.enter() {
+		return nil, fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.OpenDir(name, context)
+}
+
+// Symlink implements pathfs.FileSystem
+func (l *FS) Symlink(target string, linkName string, context *fuse.Context) fuse.Status {
+	if !l.enter() {
+		return fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.Symlink(target, linkName, context)
+}
+
+// Readlink implements pathfs.FileSystem
+func (l *FS) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	if !l.enter() {
+		return "", fuse.EACCES
+	}
+	defer l.lock.RUnlock()
+	return l.FS.Readlink(name, context)
+}
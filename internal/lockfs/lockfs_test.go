@@ -0,0 +1,111 @@
+package lockfs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/simonhorlick/gocryptfs/internal/ctlsock"
+)
+
+type fakeBackend struct {
+	pathfs.FileSystem
+}
+
+func (fs *fakeBackend) EncryptPath(p string) (string, error) {
+	return p, nil
+}
+
+func (fs *fakeBackend) DecryptPath(p string) (string, error) {
+	return p, nil
+}
+
+func (fs *fakeBackend) Status() ctlsock.StatusStruct {
+	return ctlsock.StatusStruct{Cipherdir: "/cipher"}
+}
+
+func (fs *fakeBackend) ListDir(cipherPath string, recursive bool) ([]ctlsock.DirEntry, error) {
+	return nil, nil
+}
+
+func (fs *fakeBackend) UpdateManifest() error {
+	return nil
+}
+
+func (fs *fakeBackend) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	return &fuse.Attr{}, fuse.OK
+}
+
+func (fs *fakeBackend) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	return &nodefs.WithFlags{
+		File:      nodefs.NewDataFile([]byte("hello")),
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, fuse.OK
+}
+
+func TestLockUnlock(t *testing.T) {
+	l := New(&fakeBackend{pathfs.NewDefaultFileSystem()})
+	f, status := l.Open("foo", 0, nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	// nodefs must still see the flags
+	wf, ok := f.(*nodefs.WithFlags)
+	if !ok || wf.FuseFlags != fuse.FOPEN_DIRECT_IO {
+		t.Fatalf("flags lost: %#v", f)
+	}
+	buf := make([]byte, 10)
+	if _, status = wf.File.Read(buf, 0); !status.Ok() {
+		t.Fatal(status)
+	}
+
+	wiped := false
+	err := l.Lock(func() { wiped = true })
+	if err != nil || !wiped {
+		t.Fatalf("Lock: err=%v wiped=%v", err, wiped)
+	}
+	if l.Lock(func() {}) == nil {
+		t.Error("locking twice should fail")
+	}
+	if _, status = l.GetAttr("foo", nil); status != fuse.EACCES {
+		t.Errorf("GetAttr while locked: %v", status)
+	}
+	if _, err = l.EncryptPath("foo"); err == nil {
+		t.Error("EncryptPath while locked should fail")
+	}
+	if !l.Status().Locked {
+		t.Error("Status should report the lock")
+	}
+	// Open files are blocked as well, but can still be closed
+	if _, status = wf.File.Read(buf, 0); status != fuse.EACCES {
+		t.Errorf("Read while locked: %v", status)
+	}
+	if status = wf.File.Flush(); !status.Ok() {
+		t.Errorf("Flush while locked: %v", status)
+	}
+
+	// A failed unlock leaves the filesystem locked
+	err = l.Unlock(func() error { return errors.New("wrong password") })
+	if err == nil {
+		t.Fatal("Unlock should have failed")
+	}
+	if _, status = l.GetAttr("foo", nil); status != fuse.EACCES {
+		t.Errorf("GetAttr after failed unlock: %v", status)
+	}
+	err = l.Unlock(func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, status = l.GetAttr("foo", nil); !status.Ok() {
+		t.Errorf("GetAttr after unlock: %v", status)
+	}
+	if _, status = wf.File.Read(buf, 0); !status.Ok() {
+		t.Errorf("Read after unlock: %v", status)
+	}
+	if l.Unlock(func() error { return nil }) == nil {
+		t.Error("unlocking twice should fail")
+	}
+}
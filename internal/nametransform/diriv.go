@@ -39,6 +39,16 @@ func ReadDirIVAt(dirfd int) (iv []byte, err error) {
 // allZeroDirIV is preallocated to quickly check if the data read from disk is all zero
 var allZeroDirIV = make([]byte, DirIVLen)
 
+// InvalidDirIVError is returned by ReadDirIVAt if gocryptfs.diriv could be
+// read but has the wrong length or is all-zero.
+type InvalidDirIVError struct {
+	msg string
+}
+
+func (e *InvalidDirIVError) Error() string {
+	return e.msg
+}
+
 // fdReadDirIV reads and verifies the DirIV from an opened gocryptfs.diriv file.
 func fdReadDirIV(fd *os.File) (iv []byte, err error) {
 	// We want to detect if the file is bigger than DirIVLen, so
@@ -50,10 +60,10 @@ func fdReadDirIV(fd *os.File) (iv []byte, err error) {
 	}
 	iv = iv[0:n]
 	if len(iv) != DirIVLen {
-		return nil, fmt.Errorf("wanted %d bytes, got %d", DirIVLen, len(iv))
+		return nil, &InvalidDirIVError{fmt.Sprintf("wanted %d bytes, got %d", DirIVLen, len(iv))}
 	}
 	if bytes.Equal(iv, allZeroDirIV) {
-		return nil, fmt.Errorf("diriv is all-zero")
+		return nil, &InvalidDirIVError{"diriv is all-zero"}
 	}
 	return iv, nil
 }
@@ -34,6 +34,14 @@ func New(e *eme.EMECipher, longNames bool, raw64 bool) *NameTransform {
 	}
 }
 
+// SetEMECipher replaces the filename encryption key. Passing nil drops the
+// reference to the old key, after which the NameTransform cannot be used
+// until a new key is set. The caller must make sure that no filename is
+// encrypted or decrypted concurrently.
+func (n *NameTransform) SetEMECipher(e *eme.EMECipher) {
+	n.emeCipher = e
+}
+
 // DecryptName decrypts a base64-encoded encrypted filename "cipherName" using the
 // initialization vector "iv".
 func (n *NameTransform) DecryptName(cipherName string, iv []byte) (string, error) {
@@ -65,8 +65,15 @@ type Entry struct {
 	// ID is the file ID in the file header.
 	ID []byte
 	// IDLock must be taken before reading or writing the ID field in this struct,
-	// unless you have an exclusive lock on ContentLock.
+	// unless you have an exclusive lock on ContentLock. The same applies to
+	// Binding and Bound.
 	IDLock sync.Mutex
+	// Binding identifies the encrypted name of the file. Only used by
+	// filesystems in the integrity format, where block 0 is authenticated
+	// together with it.
+	Binding []byte
+	// Bound is set once block 0 has been verified against Binding.
+	Bound bool
 }
 
 // Register creates an open file table entry for "qi" (or incrementes the
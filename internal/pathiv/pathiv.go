@@ -20,6 +20,9 @@ const (
 	PurposeSymlinkIV Purpose = "SYMLINKIV"
 	// PurposeBlock0IV means the value will be used as the IV of ciphertext block #0.
 	PurposeBlock0IV Purpose = "BLOCK0IV"
+	// PurposeStableID means the value will be used as the IV for encrypting
+	// the stable identifier of a file (reverse mode with StableIDs)
+	PurposeStableID Purpose = "STABLEID"
 )
 
 // Derive derives an IV from an encrypted path by hashing it with sha256
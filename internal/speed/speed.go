@@ -12,6 +12,8 @@ import (
 	"log"
 	"testing"
 
+	"golang.org/x/crypto/chacha20poly1305"
+
 	"github.com/simonhorlick/gocryptfs/internal/prefer_openssl"
 	"github.com/simonhorlick/gocryptfs/internal/siv_aead"
 	"github.com/simonhorlick/gocryptfs/internal/stupidgcm"
@@ -27,9 +29,10 @@ func Run() {
 		{name: "AES-GCM-256-OpenSSL", f: bStupidGCM, preferred: prefer_openssl.PreferOpenSSL()},
 		{name: "AES-GCM-256-Go", f: bGoGCM, preferred: !prefer_openssl.PreferOpenSSL()},
 		{name: "AES-SIV-512-Go", f: bAESSIV, preferred: false},
+		{name: "XChaCha20-Poly1305-Go", f: bXChaCha20Poly1305, preferred: false},
 	}
 	for _, b := range bTable {
-		fmt.Printf("%-20s\t", b.name)
+		fmt.Printf("%-22s\t", b.name)
 		mbs := mbPerSec(testing.Benchmark(b.f))
 		if mbs > 0 {
 			fmt.Printf("%7.2f MB/s", mbs)
@@ -119,3 +122,21 @@ func bAESSIV(b *testing.B) {
 		gGCM.Seal(iv, iv, in, authData)
 	}
 }
+
+func bXChaCha20Poly1305(b *testing.B) {
+	key := randBytes(32)
+	authData := randBytes(24)
+	iv := randBytes(chacha20poly1305.NonceSizeX)
+	in := make([]byte, blockSize)
+	b.SetBytes(int64(len(in)))
+	c, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Encrypt and append to nonce
+		c.Seal(iv, iv, in, authData)
+	}
+}
@@ -27,3 +27,7 @@ func BenchmarkGoGCM(b *testing.B) {
 func BenchmarkAESSIV(b *testing.B) {
 	bAESSIV(b)
 }
+
+func BenchmarkXChaCha20Poly1305(b *testing.B) {
+	bXChaCha20Poly1305(b)
+}
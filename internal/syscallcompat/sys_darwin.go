@@ -128,3 +128,8 @@ func MkdiratUser(dirfd int, path string, mode uint32, context *fuse.Context) (er
 func Getdents(fd int) ([]fuse.DirEntry, error) {
 	return emulateGetdents(fd)
 }
+
+// GetGeneration returns 0. MacOS only reports st_gen to root.
+func GetGeneration(fd int) uint32 {
+	return 0
+}
@@ -6,6 +6,7 @@ import (
 	"runtime"
 	"sync"
 	"syscall"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 
@@ -195,3 +196,17 @@ func MkdiratUser(dirfd int, path string, mode uint32, context *fuse.Context) (er
 func Getdents(fd int) ([]fuse.DirEntry, error) {
 	return getdents(fd)
 }
+
+// _FS_IOC_GETVERSION is _IOR('v', 1, long). The size of "long" is part of
+// the request number.
+const _FS_IOC_GETVERSION = 0x80007601 | uint(unsafe.Sizeof(uintptr(0)))<<16
+
+// GetGeneration returns the inode generation number of the file "fd", or 0
+// if the filesystem does not support FS_IOC_GETVERSION.
+func GetGeneration(fd int) uint32 {
+	gen, err := unix.IoctlGetUint32(fd, _FS_IOC_GETVERSION)
+	if err != nil {
+		return 0
+	}
+	return gen
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/simonhorlick/gocryptfs/internal/configfile"
+	"github.com/simonhorlick/gocryptfs/internal/exitcodes"
+	"github.com/simonhorlick/gocryptfs/internal/readpassword"
+	"github.com/simonhorlick/gocryptfs/internal/tlog"
+)
+
+// addKeySlot implements "-addkey LABEL CIPHERDIR". It asks for an existing
+// password (or takes "-masterkey") and for the password of the new slot.
+// Does not return on error.
+func addKeySlot(args *argContainer) {
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagTrezor) {
+		tlog.Fatal.Printf("Key slots are not supported on Trezor-enabled filesystems.")
+		os.Exit(exitcodes.Usage)
+	}
+	masterkey, confFile, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	tlog.Info.Printf("Please enter the password for the new key slot %q.", args.addkey)
+	pw := readpassword.Twice(args.extpass, args.passfile)
+	readpassword.CheckTrailingGarbage()
+	err = confFile.AddKeySlot(args.addkey, masterkey, pw, args.scryptn)
+	for i := range pw {
+		pw[i] = 0
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.Usage)
+	}
+	err = confFile.WriteFile()
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Key slot %q added."+tlog.ColorReset, args.addkey)
+}
+
+// listKeySlots implements "-listkeys CIPHERDIR". Does not need a password.
+func listKeySlots(args *argContainer) {
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	fmt.Printf("%-20s %s\n", configfile.PrimaryKeySlotLabel, kdfSummary(&cf.ScryptObject, cf.Argon2Object))
+	for _, s := range cf.KeySlots {
+		fmt.Printf("%-20s %s\n", s.Label, kdfSummary(&s.ScryptObject, s.Argon2Object))
+	}
+}
+
+// kdfSummary describes the password hash of a key slot in one line.
+func kdfSummary(s *configfile.ScryptKDF, a *configfile.Argon2KDF) string {
+	if a != nil {
+		return fmt.Sprintf("argon2id m=%d t=%d p=%d", a.Memory, a.Time, a.Threads)
+	}
+	return fmt.Sprintf("scrypt N=%d", s.N)
+}
+
+// revokeKeySlot implements "-revokekey LABEL CIPHERDIR". To prove that the
+// user is allowed to manage the key slots, the master key must be unlocked
+// first, using the password of any slot or "-masterkey".
+// Does not return on error.
+func revokeKeySlot(args *argContainer) {
+	masterkey, confFile, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	readpassword.CheckTrailingGarbage()
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	err = confFile.RevokeKeySlot(args.revokekey)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.Usage)
+	}
+	err = confFile.WriteFile()
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Key slot %q revoked."+tlog.ColorReset, args.revokekey)
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/simonhorlick/gocryptfs/internal/configfile"
 	"github.com/simonhorlick/gocryptfs/internal/contentenc"
+	"github.com/simonhorlick/gocryptfs/internal/cryptocore"
 	"github.com/simonhorlick/gocryptfs/internal/exitcodes"
 	"github.com/simonhorlick/gocryptfs/internal/readpassword"
 	"github.com/simonhorlick/gocryptfs/internal/speed"
@@ -92,10 +93,19 @@ func changePassword(args *argContainer) {
 		if len(masterkey) == 0 {
 			log.Panic("empty masterkey")
 		}
-		tlog.Info.Println("Please enter your new password.")
+		// Change the password of the key slot the user has unlocked
+		slot := confFile.UnlockedKeySlot()
+		if slot != "" {
+			tlog.Info.Printf("Please enter your new password for key slot %q.", slot)
+		} else {
+			tlog.Info.Println("Please enter your new password.")
+		}
 		newPw := readpassword.Twice(args.extpass, args.passfile)
 		readpassword.CheckTrailingGarbage()
-		confFile.EncryptKey(masterkey, newPw, confFile.ScryptObject.LogN())
+		err = confFile.EncryptKeySlot(slot, masterkey, newPw, confFile.ScryptObject.LogN())
+		if err != nil {
+			log.Panic(err)
+		}
 		for i := range newPw {
 			newPw[i] = 0
 		}
@@ -165,7 +175,7 @@ func main() {
 	args := parseCliOpts()
 	// Fork a child into the background if "-fg" is not set AND we are mounting
 	// a filesystem. The child will do all the work.
-	if !args.fg && flagSet.NArg() == 2 {
+	if !args.fg && flagSet.NArg() == 2 && countOpFlags(&args) == 0 {
 		ret := forkChild()
 		os.Exit(ret)
 	}
@@ -189,6 +199,10 @@ func main() {
 		speed.Run()
 		os.Exit(0)
 	}
+	// "-selftest"
+	if args.selftest {
+		selfTest()
+	}
 	if args.wpanic {
 		tlog.Warn.Wpanic = true
 		tlog.Debug.Printf("Panicking on warnings")
@@ -205,6 +219,8 @@ func main() {
 		}
 		os.Exit(exitcodes.Usage)
 	}
+	// The master key in the config file is always encrypted with Go GCM
+	selfTestOrExit(cryptocore.BackendGoGCM)
 	// Check that CIPHERDIR exists
 	args.cipherdir, _ = filepath.Abs(flagSet.Arg(0))
 	err = isDir(args.cipherdir)
@@ -212,19 +228,86 @@ func main() {
 		tlog.Fatal.Printf("Invalid cipherdir: %v", err)
 		os.Exit(exitcodes.CipherDir)
 	}
-	// "-q"
-	if args.quiet {
+	// "-q". "-json" needs a stdout that only contains the report.
+	if args.quiet || args.json {
 		tlog.Info.Enabled = false
 	}
 	// "-reverse" implies "-aessiv"
 	if args.reverse {
 		args.aessiv = true
 	} else {
-		if args.exclude != nil {
-			tlog.Fatal.Printf("-exclude only works in reverse mode")
+		if args.exclude != nil || args.excludeWildcard != nil || args.excludeFrom != nil {
+			tlog.Fatal.Printf("-exclude, -exclude-wildcard and -exclude-from only work in reverse mode")
 			os.Exit(exitcodes.ExcludeError)
 		}
 	}
+	if args.xchacha && args.aessiv {
+		tlog.Fatal.Printf("-xchacha cannot be combined with -aessiv or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.stableids && !args.reverse {
+		tlog.Fatal.Printf("-stableids only works in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.ivcache && !args.reverse {
+		tlog.Fatal.Printf("-ivcache only works in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.manifest && !args.reverse {
+		tlog.Fatal.Printf("-manifest only works in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.repair && !args.fsck {
+		tlog.Fatal.Printf("-repair only works with -fsck")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.json && !args.fsck && !args.scrub {
+		tlog.Fatal.Printf("-json only works with -fsck or -scrub")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.fsckJobs != 1 || args.fsckCheckpoint != "" || args.fsckIncremental) && !args.fsck {
+		tlog.Fatal.Printf("-fsck-jobs, -fsck-checkpoint and -fsck-incremental only work with -fsck")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.fsckJobs < 1 {
+		tlog.Fatal.Printf("-fsck-jobs must be at least 1")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.fsckIncremental && args.fsckCheckpoint == "" {
+		tlog.Fatal.Printf("-fsck-incremental needs -fsck-checkpoint")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.fsckCheckpoint != "" {
+		args.fsckCheckpoint, _ = filepath.Abs(args.fsckCheckpoint)
+	}
+	if args.dryRun && !args.repair {
+		tlog.Fatal.Printf("-dry-run only works with -fsck -repair")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.crossMounts || args.followSymlinks != nil) && !args.reverse {
+		tlog.Fatal.Printf("-cross-mounts and -follow-symlinks only work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-follow-symlinks": the directories are compared against resolved
+	// symlink targets
+	for i, d := range args.followSymlinks {
+		d, err = filepath.Abs(d)
+		if err == nil {
+			d, err = filepath.EvalSymlinks(d)
+		}
+		if err == nil {
+			err = isDir(d)
+		}
+		if err != nil {
+			tlog.Fatal.Printf("Invalid -follow-symlinks directory: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		args.followSymlinks[i] = d
+	}
+	if args.integrity && (args.reverse || args.plaintextnames) {
+		tlog.Fatal.Printf("-integrity cannot be combined with -reverse or -plaintextnames")
+		os.Exit(exitcodes.Usage)
+	}
 	// "-config"
 	if args.config != "" {
 		args.config, err = filepath.Abs(args.config)
@@ -259,6 +342,14 @@ func main() {
 		}
 		args._forceOwner = &fuse.Owner{Uid: uint32(uidNum), Gid: uint32(gidNum)}
 	}
+	// "-blocksize"
+	if args.blocksize != "" {
+		args._blockSize, err = parseBlockSize(args.blocksize)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-blocksize\" setting: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	// "-cpuprofile"
 	if args.cpuprofile != "" {
 		onExitFunc := setupCpuprofile(args.cpuprofile)
@@ -299,11 +390,25 @@ func main() {
 		return
 	}
 	if nOps > 1 {
-		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck is allowed")
+		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck, -scrub, -extract, -cat, -import, -rekey, -addkey, -listkeys, -revokekey is allowed")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-extract", "-cat" and "-import" take additional arguments and check
+	// them themselves
+	if args.extract || args.cat {
+		extract(&args)
+		os.Exit(0)
+	}
+	if args.importDir {
+		importTree(&args)
+		os.Exit(0)
+	}
+	if args.rollback && !args.rekey {
+		tlog.Fatal.Printf("-rollback only works together with -rekey")
 		os.Exit(exitcodes.Usage)
 	}
 	if flagSet.NArg() != 1 {
-		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck take exactly one argument, %d given",
+		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck, -scrub, -rekey, -addkey, -listkeys, -revokekey take exactly one argument, %d given",
 			flagSet.NArg())
 		os.Exit(exitcodes.Usage)
 	}
@@ -327,4 +432,27 @@ func main() {
 		fsck(&args)
 		os.Exit(0)
 	}
+	// "-scrub"
+	if args.scrub {
+		scrub(&args)
+		os.Exit(0)
+	}
+	// "-rekey"
+	if args.rekey {
+		rekey(&args)
+		os.Exit(0)
+	}
+	// "-addkey", "-listkeys", "-revokekey"
+	if args.addkey != "" {
+		addKeySlot(&args)
+		os.Exit(0)
+	}
+	if args.listkeys {
+		listKeySlots(&args)
+		os.Exit(0)
+	}
+	if args.revokekey != "" {
+		revokeKeySlot(&args)
+		os.Exit(0)
+	}
 }
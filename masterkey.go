@@ -1,7 +1,11 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"os"
 	"strings"
 
@@ -15,14 +19,9 @@ import (
 // parseMasterKey - Parse a hex-encoded master key that was passed on the command line
 // Calls os.Exit on failure
 func parseMasterKey(masterkey string, fromStdin bool) []byte {
-	masterkey = strings.Replace(masterkey, "-", "", -1)
-	key, err := hex.DecodeString(masterkey)
+	key, err := decodeMasterKey(masterkey)
 	if err != nil {
-		tlog.Fatal.Printf("Could not parse master key: %v", err)
-		os.Exit(exitcodes.MasterKey)
-	}
-	if len(key) != cryptocore.KeyLen {
-		tlog.Fatal.Printf("Master key has length %d but we require length %d", len(key), cryptocore.KeyLen)
+		tlog.Fatal.Println(err)
 		os.Exit(exitcodes.MasterKey)
 	}
 	tlog.Info.Printf("Using explicit master key.")
@@ -34,6 +33,19 @@ func parseMasterKey(masterkey string, fromStdin bool) []byte {
 	return key
 }
 
+// decodeMasterKey parses a hex-encoded master key in the "-masterkey" format
+func decodeMasterKey(masterkey string) ([]byte, error) {
+	masterkey = strings.Replace(masterkey, "-", "", -1)
+	key, err := hex.DecodeString(masterkey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse master key: %v", err)
+	}
+	if len(key) != cryptocore.KeyLen {
+		return nil, fmt.Errorf("Master key has length %d but we require length %d", len(key), cryptocore.KeyLen)
+	}
+	return key, nil
+}
+
 // getMasterKey looks at "args" to determine where the master key should come
 // from (-masterkey=a-b-c-d or stdin or from the config file).
 // If it comes from the config file, the user is prompted for the password
@@ -74,3 +86,36 @@ func getMasterKey(args *argContainer) (masterkey []byte, confFile *configfile.Co
 	}
 	return masterkey, confFile
 }
+
+// unlockMasterKey returns the master key for the ctlsock "Unlock" request,
+// decoded from "masterkey" or, if that is empty, decrypted from the config
+// file using "password". "keyCheck" is the SHA256 hash of the key the
+// filesystem was mounted with. A different key is rejected, as it would
+// garble the filesystem.
+// Unlike getMasterKey, this function never prompts and never exits.
+func unlockMasterKey(args *argContainer, password []byte, masterkey string, keyCheck [sha256.Size]byte) (key []byte, err error) {
+	if masterkey != "" {
+		key, err = decodeMasterKey(masterkey)
+	} else {
+		var cf *configfile.ConfFile
+		cf, err = configfile.Load(args.config)
+		if err != nil {
+			return nil, err
+		}
+		if cf.IsFeatureFlagSet(configfile.FlagTrezor) {
+			return nil, errors.New("Trezor-enabled filesystems can only be unlocked using the master key")
+		}
+		key, err = cf.DecryptMasterKey(password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(key)
+	if subtle.ConstantTimeCompare(h[:], keyCheck[:]) != 1 {
+		for i := range key {
+			key[i] = 0
+		}
+		return nil, errors.New("this is not the master key of the mounted filesystem")
+	}
+	return key, nil
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"log/syslog"
-	"math"
 	"net"
 	"os"
 	"os/exec"
@@ -15,6 +16,7 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -30,6 +32,7 @@ import (
 	"github.com/simonhorlick/gocryptfs/internal/exitcodes"
 	"github.com/simonhorlick/gocryptfs/internal/fusefrontend"
 	"github.com/simonhorlick/gocryptfs/internal/fusefrontend_reverse"
+	"github.com/simonhorlick/gocryptfs/internal/lockfs"
 	"github.com/simonhorlick/gocryptfs/internal/nametransform"
 	"github.com/simonhorlick/gocryptfs/internal/openfiletable"
 	"github.com/simonhorlick/gocryptfs/internal/tlog"
@@ -74,6 +77,8 @@ func doMount(args *argContainer) {
 		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
 		os.Exit(exitcodes.MountPoint)
 	}
+	// Closed when ctlsock.Serve returns
+	var ctlsockDone chan struct{}
 	// Open control socket early so we can error out before asking the user
 	// for the password
 	if args.ctlsock != "" {
@@ -93,6 +98,13 @@ func doMount(args *argContainer) {
 			if err != nil {
 				tlog.Warn.Printf("ctlsock close: %v", err)
 			}
+			// Give ctlsock a chance to reply to an Unmount request
+			if ctlsockDone != nil {
+				select {
+				case <-ctlsockDone:
+				case <-time.After(time.Second):
+				}
+			}
 		}()
 	}
 	// We cannot use JSON for pretty-printing as the fields are unexported
@@ -103,6 +115,26 @@ func doMount(args *argContainer) {
 	srv := initGoFuse(fs, args)
 	// Try to wipe secret keys from memory after unmount
 	defer wipeKeys()
+	// The idle timeout can be changed through the control socket
+	idle := newIdleTimeout(args.idle)
+	if args._ctlsockFd != nil {
+		info := args._ctlsockInfo
+		info.Mountpoint = args.mountpoint
+		info.Started = time.Now()
+		info.Unmount = func(lazy bool, force bool) error {
+			return ctlsockUnmount(srv, args.mountpoint, lazy, force)
+		}
+		// -idle is ignored in reverse mode
+		if !args.reverse {
+			info.IdleTimeout = idle.get
+			info.SetIdleTimeout = idle.set
+		}
+		ctlsockDone = make(chan struct{})
+		go func() {
+			ctlsock.Serve(args._ctlsockFd, fs.(ctlsock.Interface), info)
+			close(ctlsockDone)
+		}()
+	}
 
 	tlog.Info.Println(tlog.ColorGreen + "Filesystem mounted and ready." + tlog.ColorReset)
 	// We have been forked into the background, as evidenced by the set
@@ -141,46 +173,92 @@ func doMount(args *argContainer) {
 	// Return memory that was allocated for scrypt (64M by default!) and other
 	// stuff that is no longer needed to the OS
 	debug.FreeOSMemory()
-	// Set up autounmount, if requested.
-	if args.idle > 0 && !args.reverse {
+	// Set up autounmount, if requested. With -ctlsock, it can also be
+	// requested later.
+	if (args.idle > 0 || args._ctlsockFd != nil) && !args.reverse {
 		// Not being in reverse mode means we always have a forward file system.
+		if lfs, ok := fs.(*lockfs.FS); ok {
+			fs = lfs.FS
+		}
 		fwdFs := fs.(*fusefrontend.FS)
-		go idleMonitor(args.idle, fwdFs, srv, args.mountpoint)
+		go idleMonitor(idle, fwdFs, srv, args.mountpoint)
 	}
 	// Jump into server loop. Returns when it gets an umount request from the kernel.
 	srv.Serve()
 }
 
+// idleTimeout holds the "-idle" duration. The control socket can change it
+// at runtime.
+type idleTimeout struct {
+	sync.Mutex
+	d time.Duration
+	// changed wakes up idleMonitor when d is changed
+	changed chan struct{}
+}
+
+func newIdleTimeout(d time.Duration) *idleTimeout {
+	return &idleTimeout{d: d, changed: make(chan struct{}, 1)}
+}
+
+func (i *idleTimeout) get() time.Duration {
+	i.Lock()
+	defer i.Unlock()
+	return i.d
+}
+
+func (i *idleTimeout) set(d time.Duration) error {
+	i.Lock()
+	i.d = d
+	i.Unlock()
+	select {
+	case i.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
 // Based on the EncFS idle monitor:
 // https://github.com/vgough/encfs/blob/1974b417af189a41ffae4c6feb011d2a0498e437/encfs/main.cpp#L851
 // idleMonitor is a function to be run as a thread that checks for
 // filesystem idleness and unmounts if we've been idle for long enough.
 const checksDuringTimeoutPeriod = 4
 
-func idleMonitor(idleTimeout time.Duration, fs *fusefrontend.FS, srv *fuse.Server, mountpoint string) {
-	sleepTimeBetweenChecks := contentenc.MinUint64(
-		uint64(idleTimeout/checksDuringTimeoutPeriod),
-		uint64(2*time.Minute))
-	timeoutCycles := int(math.Ceil(float64(idleTimeout) / float64(sleepTimeBetweenChecks)))
-	idleCount := 0
+func idleMonitor(idle *idleTimeout, fs *fusefrontend.FS, srv *fuse.Server, mountpoint string) {
+	// How long we have been idle
+	var idleFor time.Duration
 	for {
+		idleTimeout := idle.get()
+		if idleTimeout == 0 {
+			// Disabled. Wait until it is enabled through the control socket.
+			idleFor = 0
+			<-idle.changed
+			continue
+		}
+		sleepTimeBetweenChecks := time.Duration(contentenc.MinUint64(
+			uint64(idleTimeout/checksDuringTimeoutPeriod),
+			uint64(2*time.Minute)))
 		// Atomically check whether the access flag is set and reset it to 0 if so.
 		recentAccess := atomic.CompareAndSwapUint32(&fs.AccessedSinceLastCheck, 1, 0)
 		// Any form of current or recent access resets the idle counter.
 		openFileCount := openfiletable.CountOpenFiles()
 		if recentAccess || openFileCount > 0 {
-			idleCount = 0
-		} else {
-			idleCount++
+			idleFor = 0
 		}
 		tlog.Debug.Printf(
 			"Checking for idle (recentAccess = %t, open = %d): %s",
 			recentAccess, openFileCount, time.Now().String())
-		if idleCount > 0 && idleCount%timeoutCycles == 0 {
+		if idleFor >= idleTimeout {
 			tlog.Info.Printf("Filesystem idle; unmounting: %s", mountpoint)
 			unmount(srv, mountpoint)
+			idleFor = 0
+		}
+		select {
+		case <-time.After(sleepTimeBetweenChecks):
+			idleFor += sleepTimeBetweenChecks
+		case <-idle.changed:
+			// Start over with the new timeout
+			idleFor = 0
 		}
-		time.Sleep(time.Duration(sleepTimeBetweenChecks))
 	}
 }
 
@@ -214,6 +292,13 @@ type ctlsockFs interface {
 // initFuseFrontend - initialize gocryptfs/fusefrontend
 // Calls os.Exit on errors
 func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func()) {
+	// Half of the files may be encrypted with the new key
+	if !args.reverse && rekeyInProgress(args.cipherdir) {
+		tlog.Fatal.Printf("An interrupted -rekey run has been detected (%s exists). "+
+			"Run \"%s -rekey\" to complete it or \"%s -rekey -rollback\" to undo it.",
+			filepath.Join(args.cipherdir, configfile.RekeyDirName), tlog.ProgramName, tlog.ProgramName)
+		os.Exit(exitcodes.Rekey)
+	}
 	// Get master key (may prompt for the password) and read config file
 	masterkey, confFile := getMasterKey(args)
 	// Reconciliate CLI and config file arguments into a fusefrontend.Args struct
@@ -225,21 +310,38 @@ func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func(
 	if args.aessiv {
 		cryptoBackend = cryptocore.BackendAESSIV
 	}
+	if args.xchacha {
+		cryptoBackend = cryptocore.BackendXChaCha20Poly1305
+	}
+	var plainBS uint64 = contentenc.DefaultBS
+	if args._blockSize != 0 {
+		plainBS = args._blockSize
+	}
 	// forceOwner implies allow_other, as documented.
 	// Set this early, so args.allow_other can be relied on below this point.
 	if args._forceOwner != nil {
 		args.allow_other = true
 	}
 	frontendArgs := fusefrontend.Args{
-		Cipherdir:      args.cipherdir,
-		PlaintextNames: args.plaintextnames,
-		LongNames:      args.longnames,
-		ConfigCustom:   args._configCustom,
-		NoPrealloc:     args.noprealloc,
-		SerializeReads: args.serialize_reads,
-		ForceDecode:    args.forcedecode,
-		ForceOwner:     args._forceOwner,
-		Exclude:        args.exclude,
+		Cipherdir:       args.cipherdir,
+		PlaintextNames:  args.plaintextnames,
+		LongNames:       args.longnames,
+		ConfigCustom:    args._configCustom,
+		NoPrealloc:      args.noprealloc,
+		SerializeReads:  args.serialize_reads,
+		ForceDecode:     args.forcedecode,
+		ForceOwner:      args._forceOwner,
+		Exclude:         args.exclude,
+		ExcludeWildcard: args.excludeWildcard,
+		ExcludeFrom:     args.excludeFrom,
+		Integrity:       args.integrity,
+		StableIDs:       args.stableids,
+		Manifest:        args.manifest,
+		OneFileSystem:   args.oneFileSystem && !args.crossMounts,
+		FollowSymlinks:  args.followSymlinks,
+	}
+	if args.ivcache {
+		frontendArgs.IVCache = args.config + ".ivcache"
 	}
 	// confFile is nil when "-zerokey" or "-masterkey" was used
 	if confFile != nil {
@@ -247,12 +349,22 @@ func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func(
 		frontendArgs.PlaintextNames = confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames)
 		args.raw64 = confFile.IsFeatureFlagSet(configfile.FlagRaw64)
 		args.hkdf = confFile.IsFeatureFlagSet(configfile.FlagHKDF)
+		plainBS = confFile.PlainBS()
+		frontendArgs.Integrity = confFile.IsFeatureFlagSet(configfile.FlagIntegrity)
+		frontendArgs.StableIDs = confFile.IsFeatureFlagSet(configfile.FlagStableIDs)
+		if confFile.IsFeatureFlagSet(configfile.FlagXChaCha20Poly1305) {
+			cryptoBackend = cryptocore.BackendXChaCha20Poly1305
+		}
 		if confFile.IsFeatureFlagSet(configfile.FlagAESSIV) {
 			cryptoBackend = cryptocore.BackendAESSIV
 		} else if args.reverse {
 			tlog.Fatal.Printf("AES-SIV is required by reverse mode, but not enabled in the config file")
 			os.Exit(exitcodes.Usage)
 		}
+		if frontendArgs.Integrity && args.reverse {
+			tlog.Fatal.Printf("Reverse mode does not support the integrity format")
+			os.Exit(exitcodes.Usage)
+		}
 	}
 	// If allow_other is set and we run as root, try to give newly created files to
 	// the right user.
@@ -263,9 +375,16 @@ func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func(
 	tlog.Debug.Printf("frontendArgs: %s", string(jsonBytes))
 
 	// Init crypto backend
-	cCore := cryptocore.New(masterkey, cryptoBackend, contentenc.DefaultIVBits, args.hkdf, args.forcedecode)
-	cEnc := contentenc.New(cCore, contentenc.DefaultBS, args.forcedecode)
+	IVBits := contentenc.DefaultIVBits
+	if cryptoBackend == cryptocore.BackendXChaCha20Poly1305 {
+		IVBits = contentenc.XChaCha20Poly1305IVBits
+	}
+	selfTestOrExit(cryptoBackend)
+	cCore := cryptocore.New(masterkey, cryptoBackend, IVBits, args.hkdf, args.forcedecode)
+	cEnc := contentenc.New(cCore, plainBS, args.forcedecode)
 	nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames, args.raw64)
+	// Lets the ctlsock "Unlock" request check that it got the right key
+	keyCheck := sha256.Sum256(masterkey)
 	// After the crypto backend is initialized,
 	// we can purge the master key from memory.
 	for i := range masterkey {
@@ -283,12 +402,45 @@ func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func(
 	} else {
 		fs = fusefrontend.NewFS(frontendArgs, cEnc, nameTransform)
 	}
-	// We have opened the socket early so that we cannot fail here after
-	// asking the user for the password
-	if args._ctlsockFd != nil {
-		go ctlsock.Serve(args._ctlsockFd, fs)
+	// nameTransform keeps its own reference to the EME cipher
+	wipeKeys = func() {
+		cCore.Wipe()
+		nameTransform.SetEMECipher(nil)
+	}
+	if args._ctlsockFd == nil {
+		return fs, wipeKeys
+	}
+	// The control socket can wipe the keys and put them back, so we wrap the
+	// filesystem to block all operations while the keys are gone.
+	// doMount fills in the rest of the MountInfo and starts ctlsock.Serve.
+	lfs := lockfs.New(fs)
+	info := ctlsock.MountInfo{
+		Lock: func() error {
+			return lfs.Lock(wipeKeys)
+		},
+		Unlock: func(password []byte, masterkey string) error {
+			return lfs.Unlock(func() error {
+				key, err := unlockMasterKey(args, password, masterkey, keyCheck)
+				if err != nil {
+					return err
+				}
+				cCore = cryptocore.New(key, cryptoBackend, IVBits, args.hkdf, args.forcedecode)
+				for i := range key {
+					key[i] = 0
+				}
+				cEnc.SetCryptoCore(cCore)
+				nameTransform.SetEMECipher(cCore.EMECipher)
+				return nil
+			})
+		},
+	}
+	if confFile != nil {
+		info.FeatureFlags = confFile.FeatureFlags
 	}
-	return fs, func() { cCore.Wipe() }
+	args._ctlsockInfo = info
+	// Wipe through lfs so we cannot race with an Unlock request. Lock fails
+	// if the keys are already gone, which is fine.
+	return lfs, func() { lfs.Lock(wipeKeys) }
 }
 
 func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
@@ -428,6 +580,32 @@ func handleSigint(srv *fuse.Server, mountpoint string) {
 	}()
 }
 
+// ctlsockUnmount implements the ctlsock "Unmount" request. Open files are
+// only tracked in forward mode.
+func ctlsockUnmount(srv *fuse.Server, mountpoint string, lazy bool, force bool) error {
+	if n := openfiletable.CountOpenFiles(); n > 0 && !force {
+		tlog.Info.Printf("ctlsock: not unmounting, %d files are open", n)
+		return &os.PathError{Op: "unmount", Path: mountpoint, Err: syscall.EBUSY}
+	}
+	tlog.Info.Printf("ctlsock: unmounting %s", mountpoint)
+	if lazy {
+		if runtime.GOOS != "linux" {
+			return errors.New("lazy unmount is only supported on Linux")
+		}
+		out, err := exec.Command("fusermount", "-u", "-z", mountpoint).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("fusermount: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	if force {
+		// Falls back to a lazy unmount if the mount is busy
+		unmount(srv, mountpoint)
+		return nil
+	}
+	return srv.Unmount()
+}
+
 func unmount(srv *fuse.Server, mountpoint string) {
 	err := srv.Unmount()
 	if err != nil {
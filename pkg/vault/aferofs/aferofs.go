@@ -0,0 +1,304 @@
+// Package aferofs makes a gocryptfs Vault usable as a github.com/spf13/afero
+// filesystem.
+//
+// It lives in its own package so that pkg/vault does not depend on afero.
+// Like the Vault it wraps, it never follows symlinks: Stat and Lstat both
+// describe the symlink itself, and opening a symlink fails.
+package aferofs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/simonhorlick/gocryptfs/pkg/vault"
+)
+
+// Fs is an afero.Fs backed by a Vault.
+type Fs struct {
+	v *vault.Vault
+}
+
+var _ afero.Fs = &Fs{}
+var _ afero.Symlinker = &Fs{}
+
+// New returns an afero.Fs that reads and writes the plaintext content of
+// "v". Closing the Vault invalidates the Fs.
+func New(v *vault.Vault) *Fs {
+	return &Fs{v: v}
+}
+
+// Name implements afero.Fs.
+func (fs *Fs) Name() string {
+	return "gocryptfs"
+}
+
+// Create implements afero.Fs.
+func (fs *Fs) Create(name string) (afero.File, error) {
+	f, err := fs.v.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &File{File: f}, nil
+}
+
+// Mkdir implements afero.Fs.
+func (fs *Fs) Mkdir(name string, perm os.FileMode) error {
+	return fs.v.Mkdir(name, perm)
+}
+
+// MkdirAll implements afero.Fs.
+func (fs *Fs) MkdirAll(path string, perm os.FileMode) error {
+	return fs.v.MkdirAll(path, perm)
+}
+
+// Open implements afero.Fs. Unlike Vault.Open, it also opens directories, so
+// they can be listed with Readdir and Readdirnames.
+func (fs *Fs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile implements afero.Fs. Directories can only be opened read-only.
+func (fs *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE) == 0 {
+		fi, err := fs.v.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			return &dir{v: fs.v, name: name}, nil
+		}
+	}
+	f, err := fs.v.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &File{File: f}, nil
+}
+
+// Remove implements afero.Fs.
+func (fs *Fs) Remove(name string) error {
+	return fs.v.Remove(name)
+}
+
+// RemoveAll implements afero.Fs. Like os.RemoveAll, it returns nil if "path"
+// does not exist.
+func (fs *Fs) RemoveAll(path string) error {
+	fi, err := fs.v.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		infos, err := fs.v.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, fi := range infos {
+			err = fs.RemoveAll(filepath.Join(path, fi.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = fs.v.Remove(path)
+	if os.IsNotExist(err) {
+		// Deleted concurrently
+		return nil
+	}
+	return err
+}
+
+// Rename implements afero.Fs.
+func (fs *Fs) Rename(oldname string, newname string) error {
+	return fs.v.Rename(oldname, newname)
+}
+
+// Stat implements afero.Fs. Symlinks are not followed.
+func (fs *Fs) Stat(name string) (os.FileInfo, error) {
+	return fs.v.Stat(name)
+}
+
+// Chmod implements afero.Fs.
+func (fs *Fs) Chmod(name string, mode os.FileMode) error {
+	return fs.v.Chmod(name, mode)
+}
+
+// Chown implements afero.Fs.
+func (fs *Fs) Chown(name string, uid int, gid int) error {
+	return fs.v.Chown(name, uid, gid)
+}
+
+// Chtimes implements afero.Fs.
+func (fs *Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return fs.v.Chtimes(name, atime, mtime)
+}
+
+// LstatIfPossible implements afero.Lstater. The returned bool is always
+// true.
+func (fs *Fs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	fi, err := fs.v.Lstat(name)
+	return fi, true, err
+}
+
+// SymlinkIfPossible implements afero.Linker.
+func (fs *Fs) SymlinkIfPossible(oldname string, newname string) error {
+	return fs.v.Symlink(oldname, newname)
+}
+
+// ReadlinkIfPossible implements afero.LinkReader.
+func (fs *Fs) ReadlinkIfPossible(name string) (string, error) {
+	return fs.v.Readlink(name)
+}
+
+// File is a regular file opened through Fs. It adds the methods afero.File
+// needs on top of vault.File.
+type File struct {
+	*vault.File
+}
+
+var _ afero.File = &File{}
+
+// Readdir implements afero.File. It always fails, as File is not a directory.
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.Name(), Err: syscall.ENOTDIR}
+}
+
+// Readdirnames implements afero.File. It always fails, as File is not a
+// directory.
+func (f *File) Readdirnames(n int) ([]string, error) {
+	return nil, &os.PathError{Op: "readdirent", Path: f.Name(), Err: syscall.ENOTDIR}
+}
+
+// WriteString implements afero.File.
+func (f *File) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+// dir is a directory opened through Fs. The entries are read on the first
+// Readdir or Readdirnames call. Reading and writing fail with EISDIR.
+type dir struct {
+	v       *vault.Vault
+	name    string
+	entries []os.FileInfo
+	// Number of entries already returned
+	off    int
+	closed bool
+}
+
+var _ afero.File = &dir{}
+
+func (d *dir) isDirErr(op string) error {
+	if d.closed {
+		return &os.PathError{Op: op, Path: d.name, Err: syscall.EBADF}
+	}
+	return &os.PathError{Op: op, Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *dir) Name() string {
+	return d.name
+}
+
+func (d *dir) Read(p []byte) (int, error) {
+	return 0, d.isDirErr("read")
+}
+
+func (d *dir) ReadAt(p []byte, off int64) (int, error) {
+	return 0, d.isDirErr("read")
+}
+
+func (d *dir) Write(p []byte) (int, error) {
+	return 0, d.isDirErr("write")
+}
+
+func (d *dir) WriteAt(p []byte, off int64) (int, error) {
+	return 0, d.isDirErr("write")
+}
+
+func (d *dir) WriteString(s string) (int, error) {
+	return 0, d.isDirErr("write")
+}
+
+func (d *dir) Truncate(size int64) error {
+	return d.isDirErr("truncate")
+}
+
+// Seek only supports rewinding to the start, which makes the next Readdir
+// call list the directory again.
+func (d *dir) Seek(offset int64, whence int) (int64, error) {
+	if d.closed {
+		return 0, d.isDirErr("seek")
+	}
+	if offset != 0 || whence != io.SeekStart {
+		return 0, &os.PathError{Op: "seek", Path: d.name, Err: syscall.EINVAL}
+	}
+	d.entries = nil
+	d.off = 0
+	return 0, nil
+}
+
+func (d *dir) Stat() (os.FileInfo, error) {
+	if d.closed {
+		return nil, d.isDirErr("stat")
+	}
+	return d.v.Stat(d.name)
+}
+
+func (d *dir) Sync() error {
+	if d.closed {
+		return d.isDirErr("sync")
+	}
+	return nil
+}
+
+// Readdir behaves like os.File.Readdir: for count > 0 it returns at most
+// count entries and io.EOF at the end of the directory, for count <= 0 it
+// returns all remaining entries.
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+	if d.closed {
+		return nil, d.isDirErr("readdir")
+	}
+	if d.entries == nil {
+		entries, err := d.v.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+	}
+	rest := d.entries[d.off:]
+	if count <= 0 {
+		d.off = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.off += count
+	return rest[:count], nil
+}
+
+// Readdirnames is like Readdir but only returns the names.
+func (d *dir) Readdirnames(n int) ([]string, error) {
+	infos, err := d.Readdir(n)
+	names := make([]string, len(infos))
+	for i, fi := range infos {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+func (d *dir) Close() error {
+	if d.closed {
+		return d.isDirErr("close")
+	}
+	d.closed = true
+	return nil
+}
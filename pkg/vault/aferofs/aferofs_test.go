@@ -0,0 +1,168 @@
+package aferofs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+
+	"github.com/simonhorlick/gocryptfs/internal/configfile"
+	"github.com/simonhorlick/gocryptfs/internal/nametransform"
+	"github.com/simonhorlick/gocryptfs/pkg/vault"
+	"github.com/simonhorlick/gocryptfs/tests/test_helpers"
+)
+
+// newTestFs creates a new CIPHERDIR like "gocryptfs -init" does and returns
+// it unlocked. test_helpers.InitFS cannot be used because it runs the
+// gocryptfs binary through a path relative to the package directory.
+func newTestFs(t *testing.T) (*vault.Vault, *Fs) {
+	cipherdir, err := ioutil.TempDir(test_helpers.TmpDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = configfile.Create(&configfile.CreateArgs{
+		Filename: filepath.Join(cipherdir, configfile.ConfDefaultName),
+		Password: []byte("test"),
+		LogN:     10,
+		Creator:  "aferofs_test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirfd, err := syscall.Open(cipherdir, syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := vault.Unlock(cipherdir, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, New(v)
+}
+
+// Drive the Fs through the afero helper functions, which only use the
+// afero.Fs and afero.File interfaces.
+func TestAferoHelpers(t *testing.T) {
+	v, fs := newTestFs(t)
+	defer v.Close()
+	err := fs.MkdirAll("a/b", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/x", "a/b/y", "a/b/z"} {
+		err = afero.WriteFile(fs, name, []byte("content of "+name), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := afero.ReadFile(fs, "a/b/y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "content of a/b/y" {
+		t.Errorf("wrong content %q", data)
+	}
+	var walked []string
+	err = afero.Walk(fs, "a", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a", "a/b", "a/b/y", "a/b/z", "a/x"}
+	if !reflect.DeepEqual(walked, want) {
+		t.Errorf("Walk: got %v, want %v", walked, want)
+	}
+	err = fs.RemoveAll("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.Stat("a")
+	if !os.IsNotExist(err) {
+		t.Errorf("a should be gone, Stat returned %v", err)
+	}
+	// RemoveAll on a path that does not exist is not an error
+	err = fs.RemoveAll("a")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// Readdir with a positive count returns the entries in chunks, followed by
+// io.EOF.
+func TestReaddirChunks(t *testing.T) {
+	v, fs := newTestFs(t)
+	defer v.Close()
+	for _, name := range []string{"1", "2", "3"} {
+		f, err := fs.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.WriteString(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	d, err := fs.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	var names []string
+	for {
+		chunk, err := d.Readdirnames(2)
+		names = append(names, chunk...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"1", "2", "3"}) {
+		t.Errorf("wrong names %v", names)
+	}
+	_, err = d.Read(make([]byte, 1))
+	if err == nil {
+		t.Error("reading a directory should fail")
+	}
+	f, err := fs.Open("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.Readdir(-1)
+	if err == nil {
+		t.Error("Readdir on a regular file should fail")
+	}
+}
+
+func TestChown(t *testing.T) {
+	v, fs := newTestFs(t)
+	defer v.Close()
+	err := afero.WriteFile(fs, "foo", nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Chown to ourselves is always allowed
+	err = fs.Chown("foo", os.Getuid(), os.Getgid())
+	if err != nil {
+		t.Error(err)
+	}
+}
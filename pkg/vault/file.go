@@ -0,0 +1,255 @@
+package vault
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// File is an open plaintext file in a Vault. It implements io.Reader,
+// io.ReaderAt, io.Writer, io.WriterAt, io.Seeker and io.Closer.
+//
+// Like os.File, concurrent ReadAt and WriteAt calls are safe. Read, Write and
+// Seek share the file offset and are serialized.
+type File struct {
+	name string
+	f    nodefs.File
+	// Protects "off" and "closed"
+	mu     sync.Mutex
+	off    int64
+	append bool
+	closed bool
+}
+
+// Name returns the plaintext path the file was opened with.
+func (f *File) Name() string {
+	return f.name
+}
+
+// ReadAt reads len(p) bytes starting at plaintext offset "off". It returns
+// io.EOF if fewer bytes were available.
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: errors.New("negative offset")}
+	}
+	for n < len(p) {
+		chunk := p[n:]
+		// fusefrontend uses fixed-size buffers that fit exactly one FUSE
+		// request.
+		if len(chunk) > fuse.MAX_KERNEL_WRITE {
+			chunk = chunk[:fuse.MAX_KERNEL_WRITE]
+		}
+		res, status := f.f.Read(chunk, off+int64(n))
+		if !status.Ok() {
+			return n, statusToErr("read", f.name, status)
+		}
+		data, _ := res.Bytes(chunk)
+		if len(data) == 0 {
+			return n, io.EOF
+		}
+		n += copy(p[n:], data)
+	}
+	return n, nil
+}
+
+// Read reads up to len(p) bytes from the current file offset.
+func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		// Like os.File, only report EOF when no data was read
+		err = nil
+	}
+	return n, err
+}
+
+// WriteAt writes len(p) bytes at plaintext offset "off". Writing beyond the
+// end of the file creates a file hole.
+func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: errors.New("negative offset")}
+	}
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > fuse.MAX_KERNEL_WRITE {
+			chunk = chunk[:fuse.MAX_KERNEL_WRITE]
+		}
+		written, status := f.f.Write(chunk, off+int64(n))
+		n += int(written)
+		if !status.Ok() {
+			return n, statusToErr("write", f.name, status)
+		}
+	}
+	return n, nil
+}
+
+// Write writes len(p) bytes at the current file offset, or at the end of the
+// file if it was opened with O_APPEND.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.append {
+		var a fuse.Attr
+		status := f.f.GetAttr(&a)
+		if !status.Ok() {
+			return 0, statusToErr("write", f.name, status)
+		}
+		f.off = int64(a.Size)
+	}
+	n, err := f.WriteAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+// Seek sets the file offset for the next Read or Write, like os.File.Seek.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		var a fuse.Attr
+		status := f.f.GetAttr(&a)
+		if !status.Ok() {
+			return 0, statusToErr("seek", f.name, status)
+		}
+		offset += int64(a.Size)
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// Stat returns the FileInfo of the open file.
+func (f *File) Stat() (os.FileInfo, error) {
+	var a fuse.Attr
+	status := f.f.GetAttr(&a)
+	if !status.Ok() {
+		return nil, statusToErr("stat", f.name, status)
+	}
+	return newFileInfo(filepath.Base(f.name), &a), nil
+}
+
+// Truncate changes the plaintext size of the file.
+func (f *File) Truncate(size int64) error {
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	return statusToErr("truncate", f.name, f.f.Truncate(uint64(size)))
+}
+
+// Sync commits the file content to stable storage.
+func (f *File) Sync() error {
+	return statusToErr("sync", f.name, f.f.Fsync(0))
+}
+
+// Close closes the file. It returns an error if the file was already closed.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: syscall.EBADF}
+	}
+	f.closed = true
+	f.f.Release()
+	return nil
+}
+
+// fileInfo implements os.FileInfo on top of a fuse.Attr that contains the
+// plaintext size.
+type fileInfo struct {
+	name string
+	attr *fuse.Attr
+}
+
+var _ os.FileInfo = &fileInfo{}
+
+func newFileInfo(name string, a *fuse.Attr) *fileInfo {
+	if name == "/" {
+		name = "."
+	}
+	return &fileInfo{name: name, attr: a}
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return int64(fi.attr.Size)
+}
+
+// Mode converts the Unix mode bits to an os.FileMode.
+func (fi *fileInfo) Mode() os.FileMode {
+	m := os.FileMode(fi.attr.Mode & 0777)
+	switch fi.attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		m |= os.ModeDir
+	case syscall.S_IFLNK:
+		m |= os.ModeSymlink
+	case syscall.S_IFIFO:
+		m |= os.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		m |= os.ModeSocket
+	case syscall.S_IFBLK:
+		m |= os.ModeDevice
+	case syscall.S_IFCHR:
+		m |= os.ModeDevice | os.ModeCharDevice
+	}
+	if fi.attr.Mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if fi.attr.Mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if fi.attr.Mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return time.Unix(int64(fi.attr.Mtime), int64(fi.attr.Mtimensec))
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.attr.IsDir()
+}
+
+// Sys returns the underlying *fuse.Attr.
+func (fi *fileInfo) Sys() interface{} {
+	return fi.attr
+}
+
+// byName sorts a []os.FileInfo by file name.
+type byName []os.FileInfo
+
+func (s byName) Len() int {
+	return len(s)
+}
+
+func (s byName) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s byName) Less(i, j int) bool {
+	return s[i].Name() < s[j].Name()
+}
@@ -0,0 +1,283 @@
+// +build go1.16
+
+package vault
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// maxSymlinkHops limits how many symlinks we follow while resolving a path.
+// This is the same limit Linux uses (MAXSYMLINKS).
+const maxSymlinkHops = 40
+
+// ioFS is a read-only io/fs view of a Vault.
+type ioFS struct {
+	v *Vault
+}
+
+var _ fs.FS = &ioFS{}
+var _ fs.ReadDirFS = &ioFS{}
+var _ fs.StatFS = &ioFS{}
+var _ fs.ReadFileFS = &ioFS{}
+
+// FS returns a read-only io/fs.FS view of the Vault that can be passed to
+// http.FS, template.ParseFS, fs.WalkDir and friends. The returned value also
+// implements fs.ReadDirFS, fs.StatFS and fs.ReadFileFS.
+//
+// Symlinks are followed like the operating system would do, as long as the
+// target stays inside the filesystem. Absolute targets, and relative targets
+// that point above the root, cannot be resolved and yield fs.ErrNotExist.
+func (v *Vault) FS() fs.FS {
+	return &ioFS{v: v}
+}
+
+// unwrapErr strips the *os.PathError that the Vault methods return so that
+// the caller can wrap the error with the path it was given by the user.
+func unwrapErr(err error) error {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
+
+// resolve validates "name" according to fs.ValidPath and resolves all
+// symlinks contained in it. Returns the symlink-free path relative to the
+// root of the Vault.
+func (f *ioFS) resolve(op string, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	parts := strings.Split(name, "/")
+	resolved := "."
+	hops := 0
+	for i := 0; i < len(parts); i++ {
+		if parts[i] == "." {
+			continue
+		}
+		next := path.Join(resolved, parts[i])
+		fi, err := f.v.Lstat(next)
+		if err != nil {
+			return "", &fs.PathError{Op: op, Path: name, Err: unwrapErr(err)}
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		hops++
+		if hops > maxSymlinkHops {
+			return "", &fs.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+		}
+		target, err := f.v.Readlink(next)
+		if err != nil {
+			return "", &fs.PathError{Op: op, Path: name, Err: unwrapErr(err)}
+		}
+		if path.IsAbs(target) {
+			return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		// Restart with the symlink replaced by its target
+		rest := path.Join(append([]string{resolved, target}, parts[i+1:]...)...)
+		if !fs.ValidPath(rest) {
+			// Target points above the root
+			return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		parts = strings.Split(rest, "/")
+		resolved = "."
+		i = -1
+	}
+	return resolved, nil
+}
+
+// Open implements fs.FS. Directories are returned as fs.ReadDirFile.
+func (f *ioFS) Open(name string) (fs.File, error) {
+	resolved, err := f.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.v.Stat(resolved)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: unwrapErr(err)}
+	}
+	if fi.IsDir() {
+		return &ioDir{fsys: f, name: name, resolved: resolved}, nil
+	}
+	file, err := f.v.Open(resolved)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: unwrapErr(err)}
+	}
+	return &ioFile{f: file, name: name}, nil
+}
+
+// Stat implements fs.StatFS. Like os.Stat, it follows symlinks.
+func (f *ioFS) Stat(name string) (fs.FileInfo, error) {
+	resolved, err := f.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.v.Stat(resolved)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: unwrapErr(err)}
+	}
+	return renamedInfo(fi, path.Base(name)), nil
+}
+
+// ReadDir implements fs.ReadDirFS. The entries are sorted by name and
+// describe the entries themselves, not the targets of symlinks.
+func (f *ioFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	resolved, err := f.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := f.readDir(resolved)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: unwrapErr(err)}
+	}
+	return entries, nil
+}
+
+// readDir lists the symlink-free directory "resolved".
+func (f *ioFS) readDir(resolved string) ([]fs.DirEntry, error) {
+	infos, err := f.v.ReadDir(resolved)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, len(infos))
+	for i, fi := range infos {
+		entries[i] = dirEntry{fi}
+	}
+	return entries, nil
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (f *ioFS) ReadFile(name string) ([]byte, error) {
+	resolved, err := f.resolve("read", name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := f.v.ReadFile(resolved)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: unwrapErr(err)}
+	}
+	return data, nil
+}
+
+// renamedInfo returns "fi" with the name changed to "name". Needed when
+// the FileInfo was obtained through a symlink.
+func renamedInfo(fi os.FileInfo, name string) os.FileInfo {
+	fi2, ok := fi.(*fileInfo)
+	if !ok || fi2.name == name {
+		return fi
+	}
+	return newFileInfo(name, fi2.attr)
+}
+
+// ioFile is a regular file opened through ioFS. It only exposes the read
+// methods of File.
+type ioFile struct {
+	f    *File
+	name string
+}
+
+func (i *ioFile) Read(p []byte) (int, error) {
+	return i.f.Read(p)
+}
+
+func (i *ioFile) ReadAt(p []byte, off int64) (int, error) {
+	return i.f.ReadAt(p, off)
+}
+
+func (i *ioFile) Seek(offset int64, whence int) (int64, error) {
+	return i.f.Seek(offset, whence)
+}
+
+func (i *ioFile) Stat() (fs.FileInfo, error) {
+	fi, err := i.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return renamedInfo(fi, path.Base(i.name)), nil
+}
+
+func (i *ioFile) Close() error {
+	return i.f.Close()
+}
+
+// ioDir is a directory opened through ioFS.
+type ioDir struct {
+	fsys     *ioFS
+	name     string
+	resolved string
+	// entries is loaded on the first ReadDir() call and consumed by
+	// subsequent calls.
+	entries []fs.DirEntry
+	loaded  bool
+}
+
+var _ fs.ReadDirFile = &ioDir{}
+
+func (d *ioDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *ioDir) Stat() (fs.FileInfo, error) {
+	fi, err := d.fsys.v.Stat(d.resolved)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: d.name, Err: unwrapErr(err)}
+	}
+	return renamedInfo(fi, path.Base(d.name)), nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *ioDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.loaded {
+		entries, err := d.fsys.readDir(d.resolved)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: unwrapErr(err)}
+		}
+		d.entries = entries
+		d.loaded = true
+	}
+	if n <= 0 {
+		out := d.entries
+		d.entries = nil
+		return out, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	out := d.entries[:n]
+	d.entries = d.entries[n:]
+	return out, nil
+}
+
+func (d *ioDir) Close() error {
+	return nil
+}
+
+// dirEntry implements fs.DirEntry on top of a FileInfo.
+type dirEntry struct {
+	fi os.FileInfo
+}
+
+func (e dirEntry) Name() string {
+	return e.fi.Name()
+}
+
+func (e dirEntry) IsDir() bool {
+	return e.fi.IsDir()
+}
+
+func (e dirEntry) Type() fs.FileMode {
+	return e.fi.Mode().Type()
+}
+
+func (e dirEntry) Info() (fs.FileInfo, error) {
+	return e.fi, nil
+}
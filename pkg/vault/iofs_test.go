@@ -0,0 +1,68 @@
+// +build go1.16
+
+package vault
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIOFS(t *testing.T) {
+	v := unlockTestVault(t)
+	defer v.Close()
+	v.MkdirAll("dir1/dir2", 0700)
+	v.WriteFile("dir1/file1", []byte("content1"), 0600)
+	v.WriteFile("dir1/dir2/file2", make([]byte, 140000), 0600)
+	v.WriteFile("empty", nil, 0600)
+	err := fstest.TestFS(v.FS(), "dir1/file1", "dir1/dir2/file2", "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIOFSSymlinks(t *testing.T) {
+	v := unlockTestVault(t)
+	defer v.Close()
+	v.MkdirAll("dir1/dir2", 0700)
+	v.WriteFile("dir1/dir2/file", []byte("hello"), 0600)
+	v.Symlink("dir1/dir2", "link_dir")
+	v.Symlink("../link_dir/file", "dir1/link_file")
+	v.Symlink("/etc/passwd", "link_abs")
+	v.Symlink("../outside", "link_outside")
+	v.Symlink("loop", "loop")
+	fsys := v.FS()
+
+	data, err := fs.ReadFile(fsys, "dir1/link_file")
+	if err != nil || string(data) != "hello" {
+		t.Errorf("ReadFile through symlinks: data=%q err=%v", data, err)
+	}
+	fi, err := fs.Stat(fsys, "link_dir")
+	if err != nil || !fi.IsDir() || fi.Name() != "link_dir" {
+		t.Errorf("Stat on dir symlink: fi=%v err=%v", fi, err)
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() == "link_dir" && e.Type() != fs.ModeSymlink {
+			t.Errorf("ReadDir should not follow symlinks, got type %v", e.Type())
+		}
+	}
+	for _, name := range []string{"link_abs", "link_outside"} {
+		_, err = fsys.Open(name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: want ErrNotExist, got %v", name, err)
+		}
+	}
+	_, err = fsys.Open("loop")
+	if err == nil {
+		t.Error("symlink loop should fail")
+	}
+	_, err = fsys.Open("../x")
+	if !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("invalid path: got %v", err)
+	}
+}
@@ -0,0 +1,409 @@
+// Package vault provides access to a gocryptfs filesystem without mounting it.
+//
+// A Vault operates directly on the ciphertext directory (CIPHERDIR) and takes
+// plaintext paths, relative to the root of the filesystem. It uses the same
+// code paths as the FUSE frontend, so everything written through a Vault can
+// be read by a mounted gocryptfs and vice versa. This is useful in
+// environments where /dev/fuse is not available, like containers.
+//
+// The methods of *Vault and *File follow the os package (Open, OpenFile,
+// Create, Mkdir, MkdirAll, Remove, Rename, Stat, Chmod, Chown, Chtimes).
+// For read-only users, FS() returns an io/fs.FS. To use a Vault as a
+// github.com/spf13/afero Fs, wrap it with package pkg/vault/aferofs, which
+// is kept separate so that this package does not depend on afero.
+//
+// Only forward mode is supported. A Vault must not be used while the same
+// CIPHERDIR is mounted read-write.
+package vault
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/simonhorlick/gocryptfs/internal/configfile"
+	"github.com/simonhorlick/gocryptfs/internal/contentenc"
+	"github.com/simonhorlick/gocryptfs/internal/cryptocore"
+	"github.com/simonhorlick/gocryptfs/internal/fusefrontend"
+	"github.com/simonhorlick/gocryptfs/internal/nametransform"
+	"github.com/simonhorlick/gocryptfs/internal/prefer_openssl"
+)
+
+// ErrClosed is returned by all operations on a Vault after Close() has been
+// called.
+var ErrClosed = errors.New("vault is closed")
+
+// Vault is an unlocked gocryptfs filesystem.
+type Vault struct {
+	fs    *fusefrontend.FS
+	cCore *cryptocore.CryptoCore
+}
+
+// Unlock reads "gocryptfs.conf" from "cipherdir", decrypts the master key
+// using "password" and returns a ready-to-use Vault. It fails if a crypto
+// backend does not pass its known-answer test.
+func Unlock(cipherdir string, password []byte) (*Vault, error) {
+	if len(password) == 0 {
+		return nil, errors.New("empty password")
+	}
+	// The master key is encrypted with Go GCM
+	if err := cryptocore.SelfTest(cryptocore.BackendGoGCM); err != nil {
+		return nil, err
+	}
+	masterkey, cf, err := configfile.LoadAndDecrypt(filepath.Join(cipherdir, configfile.ConfDefaultName), password)
+	if err != nil {
+		return nil, err
+	}
+	return newVault(cipherdir, cf, masterkey)
+}
+
+// UnlockMasterKey is like Unlock but uses the 32-byte "masterkey" directly
+// instead of decrypting it from the config file. The config file is still
+// read to determine the feature flags of the filesystem.
+func UnlockMasterKey(cipherdir string, masterkey []byte) (*Vault, error) {
+	if len(masterkey) != cryptocore.KeyLen {
+		return nil, errors.New("invalid master key length")
+	}
+	cf, err := configfile.Load(filepath.Join(cipherdir, configfile.ConfDefaultName))
+	if err != nil {
+		return nil, err
+	}
+	// newVault purges the key from memory, so work on a copy.
+	key := make([]byte, len(masterkey))
+	copy(key, masterkey)
+	return newVault(cipherdir, cf, key)
+}
+
+// newVault initializes the crypto backend and the fusefrontend for
+// "cipherdir" and purges "masterkey" from memory.
+func newVault(cipherdir string, cf *configfile.ConfFile, masterkey []byte) (*Vault, error) {
+	defer func() {
+		for i := range masterkey {
+			masterkey[i] = 0
+		}
+	}()
+	cipherdir, err := filepath.Abs(cipherdir)
+	if err != nil {
+		return nil, err
+	}
+	cryptoBackend := cryptocore.BackendGoGCM
+	if prefer_openssl.PreferOpenSSL() {
+		cryptoBackend = cryptocore.BackendOpenSSL
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		cryptoBackend = cryptocore.BackendAESSIV
+	}
+	IVBits := contentenc.DefaultIVBits
+	if cf.IsFeatureFlagSet(configfile.FlagXChaCha20Poly1305) {
+		cryptoBackend = cryptocore.BackendXChaCha20Poly1305
+		IVBits = contentenc.XChaCha20Poly1305IVBits
+	}
+	args := fusefrontend.Args{
+		Cipherdir:      cipherdir,
+		PlaintextNames: cf.IsFeatureFlagSet(configfile.FlagPlaintextNames),
+		LongNames:      true,
+		Integrity:      cf.IsFeatureFlagSet(configfile.FlagIntegrity),
+	}
+	if err := cryptocore.SelfTest(cryptoBackend); err != nil {
+		return nil, err
+	}
+	cCore := cryptocore.New(masterkey, cryptoBackend, IVBits,
+		cf.IsFeatureFlagSet(configfile.FlagHKDF), false)
+	cEnc := contentenc.New(cCore, cf.PlainBS(), false)
+	nameTransform := nametransform.New(cCore.EMECipher, args.LongNames,
+		cf.IsFeatureFlagSet(configfile.FlagRaw64))
+	return &Vault{
+		fs:    fusefrontend.NewFS(args, cEnc, nameTransform),
+		cCore: cCore,
+	}, nil
+}
+
+// Close purges the encryption keys from memory. The Vault cannot be used
+// afterwards. All Files opened through the Vault must be closed before.
+func (v *Vault) Close() error {
+	if v.fs == nil {
+		return ErrClosed
+	}
+	v.cCore.Wipe()
+	v.fs = nil
+	return nil
+}
+
+// cleanPath converts the user-supplied plaintext path "name" to the form
+// fusefrontend expects: relative to the root, without leading or trailing
+// slashes, "" for the root directory. ".." cannot escape the root.
+func cleanPath(name string) string {
+	p := filepath.Clean("/" + name)
+	return strings.TrimPrefix(p, "/")
+}
+
+// statusToErr converts a fuse.Status to an *os.PathError, or nil if the
+// status is OK.
+func statusToErr(op string, name string, status fuse.Status) error {
+	if status.Ok() {
+		return nil
+	}
+	return &os.PathError{Op: op, Path: name, Err: syscall.Errno(status)}
+}
+
+// Stat returns the FileInfo of the plaintext file or directory "name".
+// Symlinks are not followed.
+func (v *Vault) Stat(name string) (os.FileInfo, error) {
+	if v.fs == nil {
+		return nil, ErrClosed
+	}
+	relPath := cleanPath(name)
+	a, status := v.fs.GetAttr(relPath, nil)
+	if !status.Ok() {
+		return nil, statusToErr("stat", name, status)
+	}
+	return newFileInfo(filepath.Base("/"+relPath), a), nil
+}
+
+// Lstat is an alias for Stat. Like os.Lstat, it does not follow symlinks.
+func (v *Vault) Lstat(name string) (os.FileInfo, error) {
+	return v.Stat(name)
+}
+
+// ReadDir returns the entries of directory "name", sorted by name.
+func (v *Vault) ReadDir(name string) ([]os.FileInfo, error) {
+	if v.fs == nil {
+		return nil, ErrClosed
+	}
+	relPath := cleanPath(name)
+	entries, status := v.fs.OpenDir(relPath, nil)
+	if !status.Ok() {
+		return nil, statusToErr("readdir", name, status)
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+		a, status := v.fs.GetAttr(filepath.Join(relPath, e.Name), nil)
+		if status == fuse.ENOENT {
+			// Deleted concurrently
+			continue
+		}
+		if !status.Ok() {
+			return nil, statusToErr("readdir", filepath.Join(name, e.Name), status)
+		}
+		infos = append(infos, newFileInfo(e.Name, a))
+	}
+	sort.Sort(byName(infos))
+	return infos, nil
+}
+
+// Mkdir creates the directory "name" with permissions "perm".
+func (v *Vault) Mkdir(name string, perm os.FileMode) error {
+	if v.fs == nil {
+		return ErrClosed
+	}
+	status := v.fs.Mkdir(cleanPath(name), uint32(perm.Perm()), nil)
+	return statusToErr("mkdir", name, status)
+}
+
+// MkdirAll creates the directory "name" and all missing parents.
+func (v *Vault) MkdirAll(name string, perm os.FileMode) error {
+	relPath := cleanPath(name)
+	if relPath == "" {
+		return nil
+	}
+	fi, err := v.Stat(relPath)
+	if err == nil {
+		if fi.IsDir() {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	err = v.MkdirAll(filepath.Dir(relPath), perm)
+	if err != nil {
+		return err
+	}
+	err = v.Mkdir(relPath, perm)
+	if os.IsExist(err) {
+		// Created concurrently
+		return nil
+	}
+	return err
+}
+
+// Remove deletes the file, symlink or empty directory "name".
+func (v *Vault) Remove(name string) error {
+	if v.fs == nil {
+		return ErrClosed
+	}
+	relPath := cleanPath(name)
+	a, status := v.fs.GetAttr(relPath, nil)
+	if !status.Ok() {
+		return statusToErr("remove", name, status)
+	}
+	if a.IsDir() {
+		status = v.fs.Rmdir(relPath, nil)
+	} else {
+		status = v.fs.Unlink(relPath, nil)
+	}
+	return statusToErr("remove", name, status)
+}
+
+// Rename renames (moves) "oldName" to "newName". If "newName" already exists
+// and is not a directory, it is replaced.
+func (v *Vault) Rename(oldName string, newName string) error {
+	if v.fs == nil {
+		return ErrClosed
+	}
+	status := v.fs.Rename(cleanPath(oldName), cleanPath(newName), nil)
+	if !status.Ok() {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: syscall.Errno(status)}
+	}
+	return nil
+}
+
+// Symlink creates "newName" as a symbolic link to "target". The target is
+// stored encrypted, like all symlink targets in gocryptfs.
+func (v *Vault) Symlink(target string, newName string) error {
+	if v.fs == nil {
+		return ErrClosed
+	}
+	status := v.fs.Symlink(target, cleanPath(newName), nil)
+	if !status.Ok() {
+		return &os.LinkError{Op: "symlink", Old: target, New: newName, Err: syscall.Errno(status)}
+	}
+	return nil
+}
+
+// Readlink returns the decrypted target of the symbolic link "name".
+func (v *Vault) Readlink(name string) (string, error) {
+	if v.fs == nil {
+		return "", ErrClosed
+	}
+	target, status := v.fs.Readlink(cleanPath(name), nil)
+	if !status.Ok() {
+		return "", statusToErr("readlink", name, status)
+	}
+	return target, nil
+}
+
+// Chmod changes the permissions of "name".
+func (v *Vault) Chmod(name string, mode os.FileMode) error {
+	if v.fs == nil {
+		return ErrClosed
+	}
+	status := v.fs.Chmod(cleanPath(name), uint32(mode.Perm()), nil)
+	return statusToErr("chmod", name, status)
+}
+
+// Chown changes the numeric uid and gid of "name". Symlinks are not
+// followed.
+func (v *Vault) Chown(name string, uid int, gid int) error {
+	if v.fs == nil {
+		return ErrClosed
+	}
+	status := v.fs.Chown(cleanPath(name), uint32(uid), uint32(gid), nil)
+	return statusToErr("chown", name, status)
+}
+
+// Chtimes changes the access and modification times of "name".
+func (v *Vault) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if v.fs == nil {
+		return ErrClosed
+	}
+	status := v.fs.Utimens(cleanPath(name), &atime, &mtime, nil)
+	return statusToErr("chtimes", name, status)
+}
+
+// Open opens the plaintext file "name" for reading.
+func (v *Vault) Open(name string) (*File, error) {
+	return v.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates the plaintext file "name" and opens it
+// read-write.
+func (v *Vault) Create(name string) (*File, error) {
+	return v.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// OpenFile is the generalized open call, analogous to os.OpenFile. It
+// supports the flags O_RDONLY, O_WRONLY, O_RDWR, O_CREATE, O_EXCL, O_TRUNC
+// and O_APPEND.
+func (v *Vault) OpenFile(name string, flag int, perm os.FileMode) (*File, error) {
+	if v.fs == nil {
+		return nil, ErrClosed
+	}
+	relPath := cleanPath(name)
+	// Truncation goes through File.Truncate() so the open file table stays
+	// consistent. O_APPEND is emulated in File.Write().
+	openFlags := uint32(flag &^ (os.O_CREATE | os.O_EXCL | os.O_TRUNC | os.O_APPEND))
+	var f *File
+	if flag&os.O_CREATE != 0 {
+		// fusefrontend.FS.Create() always uses O_EXCL
+		nf, status := v.fs.Create(relPath, openFlags, uint32(perm.Perm()), nil)
+		if status.Ok() {
+			f = &File{name: name, f: nf}
+		} else if status != fuse.Status(syscall.EEXIST) || flag&os.O_EXCL != 0 {
+			return nil, statusToErr("open", name, status)
+		}
+	}
+	if f == nil {
+		a, status := v.fs.GetAttr(relPath, nil)
+		if !status.Ok() {
+			return nil, statusToErr("open", name, status)
+		}
+		if a.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		nf, status := v.fs.Open(relPath, openFlags, nil)
+		if !status.Ok() {
+			return nil, statusToErr("open", name, status)
+		}
+		f = &File{name: name, f: nf}
+		if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			err := f.Truncate(0)
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+	f.append = flag&os.O_APPEND != 0
+	return f, nil
+}
+
+// ReadFile reads the whole plaintext file "name".
+func (v *Vault) ReadFile(name string) ([]byte, error) {
+	f, err := v.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, fi.Size())
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && n != len(buf) {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// WriteFile writes "data" to the plaintext file "name", creating it with
+// permissions "perm" if necessary and truncating it otherwise.
+func (v *Vault) WriteFile(name string, data []byte, perm os.FileMode) error {
+	f, err := v.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
@@ -0,0 +1,335 @@
+package vault
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/simonhorlick/gocryptfs/tests/test_helpers"
+)
+
+func unlockTestVault(t *testing.T) *Vault {
+	cipherdir := test_helpers.InitFS(t)
+	v, err := Unlock(cipherdir, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestUnlockWrongPassword(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	_, err := Unlock(cipherdir, []byte("wrong"))
+	if err == nil {
+		t.Fatal("Unlock with wrong password should have failed")
+	}
+}
+
+// Write a file that spans several FUSE-sized chunks and read it back
+func TestWriteRead(t *testing.T) {
+	v := unlockTestVault(t)
+	defer v.Close()
+	content := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	err := v.WriteFile("foo", content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := v.ReadFile("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, out) {
+		t.Errorf("content mismatch: wrote %d bytes, read %d bytes", len(content), len(out))
+	}
+	fi, err := v.Stat("/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(content)) || fi.Mode() != 0600 || fi.Name() != "foo" {
+		t.Errorf("wrong FileInfo: size=%d mode=%v name=%q", fi.Size(), fi.Mode(), fi.Name())
+	}
+	// Partial read through Seek + Read
+	f, err := v.Open("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.Seek(-10, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, err := f.Read(buf)
+	if err != nil || n != 10 || !bytes.Equal(buf[:n], content[len(content)-10:]) {
+		t.Errorf("Read at end: n=%d err=%v", n, err)
+	}
+	n, err = f.Read(buf)
+	if n != 0 || err != io.EOF {
+		t.Errorf("Read past end: n=%d err=%v", n, err)
+	}
+}
+
+func TestAppendTruncate(t *testing.T) {
+	v := unlockTestVault(t)
+	defer v.Close()
+	err := v.WriteFile("f", []byte("hello"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := v.OpenFile("f", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(" world"))
+	f.Close()
+	out, _ := v.ReadFile("f")
+	if string(out) != "hello world" {
+		t.Errorf("append: got %q", out)
+	}
+	// O_EXCL on an existing file must fail
+	_, err = v.OpenFile("f", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if !os.IsExist(err) {
+		t.Errorf("O_EXCL: got err=%v", err)
+	}
+	// Create truncates
+	f, err = v.Create("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	out, _ = v.ReadFile("f")
+	if len(out) != 0 {
+		t.Errorf("truncate: got %q", out)
+	}
+}
+
+func TestDirOps(t *testing.T) {
+	v := unlockTestVault(t)
+	defer v.Close()
+	err := v.MkdirAll("a/b/c", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	longName := strings.Repeat("x", 200)
+	err = v.WriteFile("a/b/"+longName, []byte("long"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = v.Symlink("../target", "a/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := v.Readlink("a/link")
+	if err != nil || target != "../target" {
+		t.Errorf("Readlink: target=%q err=%v", target, err)
+	}
+	entries, err := v.ReadDir("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name() != "c" || !entries[0].IsDir() || entries[1].Name() != longName {
+		t.Errorf("ReadDir: wrong entries %v", entries)
+	}
+	err = v.Rename("a/b/"+longName, "a/short")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := v.ReadFile("a/short")
+	if err != nil || string(out) != "long" {
+		t.Errorf("after rename: content=%q err=%v", out, err)
+	}
+	// Non-empty directory
+	err = v.Remove("a/b")
+	if err == nil {
+		t.Error("removing a non-empty directory should fail")
+	}
+	for _, p := range []string{"a/b/c", "a/b", "a/short", "a/link"} {
+		err = v.Remove(p)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	_, err = v.Stat("a/b")
+	if !os.IsNotExist(err) {
+		t.Errorf("Stat on deleted dir: %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	v := unlockTestVault(t)
+	v.Close()
+	_, err := v.Open("foo")
+	if err != ErrClosed {
+		t.Errorf("want ErrClosed, got %v", err)
+	}
+}
+
+// Unaligned writes, holes and truncates on a filesystem with blocks that are
+// larger than a FUSE request
+func TestBlockSize(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t, "-blocksize=1M")
+	v, err := Unlock(cipherdir, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	f, err := v.Create("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var want []byte
+	writeAt := func(data []byte, off int) {
+		if _, err := f.WriteAt(data, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+		if len(want) < off+len(data) {
+			want = append(want, make([]byte, off+len(data)-len(want))...)
+		}
+		copy(want[off:], data)
+	}
+	writeAt(bytes.Repeat([]byte("a"), 300000), 1000)
+	writeAt(bytes.Repeat([]byte("b"), 5000), 1048000)
+	writeAt([]byte("hole"), 3*1048576+17)
+	if err = f.Truncate(2*1048576 + 5); err != nil {
+		t.Fatal(err)
+	}
+	want = want[:2*1048576+5]
+	out, err := v.ReadFile("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, want) {
+		t.Errorf("content mismatch: want %d bytes, got %d bytes", len(want), len(out))
+	}
+}
+
+// The integrity format must behave like a normal filesystem until someone
+// tampers with the ciphertext
+func TestIntegrity(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t, "-integrity")
+	v, err := Unlock(cipherdir, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := v.Create("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []byte
+	writeAt := func(data []byte, off int) {
+		if _, err := f.WriteAt(data, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+		if len(want) < off+len(data) {
+			want = append(want, make([]byte, off+len(data)-len(want))...)
+		}
+		copy(want[off:], data)
+	}
+	// Block-aligned append, a gap that would be a file hole, and a write
+	// into the middle
+	writeAt(bytes.Repeat([]byte("a"), 4096), 0)
+	writeAt(bytes.Repeat([]byte("b"), 5000), 4096)
+	writeAt([]byte("gap"), 200000)
+	writeAt([]byte("middle"), 100000)
+	for _, size := range []int{150000, 8192, 12000} {
+		if err = f.Truncate(int64(size)); err != nil {
+			t.Fatal(err)
+		}
+		if size < len(want) {
+			want = want[:size]
+		} else {
+			want = append(want, make([]byte, size-len(want))...)
+		}
+		out, err := v.ReadFile("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, want) {
+			t.Errorf("size %d: content mismatch, got %d bytes", size, len(out))
+		}
+	}
+	// Rename while open
+	if err = v.Mkdir("dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.Rename("a", "dir/a"); err != nil {
+		t.Fatal(err)
+	}
+	writeAt([]byte("after rename"), 0)
+	f.Close()
+	out, err := v.ReadFile("dir/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, want) {
+		t.Errorf("after rename: content mismatch, got %d bytes", len(out))
+	}
+	if err = v.WriteFile("dir/b", want, 0600); err != nil {
+		t.Fatal(err)
+	}
+	v.Close()
+
+	// Swap the two files on disk
+	cDir := cipherdir + "/" + onlyDir(t, cipherdir)
+	entries, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cNames []string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "gocryptfs.") {
+			cNames = append(cNames, cDir+"/"+e.Name())
+		}
+	}
+	if len(cNames) != 2 {
+		t.Fatalf("expected 2 files, got %v", cNames)
+	}
+	tmp := cNames[0] + ".tmp"
+	os.Rename(cNames[0], tmp)
+	os.Rename(cNames[1], cNames[0])
+	os.Rename(tmp, cNames[1])
+	v, err = Unlock(cipherdir, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = v.ReadFile("dir/a"); err == nil {
+		t.Error("reading a swapped file should fail")
+	}
+	v.Close()
+	// Swap back and truncate one file at a block boundary
+	os.Rename(cNames[0], tmp)
+	os.Rename(cNames[1], cNames[0])
+	os.Rename(tmp, cNames[1])
+	if err = os.Truncate(cNames[0], 18+2*4128); err != nil {
+		t.Fatal(err)
+	}
+	v, err = Unlock(cipherdir, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	_, errA := v.ReadFile("dir/a")
+	_, errB := v.ReadFile("dir/b")
+	if (errA == nil) == (errB == nil) {
+		t.Errorf("exactly one file should fail to read: %v, %v", errA, errB)
+	}
+}
+
+// onlyDir returns the name of the only directory in "dir".
+func onlyDir(t *testing.T, dir string) string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			return e.Name()
+		}
+	}
+	t.Fatal("no directory found")
+	return ""
+}
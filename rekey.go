@@ -0,0 +1,728 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/pkg/xattr"
+
+	"github.com/simonhorlick/gocryptfs/internal/configfile"
+	"github.com/simonhorlick/gocryptfs/internal/contentenc"
+	"github.com/simonhorlick/gocryptfs/internal/cryptocore"
+	"github.com/simonhorlick/gocryptfs/internal/exitcodes"
+	"github.com/simonhorlick/gocryptfs/internal/fusefrontend"
+	"github.com/simonhorlick/gocryptfs/internal/nametransform"
+	"github.com/simonhorlick/gocryptfs/internal/readpassword"
+	"github.com/simonhorlick/gocryptfs/internal/syscallcompat"
+	"github.com/simonhorlick/gocryptfs/internal/tlog"
+)
+
+// "-rekey" works in a staging directory inside CIPHERDIR:
+//
+//	gocryptfs.rekey/gocryptfs.conf  config file with the new master key
+//	gocryptfs.rekey/journal         progress, see rekeyJournal
+//	gocryptfs.rekey/tree/           the filesystem, encrypted with the new key
+//
+// In the copy phase, every file is moved from CIPHERDIR into the tree: it is
+// written and fsync'ed with the new key, then the old file is deleted. As
+// long as the old file exists, it is authoritative, so an interrupted copy
+// phase can always be resumed or rolled back. In the swap phase, the
+// contents of the tree, the root gocryptfs.diriv and the new config file are
+// renamed into place. This needs no keys at all.
+const (
+	rekeyJournalName = "journal"
+	rekeyTreeName    = "tree"
+
+	rekeyPhaseCopy     = "copy"
+	rekeyPhaseRollback = "rollback"
+	rekeyPhaseSwap     = "swap"
+
+	// Encrypted xattrs are stored under this prefix, see
+	// fusefrontend/xattr.go
+	rekeyXattrPrefix = "user.gocryptfs."
+)
+
+// rekeyJournal is stored in JSON format in gocryptfs.rekey/journal.
+type rekeyJournal struct {
+	// Phase is one of rekeyPhaseCopy, rekeyPhaseRollback or rekeyPhaseSwap
+	Phase string
+	// Links maps the inode number of a hard-linked file to the path its
+	// first link has been moved to. This way, the remaining links can be
+	// recreated even after an interruption.
+	Links map[uint64]string
+	// filename is not exported to JSON
+	filename string
+}
+
+func loadRekeyJournal(filename string) (*rekeyJournal, error) {
+	js, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	j := rekeyJournal{filename: filename}
+	err = json.Unmarshal(js, &j)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %q: %v", filename, err)
+	}
+	if j.Links == nil {
+		j.Links = make(map[uint64]string)
+	}
+	return &j, nil
+}
+
+func (j *rekeyJournal) save() error {
+	js, err := json.MarshalIndent(j, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileSync(j.filename, append(js, '\n'), 0600)
+}
+
+// writeFileSync atomically replaces "filename" by writing "filename.tmp",
+// fsync'ing it and renaming it over "filename". The directory is fsync'ed as
+// well so the new content is guaranteed to be on disk when we return.
+func writeFileSync(filename string, data []byte, perm os.FileMode) error {
+	tmp := filename + ".tmp"
+	// Left over from an earlier crash
+	os.Remove(tmp)
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, filename)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filename))
+}
+
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
+}
+
+// rekeyInProgress returns true if CIPHERDIR contains the staging directory
+// of an interrupted "-rekey" run.
+func rekeyInProgress(cipherdir string) bool {
+	_, err := os.Lstat(filepath.Join(cipherdir, configfile.RekeyDirName))
+	return err == nil
+}
+
+type rekeyObj struct {
+	// Files are moved from "src" to "dst"
+	src, dst *fusefrontend.FS
+	// dstDir is the backing directory of "dst"
+	dstDir  string
+	journal *rekeyJournal
+	// Number of items that could not be moved
+	errorCount int
+}
+
+func (rk *rekeyObj) fail(format string, a ...interface{}) {
+	tlog.Warn.Printf("rekey: "+format, a...)
+	rk.errorCount++
+}
+
+// copyContent re-encrypts the content of the regular file "path" from "src"
+// to a new file in "dst". All-zero chunks are skipped to preserve sparse
+// files.
+func (rk *rekeyObj) copyContent(path string) error {
+	in, status := rk.src.Open(path, syscall.O_RDONLY, nil)
+	if !status.Ok() {
+		return fmt.Errorf("error opening %q: %v", path, status)
+	}
+	defer in.Release()
+	out, status := rk.dst.Create(path, syscall.O_WRONLY, 0600, nil)
+	if !status.Ok() {
+		return fmt.Errorf("error creating %q: %v", path, status)
+	}
+	defer out.Release()
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	allZero := make([]byte, fuse.MAX_KERNEL_WRITE)
+	var off uint64
+	for {
+		result, status := in.Read(buf, int64(off))
+		if !status.Ok() {
+			return fmt.Errorf("error reading %q at offset %d: %v", path, off, status)
+		}
+		data, _ := result.Bytes(buf)
+		if len(data) == 0 {
+			break
+		}
+		if !bytes.Equal(data, allZero[:len(data)]) {
+			_, status = out.Write(data, int64(off))
+			if !status.Ok() {
+				return fmt.Errorf("error writing %q at offset %d: %v", path, off, status)
+			}
+		}
+		off += uint64(len(data))
+	}
+	// Trailing zeros were skipped
+	status = out.Truncate(off)
+	if !status.Ok() {
+		return fmt.Errorf("error truncating %q: %v", path, status)
+	}
+	status = out.Fsync(0)
+	if !status.Ok() {
+		return fmt.Errorf("error syncing %q: %v", path, status)
+	}
+	return nil
+}
+
+// copyXattrs re-encrypts the extended attributes of "path".
+func (rk *rekeyObj) copyXattrs(path string) {
+	attrs, status := rk.src.ListXAttr(path, nil)
+	if status == fuse.Status(syscall.ENOTSUP) {
+		return
+	} else if !status.Ok() {
+		rk.fail("listing xattrs on %q: %v", path, status)
+		return
+	}
+	for _, a := range attrs {
+		data, status := rk.src.GetXAttr(path, a, nil)
+		if !status.Ok() {
+			rk.fail("reading xattr %q from %q: %v", a, path, status)
+			continue
+		}
+		status = rk.dst.SetXAttr(path, a, data, 0, nil)
+		if !status.Ok() {
+			rk.fail("setting xattr %q on %q: %v", a, path, status)
+		}
+	}
+}
+
+// move recursively moves "path" from "src" to "dst". Whatever exists at
+// "path" in "dst" is overwritten. Returns true if "path" has been moved
+// completely and no longer exists in "src".
+func (rk *rekeyObj) move(path string) bool {
+	tlog.Debug.Printf("rk.move %q", path)
+	attr, status := rk.src.GetAttr(path, nil)
+	if !status.Ok() {
+		rk.fail("error stating %q: %v", path, status)
+		return false
+	}
+	switch attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		if path != "" {
+			// Make sure we can write into the directory. The real permissions are
+			// applied after the contents have been moved.
+			status = rk.dst.Mkdir(path, 0700, nil)
+			if status == fuse.Status(syscall.EEXIST) {
+				status = rk.dst.Chmod(path, 0700, nil)
+			}
+			if !status.Ok() {
+				rk.fail("error creating directory %q: %v", path, status)
+				return false
+			}
+		}
+		entries, status := rk.src.OpenDir(path, nil)
+		if !status.Ok() {
+			rk.fail("error opening dir %q: %v", path, status)
+			return false
+		}
+		complete := true
+		for _, entry := range entries {
+			if entry.Name == "." || entry.Name == ".." {
+				continue
+			}
+			if !rk.move(filepath.Join(path, entry.Name)) {
+				complete = false
+			}
+		}
+		if !complete {
+			return false
+		}
+		rk.copyXattrs(path)
+		setAttr(rk.dst, path, attr, rk.fail)
+		if path == "" {
+			return true
+		}
+		if !rk.syncParent(path) {
+			return false
+		}
+		status = rk.src.Rmdir(path, nil)
+		if !status.Ok() {
+			rk.fail("error removing directory %q: %v", path, status)
+			return false
+		}
+		return true
+	case syscall.S_IFREG:
+		if first, ok := rk.journal.Links[attr.Ino]; ok && first != path {
+			// Another link to this file has already been moved
+			rk.dst.Unlink(path, nil)
+			status = rk.dst.Link(first, path, nil)
+			if status.Ok() {
+				break
+			}
+			if status != fuse.ENOENT {
+				rk.fail("error linking %q to %q: %v", path, first, status)
+				return false
+			}
+			// The run that moved "first" has been interrupted. We move this
+			// link instead.
+		}
+		if attr.Nlink > 1 && rk.journal.Links[attr.Ino] != path {
+			rk.journal.Links[attr.Ino] = path
+			err := rk.journal.save()
+			if err != nil {
+				rk.fail("error writing journal: %v", err)
+				return false
+			}
+		}
+		// Left over from an interrupted run
+		rk.dst.Unlink(path, nil)
+		err := rk.copyContent(path)
+		if err != nil {
+			rk.fail("%v", err)
+			rk.dst.Unlink(path, nil)
+			return false
+		}
+		rk.copyXattrs(path)
+		setAttr(rk.dst, path, attr, rk.fail)
+	case syscall.S_IFLNK:
+		target, status := rk.src.Readlink(path, nil)
+		if !status.Ok() {
+			rk.fail("error reading symlink %q: %v", path, status)
+			return false
+		}
+		rk.dst.Unlink(path, nil)
+		status = rk.dst.Symlink(target, path, nil)
+		if !status.Ok() {
+			rk.fail("error creating symlink %q: %v", path, status)
+			return false
+		}
+		setAttr(rk.dst, path, attr, rk.fail)
+	case syscall.S_IFIFO, syscall.S_IFCHR, syscall.S_IFBLK, syscall.S_IFSOCK:
+		rk.dst.Unlink(path, nil)
+		status = rk.dst.Mknod(path, attr.Mode, attr.Rdev, nil)
+		if !status.Ok() {
+			rk.fail("error creating special file %q: %v", path, status)
+			return false
+		}
+		setAttr(rk.dst, path, attr, rk.fail)
+	default:
+		rk.fail("unsupported file type %#o: %q", attr.Mode, path)
+		return false
+	}
+	if !rk.syncParent(path) {
+		return false
+	}
+	status = rk.src.Unlink(path, nil)
+	if !status.Ok() {
+		rk.fail("error deleting %q: %v", path, status)
+		return false
+	}
+	return true
+}
+
+// syncParent fsyncs the backing directory that contains "path" in "dst".
+// The new directory entry must be on disk before the old file is deleted.
+func (rk *rekeyObj) syncParent(path string) bool {
+	cDir, err := rk.dst.CipherPath(nametransform.Dir(path))
+	if err == nil {
+		err = syncDir(filepath.Join(rk.dstDir, cDir))
+	}
+	if err != nil {
+		rk.fail("error syncing the parent directory of %q: %v", path, err)
+		return false
+	}
+	return true
+}
+
+// settle prepares an interrupted copy phase for a rollback. A non-directory
+// that exists both in "src" and "dst" may be incomplete in "dst". "src" is
+// authoritative, so the copy in "dst" is deleted.
+func (rk *rekeyObj) settle(path string) {
+	entries, status := rk.dst.OpenDir(path, nil)
+	if !status.Ok() {
+		rk.fail("error opening dir %q: %v", path, status)
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		p := filepath.Join(path, entry.Name)
+		if entry.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			rk.settle(p)
+			continue
+		}
+		if _, status := rk.src.GetAttr(p, nil); status.Ok() {
+			tlog.Debug.Printf("rk.settle: deleting incomplete copy of %q", p)
+			status = rk.dst.Unlink(p, nil)
+			if !status.Ok() {
+				rk.fail("error deleting %q: %v", p, status)
+			}
+		}
+	}
+}
+
+// rekeyFrontend returns a fusefrontend instance that accesses "cipherdir"
+// using "masterkey" and the settings from "cf". "masterkey" is wiped.
+func rekeyFrontend(args *argContainer, cf *configfile.ConfFile, cipherdir string,
+	masterkey []byte) (*fusefrontend.FS, *cryptocore.CryptoCore) {
+	cryptoBackend := cryptocore.BackendGoGCM
+	if args.openssl {
+		cryptoBackend = cryptocore.BackendOpenSSL
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		cryptoBackend = cryptocore.BackendAESSIV
+	}
+	IVBits := contentenc.DefaultIVBits
+	if cf.IsFeatureFlagSet(configfile.FlagXChaCha20Poly1305) {
+		cryptoBackend = cryptocore.BackendXChaCha20Poly1305
+		IVBits = contentenc.XChaCha20Poly1305IVBits
+	}
+	frontendArgs := fusefrontend.Args{
+		Cipherdir:      cipherdir,
+		PlaintextNames: cf.IsFeatureFlagSet(configfile.FlagPlaintextNames),
+		LongNames:      args.longnames,
+		NoPrealloc:     args.noprealloc,
+		Integrity:      cf.IsFeatureFlagSet(configfile.FlagIntegrity),
+	}
+	selfTestOrExit(cryptoBackend)
+	cCore := cryptocore.New(masterkey, cryptoBackend, IVBits,
+		cf.IsFeatureFlagSet(configfile.FlagHKDF), false)
+	cEnc := contentenc.New(cCore, cf.PlainBS(), false)
+	nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames,
+		cf.IsFeatureFlagSet(configfile.FlagRaw64))
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	return fusefrontend.NewFS(frontendArgs, cEnc, nameTransform), cCore
+}
+
+// rekeyOldKey returns the current master key and the password that protects
+// the new master key. Without "-masterkey", this is the current password.
+func rekeyOldKey(args *argContainer, cf *configfile.ConfFile, newPassword bool) (oldKey []byte, pw []byte) {
+	trezor := cf.IsFeatureFlagSet(configfile.FlagTrezor)
+	if args.masterkey != "" {
+		oldKey = parseMasterKey(args.masterkey, false)
+		if !trezor {
+			tlog.Info.Println("Please enter the password for the new master key.")
+		}
+	}
+	if trezor {
+		pw = readpassword.Trezor(cf.TrezorPayload)
+	} else if args.masterkey != "" && newPassword {
+		pw = readpassword.Twice(args.extpass, args.passfile)
+	} else {
+		pw = readpassword.Once(args.extpass, args.passfile, "")
+	}
+	if !trezor {
+		readpassword.CheckTrailingGarbage()
+	}
+	if oldKey == nil {
+		tlog.Info.Println("Decrypting master key")
+		var err error
+		oldKey, err = cf.DecryptMasterKey(pw)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			exitcodes.Exit(err)
+		}
+	}
+	return oldKey, pw
+}
+
+// rekeyStart creates the staging directory with a new config file holding
+// a new random master key, protected by "pw".
+func rekeyStart(args *argContainer, cf *configfile.ConfFile, pw []byte) (*rekeyJournal, error) {
+	staging := filepath.Join(args.cipherdir, configfile.RekeyDirName)
+	tree := filepath.Join(staging, rekeyTreeName)
+	err := os.Mkdir(staging, 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Mkdir(tree, 0700)
+	if err != nil {
+		return nil, err
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) {
+		dirfd, err := syscall.Open(tree, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+		if err != nil {
+			return nil, err
+		}
+		err = nametransform.WriteDirIVAt(dirfd)
+		syscall.Close(dirfd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	newCf := *cf
+	newCf.Creator = tlog.ProgramName + " " + GitVersion
+	// The other key slots hold the old master key, and we do not know their
+	// passwords
+	for _, s := range cf.KeySlots {
+		newCf.RevokeKeySlot(s.Label)
+	}
+	if len(cf.KeySlots) > 0 {
+		tlog.Info.Printf(tlog.ColorYellow+"The new master key is protected by the password you have entered. "+
+			"The %d additional key slots have been removed, add them again using -addkey."+tlog.ColorReset,
+			len(cf.KeySlots))
+	}
+	{
+		key := cryptocore.RandBytes(cryptocore.KeyLen)
+		tlog.PrintMasterkeyReminder(key)
+		newCf.EncryptKey(key, pw, cf.ScryptObject.LogN())
+		for i := range key {
+			key[i] = 0
+		}
+	}
+	js, err := json.MarshalIndent(newCf, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileSync(filepath.Join(staging, configfile.ConfDefaultName), append(js, '\n'), 0400)
+	if err != nil {
+		return nil, err
+	}
+	// The journal is written last. Without it, the staging directory is
+	// considered incomplete and is thrown away.
+	j := &rekeyJournal{
+		Phase:    rekeyPhaseCopy,
+		Links:    make(map[uint64]string),
+		filename: filepath.Join(staging, rekeyJournalName),
+	}
+	err = j.save()
+	if err != nil {
+		return nil, err
+	}
+	return j, syncDir(args.cipherdir)
+}
+
+// rekeyCheckRoot verifies that nothing except our own files is left in the
+// root directory of CIPHERDIR before we start to swap in the new files.
+func rekeyCheckRoot(cipherdir string, plaintextNames bool) error {
+	names, err := readDirNames(cipherdir)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if n == configfile.ConfDefaultName || n == configfile.RekeyDirName {
+			continue
+		}
+		if n == nametransform.DirIVFilename && !plaintextNames {
+			continue
+		}
+		return fmt.Errorf("unexpected leftover %q in %q", n, cipherdir)
+	}
+	return nil
+}
+
+// rekeySwapXattrs replaces the encrypted xattrs of CIPHERDIR itself with the
+// ones of the tree.
+func rekeySwapXattrs(cipherdir string, tree string) error {
+	newAttrs, err := xattr.LList(tree)
+	if err != nil {
+		if xerr, ok := err.(*xattr.Error); ok && xerr.Err == syscall.ENOTSUP {
+			// Then we could not have copied any either
+			return nil
+		}
+		return err
+	}
+	oldAttrs, err := xattr.LList(cipherdir)
+	if err != nil {
+		return err
+	}
+	for _, a := range oldAttrs {
+		if !strings.HasPrefix(a, rekeyXattrPrefix) {
+			continue
+		}
+		err = xattr.LRemove(cipherdir, a)
+		if err != nil {
+			return err
+		}
+	}
+	for _, a := range newAttrs {
+		data, err := xattr.LGet(tree, a)
+		if err != nil {
+			return err
+		}
+		err = xattr.LSet(cipherdir, a, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rekeySwap moves the re-encrypted files and the new config file into
+// place and removes the staging directory. Every step can be repeated, so
+// an interrupted swap is completed by running it again.
+func rekeySwap(args *argContainer, plaintextNames bool) error {
+	staging := filepath.Join(args.cipherdir, configfile.RekeyDirName)
+	tree := filepath.Join(staging, rekeyTreeName)
+	names, err := readDirNames(tree)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if n == nametransform.DirIVFilename && !plaintextNames {
+			// Must come last, the names in the root dir are encrypted with it
+			continue
+		}
+		err = os.Rename(filepath.Join(tree, n), filepath.Join(args.cipherdir, n))
+		if err != nil {
+			return err
+		}
+	}
+	err = rekeySwapXattrs(args.cipherdir, tree)
+	if err != nil {
+		return err
+	}
+	if !plaintextNames {
+		err = os.Rename(filepath.Join(tree, nametransform.DirIVFilename),
+			filepath.Join(args.cipherdir, nametransform.DirIVFilename))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err = syncDir(args.cipherdir)
+	if err != nil {
+		return err
+	}
+	newConf := filepath.Join(staging, configfile.ConfDefaultName)
+	js, err := ioutil.ReadFile(newConf)
+	if err == nil {
+		// Not a plain rename as "-config" may point to a different filesystem
+		err = writeFileSync(args.config, js, 0400)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(newConf)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(staging)
+}
+
+// rekey implements "-rekey [-rollback] CIPHERDIR". It generates a new master
+// key and re-encrypts all files, names and xattrs with it. When interrupted,
+// running the same command again continues where the last run stopped.
+func rekey(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("Running -rekey with -reverse is not supported")
+		os.Exit(exitcodes.Usage)
+	}
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	plaintextNames := cf.IsFeatureFlagSet(configfile.FlagPlaintextNames)
+	staging := filepath.Join(args.cipherdir, configfile.RekeyDirName)
+	journal, err := loadRekeyJournal(filepath.Join(staging, rekeyJournalName))
+	if os.IsNotExist(err) && rekeyInProgress(args.cipherdir) {
+		// Interrupted before any file has been moved
+		tlog.Info.Printf("Removing incomplete staging directory %q", staging)
+		err = os.RemoveAll(staging)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		tlog.Fatal.Printf("rekey: %v", err)
+		os.Exit(exitcodes.Rekey)
+	}
+	if args.rollback && journal == nil {
+		tlog.Fatal.Printf("There is no interrupted -rekey run that could be rolled back")
+		os.Exit(exitcodes.Rekey)
+	}
+	if args.rollback && journal.Phase == rekeyPhaseSwap {
+		tlog.Fatal.Printf("The new files are already being moved into place, a rollback is no longer possible. " +
+			"Run -rekey without -rollback to complete the operation.")
+		os.Exit(exitcodes.Rekey)
+	}
+	if !args.rollback && journal != nil && journal.Phase == rekeyPhaseRollback {
+		tlog.Fatal.Printf("A rollback was interrupted. Run -rekey -rollback to complete it.")
+		os.Exit(exitcodes.Rekey)
+	}
+	if journal == nil || journal.Phase != rekeyPhaseSwap {
+		oldKey, pw := rekeyOldKey(args, cf, journal == nil)
+		if journal == nil {
+			journal, err = rekeyStart(args, cf, pw)
+			if err != nil {
+				tlog.Fatal.Printf("rekey: could not create staging directory: %v", err)
+				os.Exit(exitcodes.Rekey)
+			}
+		}
+		newKey, newCf, err := configfile.LoadAndDecrypt(filepath.Join(staging, configfile.ConfDefaultName), pw)
+		for i := range pw {
+			pw[i] = 0
+		}
+		if err != nil {
+			tlog.Fatal.Printf("rekey: could not unlock the new master key: %v", err)
+			os.Exit(exitcodes.Rekey)
+		}
+		oldFS, oldCore := rekeyFrontend(args, cf, args.cipherdir, oldKey)
+		newFS, newCore := rekeyFrontend(args, newCf, filepath.Join(staging, rekeyTreeName), newKey)
+		rk := rekeyObj{src: oldFS, dst: newFS, dstDir: filepath.Join(staging, rekeyTreeName), journal: journal}
+		if args.rollback {
+			if journal.Phase == rekeyPhaseCopy {
+				rk.settle("")
+				if rk.errorCount == 0 {
+					journal.Phase = rekeyPhaseRollback
+					journal.Links = make(map[uint64]string)
+					err = journal.save()
+					if err != nil {
+						rk.fail("error writing journal: %v", err)
+					}
+				}
+			}
+			rk.src, rk.dst, rk.dstDir = newFS, oldFS, args.cipherdir
+		}
+		if rk.errorCount == 0 {
+			rk.move("")
+		}
+		oldCore.Wipe()
+		newCore.Wipe()
+		if rk.errorCount > 0 {
+			tlog.Fatal.Printf("rekey: %d errors. Fix them and run the same command again.", rk.errorCount)
+			os.Exit(exitcodes.Rekey)
+		}
+		if args.rollback {
+			err = os.RemoveAll(staging)
+			if err != nil {
+				tlog.Fatal.Printf("rekey: %v", err)
+				os.Exit(exitcodes.Rekey)
+			}
+			tlog.Info.Printf(tlog.ColorGreen + "Rollback complete, the old master key is in use again." + tlog.ColorReset)
+			return
+		}
+		err = rekeyCheckRoot(args.cipherdir, plaintextNames)
+		if err == nil {
+			journal.Phase = rekeyPhaseSwap
+			err = journal.save()
+		}
+		if err != nil {
+			tlog.Fatal.Printf("rekey: %v", err)
+			os.Exit(exitcodes.Rekey)
+		}
+	}
+	err = rekeySwap(args, plaintextNames)
+	if err != nil {
+		tlog.Fatal.Printf("rekey: could not move the new files into place: %v. "+
+			"Run the same command again to retry.", err)
+		os.Exit(exitcodes.Rekey)
+	}
+	tlog.Info.Printf(tlog.ColorGreen + "All files have been re-encrypted with the new master key." + tlog.ColorReset)
+}
@@ -0,0 +1,255 @@
+package main
+
+// "-scrub" checks the structure of the ciphertext in CIPHERDIR
+
+import (
+	"crypto/aes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/simonhorlick/gocryptfs/internal/configfile"
+	"github.com/simonhorlick/gocryptfs/internal/contentenc"
+	"github.com/simonhorlick/gocryptfs/internal/cryptocore"
+	"github.com/simonhorlick/gocryptfs/internal/exitcodes"
+	"github.com/simonhorlick/gocryptfs/internal/nametransform"
+	"github.com/simonhorlick/gocryptfs/internal/syscallcompat"
+	"github.com/simonhorlick/gocryptfs/internal/tlog"
+)
+
+// scrubObj walks CIPHERDIR directly, without decrypting anything. The
+// problems are collected in "ck".
+type scrubObj struct {
+	ck *fsckObj
+	// Feature flags from the config file
+	plaintextNames, longNames bool
+	// nameTransform has no key. It is only used for base64 decoding and
+	// HashLongName.
+	nameTransform *nametransform.NameTransform
+	// contentEnc has an all-zero key. It is only used for size calculations.
+	contentEnc *contentenc.ContentEnc
+}
+
+// report records and prints a problem
+func (sc *scrubObj) report(p fsckProblem) {
+	sc.ck.problem(p)
+	sc.ck.printf("scrub: %s %q: %s\n", p.Class, p.CipherPath, p.Text)
+}
+
+// dir recursively checks the ciphertext directory "cPath", relative to
+// CIPHERDIR
+func (sc *scrubObj) dir(cPath string) {
+	tlog.Debug.Printf("scrub.dir %q\n", cPath)
+	atomic.AddUint64(&sc.ck.dirCount, 1)
+	absPath := filepath.Join(sc.ck.cipherdir, cPath)
+	dirfd, err := syscall.Open(absPath, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err == nil {
+		defer syscall.Close(dirfd)
+	}
+	var entries []os.FileInfo
+	if err == nil {
+		entries, err = ioutil.ReadDir(absPath)
+	}
+	if err != nil {
+		if os.IsPermission(err) && !runsAsRoot() {
+			sc.ck.markSkipped(cPath)
+		} else {
+			sc.report(fsckProblem{CipherPath: cPath, Class: fsckIOError, Text: err.Error()})
+		}
+		return
+	}
+	if !sc.plaintextNames {
+		if _, err = nametransform.ReadDirIVAt(dirfd); err != nil {
+			class := fsckIOError
+			if _, invalid := err.(*nametransform.InvalidDirIVError); invalid || err == syscall.ENOENT {
+				class = fsckMissingDirIV
+			}
+			sc.report(fsckProblem{CipherPath: cPath, Class: class,
+				Text: fmt.Sprintf("could not read %s: %v", nametransform.DirIVFilename, err)})
+		}
+	}
+	present := make(map[string]bool)
+	for _, e := range entries {
+		present[e.Name()] = true
+	}
+	for _, e := range entries {
+		cName := e.Name()
+		if cPath == "" && (cName == configfile.ConfDefaultName || cName == configfile.RekeyDirName) {
+			continue
+		}
+		if !sc.plaintextNames && cName == nametransform.DirIVFilename {
+			continue
+		}
+		nextPath := filepath.Join(cPath, cName)
+		if !sc.plaintextNames && !sc.name(dirfd, nextPath, present) {
+			// A .name file has no content to check
+			continue
+		}
+		switch e.Mode() & os.ModeType {
+		case os.ModeDir:
+			sc.dir(nextPath)
+		case 0:
+			sc.file(dirfd, nextPath, e.Size())
+		case os.ModeSymlink:
+			sc.symlink(nextPath)
+		}
+	}
+}
+
+// name checks the name of the entry "cPath" in the directory opened as
+// "dirfd". "present" contains the names of all entries in the directory.
+// Returns false for a gocryptfs.longname.*.name file.
+func (sc *scrubObj) name(dirfd int, cPath string, present map[string]bool) bool {
+	cName := filepath.Base(cPath)
+	nameType := nametransform.LongNameNone
+	if sc.longNames {
+		nameType = nametransform.NameType(cName)
+	}
+	switch nameType {
+	case nametransform.LongNameFilename:
+		if !present[strings.TrimSuffix(cName, nametransform.LongNameSuffix)] {
+			sc.report(fsckProblem{CipherPath: cPath, Class: fsckBadName, Text: "orphaned .name file"})
+		}
+		return false
+	case nametransform.LongNameContent:
+		longName, err := nametransform.ReadLongNameAt(dirfd, cName)
+		if err != nil {
+			sc.report(fsckProblem{CipherPath: cPath, Class: fsckBadName,
+				Text: fmt.Sprintf("could not read .name file: %v", err)})
+			return true
+		}
+		if sc.nameTransform.HashLongName(longName) != cName {
+			sc.report(fsckProblem{CipherPath: cPath, Class: fsckBadName,
+				Text: "hash does not match the .name file"})
+			return true
+		}
+		cName = longName
+	}
+	bin, err := sc.nameTransform.B64.DecodeString(cName)
+	if err != nil {
+		sc.report(fsckProblem{CipherPath: cPath, Class: fsckBadName, Text: err.Error()})
+	} else if len(bin) == 0 || len(bin)%aes.BlockSize != 0 {
+		sc.report(fsckProblem{CipherPath: cPath, Class: fsckBadName,
+			Text: fmt.Sprintf("decoded length %d is not a multiple of %d", len(bin), aes.BlockSize)})
+	}
+	return true
+}
+
+// file checks the header and the size of the file "cPath" in the directory
+// opened as "dirfd"
+func (sc *scrubObj) file(dirfd int, cPath string, size int64) {
+	atomic.AddUint64(&sc.ck.fileCount, 1)
+	if size == 0 {
+		return
+	}
+	if size < contentenc.HeaderLen {
+		sc.report(fsckProblem{CipherPath: cPath, Class: fsckBadHeader,
+			Text: fmt.Sprintf("incomplete file, got %d instead of %d bytes", size, contentenc.HeaderLen)})
+		return
+	}
+	fd, err := syscallcompat.Openat(dirfd, filepath.Base(cPath), syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err == syscall.EACCES && !runsAsRoot() {
+		sc.ck.markSkipped(cPath)
+		return
+	} else if err != nil {
+		sc.report(fsckProblem{CipherPath: cPath, Class: fsckIOError, Text: err.Error()})
+		return
+	}
+	f := os.NewFile(uintptr(fd), cPath)
+	defer f.Close()
+	buf := make([]byte, contentenc.HeaderLen)
+	if _, err = f.ReadAt(buf, 0); err != nil {
+		sc.report(fsckProblem{CipherPath: cPath, Class: fsckIOError, Text: err.Error()})
+		return
+	}
+	if _, err = contentenc.ParseHeader(buf); err != nil {
+		sc.report(fsckProblem{CipherPath: cPath, Class: fsckBadHeader, Text: err.Error()})
+	}
+	// A valid size survives the round trip. A header without content is
+	// harmless, see CipherSizeToPlainSize.
+	cSize := uint64(size)
+	plainSize := sc.contentEnc.CipherSizeToPlainSize(cSize)
+	if cSize != contentenc.HeaderLen && sc.contentEnc.PlainSizeToCipherSize(plainSize) != cSize {
+		blockNo := sc.contentEnc.CipherOffToBlockNo(cSize - 1)
+		sc.report(fsckProblem{
+			CipherPath: cPath,
+			Class:      fsckTornBlock,
+			Block: &fsckBlock{
+				No:           blockNo,
+				PlainOffset:  sc.contentEnc.BlockNoToPlainOff(blockNo),
+				CipherOffset: sc.contentEnc.BlockNoToCipherOff(blockNo),
+			},
+			Text: fmt.Sprintf("invalid ciphertext size %d", size),
+		})
+	}
+}
+
+// symlink checks that the target of "cPath" is base64 and long enough to be
+// an encrypted block
+func (sc *scrubObj) symlink(cPath string) {
+	if sc.plaintextNames {
+		return
+	}
+	target, err := os.Readlink(filepath.Join(sc.ck.cipherdir, cPath))
+	if err != nil {
+		sc.report(fsckProblem{CipherPath: cPath, Class: fsckIOError, Text: err.Error()})
+		return
+	}
+	bin, err := sc.nameTransform.B64.DecodeString(target)
+	if err != nil {
+		sc.report(fsckProblem{CipherPath: cPath, Class: fsckBadSymlink, Text: err.Error()})
+	} else if uint64(len(bin)) <= sc.contentEnc.BlockOverhead() {
+		sc.report(fsckProblem{CipherPath: cPath, Class: fsckBadSymlink,
+			Text: fmt.Sprintf("target is too short: %d bytes", len(bin))})
+	}
+}
+
+// scrub checks the structure of the ciphertext in CIPHERDIR without the
+// master key. This is called when you pass the "-scrub" option. If a
+// password source ("-extpass", "-passfile" or "-masterkey") is given, all
+// blocks are also authenticated like "-fsck" does.
+func scrub(args *argContainer) {
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	var ck *fsckObj
+	if args.extpass != "" || args.passfile != "" || args.masterkey != "" {
+		ck = newFsck(args)
+	} else {
+		ck = &fsckObj{
+			cipherdir:   args.cipherdir,
+			problemKeys: make(map[string]int),
+			json:        args.json,
+		}
+	}
+	cryptoBackend := cryptocore.BackendGoGCM
+	IVBits := contentenc.DefaultIVBits
+	if cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		cryptoBackend = cryptocore.BackendAESSIV
+	} else if cf.IsFeatureFlagSet(configfile.FlagXChaCha20Poly1305) {
+		cryptoBackend = cryptocore.BackendXChaCha20Poly1305
+		IVBits = contentenc.XChaCha20Poly1305IVBits
+	}
+	cc := cryptocore.New(make([]byte, cryptocore.KeyLen), cryptoBackend, IVBits, cf.IsFeatureFlagSet(configfile.FlagHKDF), false)
+	sc := scrubObj{
+		ck:             ck,
+		plaintextNames: cf.IsFeatureFlagSet(configfile.FlagPlaintextNames),
+		longNames:      cf.IsFeatureFlagSet(configfile.FlagLongNames),
+		nameTransform:  nametransform.New(nil, false, cf.IsFeatureFlagSet(configfile.FlagRaw64)),
+		contentEnc:     contentenc.New(cc, cf.PlainBS(), false),
+	}
+	sc.dir("")
+	if ck.fs != nil {
+		tlog.Info.Printf("scrub: authenticating all blocks")
+		// The summary counts every directory and file once
+		ck.dirCount, ck.fileCount = 0, 0
+		ck.run(args.fsckJobs)
+	}
+	ck.finish("scrub")
+}
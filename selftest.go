@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/simonhorlick/gocryptfs/internal/cryptocore"
+	"github.com/simonhorlick/gocryptfs/internal/exitcodes"
+	"github.com/simonhorlick/gocryptfs/internal/stupidgcm"
+	"github.com/simonhorlick/gocryptfs/internal/tlog"
+)
+
+// selfTest runs the known-answer tests of all crypto backends and prints the
+// results. This is called when you pass the "-selftest" option.
+// Does not return.
+func selfTest() {
+	backends := []cryptocore.AEADTypeEnum{
+		cryptocore.BackendOpenSSL,
+		cryptocore.BackendGoGCM,
+		cryptocore.BackendAESSIV,
+		cryptocore.BackendXChaCha20Poly1305,
+	}
+	failed := false
+	for _, b := range backends {
+		fmt.Printf("%-22s\t", b)
+		if b == cryptocore.BackendOpenSSL && stupidgcm.BuiltWithoutOpenssl {
+			fmt.Printf("N/A\n")
+			continue
+		}
+		if err := cryptocore.SelfTest(b); err != nil {
+			fmt.Printf("FAILED: %v\n", err)
+			failed = true
+			continue
+		}
+		fmt.Printf("ok\n")
+	}
+	if failed {
+		os.Exit(exitcodes.SelfTest)
+	}
+	os.Exit(0)
+}
+
+// selfTestOrExit runs cryptocore.SelfTest for "aeadType" and exits with
+// exitcodes.SelfTest if it fails. Must be called before the backend is used.
+func selfTestOrExit(aeadType cryptocore.AEADTypeEnum) {
+	if err := cryptocore.SelfTest(aeadType); err != nil {
+		tlog.Fatal.Printf("Crypto self-test failed, refusing to continue: %v", err)
+		tlog.Fatal.Printf("Run \"%s -selftest\" for details.", tlog.ProgramName)
+		os.Exit(exitcodes.SelfTest)
+	}
+}
@@ -3,10 +3,14 @@ package cli
 // Test CLI operations like "-init", "-password" etc
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -60,6 +64,94 @@ func TestInitAessiv(t *testing.T) {
 	}
 }
 
+// Test -init with -xchacha
+func TestInitXChaCha(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-xchacha")
+	_, c, err := configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagXChaCha20Poly1305) {
+		t.Error("XChaCha20Poly1305 flag should be set but is not")
+	}
+	// -aessiv and -xchacha are mutually exclusive
+	dir2 := dir + ".2"
+	if err = os.Mkdir(dir2, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-extpass", "echo test",
+		"-scryptn=10", "-xchacha", "-aessiv", dir2)
+	err = cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.Usage {
+		t.Errorf("want exit code %d, got %d", exitcodes.Usage, exitCode)
+	}
+}
+
+// Test -init with -integrity
+func TestInitIntegrity(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-integrity")
+	c, err := configfile.Load(dir + "/" + configfile.ConfDefaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagIntegrity) {
+		t.Error("Integrity flag should be set but is not")
+	}
+	// The content is bound to encrypted names
+	dir2 := dir + ".2"
+	if err = os.Mkdir(dir2, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-extpass", "echo test",
+		"-scryptn=10", "-integrity", "-plaintextnames", dir2)
+	err = cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.Usage {
+		t.Errorf("want exit code %d, got %d", exitcodes.Usage, exitCode)
+	}
+}
+
+// Test -init with -blocksize
+func TestInitBlockSize(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-blocksize=64K")
+	c, err := configfile.Load(dir + "/" + configfile.ConfDefaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.PlainBS() != 65536 {
+		t.Errorf("wrong block size %d", c.PlainBS())
+	}
+	dir2 := dir + ".2"
+	if err = os.Mkdir(dir2, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, bs := range []string{"2K", "3000", "2M", "x"} {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-extpass", "echo test",
+			"-scryptn=10", "-blocksize="+bs, dir2)
+		err = cmd.Run()
+		exitCode := test_helpers.ExtractCmdExitCode(err)
+		if exitCode != exitcodes.Usage {
+			t.Errorf("-blocksize=%s: want exit code %d, got %d", bs, exitcodes.Usage, exitCode)
+		}
+	}
+}
+
+// Test -init with -argon2id
+func TestInitArgon2id(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-argon2id", "-argon2-mem=8192", "-argon2-time=1", "-argon2-threads=2")
+	_, c, err := configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagArgon2id) {
+		t.Error("Argon2id flag should be set but is not")
+	}
+	if a := c.Argon2Object; a == nil || a.Memory != 8192 || a.Time != 1 || a.Threads != 2 {
+		t.Errorf("wrong Argon2Object: %+v", a)
+	}
+}
+
 // Test -init with -reverse
 func TestInitReverse(t *testing.T) {
 	dir := test_helpers.InitFS(t, "-reverse")
@@ -563,3 +655,370 @@ func TestIdle(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// Test "-cat" on an example filesystem, without mounting
+func TestCat(t *testing.T) {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-cat", "-extpass", "echo test",
+		"../example_filesystems/v1.3", "status.txt")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "It works!\n" {
+		t.Errorf("wrong content: %q", out)
+	}
+	// Directories cannot be cat'ed
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-cat", "-masterkey",
+		"fd890dab-86bf61cf-ec5ad460-ad3ed01f-9c52d546-2a31783d-a56b088d-3d05232e",
+		"../example_filesystems/v1.3", "/")
+	err = cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.Extract {
+		t.Errorf("want exit code %d, got %d", exitcodes.Extract, exitCode)
+	}
+}
+
+// Test "-extract" of a whole example filesystem, without mounting
+func TestExtract(t *testing.T) {
+	dest := test_helpers.TmpDir + "/TestExtract"
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-extract", "-extpass", "echo test",
+		"../example_filesystems/v1.3", "", dest)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(dest + "/status.txt")
+	if err != nil || string(content) != "It works!\n" {
+		t.Errorf("status.txt: content=%q err=%v", content, err)
+	}
+	target, err := os.Readlink(dest + "/rel")
+	if err != nil || target != "status.txt" {
+		t.Errorf("rel: target=%q err=%v", target, err)
+	}
+	// Refuses to overwrite
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-extract", "-extpass", "echo test",
+		"../example_filesystems/v1.3", "status.txt", dest+"/status.txt")
+	err = cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.Extract {
+		t.Errorf("want exit code %d, got %d", exitcodes.Extract, exitCode)
+	}
+}
+
+// Test that "-extract" does not hard-link to a file that could not be
+// extracted completely
+func TestExtractBrokenHardlink(t *testing.T) {
+	src := test_helpers.TmpDir + "/TestExtractBrokenHardlink_src"
+	if err := os.Mkdir(src, 0700); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(src+"/a", make([]byte, 10000), 0600)
+	os.Link(src+"/a", src+"/b")
+	cipherdir := test_helpers.InitFS(t)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-import", "-extpass", "echo test", cipherdir, src)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the first block of the shared ciphertext file
+	entries, err := ioutil.ReadDir(cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := false
+	for _, e := range entries {
+		if st, ok := e.Sys().(*syscall.Stat_t); ok && e.Mode().IsRegular() && st.Nlink > 1 {
+			f, err := os.OpenFile(cipherdir+"/"+e.Name(), os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteAt([]byte("xxxx"), 100)
+			f.Close()
+			corrupted = true
+		}
+	}
+	if !corrupted {
+		t.Fatal("hard-linked ciphertext file not found")
+	}
+	dest := test_helpers.TmpDir + "/TestExtractBrokenHardlink_dest"
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-extract", "-extpass", "echo test",
+		cipherdir, "", dest)
+	exitCode := test_helpers.ExtractCmdExitCode(cmd.Run())
+	if exitCode != exitcodes.Extract {
+		t.Errorf("want exit code %d, got %d", exitcodes.Extract, exitCode)
+	}
+	for _, n := range []string{"a", "b"} {
+		if _, err := os.Lstat(dest + "/" + n); !os.IsNotExist(err) {
+			t.Errorf("%q has been extracted: %v", n, err)
+		}
+	}
+}
+
+// Test "-import" of a directory tree and check the result using "-extract"
+func TestImport(t *testing.T) {
+	src := test_helpers.TmpDir + "/TestImport_src"
+	err := os.MkdirAll(src+"/dir", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := make([]byte, 300000)
+	for i := 0; i < 1000; i++ {
+		big[i] = byte(i)
+	}
+	longName := strings.Repeat("x", 200)
+	ioutil.WriteFile(src+"/big", big, 0640)
+	ioutil.WriteFile(src+"/dir/"+longName, []byte("long"), 0600)
+	os.Link(src+"/big", src+"/dir/hardlink")
+	os.Symlink("../big", src+"/dir/symlink")
+	os.Chmod(src+"/dir", 0750)
+	cipherdir := test_helpers.InitFS(t)
+	importArgs := []string{"-q", "-import", "-extpass", "echo test", cipherdir, src}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, importArgs...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Running it again must skip everything
+	out, err := exec.Command(test_helpers.GocryptfsBinary, importArgs[1:]...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("second import failed: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "4 items were already imported") {
+		t.Errorf("second import did not skip files:\n%s", out)
+	}
+	dest := test_helpers.TmpDir + "/TestImport_dest"
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-extract", "-extpass", "echo test",
+		cipherdir, "", dest)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(dest + "/big")
+	if err != nil || !bytes.Equal(content, big) {
+		t.Errorf("big: content mismatch, err=%v", err)
+	}
+	content, err = ioutil.ReadFile(dest + "/dir/" + longName)
+	if err != nil || string(content) != "long" {
+		t.Errorf("long name: content=%q err=%v", content, err)
+	}
+	target, err := os.Readlink(dest + "/dir/symlink")
+	if err != nil || target != "../big" {
+		t.Errorf("symlink: target=%q err=%v", target, err)
+	}
+	var st syscall.Stat_t
+	syscall.Stat(dest+"/dir/hardlink", &st)
+	if st.Nlink != 2 {
+		t.Errorf("hardlink: want Nlink=2, got %d", st.Nlink)
+	}
+	fi, err := os.Stat(dest + "/dir")
+	if err != nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("dir: mode=%v err=%v", fi.Mode(), err)
+	}
+	// Source inside cipherdir is rejected
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-import", "-extpass", "echo test",
+		cipherdir, cipherdir)
+	err = cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.Import {
+		t.Errorf("want exit code %d, got %d", exitcodes.Import, exitCode)
+	}
+	// Also through a symlink, and cipherdir inside the source
+	link := test_helpers.TmpDir + "/TestImport_link"
+	os.Symlink(cipherdir, link)
+	for _, s := range []string{link, filepath.Dir(cipherdir)} {
+		cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-import", "-extpass", "echo test",
+			cipherdir, s)
+		exitCode = test_helpers.ExtractCmdExitCode(cmd.Run())
+		if exitCode != exitcodes.Import {
+			t.Errorf("source %q: want exit code %d, got %d", s, exitcodes.Import, exitCode)
+		}
+	}
+}
+
+// rekeyTestTree fills "cipherdir" with a few files using "-import" and
+// returns the plaintext source directory
+func rekeyTestTree(t *testing.T, cipherdir string) string {
+	src := cipherdir + ".src"
+	err := os.MkdirAll(src+"/dir", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(src+"/big", bytes.Repeat([]byte("rekey"), 60000), 0600)
+	ioutil.WriteFile(src+"/dir/"+strings.Repeat("y", 200), []byte("long"), 0600)
+	os.Link(src+"/big", src+"/dir/hardlink")
+	os.Symlink("../big", src+"/dir/symlink")
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-import", "-extpass", "echo test", cipherdir, src)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+// rekeyVerifyTree extracts "cipherdir" and compares the result to "src"
+func rekeyVerifyTree(t *testing.T, cipherdir string, src string, dest string) {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-extract", "-extpass", "echo test",
+		cipherdir, "", dest)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"big", "dir/" + strings.Repeat("y", 200)} {
+		want, _ := ioutil.ReadFile(src + "/" + p)
+		have, err := ioutil.ReadFile(dest + "/" + p)
+		if err != nil || !bytes.Equal(want, have) {
+			t.Errorf("%s: content mismatch, err=%v", p, err)
+		}
+	}
+	target, err := os.Readlink(dest + "/dir/symlink")
+	if err != nil || target != "../big" {
+		t.Errorf("symlink: target=%q err=%v", target, err)
+	}
+	var st syscall.Stat_t
+	syscall.Stat(dest+"/dir/hardlink", &st)
+	if st.Nlink != 2 {
+		t.Errorf("hardlink: want Nlink=2, got %d", st.Nlink)
+	}
+}
+
+// Test "-rekey" and check that the old master key no longer works
+func TestRekey(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	src := rekeyTestTree(t, cipherdir)
+	oldKey, _, err := configfile.LoadAndDecrypt(cipherdir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-rekey", "-extpass", "echo test", cipherdir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, _, err := configfile.LoadAndDecrypt(cipherdir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(oldKey, newKey) {
+		t.Fatal("master key has not changed")
+	}
+	if _, err = os.Stat(cipherdir + "/" + configfile.RekeyDirName); !os.IsNotExist(err) {
+		t.Errorf("staging dir was not removed: %v", err)
+	}
+	rekeyVerifyTree(t, cipherdir, src, cipherdir+".dest")
+	// The old master key must not decrypt the files anymore
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-cat", "-masterkey", hex.EncodeToString(oldKey),
+		cipherdir, "big")
+	err = cmd.Run()
+	if err == nil {
+		t.Error("old master key still works")
+	}
+	// Nothing to roll back
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-rekey", "-rollback", "-extpass", "echo test", cipherdir)
+	err = cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.Rekey {
+		t.Errorf("want exit code %d, got %d", exitcodes.Rekey, exitCode)
+	}
+}
+
+// Test that an interrupted "-rekey" blocks access and can be rolled back
+// or resumed
+func TestRekeyInterrupted(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	src := rekeyTestTree(t, cipherdir)
+	// An undecryptable file in the root dir cannot be moved and makes
+	// "-rekey" stop before the swap phase
+	junk := cipherdir + "/junk"
+	ioutil.WriteFile(junk, nil, 0600)
+	rekey := func(extraArgs ...string) int {
+		args := append([]string{"-q", "-rekey", "-extpass", "echo test"}, extraArgs...)
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append(args, cipherdir)...)
+		return test_helpers.ExtractCmdExitCode(cmd.Run())
+	}
+	if exitCode := rekey(); exitCode != exitcodes.Rekey {
+		t.Fatalf("want exit code %d, got %d", exitcodes.Rekey, exitCode)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-cat", "-extpass", "echo test",
+		cipherdir, "big")
+	exitCode := test_helpers.ExtractCmdExitCode(cmd.Run())
+	if exitCode != exitcodes.Rekey {
+		t.Errorf("-cat during rekey: want exit code %d, got %d", exitcodes.Rekey, exitCode)
+	}
+	if exitCode := rekey("-rollback"); exitCode != 0 {
+		t.Fatalf("rollback failed with exit code %d", exitCode)
+	}
+	rekeyVerifyTree(t, cipherdir, src, cipherdir+".dest1")
+	os.Remove(junk)
+	if exitCode := rekey(); exitCode != 0 {
+		t.Fatalf("rekey failed with exit code %d", exitCode)
+	}
+	rekeyVerifyTree(t, cipherdir, src, cipherdir+".dest2")
+}
+
+// Test -addkey, -listkeys, -revokekey and -passwd on a key slot
+func TestKeySlots(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	run := func(stdin string, args ...string) error {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append(append([]string{"-q"}, args...), dir)...)
+		cmd.Stdin = strings.NewReader(stdin)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	// Old password, then the password of the new slot
+	err := run("test\nalicepw\n", "-addkey", "alice", "-scryptn", "10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-listkeys", dir).Output()
+	if err != nil || !strings.Contains(string(out), "alice") {
+		t.Errorf("-listkeys: out=%q err=%v", out, err)
+	}
+	// Both passwords unlock the filesystem
+	for _, pw := range []string{"test", "alicepw"} {
+		err = run("", "-fsck", "-extpass", "echo "+pw)
+		if err != nil {
+			t.Errorf("password %q: %v", pw, err)
+		}
+	}
+	// -passwd changes the slot that was unlocked
+	err = run("alicepw\nalicepw2\n", "-passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := configfile.LoadAndDecrypt(dir+"/gocryptfs.conf", []byte("alicepw2"))
+	if err != nil || c.UnlockedKeySlot() != "alice" {
+		t.Errorf("new password of slot alice: err=%v", err)
+	}
+	_, _, err = configfile.LoadAndDecrypt(dir+"/gocryptfs.conf", testPw)
+	if err != nil {
+		t.Errorf("primary password no longer works: %v", err)
+	}
+	err = run("", "-revokekey", "alice", "-extpass", "echo test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = run("", "-fsck", "-extpass", "echo alicepw2")
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.PasswordIncorrect {
+		t.Errorf("revoked slot: want exit code %d, got %d", exitcodes.PasswordIncorrect, exitCode)
+	}
+	// The primary key cannot be revoked
+	err = run("", "-revokekey", configfile.PrimaryKeySlotLabel, "-extpass", "echo test")
+	if err == nil {
+		t.Error("revoking the primary key should fail")
+	}
+}
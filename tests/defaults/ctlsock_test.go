@@ -1,9 +1,12 @@
 package defaults
 
 import (
+	"io/ioutil"
 	"os"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/simonhorlick/gocryptfs/internal/ctlsock"
 	"github.com/simonhorlick/gocryptfs/tests/test_helpers"
@@ -96,3 +99,179 @@ func TestCtlSockDecryptCrash(t *testing.T) {
 	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
 	defer test_helpers.UnmountPanic(pDir)
 }
+
+func TestCtlSockStatus(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	f, err := os.Create(pDir + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Status: true})
+	st := response.Status
+	if response.ErrNo != 0 || st == nil {
+		t.Fatalf("got an error reply: %+v", response)
+	}
+	if st.Mountpoint != pDir || st.Cipherdir != cDir || st.Reverse {
+		t.Errorf("wrong paths: %+v", st)
+	}
+	if len(st.FeatureFlags) == 0 || st.CryptoBackend == "" {
+		t.Errorf("missing crypto info: %+v", st)
+	}
+	if st.OpenFiles != 1 || st.WriteOps == 0 {
+		t.Errorf("wrong file stats: %+v", st)
+	}
+	// Status cannot be combined with a path request
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Status: true, EncryptPath: "foo"})
+	if response.ErrNo == 0 || response.Status != nil {
+		t.Errorf("ambiguous request was accepted: %+v", response)
+	}
+}
+
+func TestCtlSockLock(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	file := pDir + "/foo"
+	err := ioutil.WriteFile(file, []byte("hello"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	response := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Lock: true})
+	if response.ErrNo != 0 {
+		t.Fatalf("Lock failed: %+v", response)
+	}
+	// Wait for the kernel attribute cache to expire
+	time.Sleep(1100 * time.Millisecond)
+	_, err = os.Stat(file)
+	if !os.IsPermission(err) {
+		t.Errorf("Stat while locked: want EACCES, got %v", err)
+	}
+	buf := make([]byte, 5)
+	_, err = f.ReadAt(buf, 0)
+	if err == nil {
+		t.Error("Read on an open file should fail while locked")
+	}
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Unlock: true, Password: "wrong"})
+	if response.ErrNo == 0 {
+		t.Errorf("Unlock with a wrong password succeeded")
+	}
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Unlock: true, Password: "test"})
+	if response.ErrNo != 0 {
+		t.Fatalf("Unlock failed: %+v", response)
+	}
+	_, err = f.ReadAt(buf, 0)
+	if err != nil || string(buf) != "hello" {
+		t.Errorf("Read after unlock: %q, %v", buf, err)
+	}
+}
+
+func TestCtlSockUnmount(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	response := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{SetIdle: "1h"})
+	if response.ErrNo != 0 || response.IdleTimeout != "1h0m0s" {
+		t.Errorf("SetIdle failed: %+v", response)
+	}
+	file := pDir + "/foo"
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Refused while a file is open
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Unmount: true})
+	if response.ErrNo != int32(syscall.EBUSY) {
+		f.Close()
+		test_helpers.UnmountPanic(pDir)
+		t.Fatalf("Unmount with an open file: %+v", response)
+	}
+	f.Close()
+	// FUSE close is asynchronous, retry a few times
+	for i := 0; i < 10; i++ {
+		response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Unmount: true})
+		if response.ErrNo != int32(syscall.EBUSY) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if response.ErrNo != 0 {
+		test_helpers.UnmountPanic(pDir)
+		t.Fatalf("Unmount failed: %+v", response)
+	}
+	if _, err = os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("filesystem is still mounted: %v", err)
+	}
+}
+
+func TestCtlSockListDir(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	err := os.MkdirAll(pDir+"/dir/"+test_helpers.X255, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(pDir+"/dir/"+test_helpers.X255+"/file", nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("file", pDir+"/dir/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := "dir"
+	response := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{ListDir: &dir})
+	if response.ErrNo != 0 || len(response.Entries) != 2 {
+		t.Fatalf("wrong reply: %+v", response)
+	}
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{ListDir: &dir, Recursive: true})
+	if response.ErrNo != 0 || len(response.Entries) != 3 {
+		t.Fatalf("wrong reply: %+v", response)
+	}
+	types := map[string]string{
+		"dir/" + test_helpers.X255:           "dir",
+		"dir/" + test_helpers.X255 + "/file": "file",
+		"dir/link":                           "symlink",
+	}
+	for _, e := range response.Entries {
+		if types[e.PlainPath] != e.Type {
+			t.Errorf("wrong entry: %+v", e)
+		}
+		if e.LongName != (e.PlainPath == "dir/"+test_helpers.X255) {
+			t.Errorf("wrong LongName flag: %+v", e)
+		}
+		// The ciphertext path must exist and decrypt to the plaintext path
+		if _, err = os.Lstat(cDir + "/" + e.CipherPath); err != nil {
+			t.Error(err)
+		}
+		r := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{DecryptPath: e.CipherPath})
+		if r.Result != e.PlainPath {
+			t.Errorf("DecryptPath(%q) = %q, want %q", e.CipherPath, r.Result, e.PlainPath)
+		}
+	}
+	// The same listing by ciphertext path
+	cipherDir := response.Entries[0].CipherPath[:strings.Index(response.Entries[0].CipherPath, "/")]
+	r := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{ListDir: &cipherDir, Cipher: true, Recursive: true})
+	if r.ErrNo != 0 || len(r.Entries) != 3 {
+		t.Errorf("wrong reply: %+v", r)
+	}
+}
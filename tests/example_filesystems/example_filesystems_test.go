@@ -383,3 +383,24 @@ func TestExampleFSv13reverse(t *testing.T) {
 	test_helpers.UnmountPanic(dirC)
 	test_helpers.UnmountPanic(dirB)
 }
+
+// XChaCha20-Poly1305 content encryption, see "-xchacha"
+func TestExampleFSxchacha(t *testing.T) {
+	cDir := "xchacha"
+	pDir := test_helpers.TmpDir + "/" + cDir
+	cDir = tmpFsPath + cDir
+	err := os.Mkdir(pDir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", opensslOpt)
+	checkExampleFSLongnames(t, pDir)
+	test_helpers.UnmountPanic(pDir)
+
+	pDir = pDir + "_m"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-masterkey",
+		"375e748a-c6765203-d5aae7b2-4070768f-09c25b9b-87171629-d729f255-ddd82cad",
+		"-xchacha", opensslOpt)
+	checkExampleFSLongnames(t, pDir)
+	test_helpers.UnmountPanic(pDir)
+}
@@ -2,6 +2,8 @@ package fsck
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"runtime"
@@ -124,3 +126,187 @@ func TestTerabyteFile(t *testing.T) {
 	cmd.Wait()
 	timer.Stop()
 }
+
+// TestIntegrity checks that fsck reports a file that has been truncated at a
+// block boundary in the integrity format.
+func TestIntegrity(t *testing.T) {
+	cDir := test_helpers.InitFS(t, "-integrity")
+	src := cDir + ".src"
+	if err := os.Mkdir(src, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(src+"/file", make([]byte, 10000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-import", "-extpass", "echo test", cDir, src)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "gocryptfs.") {
+			continue
+		}
+		// Header + 2 of 3 blocks
+		if err = os.Truncate(cDir+"/"+e.Name(), 18+2*4128); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test", cDir)
+	outBin, err := cmd.CombinedOutput()
+	out := string(outBin)
+	t.Log(out)
+	code := test_helpers.ExtractCmdExitCode(err)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	if !strings.Contains(out, "file has been truncated after block #1") {
+		t.Errorf("fsck did not report the truncation")
+	}
+	// This is also what an interrupted truncate leaves behind, so -repair
+	// marks block #1 as the last block
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-repair", "-extpass", "echo test", cDir)
+	outBin, _ = cmd.CombinedOutput()
+	t.Log(string(outBin))
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test", cDir)
+	if outBin, err = cmd.CombinedOutput(); err != nil {
+		t.Errorf("fsck after repair failed: %v\n%s", err, outBin)
+	}
+}
+
+// TestJSON checks that "-fsck -json" prints a report that can be parsed
+func TestJSON(t *testing.T) {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-json", "-extpass", "echo test", "broken_fs_v1.4")
+	cmd.Stderr = os.Stderr
+	outBin, err := cmd.Output()
+	code := test_helpers.ExtractCmdExitCode(err)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	var report struct {
+		Problems []struct {
+			Path, CipherPath, Class string
+		}
+		Summary struct {
+			Problems int
+			Classes  map[string]int
+		}
+	}
+	if err = json.Unmarshal(outBin, &report); err != nil {
+		t.Fatalf("%v\n%s", err, outBin)
+	}
+	if report.Summary.Problems != len(report.Problems) {
+		t.Errorf("summary says %d problems, got %d", report.Summary.Problems, len(report.Problems))
+	}
+	for _, class := range []string{"bad_name", "missing_diriv", "bad_header", "torn_block", "bad_symlink"} {
+		if report.Summary.Classes[class] == 0 {
+			t.Errorf("no %s problem reported", class)
+		}
+	}
+}
+
+// TestIncremental checks that "-fsck-incremental" skips the files that have
+// not changed since the last successful "-fsck-checkpoint" run
+func TestIncremental(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	src := cDir + ".src"
+	if err := os.Mkdir(src, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(src+"/"+n, make([]byte, 10000), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-import", "-extpass", "echo test", cDir, src)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint := cDir + ".checkpoint"
+	fsck := func(extra ...string) (files, unchanged int) {
+		args := append([]string{"-fsck", "-json", "-fsck-jobs", "2", "-fsck-checkpoint", checkpoint,
+			"-extpass", "echo test"}, extra...)
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append(args, cDir)...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var report struct {
+			Summary struct {
+				Files, Unchanged int
+			}
+		}
+		if err = json.Unmarshal(out, &report); err != nil {
+			t.Fatal(err)
+		}
+		return report.Summary.Files, report.Summary.Unchanged
+	}
+	if files, unchanged := fsck(); files != 3 || unchanged != 0 {
+		t.Errorf("first run: files=%d unchanged=%d", files, unchanged)
+	}
+	if files, unchanged := fsck("-fsck-incremental"); files != 3 || unchanged != 3 {
+		t.Errorf("incremental run: files=%d unchanged=%d", files, unchanged)
+	}
+}
+
+// TestScrub checks that "-scrub" finds the structural problems without the
+// password and stays quiet on healthy filesystems
+func TestScrub(t *testing.T) {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-scrub", "-json", "broken_fs_v1.4")
+	cmd.Stderr = os.Stderr
+	outBin, err := cmd.Output()
+	code := test_helpers.ExtractCmdExitCode(err)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	var report struct {
+		Summary struct {
+			Classes map[string]int
+		}
+	}
+	if err = json.Unmarshal(outBin, &report); err != nil {
+		t.Fatalf("%v\n%s", err, outBin)
+	}
+	for _, class := range []string{"bad_name", "missing_diriv", "bad_header", "torn_block", "bad_symlink"} {
+		if report.Summary.Classes[class] == 0 {
+			t.Errorf("no %s problem reported", class)
+		}
+	}
+	// With the password, the problems found by the structural pass must not
+	// be reported a second time by the full check
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-scrub", "-json", "-extpass", "echo test", "broken_fs_v1.4")
+	cmd.Stderr = os.Stderr
+	outBin, _ = cmd.Output()
+	var keyed struct {
+		Problems []struct {
+			Path, CipherPath, Class, Text string
+		}
+	}
+	if err = json.Unmarshal(outBin, &keyed); err != nil {
+		t.Fatalf("%v\n%s", err, outBin)
+	}
+	seen := make(map[string]bool)
+	for _, p := range keyed.Problems {
+		k := p.CipherPath + "\x00" + p.Class
+		if p.Class == "bad_xattr" {
+			k += "\x00" + p.Text
+		}
+		if seen[k] {
+			t.Errorf("duplicate problem: %s %q %q", p.Class, p.Path, p.CipherPath)
+		}
+		seen[k] = true
+	}
+	for _, n := range []string{"v0.7-plaintextnames", "v1.1-aessiv", "v1.3", "xchacha"} {
+		cmd = exec.Command(test_helpers.GocryptfsBinary, "-scrub", "../example_filesystems/"+n)
+		outBin, err = cmd.CombinedOutput()
+		if err != nil {
+			t.Errorf("%s: %v\n%s", n, err, outBin)
+		}
+	}
+}
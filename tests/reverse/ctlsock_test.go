@@ -2,6 +2,9 @@ package reverse_test
 
 import (
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 
@@ -69,6 +72,50 @@ func TestCtlSockPathOps(t *testing.T) {
 	}
 }
 
+// Test ListDir against the same testcases
+func TestCtlSockListDir(t *testing.T) {
+	if plaintextnames {
+		t.Skip("this only tests encrypted names")
+	}
+	mnt, err := ioutil.TempDir(test_helpers.TmpDir, "reverse_mnt_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := mnt + ".sock"
+	test_helpers.MountOrFatal(t, "ctlsock_reverse_test_fs", mnt, "-reverse", "-extpass", "echo test", "-ctlsock="+sock)
+	defer test_helpers.UnmountPanic(mnt)
+	root := ""
+	req := ctlsock.RequestStruct{ListDir: &root, Recursive: true}
+	response := test_helpers.QueryCtlSock(t, sock, req)
+	if response.ErrNo != 0 {
+		t.Fatalf("ErrNo=%d ErrText=%s", response.ErrNo, response.ErrText)
+	}
+	entries := make(map[string]ctlsock.DirEntry)
+	for _, e := range response.Entries {
+		entries[e.CipherPath] = e
+	}
+	for i, tc := range ctlSockTestCases {
+		if _, err := os.Lstat("ctlsock_reverse_test_fs/" + tc[1]); err != nil {
+			// Not all testcases exist on disk
+			continue
+		}
+		e, ok := entries[tc[0]]
+		if !ok {
+			t.Errorf("Testcase %d: %q is missing", i, tc[0])
+			continue
+		}
+		if e.PlainPath != tc[1] {
+			t.Errorf("Testcase %d: want %q got %q", i, tc[1], e.PlainPath)
+		}
+		if e.LongName != strings.Contains(filepath.Base(tc[0]), "longname") {
+			t.Errorf("Testcase %d: wrong LongName flag: %+v", i, e)
+		}
+	}
+	if e := entries["gocryptfs.conf"]; e.PlainPath != ".gocryptfs.reverse.conf" {
+		t.Errorf("config file is not mapped: %+v", e)
+	}
+}
+
 // We should not panic when somebody feeds requests that make no sense
 func TestCtlSockCrash(t *testing.T) {
 	if plaintextnames {
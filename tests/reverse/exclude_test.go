@@ -2,7 +2,9 @@ package reverse_test
 
 import (
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/simonhorlick/gocryptfs/internal/ctlsock"
@@ -46,28 +48,41 @@ func ctlsockEncryptPath(t *testing.T, sock string, path string) string {
 	return response.Result
 }
 
+// pOk and pExclude are the testcases for testExclude
+var pOk = []string{
+	"file2",
+	"dir1/file1",
+	"dir1/longfile1" + xxx,
+	"longdir1" + xxx,
+	"longdir1" + xxx + "/file",
+	"longfile1" + xxx,
+}
+
+var pExclude = []string{
+	"file1",
+	"dir1/file2",
+	"dir1/longfile2" + xxx,
+	"dir2",
+	"dir2/file",
+	"dir2/file/xxx",
+	"dir2/subdir",
+	"dir2/subdir/file",
+	"dir2/longdir1" + xxx + "/file",
+	"dir2/longfile." + xxx,
+	"longfile2" + xxx,
+}
+
 func testExclude(t *testing.T, flag string) {
-	pOk := []string{
-		"file2",
-		"dir1/file1",
-		"dir1/longfile1" + xxx,
-		"longdir1" + xxx,
-		"longdir1" + xxx + "/file",
-		"longfile1" + xxx,
-	}
-	pExclude := []string{
-		"file1",
-		"dir1/file2",
-		"dir1/longfile2" + xxx,
-		"dir2",
-		"dir2/file",
-		"dir2/file/xxx",
-		"dir2/subdir",
-		"dir2/subdir/file",
-		"dir2/longdir1" + xxx + "/file",
-		"dir2/longfile." + xxx,
-		"longfile2" + xxx,
+	var excludeArgs []string
+	for _, v := range pExclude {
+		excludeArgs = append(excludeArgs, flag, v)
 	}
+	testExcludeArgs(t, excludeArgs)
+}
+
+// testExcludeArgs mounts exclude_test_fs with "excludeArgs" and checks that
+// exactly the paths in pExclude are hidden
+func testExcludeArgs(t *testing.T, excludeArgs []string) {
 	// Mount reverse fs
 	mnt, err := ioutil.TempDir(test_helpers.TmpDir, "TestExclude")
 	if err != nil {
@@ -75,9 +90,7 @@ func testExclude(t *testing.T, flag string) {
 	}
 	sock := mnt + ".sock"
 	cliArgs := []string{"-reverse", "-extpass", "echo test", "-ctlsock", sock}
-	for _, v := range pExclude {
-		cliArgs = append(cliArgs, flag, v)
-	}
+	cliArgs = append(cliArgs, excludeArgs...)
 	if plaintextnames {
 		cliArgs = append(cliArgs, "-config", "exclude_test_fs/.gocryptfs.reverse.conf.plaintextnames")
 	}
@@ -123,3 +136,28 @@ func TestExclude(t *testing.T) {
 	testExclude(t, "-exclude")
 	testExclude(t, "-e")
 }
+
+// The same exclusions, written as gitignore-style patterns
+func TestExcludeWildcard(t *testing.T) {
+	patterns := []string{
+		"# comment",
+		"/file1",
+		"dir1/file2",
+		"longfile*",
+		"!longfile1*",
+		"dir2/",
+	}
+	testExcludeArgs(t, []string{"-ew", "/file1", "-exclude-wildcard", "dir1/file2",
+		"-ew", "longfile*", "-ew", "!longfile1*", "-ew", "dir2/"})
+	f, err := ioutil.TempFile(test_helpers.TmpDir, "TestExcludeWildcard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(strings.Join(patterns, "\n"))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testExcludeArgs(t, []string{"-exclude-from", f.Name()})
+}
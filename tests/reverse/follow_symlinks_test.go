@@ -0,0 +1,41 @@
+package reverse_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/simonhorlick/gocryptfs/tests/test_helpers"
+)
+
+// TestFollowSymlinks checks that a symlink to a directory inside the
+// -follow-symlinks directory shows up as that directory
+func TestFollowSymlinks(t *testing.T) {
+	pDir := test_helpers.InitFS(t, "-reverse")
+	target, err := ioutil.TempDir(test_helpers.TmpDir, "follow_target_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("hello")
+	if err = ioutil.WriteFile(target+"/file", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(target, pDir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	mntB := pDir + ".b"
+	mntC := pDir + ".c"
+	test_helpers.MountOrFatal(t, pDir, mntB, "-reverse", "-extpass", "echo test", "-follow-symlinks", target)
+	defer test_helpers.UnmountPanic(mntB)
+	test_helpers.MountOrFatal(t, mntB, mntC, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mntC)
+
+	fi, err := os.Lstat(mntC + "/link")
+	if err != nil || !fi.IsDir() {
+		t.Fatalf("link should be a directory: %v %v", fi, err)
+	}
+	got, err := ioutil.ReadFile(mntC + "/link/file")
+	if err != nil || string(got) != string(content) {
+		t.Errorf("wrong content: %q %v", got, err)
+	}
+}
@@ -341,13 +341,11 @@ func QueryCtlSock(t *testing.T, socketPath string, req ctlsock.RequestStruct) (r
 	if err != nil {
 		t.Fatal(err)
 	}
-	buf := make([]byte, ctlsock.ReadBufSize)
-	n, err := conn.Read(buf)
+	// A ListDir response can be bigger than ReadBufSize
+	err = json.NewDecoder(conn).Decode(&response)
 	if err != nil {
 		t.Fatal(err)
 	}
-	buf = buf[:n]
-	json.Unmarshal(buf, &response)
 	return response
 }
 